@@ -1,7 +1,11 @@
 package main
 
 import (
+	"bytes"
+	"encoding/binary"
 	"encoding/json"
+	"io"
+	"time"
 
 	"github.com/boltdb/bolt"
 )
@@ -12,24 +16,8 @@ type BoltHivemindStore struct {
 }
 
 func (b *BoltHivemindStore) getSensor(id string) (Sensor, error) {
-	var err error
 	var sensor Sensor
-	err = b.database.View(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket([]byte("sensor"))
-		if bucket == nil {
-			return nil
-		}
-		v := bucket.Get([]byte(id))
-		if v == nil {
-			return nil
-		}
-		err = json.Unmarshal(v, &sensor)
-		if err != nil {
-			return err
-		}
-		return nil
-	})
-
+	err := b.getJSON("sensor", id, &sensor)
 	return sensor, err
 }
 
@@ -37,7 +25,6 @@ func (b *BoltHivemindStore) getAllSensors() []Sensor {
 	var sensors []Sensor
 
 	_ = b.database.View(func(tx *bolt.Tx) error {
-		var s Sensor
 		bucket := tx.Bucket([]byte("sensor"))
 		if bucket == nil {
 			return nil
@@ -45,6 +32,7 @@ func (b *BoltHivemindStore) getAllSensors() []Sensor {
 		c := bucket.Cursor()
 
 		for k, v := c.First(); k != nil; k, v = c.Next() {
+			var s Sensor
 			err := json.Unmarshal(v, &s)
 			if err != nil {
 				return err
@@ -57,14 +45,37 @@ func (b *BoltHivemindStore) getAllSensors() []Sensor {
 	return sensors
 }
 
+func (b *BoltHivemindStore) listSensors(q pageQuery) ([]Sensor, bool, error) {
+	p := &pageCollector{query: q}
+	err := b.scanJSON("sensor", p, func(v []byte) error {
+		var s Sensor
+		err := json.Unmarshal(v, &s)
+		if err == nil {
+			p.offer(q.position(sensorSortKey(s, q.Sort), s.ID), s)
+		}
+		return err
+	})
+	items, more := p.page()
+	var sensors []Sensor
+	for _, item := range items {
+		sensors = append(sensors, item.(Sensor))
+	}
+	return sensors, more, err
+}
+
 func (b *BoltHivemindStore) storeSensor(sensor Sensor) error {
 	var err error
+	if sensor.ID == "" {
+		return errMissingID
+	}
 
 	err = b.database.Update(func(tx *bolt.Tx) error {
 		bucket, err := tx.CreateBucketIfNotExists([]byte("sensor"))
 		if err != nil {
 			return err
 		}
+		sensor.Revision = nextRevision(bucket, sensor.ID)
+		sensor.Updated = time.Now().UTC()
 		encoded, err := json.Marshal(sensor)
 		if err != nil {
 			return err
@@ -75,25 +86,64 @@ func (b *BoltHivemindStore) storeSensor(sensor Sensor) error {
 	return err
 }
 
-func (b *BoltHivemindStore) getSwitch(id string) (Switch, error) {
-	var err error
-	var sw Switch
-	err = b.database.View(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket([]byte("switch"))
-		if bucket == nil {
-			return nil
-		}
-		v := bucket.Get([]byte(id))
-		if v == nil {
-			return nil
-		}
-		err = json.Unmarshal(v, &sw)
+// storeSensors stores all sensors in a single transaction, returning an error per sensor
+func (b *BoltHivemindStore) storeSensors(sensors []Sensor, fn func(previous, s Sensor)) ([]error, error) {
+	errs := make([]error, len(sensors))
+
+	err := b.database.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte("sensor"))
 		if err != nil {
 			return err
 		}
+		for i, sensor := range sensors {
+			if sensor.ID == "" {
+				errs[i] = errMissingID
+				continue
+			}
+			var previous Sensor
+			if encoded := bucket.Get([]byte(sensor.ID)); encoded != nil {
+				json.Unmarshal(encoded, &previous)
+			}
+			sensor.Revision = previous.Revision + 1
+			sensor.Updated = time.Now().UTC()
+			encoded, err := json.Marshal(sensor)
+			if err != nil {
+				errs[i] = err
+				continue
+			}
+			errs[i] = bucket.Put([]byte(sensor.ID), encoded)
+			if errs[i] == nil && fn != nil {
+				fn(previous, sensor)
+			}
+		}
 		return nil
 	})
 
+	return errs, err
+}
+
+func (b *BoltHivemindStore) updateSensor(id string, fn func(s *Sensor) error) (Sensor, error) {
+	var sensor Sensor
+	err := b.updateJSON("sensor", id, &sensor, func() error {
+		revision := sensor.Revision
+		err := fn(&sensor)
+		sensor.Revision = revision + 1
+		sensor.Updated = time.Now().UTC()
+		return err
+	})
+	return sensor, err
+}
+
+func (b *BoltHivemindStore) deleteSensor(id string, fn func(s Sensor) error) error {
+	var sensor Sensor
+	return b.deleteJSON("sensor", id, &sensor, func() error {
+		return fn(sensor)
+	})
+}
+
+func (b *BoltHivemindStore) getSwitch(id string) (Switch, error) {
+	var sw Switch
+	err := b.getJSON("switch", id, &sw)
 	return sw, err
 }
 
@@ -101,7 +151,6 @@ func (b *BoltHivemindStore) getAllSwitches() []Switch {
 	var switches []Switch
 
 	_ = b.database.View(func(tx *bolt.Tx) error {
-		var sw Switch
 		bucket := tx.Bucket([]byte("switch"))
 		if bucket == nil {
 			return nil
@@ -109,6 +158,7 @@ func (b *BoltHivemindStore) getAllSwitches() []Switch {
 		c := bucket.Cursor()
 
 		for k, v := c.First(); k != nil; k, v = c.Next() {
+			var sw Switch
 			err := json.Unmarshal(v, &sw)
 			if err != nil {
 				return err
@@ -121,14 +171,37 @@ func (b *BoltHivemindStore) getAllSwitches() []Switch {
 	return switches
 }
 
+func (b *BoltHivemindStore) listSwitches(q pageQuery) ([]Switch, bool, error) {
+	p := &pageCollector{query: q}
+	err := b.scanJSON("switch", p, func(v []byte) error {
+		var sw Switch
+		err := json.Unmarshal(v, &sw)
+		if err == nil {
+			p.offer(q.position(switchSortKey(sw, q.Sort), sw.ID), sw)
+		}
+		return err
+	})
+	items, more := p.page()
+	var switches []Switch
+	for _, item := range items {
+		switches = append(switches, item.(Switch))
+	}
+	return switches, more, err
+}
+
 func (b *BoltHivemindStore) storeSwitch(sw Switch) error {
 	var err error
+	if sw.ID == "" {
+		return errMissingID
+	}
 
 	err = b.database.Update(func(tx *bolt.Tx) error {
 		bucket, err := tx.CreateBucketIfNotExists([]byte("switch"))
 		if err != nil {
 			return err
 		}
+		sw.Revision = nextRevision(bucket, sw.ID)
+		sw.Updated = time.Now().UTC()
 		encoded, err := json.Marshal(sw)
 		if err != nil {
 			return err
@@ -138,3 +211,572 @@ func (b *BoltHivemindStore) storeSwitch(sw Switch) error {
 
 	return err
 }
+
+func (b *BoltHivemindStore) updateSwitch(id string, fn func(s *Switch) error) (Switch, error) {
+	var sw Switch
+	err := b.updateJSON("switch", id, &sw, func() error {
+		revision := sw.Revision
+		err := fn(&sw)
+		sw.Revision = revision + 1
+		sw.Updated = time.Now().UTC()
+		return err
+	})
+	return sw, err
+}
+
+func (b *BoltHivemindStore) deleteSwitch(id string, fn func(s Switch) error) error {
+	var sw Switch
+	return b.deleteJSON("switch", id, &sw, func() error {
+		return fn(sw)
+	})
+}
+
+// maxWebhookDeliveries is the number of delivery attempts kept per webhook
+const maxWebhookDeliveries = 100
+
+func (b *BoltHivemindStore) getWebhook(id string) (Webhook, error) {
+	var webhook Webhook
+	err := b.getJSON("webhook", id, &webhook)
+	return webhook, err
+}
+
+func (b *BoltHivemindStore) getAllWebhooks() []Webhook {
+	var webhooks []Webhook
+	_ = b.forEachJSON("webhook", func(v []byte) error {
+		var webhook Webhook
+		err := json.Unmarshal(v, &webhook)
+		webhooks = append(webhooks, webhook)
+		return err
+	})
+	return webhooks
+}
+
+func (b *BoltHivemindStore) storeWebhook(webhook Webhook) error {
+	return b.storeJSON("webhook", webhook.ID, webhook)
+}
+
+func (b *BoltHivemindStore) deleteWebhook(id string) error {
+	return b.database.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("webhook"))
+		if bucket == nil {
+			return nil
+		}
+		err := bucket.Delete([]byte(id))
+		if err != nil {
+			return err
+		}
+		deliveries := tx.Bucket([]byte("webhook_delivery"))
+		if deliveries == nil || deliveries.Bucket([]byte(id)) == nil {
+			return nil
+		}
+		return deliveries.DeleteBucket([]byte(id))
+	})
+}
+
+func (b *BoltHivemindStore) getWebhookDeliveries(id string) []WebhookDelivery {
+	var deliveries []WebhookDelivery
+
+	_ = b.database.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("webhook_delivery"))
+		if bucket == nil {
+			return nil
+		}
+		bucket = bucket.Bucket([]byte(id))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			var d WebhookDelivery
+			err := json.Unmarshal(v, &d)
+			if err != nil {
+				return err
+			}
+			deliveries = append(deliveries, d)
+			return nil
+		})
+	})
+
+	return deliveries
+}
+
+// storeWebhookDelivery appends d to the deliveries of its webhook, dropping the oldest beyond maxWebhookDeliveries
+func (b *BoltHivemindStore) storeWebhookDelivery(d WebhookDelivery) error {
+	return b.database.Update(func(tx *bolt.Tx) error {
+		root, err := tx.CreateBucketIfNotExists([]byte("webhook_delivery"))
+		if err != nil {
+			return err
+		}
+		bucket, err := root.CreateBucketIfNotExists([]byte(d.Webhook))
+		if err != nil {
+			return err
+		}
+		seq, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		encoded, err := json.Marshal(d)
+		if err != nil {
+			return err
+		}
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, seq)
+		err = bucket.Put(key, encoded)
+		if err != nil {
+			return err
+		}
+
+		if seq <= maxWebhookDeliveries {
+			return nil
+		}
+		oldest := make([]byte, 8)
+		binary.BigEndian.PutUint64(oldest, seq-maxWebhookDeliveries)
+		return bucket.Delete(oldest)
+	})
+}
+
+// getReadings returns the readings of sensor id from from to to, starting with the last one before
+// from; they are kept in a bucket per sensor under their sortableTime
+func (b *BoltHivemindStore) getReadings(id string, from, to time.Time) ([]Reading, error) {
+	var readings []Reading
+
+	err := b.database.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("history"))
+		if bucket == nil {
+			return nil
+		}
+		bucket = bucket.Bucket([]byte(id))
+		if bucket == nil {
+			return nil
+		}
+		c := bucket.Cursor()
+		start, end := []byte(sortableTime(from)), []byte(sortableTime(to))
+		k, v := c.Seek(start)
+		if !bytes.Equal(k, start) {
+			// the reading before from is the value the sensor had at from
+			if k == nil {
+				k, v = c.Last()
+			} else {
+				k, v = c.Prev()
+			}
+			if k == nil {
+				k, v = c.First()
+			}
+		}
+		for ; k != nil && bytes.Compare(k, end) <= 0; k, v = c.Next() {
+			var r Reading
+			err := json.Unmarshal(v, &r)
+			if err != nil {
+				return err
+			}
+			readings = append(readings, r)
+		}
+		return nil
+	})
+
+	return readings, err
+}
+
+// storeReadings appends the readings to those of their sensors in a single transaction, dropping the
+// readings of these sensors before keepSince
+func (b *BoltHivemindStore) storeReadings(readings []sensorReading, keepSince time.Time) error {
+	return b.database.Update(func(tx *bolt.Tx) error {
+		root, err := tx.CreateBucketIfNotExists([]byte("history"))
+		if err != nil {
+			return err
+		}
+		buckets := map[string]*bolt.Bucket{}
+		for _, r := range readings {
+			bucket, ok := buckets[r.ID]
+			if !ok {
+				bucket, err = root.CreateBucketIfNotExists([]byte(r.ID))
+				if err != nil {
+					return err
+				}
+				buckets[r.ID] = bucket
+			}
+			encoded, err := json.Marshal(r.Reading)
+			if err != nil {
+				return err
+			}
+			err = bucket.Put([]byte(sortableTime(r.Time)), encoded)
+			if err != nil {
+				return err
+			}
+		}
+
+		oldest := []byte(sortableTime(keepSince))
+		for _, bucket := range buckets {
+			c := bucket.Cursor()
+			for k, _ := c.First(); k != nil && bytes.Compare(k, oldest) < 0; k, _ = c.First() {
+				err = c.Delete()
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func (b *BoltHivemindStore) deleteReadings(id string) error {
+	return b.database.Update(func(tx *bolt.Tx) error {
+		history := tx.Bucket([]byte("history"))
+		if history == nil || history.Bucket([]byte(id)) == nil {
+			return nil
+		}
+		return history.DeleteBucket([]byte(id))
+	})
+}
+
+func (b *BoltHivemindStore) getAlertRule(id string) (AlertRule, error) {
+	var rule AlertRule
+	err := b.getJSON("alert_rule", id, &rule)
+	return rule, err
+}
+
+func (b *BoltHivemindStore) getAllAlertRules() []AlertRule {
+	var rules []AlertRule
+	_ = b.forEachJSON("alert_rule", func(v []byte) error {
+		var rule AlertRule
+		err := json.Unmarshal(v, &rule)
+		rules = append(rules, rule)
+		return err
+	})
+	return rules
+}
+
+func (b *BoltHivemindStore) storeAlertRule(rule AlertRule) error {
+	return b.storeJSON("alert_rule", rule.ID, rule)
+}
+
+// deleteAlertRule deletes the rule and the state of its alert
+func (b *BoltHivemindStore) deleteAlertRule(id string) error {
+	return b.database.Update(func(tx *bolt.Tx) error {
+		for _, name := range []string{"alert_rule", "alert"} {
+			bucket := tx.Bucket([]byte(name))
+			if bucket == nil {
+				continue
+			}
+			err := bucket.Delete([]byte(id))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (b *BoltHivemindStore) getAlert(rule string) (Alert, error) {
+	var alert Alert
+	err := b.getJSON("alert", rule, &alert)
+	return alert, err
+}
+
+func (b *BoltHivemindStore) getAllAlerts() []Alert {
+	var alerts []Alert
+	_ = b.forEachJSON("alert", func(v []byte) error {
+		var alert Alert
+		err := json.Unmarshal(v, &alert)
+		alerts = append(alerts, alert)
+		return err
+	})
+	return alerts
+}
+
+func (b *BoltHivemindStore) storeAlert(alert Alert) error {
+	return b.storeJSON("alert", alert.Rule, alert)
+}
+
+func (b *BoltHivemindStore) getToken(id string) (Token, error) {
+	var t Token
+	err := b.getJSON("token", id, &t)
+	return t, err
+}
+
+func (b *BoltHivemindStore) getAllTokens() []Token {
+	var tokens []Token
+	_ = b.forEachJSON("token", func(v []byte) error {
+		var t Token
+		err := json.Unmarshal(v, &t)
+		tokens = append(tokens, t)
+		return err
+	})
+	return tokens
+}
+
+func (b *BoltHivemindStore) storeToken(t Token) error {
+	return b.storeJSON("token", t.ID, t)
+}
+
+func (b *BoltHivemindStore) deleteToken(id string) error {
+	return b.deleteKey("token", id)
+}
+
+func (b *BoltHivemindStore) getUser(username string) (User, error) {
+	var u User
+	err := b.getJSON("user", username, &u)
+	return u, err
+}
+
+func (b *BoltHivemindStore) getAllUsers() []User {
+	var users []User
+	_ = b.forEachJSON("user", func(v []byte) error {
+		var u User
+		err := json.Unmarshal(v, &u)
+		users = append(users, u)
+		return err
+	})
+	return users
+}
+
+func (b *BoltHivemindStore) storeUser(u User) error {
+	return b.storeJSON("user", u.Username, u)
+}
+
+func (b *BoltHivemindStore) deleteUser(username string) error {
+	return b.deleteKey("user", username)
+}
+
+func (b *BoltHivemindStore) getSession(id string) (Session, error) {
+	var s Session
+	err := b.getJSON("session", id, &s)
+	return s, err
+}
+
+func (b *BoltHivemindStore) storeSession(s Session) error {
+	return b.storeJSON("session", s.ID, s)
+}
+
+func (b *BoltHivemindStore) deleteSession(id string) error {
+	return b.deleteKey("session", id)
+}
+
+func (b *BoltHivemindStore) getLocation(id string) (Location, error) {
+	var l Location
+	err := b.getJSON("location", id, &l)
+	return l, err
+}
+
+func (b *BoltHivemindStore) getAllLocations() []Location {
+	var locations []Location
+	_ = b.forEachJSON("location", func(v []byte) error {
+		var l Location
+		err := json.Unmarshal(v, &l)
+		locations = append(locations, l)
+		return err
+	})
+	return locations
+}
+
+func (b *BoltHivemindStore) storeLocation(l Location) error {
+	return b.storeJSON("location", l.ID, l)
+}
+
+func (b *BoltHivemindStore) deleteLocation(id string) error {
+	return b.deleteKey("location", id)
+}
+
+func (b *BoltHivemindStore) getDevice(id string) (Device, error) {
+	var d Device
+	err := b.getJSON("device", id, &d)
+	return d, err
+}
+
+func (b *BoltHivemindStore) getAllDevices() []Device {
+	var devices []Device
+	_ = b.forEachJSON("device", func(v []byte) error {
+		var d Device
+		err := json.Unmarshal(v, &d)
+		devices = append(devices, d)
+		return err
+	})
+	return devices
+}
+
+func (b *BoltHivemindStore) storeDevice(d Device) error {
+	return b.storeJSON("device", d.ID, d)
+}
+
+func (b *BoltHivemindStore) deleteDevice(id string) error {
+	return b.deleteKey("device", id)
+}
+
+// getJSON decodes the value stored under id in bucket into v, returning ErrNotFound when it is missing
+func (b *BoltHivemindStore) getJSON(bucket, id string, v interface{}) error {
+	return b.database.View(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(bucket))
+		if bkt == nil {
+			return notFound(bucket, id)
+		}
+		encoded := bkt.Get([]byte(id))
+		if encoded == nil {
+			return notFound(bucket, id)
+		}
+		return json.Unmarshal(encoded, v)
+	})
+}
+
+// forEachJSON calls fn with every value in bucket
+func (b *BoltHivemindStore) forEachJSON(bucket string, fn func(v []byte) error) error {
+	return b.database.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(bucket))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			return fn(v)
+		})
+	})
+}
+
+// storeJSON stores v encoded as JSON under id in bucket
+func (b *BoltHivemindStore) storeJSON(bucket, id string, v interface{}) error {
+	return b.database.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		if err != nil {
+			return err
+		}
+		encoded, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(id), encoded)
+	})
+}
+
+// updateJSON decodes the value stored under id in bucket into v, calls change and stores v again,
+// all in one transaction which is rolled back when change fails
+func (b *BoltHivemindStore) updateJSON(bucket, id string, v interface{}, change func() error) error {
+	return b.database.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(bucket))
+		if bkt == nil {
+			return notFound(bucket, id)
+		}
+		encoded := bkt.Get([]byte(id))
+		if encoded == nil {
+			return notFound(bucket, id)
+		}
+		err := json.Unmarshal(encoded, v)
+		if err != nil {
+			return err
+		}
+		err = change()
+		if err != nil {
+			return err
+		}
+		encoded, err = json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		return bkt.Put([]byte(id), encoded)
+	})
+}
+
+// scanJSON calls fn with the values in bucket in key order until p is complete, a page in ID order
+// starts right after its cursor
+func (b *BoltHivemindStore) scanJSON(bucket string, p *pageCollector, fn func(v []byte) error) error {
+	return b.database.View(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(bucket))
+		if bkt == nil {
+			return nil
+		}
+		c := bkt.Cursor()
+		k, v := c.First()
+		if q := p.query; q.After != nil && q.Sort == "id" && !q.Descending {
+			k, v = c.Seek([]byte(q.After.ID))
+		}
+		for ; k != nil && !p.complete(); k, v = c.Next() {
+			err := fn(v)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// deleteJSON decodes the value stored under id in bucket into v, calls check and deletes id, all in
+// one transaction; the value is kept when check fails
+func (b *BoltHivemindStore) deleteJSON(bucket, id string, v interface{}, check func() error) error {
+	return b.database.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(bucket))
+		if bkt == nil {
+			return notFound(bucket, id)
+		}
+		encoded := bkt.Get([]byte(id))
+		if encoded == nil {
+			return notFound(bucket, id)
+		}
+		err := json.Unmarshal(encoded, v)
+		if err != nil {
+			return err
+		}
+		err = check()
+		if err != nil {
+			return err
+		}
+		return bkt.Delete([]byte(id))
+	})
+}
+
+// nextRevision returns the revision following the one of the sensor or switch stored under id in
+// bucket, 1 for a new one
+func nextRevision(bucket *bolt.Bucket, id string) uint64 {
+	var current struct{ Revision uint64 }
+	if encoded := bucket.Get([]byte(id)); encoded != nil {
+		json.Unmarshal(encoded, &current)
+	}
+	return current.Revision + 1
+}
+
+// deleteKey deletes id from bucket
+func (b *BoltHivemindStore) deleteKey(bucket, id string) error {
+	return b.database.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(bucket))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.Delete([]byte(id))
+	})
+}
+
+// ping reads and decodes the first sensor, for the readiness check
+func (b *BoltHivemindStore) ping() error {
+	return b.database.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("sensor"))
+		if bucket == nil {
+			return nil
+		}
+		_, v := bucket.Cursor().First()
+		if v == nil {
+			return nil
+		}
+		var sensor Sensor
+		return json.Unmarshal(v, &sensor)
+	})
+}
+
+func (b *BoltHivemindStore) collectMetrics(w io.Writer) {
+	stats := b.database.Stats()
+
+	writeMetricHeader(w, "hivemind_bolt_read_tx_total", "counter", "Total number of started read transactions.")
+	writeMetric(w, "hivemind_bolt_read_tx_total", nil, float64(stats.TxN))
+	writeMetricHeader(w, "hivemind_bolt_open_read_tx", "gauge", "Number of currently open read transactions.")
+	writeMetric(w, "hivemind_bolt_open_read_tx", nil, float64(stats.OpenTxN))
+	writeMetricHeader(w, "hivemind_bolt_free_pages", "gauge", "Number of free pages on the freelist.")
+	writeMetric(w, "hivemind_bolt_free_pages", nil, float64(stats.FreePageN))
+	writeMetricHeader(w, "hivemind_bolt_pending_pages", "gauge", "Number of pending pages on the freelist.")
+	writeMetric(w, "hivemind_bolt_pending_pages", nil, float64(stats.PendingPageN))
+	writeMetricHeader(w, "hivemind_bolt_page_alloc_bytes_total", "counter", "Total bytes allocated for pages.")
+	writeMetric(w, "hivemind_bolt_page_alloc_bytes_total", nil, float64(stats.TxStats.PageAlloc))
+	writeMetricHeader(w, "hivemind_bolt_cursors_total", "counter", "Total number of cursors created.")
+	writeMetric(w, "hivemind_bolt_cursors_total", nil, float64(stats.TxStats.CursorCount))
+	writeMetricHeader(w, "hivemind_bolt_writes_total", "counter", "Total number of writes to disk.")
+	writeMetric(w, "hivemind_bolt_writes_total", nil, float64(stats.TxStats.Write))
+	writeMetricHeader(w, "hivemind_bolt_write_seconds_total", "counter", "Total time spent writing to disk.")
+	writeMetric(w, "hivemind_bolt_write_seconds_total", nil, stats.TxStats.WriteTime.Seconds())
+	writeMetricHeader(w, "hivemind_bolt_spill_seconds_total", "counter", "Total time spent spilling nodes.")
+	writeMetric(w, "hivemind_bolt_spill_seconds_total", nil, stats.TxStats.SpillTime.Seconds())
+	writeMetricHeader(w, "hivemind_bolt_rebalance_seconds_total", "counter", "Total time spent rebalancing nodes.")
+	writeMetric(w, "hivemind_bolt_rebalance_seconds_total", nil, stats.TxStats.RebalanceTime.Seconds())
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"errors"
+	"reflect"
 	"testing"
 	"time"
 
@@ -16,8 +18,8 @@ func TestBoltHivemindStore(t *testing.T) {
 	defer deleteDatabase(t, "test.db")
 
 	seed := []Sensor{
-		Sensor{"13", "13", "C", "generic", 666},
-		Sensor{"first", "First", "C", "generic", 1},
+		Sensor{ID: "13", Name: "13", Unit: "C", Type: "generic", Value: 666},
+		Sensor{ID: "first", Name: "First", Unit: "C", Type: "generic", Value: 1},
 	}
 
 	err = seedBoltDB(t, database, seed)
@@ -26,7 +28,7 @@ func TestBoltHivemindStore(t *testing.T) {
 	}
 
 	t.Run("getSensor: json object matches", func(t *testing.T) {
-		want := Sensor{"13", "13", "C", "generic", 666}
+		want := Sensor{ID: "13", Name: "13", Unit: "C", Type: "generic", Value: 666}
 
 		store := BoltHivemindStore{database}
 
@@ -45,17 +47,26 @@ func TestBoltHivemindStore(t *testing.T) {
 		store := BoltHivemindStore{database}
 
 		got, err := store.getSensor("unknown")
-		if err != nil {
-			t.Fatalf("failure within getSensor() for unknown: %s", err)
+		if !errors.Is(err, ErrNotFound) {
+			t.Fatalf("getSensor() for unknown returned %v, want ErrNotFound", err)
 		}
 
 		assertSensor(t, got, want)
 	})
 
+	t.Run("storeSensor: reject a missing ID", func(t *testing.T) {
+		store := BoltHivemindStore{database}
+
+		err := store.storeSensor(Sensor{Name: "No ID"})
+		if !errors.Is(err, ErrValidation) {
+			t.Fatalf("storeSensor() without ID returned %v, want ErrValidation", err)
+		}
+	})
+
 	t.Run("getAllSensors: get slice and match", func(t *testing.T) {
 		want := []Sensor{
-			Sensor{"13", "13", "C", "generic", 666},
-			Sensor{"first", "First", "C", "generic", 1},
+			Sensor{ID: "13", Name: "13", Unit: "C", Type: "generic", Value: 666},
+			Sensor{ID: "first", Name: "First", Unit: "C", Type: "generic", Value: 1},
 		}
 
 		store := BoltHivemindStore{database}
@@ -67,7 +78,7 @@ func TestBoltHivemindStore(t *testing.T) {
 
 	t.Run("storeSensor: storing a new sensor", func(t *testing.T) {
 		var want error
-		s := Sensor{"new", "New", "C", "generic", 2019}
+		s := Sensor{ID: "new", Name: "New", Unit: "C", Type: "generic", Value: 2019}
 
 		store := BoltHivemindStore{database}
 
@@ -77,4 +88,139 @@ func TestBoltHivemindStore(t *testing.T) {
 			t.Errorf("failure within storeSensor: %s", err)
 		}
 	})
+
+	t.Run("storeSensors: storing sensors in one transaction", func(t *testing.T) {
+		sensors := []Sensor{
+			Sensor{ID: "batch1", Name: "Batch 1", Unit: "C", Type: "generic", Value: 1},
+			Sensor{Name: "No ID", Unit: "C", Type: "generic", Value: 2},
+		}
+
+		store := BoltHivemindStore{database}
+
+		errs, err := store.storeSensors(sensors, nil)
+		if err != nil {
+			t.Fatalf("failure within storeSensors(): %s", err)
+		}
+		if errs[0] != nil || errs[1] == nil {
+			t.Errorf("unexpected per sensor errors %v", errs)
+		}
+
+		got, _ := store.getSensor("batch1")
+		assertStoredSensor(t, got, Sensor{ID: "batch1", Name: "Batch 1", Unit: "C", Type: "generic", Value: 1, Revision: 1})
+	})
+
+	t.Run("updateSensor: change a stored sensor, keep it when the change fails", func(t *testing.T) {
+		store := BoltHivemindStore{database}
+
+		got, err := store.updateSensor("first", func(s *Sensor) error {
+			s.Value = 2
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("failure within updateSensor(): %s", err)
+		}
+		assertStoredSensor(t, got, Sensor{ID: "first", Name: "First", Unit: "C", Type: "generic", Value: 2, Revision: 1})
+
+		_, err = store.updateSensor("first", func(s *Sensor) error {
+			s.Value = 3
+			return ErrConflict
+		})
+		got, _ = store.getSensor("first")
+		if err != ErrConflict {
+			t.Errorf("updateSensor() returned %v, want the error of the change", err)
+		}
+		assertStoredSensor(t, got, Sensor{ID: "first", Name: "First", Unit: "C", Type: "generic", Value: 2, Revision: 1})
+
+		_, err = store.updateSensor("unknown", func(s *Sensor) error { return nil })
+		if !errors.Is(err, ErrNotFound) {
+			t.Errorf("updateSensor() for unknown returned %v, want ErrNotFound", err)
+		}
+	})
+
+	t.Run("listSensors: read pages in ID order", func(t *testing.T) {
+		store := BoltHivemindStore{database}
+		q := pageQuery{Sort: "id", Limit: 2}
+
+		got, more, err := store.listSensors(q)
+		if err != nil || !more || len(got) != 2 || got[0].ID != "13" || got[1].ID != "batch1" {
+			t.Fatalf("got first page %v, %v, %v", got, more, err)
+		}
+
+		q.After = &pageCursor{"id", "", got[1].ID}
+		got, more, err = store.listSensors(q)
+		if err != nil || more || len(got) != 2 || got[0].ID != "first" || got[1].ID != "new" {
+			t.Errorf("got second page %v, %v, %v", got, more, err)
+		}
+	})
+
+	t.Run("storeSensor: count up the revision on every write", func(t *testing.T) {
+		store := BoltHivemindStore{database}
+
+		store.storeSensor(Sensor{ID: "rev", Name: "Rev", Unit: "C", Type: "generic", Value: 1})
+		store.storeSensor(Sensor{ID: "rev", Name: "Rev", Unit: "C", Type: "generic", Value: 1, Revision: 7})
+
+		got, _ := store.getSensor("rev")
+		assertStoredSensor(t, got, Sensor{ID: "rev", Name: "Rev", Unit: "C", Type: "generic", Value: 1, Revision: 2})
+	})
+
+	t.Run("deleteSensor: delete a sensor, keep it when the check fails", func(t *testing.T) {
+		store := BoltHivemindStore{database}
+
+		err := store.deleteSensor("rev", func(s Sensor) error { return ErrPreconditionFailed })
+		if err != ErrPreconditionFailed {
+			t.Errorf("deleteSensor() returned %v, want the error of the check", err)
+		}
+		err = store.deleteSensor("rev", func(s Sensor) error { return nil })
+		if err != nil {
+			t.Fatalf("failure within deleteSensor(): %s", err)
+		}
+		_, err = store.getSensor("rev")
+		if !errors.Is(err, ErrNotFound) {
+			t.Errorf("getSensor() after deleteSensor() returned %v, want ErrNotFound", err)
+		}
+		err = store.deleteSensor("rev", func(s Sensor) error { return nil })
+		if !errors.Is(err, ErrNotFound) {
+			t.Errorf("deleteSensor() for unknown returned %v, want ErrNotFound", err)
+		}
+	})
+
+	t.Run("storeReadings: keep readings in time order and drop those before the retention", func(t *testing.T) {
+		store := BoltHivemindStore{database}
+		at := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+
+		for i := 0; i < 4; i += 2 {
+			readings := []sensorReading{
+				{"13", Reading{at.Add(time.Duration(i+1) * time.Hour), i + 1}},
+				{"13", Reading{at.Add(time.Duration(i) * time.Hour), i}},
+			}
+			err := store.storeReadings(readings, at.Add(time.Duration(i-1)*time.Hour))
+			if err != nil {
+				t.Fatalf("failure within storeReadings(): %s", err)
+			}
+		}
+
+		got, err := store.getReadings("13", at, at.Add(2*time.Hour))
+		want := []Reading{{at.Add(time.Hour), 1}, {at.Add(2 * time.Hour), 2}}
+		if err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("getReadings() returned %v, %v, want %v", got, err, want)
+		}
+
+		got, err = store.getReadings("13", at.Add(90*time.Minute), at.Add(150*time.Minute))
+		want = []Reading{{at.Add(time.Hour), 1}, {at.Add(2 * time.Hour), 2}}
+		if err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("getReadings() returned %v, %v, want the reading before from first %v", got, err, want)
+		}
+
+		got, err = store.getReadings("13", at.Add(5*time.Hour), at.Add(6*time.Hour))
+		want = []Reading{{at.Add(3 * time.Hour), 3}}
+		if err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("getReadings() after the last reading returned %v, %v, want %v", got, err, want)
+		}
+
+		store.deleteReadings("13")
+		got, err = store.getReadings("13", at, at.Add(4*time.Hour))
+		if err != nil || len(got) != 0 {
+			t.Errorf("getReadings() after deleteReadings() returned %v, %v, want none", got, err)
+		}
+	})
 }
@@ -1,9 +1,5 @@
 package main
 
-import (
-	"errors"
-)
-
 // InMemoryHivemindStore is a small in-memory implementation of a HivemindStore
 type InMemoryHivemindStore struct {
 	sensors map[string]Sensor
@@ -13,7 +9,7 @@ func (i *InMemoryHivemindStore) getSensor(id string) (Sensor, error) {
 	var err error
 	sensor, ok := i.sensors[id]
 	if !ok {
-		err = errors.New("sensor not found in store")
+		err = notFound("sensor", id)
 	}
 	return sensor, err
 }
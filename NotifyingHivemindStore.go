@@ -0,0 +1,205 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"reflect"
+)
+
+// ChangeListener gets notified after a sensor or switch has been stored, l is the logger of the store
+// carrying the correlation ID of the request or message that caused the change
+type ChangeListener interface {
+	sensorChanged(s Sensor, l *slog.Logger)
+	switchChanged(s Switch, l *slog.Logger)
+}
+
+// RemovalListener is a ChangeListener that also gets notified after a sensor or switch has been deleted
+type RemovalListener interface {
+	sensorRemoved(id string)
+	switchRemoved(id string)
+}
+
+// DistinctChangeListener is a ChangeListener that only gets notified when a stored sensor or switch
+// differs from its previous version other than by revision and time of the update
+type DistinctChangeListener interface {
+	ChangeListener
+	distinctChangesOnly()
+}
+
+// NotifyingHivemindStore is a HivemindStore wrapper that notifies listeners on every successful store
+type NotifyingHivemindStore struct {
+	HivemindStore
+	listeners []ChangeListener
+	logger    *slog.Logger
+}
+
+func (n *NotifyingHivemindStore) addListener(l ChangeListener) {
+	n.listeners = append(n.listeners, l)
+}
+
+// withLogger returns a copy of n logging changes to l, listeners added afterwards are not shared
+func (n *NotifyingHivemindStore) withLogger(l *slog.Logger) HivemindStore {
+	c := *n
+	c.logger = l
+	return &c
+}
+
+func (n *NotifyingHivemindStore) log() *slog.Logger {
+	if n.logger == nil {
+		return slog.Default()
+	}
+	return n.logger
+}
+
+// storeSensor replaces an existing sensor by updateSensor to compare it with its previous version in
+// the same transaction
+func (n *NotifyingHivemindStore) storeSensor(s Sensor) error {
+	var previous Sensor
+	stored, err := n.HivemindStore.updateSensor(s.ID, func(current *Sensor) error {
+		previous = *current
+		*current = s
+		return nil
+	})
+	if errors.Is(err, ErrNotFound) {
+		err = n.HivemindStore.storeSensor(s)
+		if err == nil {
+			// read back the revision the new sensor got for the listeners
+			stored, _ = n.HivemindStore.getSensor(s.ID)
+		}
+	}
+	if err != nil {
+		n.log().Error("storing sensor failed", "id", s.ID, "error", err)
+		return err
+	}
+	n.sensorStored(previous, stored)
+	return nil
+}
+
+func (n *NotifyingHivemindStore) storeSensors(sensors []Sensor, fn func(previous, s Sensor)) ([]error, error) {
+	var previous, stored []Sensor
+	errs, err := n.HivemindStore.storeSensors(sensors, func(p, s Sensor) {
+		previous, stored = append(previous, p), append(stored, s)
+		if fn != nil {
+			fn(p, s)
+		}
+	})
+	if err != nil {
+		n.log().Error("storing sensors failed", "count", len(sensors), "error", err)
+		return errs, err
+	}
+	for i, s := range sensors {
+		if errs[i] != nil {
+			n.log().Error("storing sensor failed", "id", s.ID, "error", errs[i])
+		}
+	}
+	for i := range stored {
+		n.sensorStored(previous[i], stored[i])
+	}
+	return errs, nil
+}
+
+func (n *NotifyingHivemindStore) updateSensor(id string, fn func(s *Sensor) error) (Sensor, error) {
+	var previous Sensor
+	s, err := n.HivemindStore.updateSensor(id, func(s *Sensor) error {
+		previous = *s
+		return fn(s)
+	})
+	if err != nil {
+		return s, err
+	}
+	n.sensorStored(previous, s)
+	return s, nil
+}
+
+func (n *NotifyingHivemindStore) deleteSensor(id string, fn func(s Sensor) error) error {
+	err := n.HivemindStore.deleteSensor(id, fn)
+	if err != nil {
+		return err
+	}
+	n.log().Info("sensor deleted", "id", id)
+	for _, l := range n.listeners {
+		if r, ok := l.(RemovalListener); ok {
+			r.sensorRemoved(id)
+		}
+	}
+	return nil
+}
+
+// sensorStored notifies the listeners of s, a DistinctChangeListener only when s differs from its
+// previous version
+func (n *NotifyingHivemindStore) sensorStored(previous, s Sensor) {
+	previous.Revision, previous.Updated = s.Revision, s.Updated
+	changed := !reflect.DeepEqual(previous, s)
+	if changed {
+		n.log().Debug("sensor changed", "id", s.ID, "value", s.Value, "previous", previous.Value)
+	}
+	for _, l := range n.listeners {
+		if _, distinct := l.(DistinctChangeListener); changed || !distinct {
+			l.sensorChanged(s, n.log())
+		}
+	}
+}
+
+// storeSwitch replaces an existing switch by updateSwitch like storeSensor
+func (n *NotifyingHivemindStore) storeSwitch(s Switch) error {
+	var previous Switch
+	stored, err := n.HivemindStore.updateSwitch(s.ID, func(current *Switch) error {
+		previous = *current
+		*current = s
+		return nil
+	})
+	if errors.Is(err, ErrNotFound) {
+		err = n.HivemindStore.storeSwitch(s)
+		if err == nil {
+			// read back the revision the new switch got for the listeners
+			stored, _ = n.HivemindStore.getSwitch(s.ID)
+		}
+	}
+	if err != nil {
+		n.log().Error("storing switch failed", "id", s.ID, "error", err)
+		return err
+	}
+	n.switchStored(previous, stored)
+	return nil
+}
+
+func (n *NotifyingHivemindStore) updateSwitch(id string, fn func(s *Switch) error) (Switch, error) {
+	var previous Switch
+	s, err := n.HivemindStore.updateSwitch(id, func(s *Switch) error {
+		previous = *s
+		return fn(s)
+	})
+	if err != nil {
+		return s, err
+	}
+	n.switchStored(previous, s)
+	return s, nil
+}
+
+func (n *NotifyingHivemindStore) deleteSwitch(id string, fn func(s Switch) error) error {
+	err := n.HivemindStore.deleteSwitch(id, fn)
+	if err != nil {
+		return err
+	}
+	n.log().Info("switch deleted", "id", id)
+	for _, l := range n.listeners {
+		if r, ok := l.(RemovalListener); ok {
+			r.switchRemoved(id)
+		}
+	}
+	return nil
+}
+
+// switchStored notifies the listeners of s like sensorStored
+func (n *NotifyingHivemindStore) switchStored(previous, s Switch) {
+	previous.Revision, previous.Updated = s.Revision, s.Updated
+	changed := !reflect.DeepEqual(previous, s)
+	if changed {
+		n.log().Info("switch changed", "id", s.ID, "state", s.State, "previous", previous.State)
+	}
+	for _, l := range n.listeners {
+		if _, distinct := l.(DistinctChangeListener); changed || !distinct {
+			l.switchChanged(s, n.log())
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"log/slog"
+	"testing"
+)
+
+func TestNotifyingHivemindStore(t *testing.T) {
+	store := NotifyingHivemindStore{
+		HivemindStore: &StubHivemindStore{
+			map[string]Sensor{"test": Sensor{ID: "test", Name: "Test", Unit: "C", Type: "generic", Value: 1}},
+			map[string]Switch{"lamp": Switch{ID: "lamp", Name: "Lamp", Type: "generic"}},
+		},
+	}
+	listener := &recordingListener{}
+	distinct := &distinctRecordingListener{}
+	store.addListener(listener)
+	store.addListener(distinct)
+
+	t.Run("notify on every stored sensor", func(t *testing.T) {
+		store.storeSensor(Sensor{ID: "test", Name: "Test", Unit: "C", Type: "generic", Value: 1})
+		store.storeSensor(Sensor{ID: "test", Name: "Test", Unit: "C", Type: "generic", Value: 2})
+		store.storeSensors([]Sensor{{ID: "test", Name: "Test", Unit: "C", Type: "generic", Value: 2}, {ID: "new", Name: "New", Unit: "C", Type: "generic", Value: 3}}, nil)
+
+		if len(listener.sensors) != 4 {
+			t.Errorf("unexpected notifications %v", listener.sensors)
+		}
+	})
+
+	t.Run("notify distinct change listeners only when a sensor changed", func(t *testing.T) {
+		if len(distinct.sensors) != 2 || distinct.sensors[0].Value != 2 || distinct.sensors[1].ID != "new" {
+			t.Errorf("unexpected notifications %v", distinct.sensors)
+		}
+	})
+
+	t.Run("notify distinct change listeners only when a switch changed", func(t *testing.T) {
+		store.storeSwitch(Switch{ID: "lamp", Name: "Lamp", Type: "generic"})
+		store.storeSwitch(Switch{ID: "lamp", Name: "Lamp", Type: "generic", State: true})
+
+		if len(listener.switches) != 2 {
+			t.Errorf("unexpected notifications %v", listener.switches)
+		}
+		if len(distinct.switches) != 1 || !distinct.switches[0].State {
+			t.Errorf("unexpected distinct notifications %v", distinct.switches)
+		}
+	})
+
+	t.Run("ignore a new revision of an unchanged switch for distinct change listeners", func(t *testing.T) {
+		store.updateSwitch("lamp", func(sw *Switch) error {
+			sw.Revision++
+			return nil
+		})
+
+		if len(listener.switches) != 3 {
+			t.Errorf("unexpected notifications %v", listener.switches)
+		}
+		if len(distinct.switches) != 1 {
+			t.Errorf("unexpected distinct notifications %v", distinct.switches)
+		}
+	})
+}
+
+type recordingListener struct {
+	sensors  []Sensor
+	switches []Switch
+}
+
+func (r *recordingListener) sensorChanged(s Sensor, l *slog.Logger) {
+	r.sensors = append(r.sensors, s)
+}
+
+func (r *recordingListener) switchChanged(s Switch, l *slog.Logger) {
+	r.switches = append(r.switches, s)
+}
+
+type distinctRecordingListener struct {
+	recordingListener
+}
+
+func (r *distinctRecordingListener) distinctChangesOnly() {}
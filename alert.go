@@ -0,0 +1,450 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	alertOK           = "ok"
+	alertPending      = "pending"
+	alertFiring       = "firing"
+	alertAcknowledged = "acknowledged"
+	alertResolved     = "resolved"
+)
+
+// duration is a time.Duration written as a string like "5m" in JSON
+type duration time.Duration
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	err := json.Unmarshal(b, &s)
+	if err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(parsed)
+	return nil
+}
+
+// AlertRule fires when Sensor stays above or below Threshold for at least For, it only resolves
+// after the value crossed back past the threshold by Hysteresis
+type AlertRule struct {
+	ID         string
+	Name       string
+	Sensor     string
+	Condition  string
+	Threshold  int
+	Hysteresis int
+	For        duration
+	Notifiers  []AlertNotifier
+}
+
+// AlertNotifier is a notification target of an AlertRule, Type is one of webhook, ntfy or smtp
+type AlertNotifier struct {
+	Type string
+	URL  string   `json:",omitempty"`
+	To   []string `json:",omitempty"`
+}
+
+// Alert is the current state of an AlertRule
+type Alert struct {
+	Rule           string
+	State          string
+	Value          int
+	Since          time.Time
+	FiredAt        time.Time
+	ResolvedAt     time.Time
+	AcknowledgedAt time.Time
+}
+
+// AlertStore is an interface for alert datastorage
+type AlertStore interface {
+	getAlertRule(id string) (AlertRule, error)
+	getAllAlertRules() []AlertRule
+	storeAlertRule(r AlertRule) error
+	deleteAlertRule(id string) error
+	getAlert(rule string) (Alert, error)
+	getAllAlerts() []Alert
+	storeAlert(a Alert) error
+}
+
+// AlertManager evaluates alert rules on every sensor change and periodically for pending alerts
+type AlertManager struct {
+	store     AlertStore
+	client    *http.Client
+	smtpRelay string
+	smtpFrom  string
+	mutex     sync.Mutex
+	wg        sync.WaitGroup
+	stop      chan struct{}
+	evaluator int32
+	now       func() time.Time
+	send      func(n AlertNotifier, r AlertRule, a Alert) error
+}
+
+// NewAlertManager creates an AlertManager, register it as ChangeListener and start it to evaluate rules
+func NewAlertManager(s AlertStore) *AlertManager {
+	m := &AlertManager{
+		store:    s,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		smtpFrom: "hivemind@localhost",
+		stop:     make(chan struct{}),
+		now:      time.Now,
+	}
+	m.send = m.deliver
+	return m
+}
+
+// start evaluates pending alerts every interval until shutdown
+func (m *AlertManager) start(interval time.Duration) {
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		atomic.StoreInt32(&m.evaluator, 1)
+		defer atomic.StoreInt32(&m.evaluator, 0)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				m.evaluateAll()
+			case <-m.stop:
+				return
+			}
+		}
+	}()
+}
+
+// shutdown stops evaluation and waits for notifications in flight
+func (m *AlertManager) shutdown() {
+	close(m.stop)
+	m.wg.Wait()
+}
+
+// running reports whether pending alerts are evaluated, for the readiness check
+func (m *AlertManager) running() error {
+	if atomic.LoadInt32(&m.evaluator) == 0 {
+		return errors.New("alert evaluation not running")
+	}
+	return nil
+}
+
+func (m *AlertManager) sensorChanged(s Sensor, l *slog.Logger) {
+	for _, r := range m.store.getAllAlertRules() {
+		if r.Sensor == s.ID {
+			m.evaluate(r, s.Value, l)
+		}
+	}
+}
+
+func (m *AlertManager) switchChanged(s Switch, l *slog.Logger) {}
+
+// evaluateAll re-evaluates pending alerts with their last value so For elapses without new readings
+func (m *AlertManager) evaluateAll() {
+	for _, a := range m.store.getAllAlerts() {
+		if a.State != alertPending {
+			continue
+		}
+		r, err := m.store.getAlertRule(a.Rule)
+		if err != nil || r.ID == "" {
+			continue
+		}
+		m.evaluate(r, a.Value, slog.Default())
+	}
+}
+
+// evaluate updates the alert of r with value, logging state changes and notifications to l
+func (m *AlertManager) evaluate(r AlertRule, value int, l *slog.Logger) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	now := m.now()
+	a, _ := m.store.getAlert(r.ID)
+	if a.Rule == "" {
+		a = Alert{Rule: r.ID, State: alertOK}
+	}
+	previous := a.State
+	a.Value = value
+
+	switch a.State {
+	case alertOK, alertResolved:
+		if r.breached(value) {
+			a.State = alertPending
+			a.Since = now
+		}
+	case alertPending:
+		if !r.breached(value) {
+			a.State = alertOK
+			if !a.FiredAt.IsZero() {
+				a.State = alertResolved
+			}
+		}
+	case alertFiring, alertAcknowledged:
+		if r.recovered(value) {
+			a.State = alertResolved
+			a.ResolvedAt = now
+		}
+	}
+	if a.State == alertPending && now.Sub(a.Since) >= time.Duration(r.For) {
+		a.State = alertFiring
+		a.FiredAt = now
+	}
+
+	m.store.storeAlert(a)
+	if a.State != previous {
+		l.Info("alert state changed", "rule", r.ID, "sensor", r.Sensor, "value", value, "state", a.State, "previous", previous)
+	}
+	if a.State != previous && (a.State == alertFiring || (a.State == alertResolved && previous != alertPending)) {
+		m.notify(r, a, l)
+	}
+}
+
+// acknowledge silences a firing alert until it resolves
+func (m *AlertManager) acknowledge(id string) (Alert, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	a, err := m.store.getAlert(id)
+	if err != nil {
+		return a, err
+	}
+	if a.Rule == "" {
+		return a, notFound("alert", id)
+	}
+	if a.State != alertFiring {
+		return a, fmt.Errorf("only firing alerts can be acknowledged: %w", ErrConflict)
+	}
+	a.State = alertAcknowledged
+	a.AcknowledgedAt = m.now()
+	return a, m.store.storeAlert(a)
+}
+
+func (m *AlertManager) notify(r AlertRule, a Alert, l *slog.Logger) {
+	for _, n := range r.Notifiers {
+		m.wg.Add(1)
+		go func(n AlertNotifier) {
+			defer m.wg.Done()
+			if err := m.send(n, r, a); err != nil {
+				l.Warn("alert notification failed", "rule", r.ID, "notifier", n.Type, "state", a.State, "error", err)
+			}
+		}(n)
+	}
+}
+
+// deliver sends a notification about a to n
+func (m *AlertManager) deliver(n AlertNotifier, r AlertRule, a Alert) error {
+	title, message := r.describe(a)
+	switch n.Type {
+	case "webhook":
+		payload, err := json.Marshal(struct {
+			Rule  AlertRule
+			Alert Alert
+		}{r, a})
+		if err != nil {
+			return err
+		}
+		return m.post(n.URL, "application/json", payload, nil)
+	case "ntfy":
+		headers := map[string]string{"Title": title, "Priority": "high", "Tags": "rotating_light"}
+		if a.State == alertResolved {
+			headers["Priority"] = "default"
+			headers["Tags"] = "white_check_mark"
+		}
+		return m.post(n.URL, "text/plain", []byte(message), headers)
+	case "smtp":
+		if m.smtpRelay == "" {
+			return errors.New("no SMTP relay configured")
+		}
+		msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\n\r\n%s\r\n", m.smtpFrom, strings.Join(n.To, ", "), title, message)
+		return smtp.SendMail(m.smtpRelay, nil, m.smtpFrom, n.To, []byte(msg))
+	}
+	return fmt.Errorf("unknown notifier type %s", n.Type)
+}
+
+func (m *AlertManager) post(target, contentType string, body []byte, headers map[string]string) error {
+	request, err := http.NewRequest(http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("content-type", contentType)
+	for k, v := range headers {
+		request.Header.Set(k, v)
+	}
+	response, err := m.client.Do(request)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return errors.New(response.Status)
+	}
+	return nil
+}
+
+func (r AlertRule) breached(value int) bool {
+	if r.Condition == "below" {
+		return value < r.Threshold
+	}
+	return value > r.Threshold
+}
+
+func (r AlertRule) recovered(value int) bool {
+	if r.Condition == "below" {
+		return value >= r.Threshold+r.Hysteresis
+	}
+	return value <= r.Threshold-r.Hysteresis
+}
+
+func (r AlertRule) describe(a Alert) (string, string) {
+	name := r.Name
+	if name == "" {
+		name = r.ID
+	}
+	return fmt.Sprintf("%s %s", name, a.State), fmt.Sprintf("Sensor %s is %d, alert when %s %d for %s", r.Sensor, a.Value, r.Condition, r.Threshold, time.Duration(r.For))
+}
+
+func (r AlertRule) validate() error {
+	if r.Sensor == "" {
+		return errors.New("missing Sensor")
+	}
+	if r.Condition != "above" && r.Condition != "below" {
+		return errors.New("Condition must be above or below")
+	}
+	if r.Hysteresis < 0 || r.For < 0 {
+		return errors.New("Hysteresis and For can not be negative")
+	}
+	for _, n := range r.Notifiers {
+		switch n.Type {
+		case "webhook", "ntfy":
+			u, err := url.Parse(n.URL)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return fmt.Errorf("%s notifier needs an absolute http or https URL", n.Type)
+			}
+		case "smtp":
+			if len(n.To) == 0 {
+				return errors.New("smtp notifier needs at least one recipient in To")
+			}
+		default:
+			return fmt.Errorf("unknown notifier type %s", n.Type)
+		}
+	}
+	return nil
+}
+
+func (h *HivemindServer) apiAlertHandler(w http.ResponseWriter, r *http.Request) {
+	trailing := r.URL.Path[len("/api/alert"):]
+	parts := strings.Split(trailing[1:], "/")
+	w.Header().Set("content-type", "application/json")
+	if h.alerts == nil {
+		writeProblem(w, r, http.StatusNotImplemented, "")
+		return
+	}
+	if parts[0] == "rule" {
+		h.apiAlertRuleHandler(w, r, parts[1:])
+		return
+	}
+	store := h.alerts.store
+	id := parts[0]
+
+	switch {
+	case id == "" && r.Method == http.MethodGet:
+		json.NewEncoder(w).Encode(store.getAllAlerts())
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		a, err := store.getAlert(id)
+		if err != nil || a.Rule == "" {
+			writeProblem(w, r, http.StatusNotFound, "")
+			return
+		}
+		json.NewEncoder(w).Encode(a)
+	case len(parts) == 2 && parts[1] == "ack" && r.Method == http.MethodPost:
+		a, err := h.alerts.acknowledge(id)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		json.NewEncoder(w).Encode(a)
+	case len(parts) == 1 || (len(parts) == 2 && parts[1] == "ack"):
+		writeProblem(w, r, http.StatusMethodNotAllowed, "")
+	default:
+		writeProblem(w, r, http.StatusNotFound, "")
+	}
+}
+
+func (h *HivemindServer) apiAlertRuleHandler(w http.ResponseWriter, r *http.Request, parts []string) {
+	store := h.alerts.store
+	id := ""
+	if len(parts) > 0 {
+		id = parts[0]
+	}
+	if len(parts) > 1 {
+		writeProblem(w, r, http.StatusNotFound, "")
+		return
+	}
+
+	switch {
+	case id == "" && r.Method == http.MethodGet:
+		json.NewEncoder(w).Encode(store.getAllAlertRules())
+	case id == "" && r.Method == http.MethodPost:
+		h.apiAlertRuleStore(w, r, newID())
+	case id == "":
+		writeProblem(w, r, http.StatusMethodNotAllowed, "")
+	case r.Method == http.MethodGet:
+		rule, err := store.getAlertRule(id)
+		if err != nil || rule.ID == "" {
+			writeProblem(w, r, http.StatusNotFound, "")
+			return
+		}
+		json.NewEncoder(w).Encode(rule)
+	case r.Method == http.MethodPut:
+		h.apiAlertRuleStore(w, r, id)
+	case r.Method == http.MethodDelete:
+		err := store.deleteAlertRule(id)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeProblem(w, r, http.StatusMethodNotAllowed, "")
+	}
+}
+
+func (h *HivemindServer) apiAlertRuleStore(w http.ResponseWriter, r *http.Request, id string) {
+	var rule AlertRule
+	err := json.NewDecoder(r.Body).Decode(&rule)
+	if err != nil {
+		writeDecodeError(w, r, err)
+		return
+	}
+	rule.ID = id
+	err = rule.validate()
+	if err != nil {
+		writeProblem(w, r, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	err = h.alerts.store.storeAlertRule(rule)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(rule)
+}
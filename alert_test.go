@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAlertManager(t *testing.T) {
+	store := newStubAlertStore()
+	store.storeAlertRule(AlertRule{
+		ID:         "freezer",
+		Sensor:     "freezer",
+		Condition:  "above",
+		Threshold:  -10,
+		Hysteresis: 2,
+		For:        duration(5 * time.Minute),
+		Notifiers:  []AlertNotifier{{Type: "webhook", URL: "http://localhost/alert"}},
+	})
+	manager := NewAlertManager(store)
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	manager.now = func() time.Time { return now }
+	var notified []string
+	var mutex sync.Mutex
+	manager.send = func(n AlertNotifier, r AlertRule, a Alert) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		notified = append(notified, a.State)
+		return nil
+	}
+	reading := func(value int, after time.Duration) string {
+		now = now.Add(after)
+		manager.sensorChanged(Sensor{ID: "freezer", Name: "Freezer", Unit: "C", Type: "temperature", Value: value}, slog.Default())
+		manager.wg.Wait()
+		a, _ := store.getAlert("freezer")
+		return a.State
+	}
+
+	t.Run("pending until the condition held for the configured duration", func(t *testing.T) {
+		assertBody(t, reading(-18, 0), alertOK)
+		assertBody(t, reading(-8, time.Minute), alertPending)
+		assertBody(t, reading(-9, 4*time.Minute), alertPending)
+
+		now = now.Add(time.Minute)
+		manager.evaluateAll()
+		manager.wg.Wait()
+		a, _ := store.getAlert("freezer")
+
+		assertBody(t, a.State, alertFiring)
+		if len(notified) != 1 {
+			t.Errorf("got %d notifications, want 1", len(notified))
+		}
+	})
+
+	t.Run("resolve only after crossing back past the hysteresis", func(t *testing.T) {
+		assertBody(t, reading(-11, time.Minute), alertFiring)
+		assertBody(t, reading(-12, time.Minute), alertResolved)
+		if len(notified) != 2 || notified[1] != alertResolved {
+			t.Errorf("unexpected notifications %v", notified)
+		}
+	})
+
+	t.Run("a short breach does not fire", func(t *testing.T) {
+		assertBody(t, reading(-5, time.Minute), alertPending)
+		assertBody(t, reading(-15, time.Minute), alertResolved)
+		if len(notified) != 2 {
+			t.Errorf("unexpected notifications %v", notified)
+		}
+	})
+}
+
+func TestAlertAPI(t *testing.T) {
+	store := newStubAlertStore()
+	server := NewHivemindServer(nil)
+	server.alerts = NewAlertManager(store)
+	store.storeAlert(Alert{Rule: "freezer", State: alertFiring, Value: -4})
+
+	t.Run("return status 202 on POST /api/alert/rule/", func(t *testing.T) {
+		request := newPostRequest("api/alert/rule/", strings.NewReader(`{"Sensor": "freezer", "Condition": "above", "Threshold": -10, "For": "5m", "Notifiers": [{"Type": "ntfy", "URL": "http://ntfy.local/freezer"}]}`))
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, request)
+
+		var got AlertRule
+		json.NewDecoder(response.Body).Decode(&got)
+
+		assertResponseCode(t, response.Code, http.StatusAccepted)
+		if got.ID == "" || time.Duration(got.For) != 5*time.Minute {
+			t.Errorf("unexpected rule in response %v", got)
+		}
+	})
+
+	t.Run("return status 422 on POST /api/alert/rule/ with an unknown notifier", func(t *testing.T) {
+		request := newPostRequest("api/alert/rule/", strings.NewReader(`{"Sensor": "freezer", "Condition": "above", "Notifiers": [{"Type": "pager"}]}`))
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, request)
+
+		assertResponseCode(t, response.Code, http.StatusUnprocessableEntity)
+	})
+
+	t.Run("return status 200 on POST /api/alert/{id}/ack", func(t *testing.T) {
+		request := newPostRequest("api/alert/freezer/ack", nil)
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, request)
+
+		assertResponseCode(t, response.Code, http.StatusOK)
+		a, _ := store.getAlert("freezer")
+		assertBody(t, a.State, alertAcknowledged)
+	})
+
+	t.Run("return status 409 on POST /api/alert/{id}/ack for an acknowledged alert", func(t *testing.T) {
+		request := newPostRequest("api/alert/freezer/ack", nil)
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, request)
+
+		assertResponseCode(t, response.Code, http.StatusConflict)
+	})
+}
+
+func TestAlertNotifiers(t *testing.T) {
+	var headers http.Header
+	var body []byte
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers = r.Header
+		body, _ = ioutil.ReadAll(r.Body)
+	}))
+	defer target.Close()
+
+	manager := NewAlertManager(newStubAlertStore())
+	rule := AlertRule{ID: "freezer", Name: "Freezer", Sensor: "freezer", Condition: "above", Threshold: -10}
+
+	t.Run("ntfy notification with title and priority", func(t *testing.T) {
+		err := manager.deliver(AlertNotifier{Type: "ntfy", URL: target.URL}, rule, Alert{Rule: "freezer", State: alertFiring, Value: -4})
+		if err != nil {
+			t.Fatalf("failure within deliver(): %s", err)
+		}
+		assertBody(t, headers.Get("Title"), "Freezer firing")
+		assertBody(t, headers.Get("Priority"), "high")
+		assertBody(t, string(body), "Sensor freezer is -4, alert when above -10 for 0s")
+	})
+
+	t.Run("smtp notification without relay fails", func(t *testing.T) {
+		err := manager.deliver(AlertNotifier{Type: "smtp", To: []string{"me@localhost"}}, rule, Alert{Rule: "freezer", State: alertFiring})
+		if err == nil {
+			t.Errorf("expected error without SMTP relay")
+		}
+	})
+}
+
+// stubs
+type stubAlertStore struct {
+	mutex  sync.Mutex
+	rules  map[string]AlertRule
+	alerts map[string]Alert
+}
+
+func newStubAlertStore() *stubAlertStore {
+	return &stubAlertStore{rules: make(map[string]AlertRule), alerts: make(map[string]Alert)}
+}
+
+func (s *stubAlertStore) getAlertRule(id string) (AlertRule, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.rules[id], nil
+}
+
+func (s *stubAlertStore) getAllAlertRules() []AlertRule {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var rules []AlertRule
+	for _, r := range s.rules {
+		rules = append(rules, r)
+	}
+	return rules
+}
+
+func (s *stubAlertStore) storeAlertRule(r AlertRule) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.rules[r.ID] = r
+	return nil
+}
+
+func (s *stubAlertStore) deleteAlertRule(id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.rules, id)
+	delete(s.alerts, id)
+	return nil
+}
+
+func (s *stubAlertStore) getAlert(rule string) (Alert, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.alerts[rule], nil
+}
+
+func (s *stubAlertStore) getAllAlerts() []Alert {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var alerts []Alert
+	for _, a := range s.alerts {
+		alerts = append(alerts, a)
+	}
+	return alerts
+}
+
+func (s *stubAlertStore) storeAlert(a Alert) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.alerts[a.Rule] = a
+	return nil
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	scopeAdmin       = "admin"
+	scopeSensorRead  = "sensor:read"
+	scopeSensorWrite = "sensor:write"
+	scopeSwitchRead  = "switch:read"
+	scopeSwitchWrite = "switch:write"
+	scopeAlertRead   = "alert:read"
+	scopeAlertWrite  = "alert:write"
+	scopeMetricsRead = "metrics:read"
+	tokenPrefix      = "hm_"
+
+	// scopeAuthenticated is held by every caller that authenticated
+	scopeAuthenticated = "authenticated"
+)
+
+var knownScopes = []string{scopeAdmin, scopeSensorRead, scopeSensorWrite, scopeSwitchRead, scopeSwitchWrite, scopeAlertRead, scopeAlertWrite, scopeMetricsRead}
+
+// Token is an API token, only the SHA-256 hash of its secret is stored; a device token has
+// Sensors set and may only write the readings of those sensors
+type Token struct {
+	ID      string
+	Name    string
+	Hash    string `json:",omitempty"`
+	Scopes  []string
+	Sensors []string `json:",omitempty"`
+	Created time.Time
+}
+
+// TokenStore is an interface for API token datastorage
+type TokenStore interface {
+	getToken(id string) (Token, error)
+	getAllTokens() []Token
+	storeToken(t Token) error
+	deleteToken(id string) error
+}
+
+// identity is the authenticated caller of a request, either an API token or a user session
+type identity struct {
+	Kind    string
+	Name    string
+	Scopes  []string
+	roles   []RoleGrant
+	sensors []string
+	session *Session
+}
+
+type contextKey int
+
+const (
+	identityContextKey contextKey = iota
+	requestInfoContextKey
+)
+
+// mintToken creates and stores a token limited to sensors when not nil, the returned secret is the
+// only copy of it
+func mintToken(s TokenStore, name string, scopes, sensors []string) (Token, string, error) {
+	id := newID()[:16]
+	secret := newID() + newID()
+	t := Token{
+		ID:      id,
+		Name:    name,
+		Hash:    hashTokenSecret(secret),
+		Scopes:  scopes,
+		Sensors: sensors,
+		Created: time.Now().UTC(),
+	}
+	err := s.storeToken(t)
+	return t, tokenPrefix + id + "_" + secret, err
+}
+
+// mintDeviceToken creates and stores a token that may only write the readings of sensors
+func mintDeviceToken(s TokenStore, name string, sensors []string) (Token, string, error) {
+	if len(sensors) == 0 {
+		return Token{}, "", errors.New("a device token needs at least one sensor")
+	}
+	for _, id := range sensors {
+		if id == "" {
+			return Token{}, "", errors.New("empty sensor ID")
+		}
+	}
+	return mintToken(s, name, []string{scopeSensorWrite}, sensors)
+}
+
+// verifyToken returns the stored token matching the presented value
+func verifyToken(s TokenStore, presented string) (Token, error) {
+	invalid := errors.New("invalid token")
+	if !strings.HasPrefix(presented, tokenPrefix) {
+		return Token{}, invalid
+	}
+	parts := strings.SplitN(presented[len(tokenPrefix):], "_", 2)
+	if len(parts) != 2 {
+		return Token{}, invalid
+	}
+	t, err := s.getToken(parts[0])
+	if err != nil || t.ID == "" {
+		return Token{}, invalid
+	}
+	if subtle.ConstantTimeCompare([]byte(t.Hash), []byte(hashTokenSecret(parts[1]))) != 1 {
+		return Token{}, invalid
+	}
+	return t, nil
+}
+
+func hashTokenSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func (i identity) hasScope(scope string) bool {
+	if scope == "" || scope == scopeAuthenticated || contains(i.Scopes, scopeAdmin) || contains(i.Scopes, scope) {
+		return true
+	}
+	for _, g := range i.roles {
+		if g.Role == roleAdmin && g.global() {
+			return true
+		}
+	}
+	return false
+}
+
+// mayAccessEntities reports whether role grants can give access for scope, to be decided per sensor or switch
+func (i identity) mayAccessEntities(scope string) bool {
+	switch scope {
+	case scopeSensorRead, scopeSensorWrite, scopeSwitchRead, scopeSwitchWrite:
+		return len(i.roles) > 0
+	}
+	return false
+}
+
+// requiredScope returns the scope needed for r, an empty scope means public
+func requiredScope(r *http.Request) string {
+	path := unversionedPath(r.URL.Path)
+	read := r.Method == http.MethodGet || r.Method == http.MethodHead
+	switch {
+	case path == "/" || path == "/api/" || strings.HasPrefix(path, "/api/auth/") || path == "/healthz" || path == "/readyz":
+		return ""
+	case path == "/api/openapi.json" || path == "/api/docs":
+		return ""
+	case strings.HasPrefix(path, "/api/device/enroll") || path == "/api/device/crl" || path == "/api/device/ca":
+		return ""
+	case strings.HasPrefix(path, "/api/sensor/") || path == "/api/v2/write":
+		if read {
+			return scopeSensorRead
+		}
+		return scopeSensorWrite
+	case strings.HasPrefix(path, "/api/switch/"):
+		if read {
+			return scopeSwitchRead
+		}
+		return scopeSwitchWrite
+	case strings.HasPrefix(path, "/api/alert/") && !strings.HasPrefix(path, "/api/alert/rule/"):
+		if read {
+			return scopeAlertRead
+		}
+		return scopeAlertWrite
+	case strings.HasPrefix(path, "/api/location/") && read:
+		return scopeAuthenticated
+	case path == "/api/graphql":
+		// fields are authorized like the REST API they expose
+		return scopeAuthenticated
+	case path == "/metrics":
+		return scopeMetricsRead
+	}
+	return scopeAdmin
+}
+
+// bearerToken returns the token of an Authorization header using the Bearer or InfluxDB Token scheme
+func bearerToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	for _, scheme := range []string{"Bearer ", "Token "} {
+		if len(header) > len(scheme) && strings.EqualFold(header[:len(scheme)], scheme) {
+			return strings.TrimSpace(header[len(scheme):])
+		}
+	}
+	return ""
+}
+
+// identityFromRequest returns the caller the request was authenticated as
+func identityFromRequest(r *http.Request) (identity, bool) {
+	i, ok := r.Context().Value(identityContextKey).(identity)
+	return i, ok
+}
+
+// identify resolves the bearer token, session cookie or device certificate of r, presented is false
+// when r carries none of them
+func (h *HivemindServer) identify(r *http.Request) (i identity, presented bool, err error) {
+	if t := bearerToken(r); t != "" && h.tokens != nil {
+		token, err := verifyToken(h.tokens, t)
+		if err != nil {
+			return i, true, err
+		}
+		if len(token.Sensors) > 0 {
+			return identity{Kind: "device", Name: token.Name, Scopes: []string{scopeSensorWrite}, sensors: token.Sensors}, true, nil
+		}
+		return identity{Kind: "token", Name: token.Name, Scopes: token.Scopes}, true, nil
+	}
+	if c, err := r.Cookie(sessionCookie); err == nil && h.users != nil {
+		session, u, err := verifySession(h.users, c.Value)
+		if err != nil {
+			return i, true, err
+		}
+		return identity{Kind: "user", Name: u.Username, Scopes: u.Scopes, roles: u.Roles, session: &session}, true, nil
+	}
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 && h.devices != nil {
+		d, err := deviceForCertificate(h.devices, r.TLS.VerifiedChains[0][0])
+		if err != nil {
+			return i, true, err
+		}
+		return identity{Kind: "device", Name: d.Name, Scopes: []string{scopeSensorWrite}, sensors: d.Sensors}, true, nil
+	}
+	return i, false, nil
+}
+
+// authenticate wraps next, requiring a token, session or device certificate with the scope of the
+// request when tokens or users are configured, state changing requests of sessions need their CSRF token;
+// callers with role grants are let through to sensors and switches, which are checked per entity
+func (h *HivemindServer) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if (h.tokens == nil && h.users == nil) || r.Method == http.MethodOptions {
+			next.ServeHTTP(w, r)
+			return
+		}
+		scope := requiredScope(r)
+		i, presented, err := h.identify(r)
+		if !presented || err != nil {
+			if scope == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			challenge := `Bearer realm="hivemind"`
+			if err != nil {
+				challenge += `, error="invalid_token"`
+			}
+			w.Header().Set("WWW-Authenticate", challenge)
+			writeProblem(w, r, http.StatusUnauthorized, "")
+			return
+		}
+		if i.session != nil && r.Method != http.MethodGet && r.Method != http.MethodHead && r.URL.Path != "/api/auth/login" {
+			if subtle.ConstantTimeCompare([]byte(r.Header.Get(csrfHeader)), []byte(i.session.CSRFToken)) != 1 {
+				writeProblem(w, r, http.StatusForbidden, "")
+				return
+			}
+		}
+		if !i.hasScope(scope) && !i.mayAccessEntities(scope) {
+			writeProblem(w, r, http.StatusForbidden, "")
+			return
+		}
+		setRequestCaller(r, i)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), identityContextKey, i)))
+	})
+}
+
+// reidentify returns r with the identity its token, session or device certificate resolves to now,
+// for long running requests to notice changed grants and revoked credentials
+func (h *HivemindServer) reidentify(r *http.Request) (*http.Request, error) {
+	if _, ok := identityFromRequest(r); !ok {
+		return r, nil
+	}
+	i, presented, err := h.identify(r)
+	if err != nil {
+		return nil, err
+	}
+	if !presented {
+		return nil, errors.New("credentials are gone")
+	}
+	return r.WithContext(context.WithValue(r.Context(), identityContextKey, i)), nil
+}
+
+// mintedToken is the response to minting a token, Secret is only shown once
+type mintedToken struct {
+	Token
+	Secret string
+}
+
+func (h *HivemindServer) apiTokenHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.Split(r.URL.Path[len("/api/token/"):], "/")[0]
+	w.Header().Set("content-type", "application/json")
+	if h.tokens == nil {
+		writeProblem(w, r, http.StatusNotImplemented, "")
+		return
+	}
+
+	switch {
+	case id == "" && r.Method == http.MethodGet:
+		tokens := h.tokens.getAllTokens()
+		for i := range tokens {
+			tokens[i].Hash = ""
+		}
+		json.NewEncoder(w).Encode(tokens)
+	case id == "" && r.Method == http.MethodPost:
+		var request Token
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			writeDecodeError(w, r, err)
+			return
+		}
+		if len(request.Sensors) > 0 {
+			if len(request.Scopes) > 0 {
+				writeProblem(w, r, http.StatusUnprocessableEntity, "a device token has no Scopes, only Sensors")
+				return
+			}
+			t, secret, err := mintDeviceToken(h.tokens, request.Name, request.Sensors)
+			if err != nil {
+				writeProblem(w, r, http.StatusUnprocessableEntity, err.Error())
+				return
+			}
+			t.Hash = ""
+			w.WriteHeader(http.StatusAccepted)
+			json.NewEncoder(w).Encode(mintedToken{t, secret})
+			return
+		}
+		if len(request.Scopes) == 0 {
+			writeProblem(w, r, http.StatusUnprocessableEntity, "at least one scope is required")
+			return
+		}
+		for _, scope := range request.Scopes {
+			if !contains(knownScopes, scope) {
+				writeProblem(w, r, http.StatusUnprocessableEntity, "unknown scope "+scope)
+				return
+			}
+		}
+		t, secret, err := mintToken(h.tokens, request.Name, request.Scopes, nil)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		t.Hash = ""
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(mintedToken{t, secret})
+	case id != "" && r.Method == http.MethodDelete:
+		err := h.tokens.deleteToken(id)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeProblem(w, r, http.StatusMethodNotAllowed, "")
+	}
+}
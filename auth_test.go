@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTokenAuthentication(t *testing.T) {
+	store := StubHivemindStore{
+		map[string]Sensor{"test": Sensor{ID: "test", Name: "Test", Unit: "C", Type: "generic", Value: 64}},
+		map[string]Switch{"fridge": Switch{ID: "fridge", Name: "Fridge", Type: "generic", State: true}},
+	}
+	tokens := newStubTokenStore()
+	server := NewHivemindServer(&store)
+	server.tokens = tokens
+
+	_, reader, _ := mintToken(tokens, "dashboard", []string{scopeSensorRead, scopeSwitchRead}, nil)
+	_, admin, _ := mintToken(tokens, "admin", []string{scopeAdmin}, nil)
+
+	authorized := func(request *http.Request, token string) *http.Request {
+		request.Header.Set("Authorization", "Bearer "+token)
+		return request
+	}
+
+	t.Run("return status 200 on / without token", func(t *testing.T) {
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, newGetRequest(""))
+
+		assertResponseCode(t, response.Code, http.StatusOK)
+	})
+
+	t.Run("return status 401 on GET /api/switch/ without token", func(t *testing.T) {
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, newGetRequest("api/switch/"))
+
+		assertResponseCode(t, response.Code, http.StatusUnauthorized)
+	})
+
+	t.Run("return status 401 on GET /api/switch/ with an unknown token", func(t *testing.T) {
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, authorized(newGetRequest("api/switch/"), reader+"x"))
+
+		assertResponseCode(t, response.Code, http.StatusUnauthorized)
+	})
+
+	t.Run("return status 200 on GET /api/switch/fridge with switch:read", func(t *testing.T) {
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, authorized(newGetRequest("api/switch/fridge"), reader))
+
+		assertResponseCode(t, response.Code, http.StatusOK)
+	})
+
+	t.Run("return status 200 on GET /api/v1/switch/fridge with switch:read", func(t *testing.T) {
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, authorized(newGetRequest("api/v1/switch/fridge"), reader))
+
+		assertResponseCode(t, response.Code, http.StatusOK)
+	})
+
+	t.Run("return status 403 on PUT /api/switch/fridge without switch:write", func(t *testing.T) {
+		request := newPutRequest("api/switch/fridge", strings.NewReader(`{"ID": "fridge", "Name": "Fridge", "State": false}`))
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, authorized(request, reader))
+
+		assertResponseCode(t, response.Code, http.StatusForbidden)
+		assertSwitch(t, store.switches["fridge"], Switch{ID: "fridge", Name: "Fridge", Type: "generic", State: true})
+	})
+
+	t.Run("mint and revoke a token as admin on /api/token/", func(t *testing.T) {
+		request := newPostRequest("api/token/", strings.NewReader(`{"Name": "esp", "Scopes": ["sensor:write"]}`))
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, authorized(request, admin))
+
+		var minted mintedToken
+		json.NewDecoder(response.Body).Decode(&minted)
+
+		assertResponseCode(t, response.Code, http.StatusAccepted)
+		if minted.Secret == "" || minted.Hash != "" {
+			t.Fatalf("unexpected minted token %v", minted)
+		}
+		if tokens.tokens[minted.ID].Hash == minted.Secret {
+			t.Errorf("token secret stored in clear text")
+		}
+
+		request = newPutRequest("api/sensor/test", strings.NewReader(`{"ID": "test", "Name": "Test", "Value": 1}`))
+		response = httptest.NewRecorder()
+		server.ServeHTTP(response, authorized(request, minted.Secret))
+
+		assertResponseCode(t, response.Code, http.StatusAccepted)
+
+		request, _ = http.NewRequest(http.MethodDelete, "/api/token/"+minted.ID, nil)
+		response = httptest.NewRecorder()
+		server.ServeHTTP(response, authorized(request, admin))
+
+		assertResponseCode(t, response.Code, http.StatusNoContent)
+
+		request = newPutRequest("api/sensor/test", strings.NewReader(`{"ID": "test", "Name": "Test", "Value": 2}`))
+		response = httptest.NewRecorder()
+		server.ServeHTTP(response, authorized(request, minted.Secret))
+
+		assertResponseCode(t, response.Code, http.StatusUnauthorized)
+	})
+
+	t.Run("return status 403 on POST /api/token/ without admin", func(t *testing.T) {
+		request := newPostRequest("api/token/", strings.NewReader(`{"Name": "escalate", "Scopes": ["admin"]}`))
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, authorized(request, reader))
+
+		assertResponseCode(t, response.Code, http.StatusForbidden)
+	})
+}
+
+func TestDeviceToken(t *testing.T) {
+	store := StubHivemindStore{
+		map[string]Sensor{
+			"kitchen_temp": Sensor{ID: "kitchen_temp", Name: "Kitchen", Unit: "C", Type: "generic", Value: 21},
+			"garage_temp":  Sensor{ID: "garage_temp", Name: "Garage", Unit: "C", Type: "generic", Value: 8},
+		},
+		map[string]Switch{"boiler": Switch{ID: "boiler", Name: "Boiler", Type: "generic", State: true}},
+	}
+	tokens := newStubTokenStore()
+	server := NewHivemindServer(&store)
+	server.tokens = tokens
+
+	_, device, _ := mintDeviceToken(tokens, "kitchen-esp", []string{"kitchen_temp"})
+
+	authorized := func(request *http.Request) *http.Request {
+		request.Header.Set("Authorization", "Bearer "+device)
+		return request
+	}
+
+	t.Run("return status 202 on PUT /api/sensor/kitchen_temp with the token of the device", func(t *testing.T) {
+		request := newPutRequest("api/sensor/kitchen_temp", strings.NewReader(`{"ID": "kitchen_temp", "Name": "Kitchen", "Unit": "C", "Type": "generic", "Value": 22}`))
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, authorized(request))
+
+		assertResponseCode(t, response.Code, http.StatusAccepted)
+		assertSensor(t, store.sensors["kitchen_temp"], Sensor{ID: "kitchen_temp", Name: "Kitchen", Unit: "C", Type: "generic", Value: 22})
+	})
+
+	t.Run("return status 403 on PUT of a sensor of another device", func(t *testing.T) {
+		request := newPutRequest("api/sensor/garage_temp", strings.NewReader(`{"ID": "garage_temp", "Name": "Garage", "Unit": "C", "Type": "generic", "Value": 99}`))
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, authorized(request))
+
+		assertResponseCode(t, response.Code, http.StatusForbidden)
+		assertSensor(t, store.sensors["garage_temp"], Sensor{ID: "garage_temp", Name: "Garage", Unit: "C", Type: "generic", Value: 8})
+	})
+
+	t.Run("return status 422 on PUT /api/sensor/kitchen_temp with the ID of another sensor in the body", func(t *testing.T) {
+		request := newPutRequest("api/sensor/kitchen_temp", strings.NewReader(`{"ID": "garage_temp", "Name": "Garage", "Unit": "C", "Type": "generic", "Value": 99}`))
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, authorized(request))
+
+		assertResponseCode(t, response.Code, http.StatusUnprocessableEntity)
+		assertSensor(t, store.sensors["garage_temp"], Sensor{ID: "garage_temp", Name: "Garage", Unit: "C", Type: "generic", Value: 8})
+	})
+
+	t.Run("return status 403 on writes to switches and reads", func(t *testing.T) {
+		request := newPutRequest("api/switch/boiler", strings.NewReader(`{"ID": "boiler", "Name": "Boiler", "State": false}`))
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, authorized(request))
+
+		assertResponseCode(t, response.Code, http.StatusForbidden)
+
+		response = httptest.NewRecorder()
+		server.ServeHTTP(response, authorized(newGetRequest("api/sensor/kitchen_temp")))
+
+		assertResponseCode(t, response.Code, http.StatusForbidden)
+	})
+
+	t.Run("return status 403 on PATCH, DELETE and POST of the sensor of the device", func(t *testing.T) {
+		patch, _ := http.NewRequest(http.MethodPatch, "/api/sensor/kitchen_temp", strings.NewReader(`{"Name": "Hijacked"}`))
+		patch.Header.Set("Content-Type", mergePatchContentType)
+		remove, _ := http.NewRequest(http.MethodDelete, "/api/sensor/kitchen_temp", nil)
+		create := newPostRequest("api/sensor/", strings.NewReader(`{"ID": "kitchen_temp", "Name": "Kitchen", "Unit": "C", "Type": "generic", "Value": 1}`))
+
+		for _, request := range []*http.Request{patch, remove, create} {
+			response := httptest.NewRecorder()
+			server.ServeHTTP(response, authorized(request))
+
+			if response.Code != http.StatusForbidden {
+				t.Errorf("got status %d on %s, want %d", response.Code, request.Method, http.StatusForbidden)
+			}
+		}
+		assertSensor(t, store.sensors["kitchen_temp"], Sensor{ID: "kitchen_temp", Name: "Kitchen", Unit: "C", Type: "generic", Value: 22})
+	})
+
+	t.Run("reject only the foreign sensors of a batch", func(t *testing.T) {
+		request := newPostRequest("api/sensor/batch", strings.NewReader(`[{"ID": "kitchen_temp", "Name": "Kitchen", "Value": 23}, {"ID": "garage_temp", "Name": "Garage", "Value": 99}]`))
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, authorized(request))
+
+		var results []batchResult
+		json.NewDecoder(response.Body).Decode(&results)
+
+		assertResponseCode(t, response.Code, http.StatusOK)
+		if len(results) != 2 || results[0].Status != http.StatusAccepted || results[1].Status != http.StatusForbidden {
+			t.Errorf("unexpected batch results %v", results)
+		}
+		assertSensor(t, store.sensors["garage_temp"], Sensor{ID: "garage_temp", Name: "Garage", Unit: "C", Type: "generic", Value: 8})
+	})
+
+	t.Run("reject device tokens without sensors", func(t *testing.T) {
+		_, _, err := mintDeviceToken(tokens, "empty", nil)
+		if err == nil {
+			t.Errorf("minted a device token without sensors")
+		}
+	})
+}
+
+// stubs
+type stubTokenStore struct {
+	tokens map[string]Token
+}
+
+func newStubTokenStore() *stubTokenStore {
+	return &stubTokenStore{make(map[string]Token)}
+}
+
+func (s *stubTokenStore) getToken(id string) (Token, error) {
+	return s.tokens[id], nil
+}
+
+func (s *stubTokenStore) getAllTokens() []Token {
+	var tokens []Token
+	for _, t := range s.tokens {
+		tokens = append(tokens, t)
+	}
+	return tokens
+}
+
+func (s *stubTokenStore) storeToken(t Token) error {
+	s.tokens[t.ID] = t
+	return nil
+}
+
+func (s *stubTokenStore) deleteToken(id string) error {
+	delete(s.tokens, id)
+	return nil
+}
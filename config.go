@@ -0,0 +1,234 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+const envPrefix = "HIVEMIND_"
+
+// Config is the configuration of a Hivemind instance; every setting can be given in the YAML file,
+// as HIVEMIND_* environment variable and as flag, in increasing order of precedence
+type Config struct {
+	Listen           string        `yaml:"listen"`
+	Database         string        `yaml:"database"`
+	DatabaseTimeout  time.Duration `yaml:"database_timeout"`
+	ShutdownTimeout  time.Duration `yaml:"shutdown_timeout"`
+	LogFormat        string        `yaml:"log_format"`
+	LogLevel         string        `yaml:"log_level"`
+	Auth             bool          `yaml:"auth"`
+	MQTT             string        `yaml:"mqtt"`
+	InfluxRules      string        `yaml:"influx_rules"`
+	LegacySunset     string        `yaml:"legacy_sunset"`
+	HistoryRetention time.Duration `yaml:"history_retention"`
+	SMTP             struct {
+		Relay string `yaml:"relay"`
+		From  string `yaml:"from"`
+	} `yaml:"smtp"`
+	TLS struct {
+		Cert         string     `yaml:"cert"`
+		Key          string     `yaml:"key"`
+		Auto         bool       `yaml:"auto"`
+		Hosts        stringList `yaml:"hosts"`
+		RedirectHTTP string     `yaml:"redirect_http"`
+	} `yaml:"tls"`
+	CORS struct {
+		Origins     stringList `yaml:"origins"`
+		Credentials bool       `yaml:"credentials"`
+	} `yaml:"cors"`
+
+	// one-shot commands, only taken from flags
+	File            string `yaml:"-"`
+	PrintConfig     bool   `yaml:"-"`
+	MintAdminToken  string `yaml:"-"`
+	MintDeviceToken string `yaml:"-"`
+}
+
+// stringList is a comma separated flag value
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = nil
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+func defaultConfig() Config {
+	var c Config
+	c.Listen = ":5000"
+	c.Database = "hivemind.db"
+	c.DatabaseTimeout = time.Second
+	c.ShutdownTimeout = 15 * time.Second
+	c.LogFormat = "text"
+	c.LogLevel = "info"
+	c.LegacySunset = "2027-12-31"
+	c.HistoryRetention = 30 * 24 * time.Hour
+	c.SMTP.From = "hivemind@localhost"
+	c.CORS.Origins = stringList{"*"}
+	return c
+}
+
+// commandFlags are not read from the configuration file or environment
+var commandFlags = []string{"print-config", "mint-admin-token", "mint-device-token"}
+
+// configFlags binds the settings of c to a flag set, the flag names also name the environment variables
+func configFlags(c *Config) *flag.FlagSet {
+	fs := flag.NewFlagSet("hivemind", flag.ContinueOnError)
+	fs.StringVar(&c.File, "config", c.File, "YAML configuration file")
+	fs.StringVar(&c.Listen, "listen", c.Listen, "address to serve the API on")
+	fs.StringVar(&c.Database, "database", c.Database, "path of the Bolt database, certificates are kept next to it")
+	fs.DurationVar(&c.DatabaseTimeout, "database-timeout", c.DatabaseTimeout, "how long to wait for the lock on the database")
+	fs.DurationVar(&c.ShutdownTimeout, "shutdown-timeout", c.ShutdownTimeout, "how long in-flight requests may take to finish on SIGINT or SIGTERM")
+	fs.StringVar(&c.LogFormat, "log-format", c.LogFormat, "format of the log, text (logfmt) or json")
+	fs.StringVar(&c.LogLevel, "log-level", c.LogLevel, "lowest level logged, debug, info, warn or error")
+	fs.BoolVar(&c.Auth, "auth", c.Auth, "require an API token, user session or device certificate for all API requests")
+	fs.StringVar(&c.MQTT, "mqtt", c.MQTT, "MQTT broker for Home Assistant discovery, e.g. tcp://localhost:1883")
+	fs.StringVar(&c.InfluxRules, "influx-rules", c.InfluxRules, "JSON file with rules mapping InfluxDB line protocol onto sensors")
+	fs.StringVar(&c.LegacySunset, "legacy-sunset", c.LegacySunset, "date, e.g. 2027-12-31, announced in the Sunset header of the API paths before /api/v1/, empty for none")
+	fs.DurationVar(&c.HistoryRetention, "history-retention", c.HistoryRetention, "how long readings of sensors are kept for their history, 0 keeps none")
+	fs.StringVar(&c.SMTP.Relay, "smtp-relay", c.SMTP.Relay, "SMTP relay for alert mails, e.g. localhost:25")
+	fs.StringVar(&c.SMTP.From, "smtp-from", c.SMTP.From, "sender address of alert mails")
+	fs.StringVar(&c.TLS.Cert, "tls-cert", c.TLS.Cert, "serve HTTPS with this certificate file, reloaded when it changes")
+	fs.StringVar(&c.TLS.Key, "tls-key", c.TLS.Key, "private key file of -tls-cert")
+	fs.BoolVar(&c.TLS.Auto, "tls-auto", c.TLS.Auto, "serve HTTPS with a certificate of a local CA kept next to the database")
+	fs.Var(&c.TLS.Hosts, "tls-hosts", "comma separated host names and addresses for -tls-auto, defaults to the hostname and local addresses")
+	fs.StringVar(&c.TLS.RedirectHTTP, "redirect-http", c.TLS.RedirectHTTP, "redirect plain HTTP on this address to HTTPS, e.g. :80")
+	fs.Var(&c.CORS.Origins, "cors-origins", "comma separated origins allowed to call the API from a browser, empty disables CORS")
+	fs.BoolVar(&c.CORS.Credentials, "cors-credentials", c.CORS.Credentials, "allow browsers to send cookies with cross-origin requests, needs explicit -cors-origins")
+	fs.BoolVar(&c.PrintConfig, "print-config", false, "print the effective configuration and exit")
+	fs.StringVar(&c.MintAdminToken, "mint-admin-token", "", "mint an admin API token with the given name, print it and exit")
+	fs.StringVar(&c.MintDeviceToken, "mint-device-token", "", "mint a token for a device that may only report the values of its own sensors, e.g. kitchen-esp=kitchen_temp,kitchen_humidity, print it and exit")
+	return fs
+}
+
+// envName returns the environment variable of a flag, e.g. HIVEMIND_TLS_AUTO for tls-auto
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.Replace(flagName, "-", "_", -1))
+}
+
+// loadConfig reads the configuration from the defaults, the file named by -config or HIVEMIND_CONFIG,
+// the environment and args
+func loadConfig(args []string, lookupEnv func(string) (string, bool)) (Config, error) {
+	c := defaultConfig()
+	fs := configFlags(&c)
+	err := fs.Parse(args)
+	if err != nil {
+		return c, err
+	}
+	if fs.NArg() > 0 {
+		return c, errors.New("unexpected argument " + fs.Arg(0))
+	}
+
+	file := c.File
+	if file == "" {
+		file, _ = lookupEnv(envName("config"))
+	}
+	c = defaultConfig()
+	c.File = file
+	if file != "" {
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			return c, err
+		}
+		err = yaml.UnmarshalStrict(content, &c)
+		if err != nil {
+			return c, errors.New(file + ": " + err.Error())
+		}
+	}
+
+	fs = configFlags(&c)
+	var envErr error
+	fs.VisitAll(func(f *flag.Flag) {
+		// a variable set to an empty value applies it, e.g. HIVEMIND_CORS_ORIGINS= disables CORS
+		value, set := lookupEnv(envName(f.Name))
+		if !set || f.Name == "config" || contains(commandFlags, f.Name) || envErr != nil {
+			return
+		}
+		if err := f.Value.Set(value); err != nil {
+			envErr = errors.New(envName(f.Name) + ": " + err.Error())
+		}
+	})
+	if envErr != nil {
+		return c, envErr
+	}
+	err = fs.Parse(args)
+	if err != nil {
+		return c, err
+	}
+	return c, c.validate()
+}
+
+func (c Config) validate() error {
+	if _, _, err := net.SplitHostPort(c.Listen); err != nil {
+		return errors.New("listen: " + err.Error())
+	}
+	if c.Database == "" {
+		return errors.New("database: a path is required")
+	}
+	if c.DatabaseTimeout <= 0 {
+		return errors.New("database_timeout: needs to be positive")
+	}
+	if c.ShutdownTimeout <= 0 {
+		return errors.New("shutdown_timeout: needs to be positive")
+	}
+	if _, err := newLogger(ioutil.Discard, c.LogFormat, c.LogLevel); err != nil {
+		return errors.New("log: " + err.Error())
+	}
+	if _, err := c.legacySunset(); err != nil {
+		return errors.New("legacy_sunset: " + err.Error())
+	}
+	if c.HistoryRetention < 0 {
+		return errors.New("history_retention: must not be negative")
+	}
+	if (c.TLS.Cert == "") != (c.TLS.Key == "") {
+		return errors.New("tls: cert and key are needed together")
+	}
+	if c.TLS.Cert != "" && c.TLS.Auto {
+		return errors.New("tls: either a cert or auto")
+	}
+	if c.TLS.RedirectHTTP != "" && c.TLS.Cert == "" && !c.TLS.Auto {
+		return errors.New("tls: redirect_http needs a cert or auto")
+	}
+	if len(c.CORS.Origins) > 0 {
+		return c.corsPolicy().validate()
+	}
+	if c.CORS.Credentials {
+		return errors.New("cors: credentials need origins")
+	}
+	return nil
+}
+
+// corsPolicy returns the CORS policy of c, nil when CORS is disabled
+func (c Config) corsPolicy() *corsPolicy {
+	if len(c.CORS.Origins) == 0 {
+		return nil
+	}
+	return newCORSPolicy(c.CORS.Origins, c.CORS.Credentials)
+}
+
+// legacySunset returns the date the legacy API paths are announced to stop working, zero for none
+func (c Config) legacySunset() (time.Time, error) {
+	if c.LegacySunset == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse("2006-01-02", c.LegacySunset)
+}
+
+// yaml returns the configuration in the format of the configuration file
+func (c Config) yaml() ([]byte, error) {
+	return yaml.Marshal(c)
+}
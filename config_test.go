@@ -0,0 +1,145 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConfig(t *testing.T) {
+	file, err := ioutil.TempFile("", "hivemind-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString(`
+listen: ":5100"
+database: /var/lib/hivemind/garage.db
+database_timeout: 5s
+mqtt: tcp://garage:1883
+cors:
+  origins: ["http://garage.local:8080"]
+  credentials: true
+`)
+	file.Close()
+
+	env := func(values map[string]string) func(string) (string, bool) {
+		return func(name string) (string, bool) {
+			value, ok := values[name]
+			return value, ok
+		}
+	}
+
+	t.Run("use the defaults without file, environment or flags", func(t *testing.T) {
+		c, err := loadConfig(nil, env(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(c, defaultConfig()) {
+			t.Errorf("got %+v, want %+v", c, defaultConfig())
+		}
+	})
+
+	t.Run("read the file named by -config", func(t *testing.T) {
+		c, err := loadConfig([]string{"-config", file.Name()}, env(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.Listen != ":5100" || c.Database != "/var/lib/hivemind/garage.db" || c.DatabaseTimeout != 5*time.Second {
+			t.Errorf("file not applied, got %+v", c)
+		}
+		if !c.CORS.Credentials || !reflect.DeepEqual([]string(c.CORS.Origins), []string{"http://garage.local:8080"}) {
+			t.Errorf("nested settings not applied, got %+v", c.CORS)
+		}
+		if c.SMTP.From != "hivemind@localhost" {
+			t.Errorf("defaults missing from the file lost, got %q", c.SMTP.From)
+		}
+	})
+
+	t.Run("let the environment override the file and flags override both", func(t *testing.T) {
+		c, err := loadConfig([]string{"-listen", ":5300"}, env(map[string]string{
+			"HIVEMIND_CONFIG":   file.Name(),
+			"HIVEMIND_LISTEN":   ":5200",
+			"HIVEMIND_MQTT":     "tcp://cabin:1883",
+			"HIVEMIND_TLS_AUTO": "true",
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.Listen != ":5300" || c.MQTT != "tcp://cabin:1883" || !c.TLS.Auto || c.Database != "/var/lib/hivemind/garage.db" {
+			t.Errorf("wrong precedence, got %+v", c)
+		}
+	})
+
+	t.Run("apply variables set to an empty value", func(t *testing.T) {
+		c, err := loadConfig(nil, env(map[string]string{
+			"HIVEMIND_CONFIG":           file.Name(),
+			"HIVEMIND_CORS_ORIGINS":     "",
+			"HIVEMIND_CORS_CREDENTIALS": "false",
+			"HIVEMIND_LEGACY_SUNSET":    "",
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(c.CORS.Origins) != 0 || c.LegacySunset != "" {
+			t.Errorf("empty variables not applied, got %+v", c)
+		}
+	})
+
+	t.Run("reject invalid configurations", func(t *testing.T) {
+		for name, args := range map[string][]string{
+			"listen":     {"-listen", "5000"},
+			"timeout":    {"-database-timeout", "0s"},
+			"key":        {"-tls-cert", "cert.pem"},
+			"redirect":   {"-redirect-http", ":80"},
+			"cors":       {"-cors-credentials"},
+			"sunset":     {"-legacy-sunset", "next year"},
+			"history":    {"-history-retention", "-1h"},
+			"env":        {"-database", ""},
+			"positional": {"house"},
+		} {
+			if _, err := loadConfig(args, env(nil)); err == nil {
+				t.Errorf("%s: accepted %v", name, args)
+			}
+		}
+		if _, err := loadConfig(nil, env(map[string]string{"HIVEMIND_AUTH": "maybe"})); err == nil {
+			t.Errorf("accepted invalid HIVEMIND_AUTH")
+		}
+	})
+
+	t.Run("reject unknown keys in the file", func(t *testing.T) {
+		typo, _ := ioutil.TempFile("", "hivemind-config")
+		defer os.Remove(typo.Name())
+		typo.WriteString("listne: \":5100\"\n")
+		typo.Close()
+
+		_, err := loadConfig([]string{"-config", typo.Name()}, env(nil))
+		if err == nil || !strings.Contains(err.Error(), "listne") {
+			t.Errorf("unknown key accepted, got error %v", err)
+		}
+	})
+
+	t.Run("print a configuration that loads back to the same settings", func(t *testing.T) {
+		c, _ := loadConfig([]string{"-config", file.Name(), "-tls-auto", "-tls-hosts", "garage.local,10.0.0.2"}, env(nil))
+		out, err := c.yaml()
+		if err != nil {
+			t.Fatal(err)
+		}
+		printed, _ := ioutil.TempFile("", "hivemind-config")
+		defer os.Remove(printed.Name())
+		printed.Write(out)
+		printed.Close()
+
+		loaded, err := loadConfig([]string{"-config", printed.Name()}, env(nil))
+		if err != nil {
+			t.Fatalf("printed configuration invalid: %s\n%s", err, out)
+		}
+		loaded.File = c.File
+		if !reflect.DeepEqual(loaded, c) {
+			t.Errorf("got %+v, want %+v", loaded, c)
+		}
+	})
+}
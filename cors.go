@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	defaultCORSMethods = []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete}
+	defaultCORSHeaders = []string{"Content-Type", "Authorization", csrfHeader, "If-Match", "If-None-Match"}
+	// exposedHeaders are the response headers besides the CORS-safelisted ones scripts may read
+	exposedHeaders = []string{"ETag", "Link", "Deprecation", "Sunset"}
+)
+
+// corsPolicy configures which cross-origin requests browsers may make, "*" in Origins allows any
+// origin but not together with Credentials
+type corsPolicy struct {
+	Origins     []string
+	Methods     []string
+	Headers     []string
+	Credentials bool
+	MaxAge      time.Duration
+}
+
+// newCORSPolicy returns a policy for origins with the default methods and headers
+func newCORSPolicy(origins []string, credentials bool) *corsPolicy {
+	return &corsPolicy{
+		Origins:     origins,
+		Methods:     defaultCORSMethods,
+		Headers:     defaultCORSHeaders,
+		Credentials: credentials,
+		MaxAge:      10 * time.Minute,
+	}
+}
+
+func (p *corsPolicy) validate() error {
+	for _, o := range p.Origins {
+		if o == "*" && p.Credentials {
+			return errors.New("CORS credentials can not be allowed for any origin, list the origins instead")
+		}
+		if o != "*" && !strings.HasPrefix(o, "http://") && !strings.HasPrefix(o, "https://") {
+			return errors.New("CORS origin " + o + " needs a http:// or https:// scheme")
+		}
+	}
+	return nil
+}
+
+func (p *corsPolicy) allowsOrigin(origin string) bool {
+	for _, o := range p.Origins {
+		if o == "*" || strings.EqualFold(strings.TrimSuffix(o, "/"), origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleCORS wraps next, adding the CORS headers of h.cors to all responses and answering preflight
+// requests itself
+func (h *HivemindServer) handleCORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := h.cors
+		origin := r.Header.Get("Origin")
+		if p == nil || origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+
+		w.Header().Add("Vary", "Origin")
+		if !p.allowsOrigin(origin) {
+			if preflight {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		if contains(p.Origins, "*") {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		} else {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+		if p.Credentials {
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
+
+		if !preflight {
+			w.Header().Set("Access-Control-Expose-Headers", strings.Join(exposedHeaders, ", "))
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Access-Control-Request-Method")
+		w.Header().Add("Vary", "Access-Control-Request-Headers")
+		w.Header().Set("Access-Control-Allow-Methods", strings.Join(p.Methods, ", "))
+		w.Header().Set("Access-Control-Allow-Headers", strings.Join(p.Headers, ", "))
+		if p.MaxAge > 0 {
+			w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(p.MaxAge.Seconds())))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
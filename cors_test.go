@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCORS(t *testing.T) {
+	store := StubHivemindStore{
+		nil,
+		map[string]Switch{"lamp": Switch{ID: "lamp", Name: "Lamp", Type: "generic"}},
+	}
+	server := NewHivemindServer(&store)
+	server.users = newStubUserStore()
+	server.cors = newCORSPolicy([]string{"http://localhost:8080"}, true)
+
+	preflight := func(origin string) *http.Request {
+		request, _ := http.NewRequest(http.MethodOptions, "/api/switch/lamp", nil)
+		request.Header.Set("Origin", origin)
+		request.Header.Set("Access-Control-Request-Method", http.MethodPut)
+		request.Header.Set("Access-Control-Request-Headers", "content-type, x-csrf-token")
+		return request
+	}
+
+	t.Run("answer unauthenticated preflights of allowed origins and allow credentials", func(t *testing.T) {
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, preflight("http://localhost:8080"))
+
+		assertResponseCode(t, response.Code, http.StatusNoContent)
+		assertHeader(t, response.Header(), "Access-Control-Allow-Origin", "http://localhost:8080")
+		assertHeader(t, response.Header(), "Access-Control-Allow-Credentials", "true")
+		if !strings.Contains(response.Header().Get("Access-Control-Allow-Methods"), http.MethodPut) {
+			t.Errorf("PUT not allowed, got %q", response.Header().Get("Access-Control-Allow-Methods"))
+		}
+		if !strings.Contains(response.Header().Get("Access-Control-Allow-Headers"), csrfHeader) {
+			t.Errorf("CSRF header not allowed, got %q", response.Header().Get("Access-Control-Allow-Headers"))
+		}
+	})
+
+	t.Run("answer preflights of other origins without CORS headers", func(t *testing.T) {
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, preflight("http://evil.example"))
+
+		assertResponseCode(t, response.Code, http.StatusNoContent)
+		assertHeader(t, response.Header(), "Access-Control-Allow-Origin", "")
+	})
+
+	t.Run("add CORS headers to all routes", func(t *testing.T) {
+		for _, path := range []string{"api/switch/", "api/auth/session", "metrics"} {
+			request := newGetRequest(path)
+			request.Header.Set("Origin", "http://localhost:8080")
+			response := httptest.NewRecorder()
+
+			server.ServeHTTP(response, request)
+
+			assertHeader(t, response.Header(), "Access-Control-Allow-Origin", "http://localhost:8080")
+			assertHeader(t, response.Header(), "Vary", "Origin")
+			assertHeader(t, response.Header(), "Access-Control-Expose-Headers", "ETag, Link, Deprecation, Sunset")
+		}
+	})
+
+	t.Run("send no CORS headers without a policy", func(t *testing.T) {
+		server := NewHivemindServer(&store)
+		request := newGetRequest("api/switch/")
+		request.Header.Set("Origin", "http://localhost:8080")
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, request)
+
+		assertResponseCode(t, response.Code, http.StatusOK)
+		assertHeader(t, response.Header(), "Access-Control-Allow-Origin", "")
+	})
+
+	t.Run("reject credentials for any origin", func(t *testing.T) {
+		if err := newCORSPolicy([]string{"*"}, true).validate(); err == nil {
+			t.Errorf("credentials allowed for any origin")
+		}
+	})
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	devicePending  = "pending"
+	deviceApproved = "approved"
+	deviceRevoked  = "revoked"
+
+	deviceCertLifetime = 365 * 24 * time.Hour
+	crlLifetime        = 7 * 24 * time.Hour
+
+	// pendingDeviceLifetime is the time an enrollment waits for approval before it is dropped, at most
+	// maxPendingDevices wait at a time as anyone can enroll
+	pendingDeviceLifetime = 7 * 24 * time.Hour
+	maxPendingDevices     = 50
+)
+
+// Device is a sensor node authenticating with a client certificate of the local CA, the certificate
+// subject carries the device ID and the device may only write the readings of its Sensors
+type Device struct {
+	ID          string
+	Name        string
+	Sensors     []string
+	Status      string
+	CSR         string `json:",omitempty"`
+	Certificate string `json:",omitempty"`
+	Serial      string `json:",omitempty"`
+	Requested   time.Time
+	Approved    time.Time
+	Revoked     time.Time
+}
+
+// enrollRequest is the body of an enrollment, CSR is the PEM encoded certificate signing request of
+// the device key
+type enrollRequest struct {
+	Name    string
+	Sensors []string
+	CSR     string
+}
+
+// approveRequest is the optional body of an approval, Sensors replace the requested ones
+type approveRequest struct {
+	Sensors []string
+}
+
+// DeviceStore is an interface for device datastorage
+type DeviceStore interface {
+	getDevice(id string) (Device, error)
+	getAllDevices() []Device
+	storeDevice(d Device) error
+	deleteDevice(id string) error
+}
+
+// parseCSR decodes a PEM encoded certificate signing request and checks its signature
+func parseCSR(csrPEM string) (*x509.CertificateRequest, error) {
+	block, _ := pem.Decode([]byte(csrPEM))
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return nil, errors.New("CSR is not a PEM encoded CERTIFICATE REQUEST")
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	return csr, csr.CheckSignature()
+}
+
+// issueDeviceCert signs the CSR of d with a client certificate naming the device in its subject
+func (ca *localCA) issueDeviceCert(d Device, now time.Time) (certPEM, serial string, err error) {
+	csr, err := parseCSR(d.CSR)
+	if err != nil {
+		return "", "", err
+	}
+	template := &x509.Certificate{
+		Subject:     pkix.Name{Organization: []string{"Hivemind devices"}, CommonName: d.ID},
+		NotBefore:   now.Add(-certBackdate),
+		NotAfter:    now.Add(deviceCertLifetime),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := ca.issue(template, csr.PublicKey)
+	if err != nil {
+		return "", "", err
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})), template.SerialNumber.Text(16), nil
+}
+
+// revocationList creates a PEM encoded CRL of the revoked device certificates
+func (ca *localCA) revocationList(devices []Device, now time.Time) ([]byte, error) {
+	var revoked []pkix.RevokedCertificate
+	for _, d := range devices {
+		if d.Status != deviceRevoked || d.Serial == "" {
+			continue
+		}
+		serial, ok := new(big.Int).SetString(d.Serial, 16)
+		if !ok {
+			continue
+		}
+		revoked = append(revoked, pkix.RevokedCertificate{SerialNumber: serial, RevocationTime: d.Revoked})
+	}
+	template := &x509.RevocationList{
+		RevokedCertificates: revoked,
+		Number:              big.NewInt(now.Unix()),
+		ThisUpdate:          now,
+		NextUpdate:          now.Add(crlLifetime),
+	}
+	der, err := x509.CreateRevocationList(rand.Reader, template, ca.cert, ca.key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der}), nil
+}
+
+// deviceForCertificate returns the approved device a verified client certificate was issued to,
+// revoked and superseded certificates are rejected
+func deviceForCertificate(s DeviceStore, cert *x509.Certificate) (Device, error) {
+	d, err := s.getDevice(cert.Subject.CommonName)
+	if err != nil || d.ID == "" {
+		return Device{}, errors.New("unknown device " + cert.Subject.CommonName)
+	}
+	if d.Status != deviceApproved || d.Serial != cert.SerialNumber.Text(16) {
+		return Device{}, errors.New("certificate of device " + d.ID + " is revoked")
+	}
+	return d, nil
+}
+
+// clientAuthConfig lets config request client certificates of the CA, consulting the device store
+// on each handshake so revoked certificates are refused before any request is read
+func (h *HivemindServer) clientAuthConfig(config *tls.Config) *tls.Config {
+	if h.ca == nil || h.devices == nil {
+		return config
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(h.ca.cert)
+	config.ClientCAs = pool
+	config.ClientAuth = tls.VerifyClientCertIfGiven
+	config.VerifyPeerCertificate = func(_ [][]byte, chains [][]*x509.Certificate) error {
+		if len(chains) == 0 {
+			return nil
+		}
+		_, err := deviceForCertificate(h.devices, chains[0][0])
+		return err
+	}
+	return config
+}
+
+func (h *HivemindServer) apiDeviceHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(r.URL.Path[len("/api/device/"):], "/")
+	id := parts[0]
+	action := ""
+	if len(parts) > 1 {
+		action = parts[1]
+	}
+	w.Header().Set("content-type", "application/json")
+	if h.devices == nil || h.ca == nil {
+		writeProblem(w, r, http.StatusNotImplemented, "")
+		return
+	}
+
+	switch {
+	case id == "enroll" && action == "" && r.Method == http.MethodPost:
+		h.apiDeviceEnroll(w, r)
+	case id == "enroll" && action != "" && r.Method == http.MethodGet:
+		d, err := h.devices.getDevice(action)
+		if err != nil || d.ID == "" {
+			writeProblem(w, r, http.StatusNotFound, "")
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"ID": d.ID, "Status": d.Status, "Certificate": d.Certificate})
+	case id == "crl" && r.Method == http.MethodGet:
+		crl, err := h.ca.revocationList(h.devices.getAllDevices(), time.Now().UTC())
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		w.Header().Set("content-type", "application/pkix-crl")
+		w.Write(crl)
+	case id == "ca" && r.Method == http.MethodGet:
+		w.Header().Set("content-type", "application/x-pem-file")
+		w.Write(h.ca.certPEM)
+	case id == "enroll" || id == "crl" || id == "ca":
+		writeProblem(w, r, http.StatusMethodNotAllowed, "")
+	case id == "" && r.Method == http.MethodGet:
+		devices := h.devices.getAllDevices()
+		for i := range devices {
+			devices[i].CSR = ""
+		}
+		json.NewEncoder(w).Encode(devices)
+	case id == "":
+		writeProblem(w, r, http.StatusMethodNotAllowed, "")
+	case action == "" && r.Method == http.MethodGet:
+		d, err := h.devices.getDevice(id)
+		if err != nil || d.ID == "" {
+			writeProblem(w, r, http.StatusNotFound, "")
+			return
+		}
+		json.NewEncoder(w).Encode(d)
+	case action == "" && r.Method == http.MethodDelete:
+		err := h.devices.deleteDevice(id)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case action == "approve" && r.Method == http.MethodPost:
+		h.apiDeviceApprove(w, r, id)
+	case action == "revoke" && r.Method == http.MethodPost:
+		d, err := h.devices.getDevice(id)
+		if err != nil || d.ID == "" {
+			writeProblem(w, r, http.StatusNotFound, "")
+			return
+		}
+		d.Status = deviceRevoked
+		d.Revoked = time.Now().UTC()
+		err = h.devices.storeDevice(d)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(d)
+	default:
+		writeProblem(w, r, http.StatusMethodNotAllowed, "")
+	}
+}
+
+// expirePendingDevices deletes the enrollments older than pendingDeviceLifetime and returns the number
+// of those still pending
+func (h *HivemindServer) expirePendingDevices(now time.Time) (int, error) {
+	pending := 0
+	for _, d := range h.devices.getAllDevices() {
+		if d.Status != devicePending {
+			continue
+		}
+		if now.Sub(d.Requested) < pendingDeviceLifetime {
+			pending++
+			continue
+		}
+		err := h.devices.deleteDevice(d.ID)
+		if err != nil {
+			return pending, err
+		}
+	}
+	return pending, nil
+}
+
+// apiDeviceEnroll stores the CSR of a device for an administrator to approve
+func (h *HivemindServer) apiDeviceEnroll(w http.ResponseWriter, r *http.Request) {
+	var request enrollRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		writeDecodeError(w, r, err)
+		return
+	}
+	if request.Name == "" {
+		writeProblem(w, r, http.StatusUnprocessableEntity, "Name is required")
+		return
+	}
+	if _, err := parseCSR(request.CSR); err != nil {
+		writeProblem(w, r, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	now := time.Now().UTC()
+	pending, err := h.expirePendingDevices(now)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if pending >= maxPendingDevices {
+		writeProblem(w, r, http.StatusTooManyRequests, "too many enrollments are waiting for approval")
+		return
+	}
+	d := Device{
+		ID:        newID(),
+		Name:      request.Name,
+		Sensors:   request.Sensors,
+		Status:    devicePending,
+		CSR:       request.CSR,
+		Requested: now,
+	}
+	err = h.devices.storeDevice(d)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{"ID": d.ID, "Status": d.Status})
+}
+
+// apiDeviceApprove signs the CSR of a pending device, Sensors in the body replace the requested ones
+func (h *HivemindServer) apiDeviceApprove(w http.ResponseWriter, r *http.Request, id string) {
+	d, err := h.devices.getDevice(id)
+	if err != nil || d.ID == "" {
+		writeProblem(w, r, http.StatusNotFound, "")
+		return
+	}
+	if d.Status != devicePending {
+		writeProblem(w, r, http.StatusConflict, "device is "+d.Status)
+		return
+	}
+	var request approveRequest
+	if r.Body != nil {
+		json.NewDecoder(r.Body).Decode(&request)
+	}
+	if request.Sensors != nil {
+		d.Sensors = request.Sensors
+	}
+	if len(d.Sensors) == 0 {
+		writeProblem(w, r, http.StatusUnprocessableEntity, "a device needs at least one sensor")
+		return
+	}
+
+	now := time.Now().UTC()
+	d.Certificate, d.Serial, err = h.ca.issueDeviceCert(d, now)
+	if err != nil {
+		writeProblem(w, r, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	d.Status = deviceApproved
+	d.Approved = now
+	d.CSR = ""
+	err = h.devices.storeDevice(d)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(d)
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDeviceCertificates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hivemind-device")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca, err := loadOrCreateCA(dir, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	certs, err := newAutoCertManager(ca, dir, []string{"hivemind.local"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := StubHivemindStore{
+		map[string]Sensor{
+			"kitchen_temp": Sensor{ID: "kitchen_temp", Name: "Kitchen", Unit: "C", Type: "generic", Value: 21},
+			"garage_temp":  Sensor{ID: "garage_temp", Name: "Garage", Unit: "C", Type: "generic", Value: 8},
+		},
+		nil,
+	}
+	tokens := newStubTokenStore()
+	devices := newStubDeviceStore()
+	server := NewHivemindServer(&store)
+	server.tokens = tokens
+	server.devices = devices
+	server.ca = ca
+	_, admin, _ := mintToken(tokens, "admin", []string{scopeAdmin}, nil)
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	csr, _ := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{Subject: pkix.Name{CommonName: "garage"}}, key)
+	csrPEM := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr}))
+	enrollment, _ := json.Marshal(map[string]interface{}{"Name": "kitchen-esp", "Sensors": []string{"kitchen_temp"}, "CSR": csrPEM})
+
+	var enrolled Device
+	t.Run("return status 202 on POST /api/device/enroll without credentials", func(t *testing.T) {
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, newPostRequest("api/device/enroll", strings.NewReader(string(enrollment))))
+
+		assertResponseCode(t, response.Code, http.StatusAccepted)
+		json.NewDecoder(response.Body).Decode(&enrolled)
+		if enrolled.ID == "" || enrolled.Status != devicePending {
+			t.Fatalf("unexpected enrollment %v", enrolled)
+		}
+	})
+
+	t.Run("return status 422 on POST /api/device/enroll with an invalid CSR", func(t *testing.T) {
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, newPostRequest("api/device/enroll", strings.NewReader(`{"Name": "x", "CSR": "garbage"}`)))
+
+		assertResponseCode(t, response.Code, http.StatusUnprocessableEntity)
+	})
+
+	t.Run("return status 429 on POST /api/device/enroll when too many enrollments are pending", func(t *testing.T) {
+		for i := 0; i < maxPendingDevices; i++ {
+			devices.storeDevice(Device{ID: fmt.Sprint("waiting", i), Status: devicePending, Requested: time.Now().UTC()})
+		}
+		defer func() {
+			for i := 0; i < maxPendingDevices; i++ {
+				devices.deleteDevice(fmt.Sprint("waiting", i))
+			}
+		}()
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, newPostRequest("api/device/enroll", strings.NewReader(string(enrollment))))
+
+		assertResponseCode(t, response.Code, http.StatusTooManyRequests)
+	})
+
+	t.Run("drop expired enrollments on POST /api/device/enroll", func(t *testing.T) {
+		devices.storeDevice(Device{ID: "stale", Status: devicePending, Requested: time.Now().UTC().Add(-pendingDeviceLifetime)})
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, newPostRequest("api/device/enroll", strings.NewReader(string(enrollment))))
+
+		assertResponseCode(t, response.Code, http.StatusAccepted)
+		if _, ok := devices.devices["stale"]; ok {
+			t.Errorf("expired enrollment kept")
+		}
+		var second Device
+		json.NewDecoder(response.Body).Decode(&second)
+		devices.deleteDevice(second.ID)
+	})
+
+	t.Run("return status 401 on POST /api/device/{id}/approve without admin", func(t *testing.T) {
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, newPostRequest("api/device/"+enrolled.ID+"/approve", nil))
+
+		assertResponseCode(t, response.Code, http.StatusUnauthorized)
+		if devices.devices[enrolled.ID].Status != devicePending {
+			t.Errorf("device approved without admin")
+		}
+	})
+
+	t.Run("sign the CSR on POST /api/device/{id}/approve", func(t *testing.T) {
+		request := newPostRequest("api/device/"+enrolled.ID+"/approve", nil)
+		request.Header.Set("Authorization", "Bearer "+admin)
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, request)
+
+		assertResponseCode(t, response.Code, http.StatusAccepted)
+		if devices.devices[enrolled.ID].Status != deviceApproved {
+			t.Errorf("device not approved")
+		}
+	})
+
+	var issued struct{ Status, Certificate string }
+	response := httptest.NewRecorder()
+	server.ServeHTTP(response, newGetRequest("api/device/enroll/"+enrolled.ID))
+	json.NewDecoder(response.Body).Decode(&issued)
+	if issued.Status != deviceApproved || issued.Certificate == "" {
+		t.Fatalf("no certificate issued, got %v", issued)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	clientCert, err := tls.X509KeyPair([]byte(issued.Certificate), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	httpsServer := httptest.NewUnstartedServer(server)
+	httpsServer.TLS = server.clientAuthConfig(certs.tlsConfig())
+	httpsServer.StartTLS()
+	defer httpsServer.Close()
+
+	put := func(id string, value int) (*http.Response, error) {
+		roots := x509.NewCertPool()
+		roots.AddCert(ca.cert)
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{RootCAs: roots, ServerName: "hivemind.local", Certificates: []tls.Certificate{clientCert}},
+			DisableKeepAlives: true,
+		}}
+		body, _ := json.Marshal(Sensor{ID: id, Name: id, Unit: "C", Type: "generic", Value: value})
+		request, _ := http.NewRequest(http.MethodPut, httpsServer.URL+"/api/sensor/"+id, strings.NewReader(string(body)))
+		response, err := client.Do(request)
+		if err == nil {
+			response.Body.Close()
+		}
+		return response, err
+	}
+
+	t.Run("authenticate the device by its certificate and let it write its own sensors", func(t *testing.T) {
+		response, err := put("kitchen_temp", 22)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assertResponseCode(t, response.StatusCode, http.StatusAccepted)
+		if store.sensors["kitchen_temp"].Value != 22 {
+			t.Errorf("reading of the device not stored")
+		}
+	})
+
+	t.Run("return status 403 on PUT of a sensor of another device", func(t *testing.T) {
+		response, err := put("garage_temp", 99)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assertResponseCode(t, response.StatusCode, http.StatusForbidden)
+		assertSensor(t, store.sensors["garage_temp"], Sensor{ID: "garage_temp", Name: "Garage", Unit: "C", Type: "generic", Value: 8})
+	})
+
+	t.Run("refuse the handshake after revocation and list the certificate in the CRL", func(t *testing.T) {
+		request := newPostRequest("api/device/"+enrolled.ID+"/revoke", nil)
+		request.Header.Set("Authorization", "Bearer "+admin)
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, request)
+
+		assertResponseCode(t, response.Code, http.StatusAccepted)
+
+		if _, err := put("kitchen_temp", 23); err == nil {
+			t.Errorf("revoked certificate accepted")
+		}
+
+		response = httptest.NewRecorder()
+		server.ServeHTTP(response, newGetRequest("api/device/crl"))
+		block, _ := pem.Decode(response.Body.Bytes())
+		if block == nil {
+			t.Fatalf("no CRL returned")
+		}
+		crl, err := x509.ParseRevocationList(block.Bytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(crl.RevokedCertificateEntries) != 1 || crl.RevokedCertificateEntries[0].SerialNumber.Text(16) != devices.devices[enrolled.ID].Serial {
+			t.Errorf("unexpected CRL entries %v", crl.RevokedCertificateEntries)
+		}
+	})
+}
+
+// stubs
+type stubDeviceStore struct {
+	sync.Mutex
+	devices map[string]Device
+}
+
+func newStubDeviceStore() *stubDeviceStore {
+	return &stubDeviceStore{devices: make(map[string]Device)}
+}
+
+func (s *stubDeviceStore) getDevice(id string) (Device, error) {
+	s.Lock()
+	defer s.Unlock()
+	return s.devices[id], nil
+}
+
+func (s *stubDeviceStore) getAllDevices() []Device {
+	s.Lock()
+	defer s.Unlock()
+	var devices []Device
+	for _, d := range s.devices {
+		devices = append(devices, d)
+	}
+	return devices
+}
+
+func (s *stubDeviceStore) storeDevice(d Device) error {
+	s.Lock()
+	defer s.Unlock()
+	s.devices[d.ID] = d
+	return nil
+}
+
+func (s *stubDeviceStore) deleteDevice(id string) error {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.devices, id)
+	return nil
+}
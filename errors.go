@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Errors of the stores, wrapped with the details of the failure; the API maps them onto status codes
+var (
+	ErrNotFound   = errors.New("not found")
+	ErrConflict   = errors.New("conflict")
+	ErrValidation = errors.New("invalid")
+	// ErrPreconditionFailed is returned when a record changed since the revision a request is based on
+	ErrPreconditionFailed = errors.New("precondition failed")
+
+	errMissingID = fmt.Errorf("ID is required: %w", ErrValidation)
+)
+
+// notFound returns an ErrNotFound for the record id of kind
+func notFound(kind, id string) error {
+	return fmt.Errorf("%s %s: %w", kind, id, ErrNotFound)
+}
+
+const problemContentType = "application/problem+json"
+
+// problem is a RFC 7807 problem details body, Detail explains this occurrence of the problem
+type problem struct {
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	Detail    string `json:"detail,omitempty"`
+	Instance  string `json:"instance,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+	// Errors lists the invalid fields of a 422 response
+	Errors []fieldError `json:"errors,omitempty"`
+}
+
+func newProblem(w http.ResponseWriter, r *http.Request, status int, detail string) problem {
+	return problem{
+		Type:      "about:blank",
+		Title:     http.StatusText(status),
+		Status:    status,
+		Detail:    detail,
+		Instance:  r.URL.Path,
+		RequestID: w.Header().Get(requestIDHeader),
+	}
+}
+
+func (p problem) write(w http.ResponseWriter) {
+	w.Header().Set("content-type", problemContentType)
+	w.WriteHeader(p.Status)
+	json.NewEncoder(w).Encode(p)
+}
+
+// writeProblem answers r with status and a problem details body
+func writeProblem(w http.ResponseWriter, r *http.Request, status int, detail string) {
+	newProblem(w, r, status, detail).write(w)
+}
+
+// errorStatus returns the status code for err, 500 unless it wraps one of the store errors or is
+// a JSON decoding error
+func errorStatus(err error) int {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr), errors.As(err, &typeErr):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrConflict):
+		return http.StatusConflict
+	case errors.Is(err, ErrValidation):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, ErrPreconditionFailed):
+		return http.StatusPreconditionFailed
+	}
+	return http.StatusInternalServerError
+}
+
+// writeError answers r with the status for err; internal errors are logged and not disclosed
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	status := errorStatus(err)
+	if status == http.StatusInternalServerError {
+		requestLogger(r).Error("request failed", "error", err)
+		writeProblem(w, r, status, "")
+		return
+	}
+	p := newProblem(w, r, status, err.Error())
+	var invalid validationErrors
+	if errors.As(err, &invalid) {
+		p.Detail = "the request has invalid fields"
+		p.Errors = invalid
+	}
+	p.write(w)
+}
+
+// writeDecodeError answers r with 400 for a body that is not valid JSON of the expected shape
+func writeDecodeError(w http.ResponseWriter, r *http.Request, err error) {
+	writeProblem(w, r, http.StatusBadRequest, "malformed JSON: "+err.Error())
+}
+
+// writeMethodNotAllowed answers r with 405, listing the methods the resource supports
+func writeMethodNotAllowed(w http.ResponseWriter, r *http.Request, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	writeProblem(w, r, http.StatusMethodNotAllowed, r.Method+" is not supported here")
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestProblemDetails(t *testing.T) {
+	t.Run("map store errors onto status codes", func(t *testing.T) {
+		cases := []struct {
+			err  error
+			want int
+		}{
+			{notFound("sensor", "x"), http.StatusNotFound},
+			{fmt.Errorf("revision changed: %w", ErrConflict), http.StatusConflict},
+			{errMissingID, http.StatusUnprocessableEntity},
+			{fmt.Errorf("sensor x is at revision 4: %w", ErrPreconditionFailed), http.StatusPreconditionFailed},
+			{errors.New("disk full"), http.StatusInternalServerError},
+		}
+		for _, c := range cases {
+			if got := errorStatus(c.err); got != c.want {
+				t.Errorf("errorStatus(%v) = %d, want %d", c.err, got, c.want)
+			}
+		}
+	})
+
+	t.Run("describe the problem without disclosing internal errors", func(t *testing.T) {
+		request := newGetRequest("api/sensor/x")
+		response := httptest.NewRecorder()
+		response.Header().Set(requestIDHeader, "abc")
+
+		writeError(response, request, errors.New("open /var/lib/hivemind.db: disk full"))
+
+		assertResponseCode(t, response.Code, http.StatusInternalServerError)
+		assertContentType(t, response.Header().Get("content-type"), problemContentType)
+		var got problem
+		json.NewDecoder(response.Body).Decode(&got)
+		want := problem{Type: "about:blank", Title: "Internal Server Error", Status: 500, Instance: "/api/sensor/x", RequestID: "abc"}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got %+v, want %+v", got, want)
+		}
+	})
+
+	t.Run("explain client errors in detail", func(t *testing.T) {
+		request := newGetRequest("api/sensor/x")
+		response := httptest.NewRecorder()
+
+		writeError(response, request, notFound("sensor", "x"))
+
+		var got problem
+		json.NewDecoder(response.Body).Decode(&got)
+		if got.Status != http.StatusNotFound || got.Detail != "sensor x: not found" {
+			t.Errorf("unexpected problem %+v", got)
+		}
+	})
+}
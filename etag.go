@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// revisionETag returns the entity tag of a sensor or switch at revision
+func revisionETag(revision uint64) string {
+	return `"` + strconv.FormatUint(revision, 10) + `"`
+}
+
+// fieldsETag returns the entity tag of the fields of a sensor or switch at revision, that of the
+// whole record when fields is nil
+func fieldsETag(revision uint64, fields []string) string {
+	if fields == nil {
+		return revisionETag(revision)
+	}
+	names := make([]string, len(fields))
+	for i, field := range fields {
+		names[i] = strings.ToLower(field)
+	}
+	sort.Strings(names)
+	return `"` + strconv.FormatUint(revision, 10) + ";" + strings.Join(names, "+") + `"`
+}
+
+// contentETag returns the entity tag of a response body, for lists which have no revision of their own
+func contentETag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// etagMatches reports whether etag is in list, the value of an If-Match or If-None-Match header;
+// * matches any etag, weak tags only compare equal to others with the weak comparison of
+// If-None-Match while If-Match needs the strong one (RFC 9110 13.1.1)
+func etagMatches(list, etag string, weak bool) bool {
+	if !weak && strings.HasPrefix(etag, "W/") {
+		return false
+	}
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return true
+		}
+		if weak {
+			candidate, etag = strings.TrimPrefix(candidate, "W/"), strings.TrimPrefix(etag, "W/")
+		}
+		if candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// hasIfMatch reports whether r is a conditional write
+func hasIfMatch(r *http.Request) bool {
+	return r.Header.Get("If-Match") != ""
+}
+
+// checkIfMatch fails with ErrPreconditionFailed when the If-Match header of r does not match the
+// record of kind id at revision, requests without If-Match always pass
+func checkIfMatch(r *http.Request, kind, id string, revision uint64) error {
+	ifMatch := r.Header.Get("If-Match")
+	if ifMatch == "" || etagMatches(ifMatch, revisionETag(revision), false) {
+		return nil
+	}
+	return fmt.Errorf("%s %s is at revision %d: %w", kind, id, revision, ErrPreconditionFailed)
+}
+
+// conditionalError turns a missing record into a failed precondition for conditional writes, which
+// must not create records
+func conditionalError(r *http.Request, err error) error {
+	if hasIfMatch(r) && errorStatus(err) == http.StatusNotFound {
+		return fmt.Errorf("%v: %w", err, ErrPreconditionFailed)
+	}
+	return err
+}
+
+// writeJSONRevision writes fields of the sensor or switch v with the entity tag of its revision and
+// these fields, or 304 when the If-None-Match header of r already matches it
+func writeJSONRevision(w http.ResponseWriter, r *http.Request, v interface{}, revision uint64, fields []string) {
+	etag := fieldsETag(revision, fields)
+	w.Header().Set("ETag", etag)
+	if etagMatches(r.Header.Get("If-None-Match"), etag, true) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeRecord answers a write with status and the stored sensor or switch v with the entity tag of
+// its revision
+func writeRecord(w http.ResponseWriter, status int, v interface{}, revision uint64) {
+	w.Header().Set("ETag", revisionETag(revision))
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeJSONList writes the list v, or any other value without a revision, with an entity tag of its
+// content, or 304 when the If-None-Match header of r already matches it
+func writeJSONList(w http.ResponseWriter, r *http.Request, v interface{}) {
+	var body bytes.Buffer
+	json.NewEncoder(&body).Encode(v)
+	etag := contentETag(body.Bytes())
+	w.Header().Set("ETag", etag)
+	if etagMatches(r.Header.Get("If-None-Match"), etag, true) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Write(body.Bytes())
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestETag(t *testing.T) {
+	t.Run("match entity tags of If-Match and If-None-Match", func(t *testing.T) {
+		cases := []struct {
+			list       string
+			weak, want bool
+		}{
+			{`"3"`, false, true},
+			{`"2", "3"`, false, true},
+			{`W/"3"`, true, true},
+			{`W/"3"`, false, false},
+			{`*`, false, true},
+			{`"2"`, true, false},
+			{``, true, false},
+		}
+		for _, c := range cases {
+			if got := etagMatches(c.list, `"3"`, c.weak); got != c.want {
+				t.Errorf("etagMatches(%q, weak %v) = %v, want %v", c.list, c.weak, got, c.want)
+			}
+		}
+	})
+}
+
+func TestConditionalRequests(t *testing.T) {
+	store := StubHivemindStore{
+		map[string]Sensor{"kitchen": Sensor{ID: "kitchen", Name: "Kitchen", Unit: "C", Type: "temperature", Value: 18, Revision: 3}},
+		map[string]Switch{"lamp": Switch{ID: "lamp", Name: "Lamp", Type: "generic", Revision: 5}},
+	}
+	server := NewHivemindServer(&store)
+	send := func(method, url string, header http.Header, body io.Reader) *httptest.ResponseRecorder {
+		request, _ := http.NewRequest(method, "/"+url, body)
+		for name, values := range header {
+			request.Header[name] = values
+		}
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, request)
+		return response
+	}
+	ifMatch := func(etag string) http.Header {
+		return http.Header{"If-Match": {etag}}
+	}
+
+	t.Run("return the revision as ETag and 304 for it on GET /api/sensor/kitchen", func(t *testing.T) {
+		response := send(http.MethodGet, "api/sensor/kitchen", nil, nil)
+
+		assertResponseCode(t, response.Code, http.StatusOK)
+		assertHeader(t, response.Header(), "ETag", `"3"`)
+
+		response = send(http.MethodGet, "api/sensor/kitchen", http.Header{"If-None-Match": {`"3"`}}, nil)
+
+		assertResponseCode(t, response.Code, http.StatusNotModified)
+		assertBody(t, response.Body.String(), "")
+	})
+
+	t.Run("return an ETag of the selected fields on GET /api/sensor/kitchen?fields=value,id", func(t *testing.T) {
+		response := send(http.MethodGet, "api/sensor/kitchen?fields=value,id", http.Header{"If-None-Match": {`"3"`}}, nil)
+
+		assertResponseCode(t, response.Code, http.StatusOK)
+		assertHeader(t, response.Header(), "ETag", `"3;id+value"`)
+
+		response = send(http.MethodGet, "api/sensor/kitchen?fields=ID,Value", http.Header{"If-None-Match": {`"3;id+value"`}}, nil)
+
+		assertResponseCode(t, response.Code, http.StatusNotModified)
+	})
+
+	t.Run("return status 304 on GET /api/switch/ until a switch changes", func(t *testing.T) {
+		response := send(http.MethodGet, "api/switch/", nil, nil)
+		etag := response.Header().Get("ETag")
+
+		response = send(http.MethodGet, "api/switch/", http.Header{"If-None-Match": {etag}}, nil)
+		assertResponseCode(t, response.Code, http.StatusNotModified)
+
+		store.switches["lamp"] = Switch{ID: "lamp", Name: "Lamp", Type: "generic", State: true, Revision: 6}
+
+		response = send(http.MethodGet, "api/switch/", http.Header{"If-None-Match": {etag}}, nil)
+		assertResponseCode(t, response.Code, http.StatusOK)
+	})
+
+	t.Run("return status 412 on PUT /api/switch/lamp with a stale If-Match", func(t *testing.T) {
+		response := send(http.MethodPut, "api/switch/lamp", ifMatch(`"5"`), strings.NewReader(`{"Name": "Lamp", "State": false}`))
+
+		assertResponseCode(t, response.Code, http.StatusPreconditionFailed)
+		assertContentType(t, response.Header().Get("content-type"), problemContentType)
+		assertSwitch(t, store.switches["lamp"], Switch{ID: "lamp", Name: "Lamp", Type: "generic", State: true, Revision: 6})
+	})
+
+	t.Run("store on PUT /api/switch/lamp with the current If-Match", func(t *testing.T) {
+		response := send(http.MethodPut, "api/switch/lamp", ifMatch(`"6"`), strings.NewReader(`{"Name": "Lamp", "State": false}`))
+
+		assertResponseCode(t, response.Code, http.StatusAccepted)
+		if store.switches["lamp"].State {
+			t.Errorf("switch not stored")
+		}
+	})
+
+	t.Run("return status 412 on PUT /api/switch/lamp with a weak If-Match", func(t *testing.T) {
+		etag := `W/` + revisionETag(store.switches["lamp"].Revision)
+		response := send(http.MethodPut, "api/switch/lamp", ifMatch(etag), strings.NewReader(`{"Name": "Lamp", "State": true}`))
+
+		assertResponseCode(t, response.Code, http.StatusPreconditionFailed)
+		if store.switches["lamp"].State {
+			t.Errorf("switch stored with a weak entity tag")
+		}
+	})
+
+	t.Run("return status 412 on PATCH /api/sensor/kitchen with a stale If-Match", func(t *testing.T) {
+		header := ifMatch(`"2"`)
+		header.Set("Content-Type", mergePatchContentType)
+		response := send(http.MethodPatch, "api/sensor/kitchen", header, strings.NewReader(`{"Value": 20}`))
+
+		assertResponseCode(t, response.Code, http.StatusPreconditionFailed)
+		assertSensor(t, store.sensors["kitchen"], Sensor{ID: "kitchen", Name: "Kitchen", Unit: "C", Type: "temperature", Value: 18, Revision: 3})
+	})
+
+	t.Run("return status 412 on conditional PUT /api/sensor/{random}", func(t *testing.T) {
+		id := randomString(8)
+		response := send(http.MethodPut, "api/sensor/"+id, ifMatch("*"), strings.NewReader(`{"Name": "New", "Value": 1}`))
+
+		assertResponseCode(t, response.Code, http.StatusPreconditionFailed)
+		if _, ok := store.sensors[id]; ok {
+			t.Errorf("conditional PUT created sensor %s", id)
+		}
+	})
+
+	t.Run("delete on DELETE /api/sensor/kitchen only with the current If-Match", func(t *testing.T) {
+		response := send(http.MethodDelete, "api/sensor/kitchen", ifMatch(`"2"`), nil)
+		assertResponseCode(t, response.Code, http.StatusPreconditionFailed)
+
+		response = send(http.MethodDelete, "api/sensor/kitchen", ifMatch(`"3"`), nil)
+		assertResponseCode(t, response.Code, http.StatusNoContent)
+		if _, ok := store.sensors["kitchen"]; ok {
+			t.Errorf("sensor not deleted")
+		}
+
+		response = send(http.MethodDelete, "api/sensor/kitchen", nil, nil)
+		assertResponseCode(t, response.Code, http.StatusNotFound)
+	})
+}
@@ -0,0 +1,18 @@
+// fetchAll fetches a list of the API with all its pages, following the Link rel="next" headers
+export function fetchAll(url) {
+  return fetch(url, { credentials: 'include' })
+    .then(response => {
+      const next = nextLink(response)
+      return response.json().then(items => {
+        if (!next) {
+          return items
+        }
+        return fetchAll(new URL(next, response.url).href).then(rest => items.concat(rest))
+      })
+    })
+}
+
+function nextLink(response) {
+  const match = (response.headers.get('Link') || '').match(/<([^>]*)>;\s*rel="next"/)
+  return match ? match[1] : null
+}
@@ -0,0 +1,1922 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// gqlMaxDepth is the deepest nesting of selection sets, values and types a request may have, deeper
+// ones are rejected before they are parsed, validated or coerced any further
+const gqlMaxDepth = 64
+
+// gqlSchema is a GraphQL schema of object, input object, enum and scalar types; the root types are
+// named Query, Mutation and Subscription
+type gqlSchema struct {
+	types map[string]*gqlType
+}
+
+// gqlType is a named type, kind is OBJECT, INPUT_OBJECT, ENUM or SCALAR
+type gqlType struct {
+	name        string
+	kind        string
+	description string
+	// fields of an object or input object in the order they are listed
+	fields []*gqlField
+	// values of an enum
+	values []string
+}
+
+// gqlField is a field of an object, an argument of a field or a field of an input object; types are
+// written as in GraphQL, e.g. [Sensor!]!
+type gqlField struct {
+	name        string
+	typ         string
+	description string
+	args        []*gqlField
+	// defaultValue of an argument or input field, nil for none
+	defaultValue interface{}
+	// resolve returns the value of the field of source, a struct field of the same name when nil
+	resolve gqlResolver
+	// subscribe returns the events of a subscription and a function to end it, each event is the
+	// source of an execution of the selection set
+	subscribe func(r *http.Request, args map[string]interface{}) (<-chan interface{}, func(), error)
+}
+
+type gqlResolver func(r *http.Request, source interface{}, args map[string]interface{}) (interface{}, error)
+
+// gqlObjectType returns an object type with fields
+func gqlObjectType(name, description string, fields ...*gqlField) *gqlType {
+	return &gqlType{name: name, kind: "OBJECT", description: description, fields: fields}
+}
+
+// gqlInputType returns an input object type with fields
+func gqlInputType(name, description string, fields ...*gqlField) *gqlType {
+	return &gqlType{name: name, kind: "INPUT_OBJECT", description: description, fields: fields}
+}
+
+// gqlEnumType returns an enum type with values
+func gqlEnumType(name, description string, values ...string) *gqlType {
+	return &gqlType{name: name, kind: "ENUM", description: description, values: values}
+}
+
+// gqlArg returns an argument or input field, defaultValue is nil for none
+func gqlArg(name, typ string, defaultValue interface{}, description string) *gqlField {
+	return &gqlField{name: name, typ: typ, defaultValue: defaultValue, description: description}
+}
+
+func (t *gqlType) field(name string) *gqlField {
+	for _, f := range t.fields {
+		if f.name == name {
+			return f
+		}
+	}
+	return nil
+}
+
+func (f *gqlField) arg(name string) *gqlField {
+	for _, a := range f.args {
+		if a.name == name {
+			return a
+		}
+	}
+	return nil
+}
+
+// newGQLSchema returns a schema of types, the built-in scalars, Time and the introspection types
+func newGQLSchema(types ...*gqlType) *gqlSchema {
+	s := &gqlSchema{types: map[string]*gqlType{}}
+	for _, name := range []string{"ID", "String", "Int", "Float", "Boolean"} {
+		s.types[name] = &gqlType{name: name, kind: "SCALAR"}
+	}
+	s.types["Time"] = &gqlType{name: "Time", kind: "SCALAR", description: "An RFC 3339 timestamp"}
+	for _, t := range append(types, s.introspectionTypes()...) {
+		s.types[t.name] = t
+	}
+	if query := s.types["Query"]; query != nil {
+		query.fields = append(query.fields,
+			&gqlField{name: "__schema", typ: "__Schema!", resolve: func(r *http.Request, source interface{}, args map[string]interface{}) (interface{}, error) {
+				return s, nil
+			}},
+			&gqlField{name: "__type", typ: "__Type", args: []*gqlField{gqlArg("name", "String!", nil, "")}, resolve: func(r *http.Request, source interface{}, args map[string]interface{}) (interface{}, error) {
+				if s.types[args["name"].(string)] == nil {
+					return nil, nil
+				}
+				return args["name"], nil
+			}},
+		)
+	}
+	return s
+}
+
+// namedType returns the named type of the type reference typ, Sensor for [Sensor!]!
+func namedType(typ string) string {
+	return strings.Trim(typ, "[]!")
+}
+
+// graphQLError is an error in the response to a GraphQL request
+type graphQLError struct {
+	Message   string            `json:"message"`
+	Locations []graphQLLocation `json:"locations,omitempty"`
+	Path      []interface{}     `json:"path,omitempty"`
+}
+
+type graphQLLocation struct {
+	Line   int `json:"line"`
+	Column int `json:"column"`
+}
+
+func (e *graphQLError) Error() string {
+	return e.Message
+}
+
+// graphQLRequest is a GraphQL request as sent in the body of a POST or the query of a GET
+type graphQLRequest struct {
+	Query         string                 `json:"query"`
+	Variables     map[string]interface{} `json:"variables"`
+	OperationName string                 `json:"operationName"`
+}
+
+// graphQLResponse is the result of a GraphQL request, Data is missing when the request failed before
+// execution
+type graphQLResponse struct {
+	Data   interface{}     `json:"data,omitempty"`
+	Errors []*graphQLError `json:"errors,omitempty"`
+}
+
+// gqlObject is an object of a response, its members are encoded in the order of the selection set
+type gqlObject struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+func (o *gqlObject) set(key string, value interface{}) {
+	if _, ok := o.values[key]; !ok {
+		o.keys = append(o.keys, key)
+	}
+	o.values[key] = value
+}
+
+func (o *gqlObject) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, key := range o.keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		encoded, err := json.Marshal(o.values[key])
+		if err != nil {
+			return nil, err
+		}
+		name, _ := json.Marshal(key)
+		b.Write(name)
+		b.WriteByte(':')
+		b.Write(encoded)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+// gqlExecution is a prepared operation of a request
+type gqlExecution struct {
+	schema    *gqlSchema
+	document  *gqlDocument
+	operation *gqlOperation
+	variables map[string]interface{}
+	request   *http.Request
+	errors    []*graphQLError
+	// usedVariables are the variables of the operation used by its selections, found by validate
+	usedVariables map[string]bool
+}
+
+// prepare parses and validates the document of req and coerces its variables for the operation
+// to execute, errors are request errors
+func (s *gqlSchema) prepare(r *http.Request, req graphQLRequest) (*gqlExecution, error) {
+	document, err := parseGraphQL(req.Query)
+	if err != nil {
+		return nil, err
+	}
+	if err := document.validate(); err != nil {
+		return nil, err
+	}
+	var operation *gqlOperation
+	for _, op := range document.operations {
+		if op.name == req.OperationName || (req.OperationName == "" && len(document.operations) == 1) {
+			operation = op
+		}
+	}
+	if operation == nil {
+		if req.OperationName == "" {
+			return nil, &graphQLError{Message: "operationName is required for a document with several operations"}
+		}
+		return nil, &graphQLError{Message: "no operation " + req.OperationName}
+	}
+	e := &gqlExecution{schema: s, document: document, operation: operation, request: r, usedVariables: map[string]bool{}}
+	root := e.rootType()
+	if root == nil {
+		return nil, &graphQLError{Message: "the schema supports no " + operation.kind}
+	}
+	if err := e.validateVariableDefinitions(); err != nil {
+		return nil, err
+	}
+	if err := e.validate(root, operation.selections, map[string]bool{}, 0); err != nil {
+		return nil, err
+	}
+	for _, v := range operation.variables {
+		if !e.usedVariables[v.name] {
+			return nil, &graphQLError{Message: "variable $" + v.name + " is not used"}
+		}
+	}
+	if err := e.validateMerge(root, operation.selections, 0); err != nil {
+		return nil, err
+	}
+	e.variables = map[string]interface{}{}
+	for _, v := range operation.variables {
+		value, ok := req.Variables[v.name]
+		if nestedDeeper(value, gqlMaxDepth) {
+			return nil, &graphQLError{Message: fmt.Sprintf("variable $%s: nested deeper than %d", v.name, gqlMaxDepth)}
+		}
+		if !ok && v.hasDefault {
+			value, err = s.coerceLiteral(v.typ, v.defaultValue, nil)
+		} else if ok || strings.HasSuffix(v.typ, "!") {
+			value, err = s.coerceValue(v.typ, value)
+		} else {
+			continue
+		}
+		if err != nil {
+			return nil, &graphQLError{Message: "variable $" + v.name + ": " + err.Error()}
+		}
+		e.variables[v.name] = value
+	}
+	if operation.kind == "subscription" {
+		fields, err := e.collectFields(root, operation.selections)
+		if err != nil {
+			return nil, err
+		}
+		if len(fields) != 1 {
+			return nil, &graphQLError{Message: "a subscription selects a single field"}
+		}
+	}
+	return e, nil
+}
+
+// validate checks that the operation names are unique, an anonymous operation is the only one and
+// every fragment is spread by an operation
+func (d *gqlDocument) validate() error {
+	names := map[string]bool{}
+	for _, op := range d.operations {
+		if op.name == "" && len(d.operations) > 1 {
+			return &graphQLError{Message: "an anonymous operation has to be the only one of the document"}
+		}
+		if names[op.name] {
+			return &graphQLError{Message: "operation " + op.name + " is defined twice"}
+		}
+		names[op.name] = true
+	}
+
+	used := map[string]bool{}
+	var spread func(selections []*gqlSelection)
+	spread = func(selections []*gqlSelection) {
+		for _, sel := range selections {
+			if fragment := d.fragments[sel.fragment]; fragment != nil && !used[sel.fragment] {
+				used[sel.fragment] = true
+				spread(fragment.selections)
+			}
+			spread(sel.selections)
+		}
+	}
+	for _, op := range d.operations {
+		spread(op.selections)
+	}
+	var unused []string
+	for name := range d.fragments {
+		if !used[name] {
+			unused = append(unused, name)
+		}
+	}
+	if len(unused) > 0 {
+		sort.Strings(unused)
+		fragment := d.fragments[unused[0]]
+		return &graphQLError{Message: "fragment " + unused[0] + " is not used", Locations: []graphQLLocation{fragment.location}}
+	}
+	return nil
+}
+
+// variable returns the definition of the variable name, nil when op defines none
+func (op *gqlOperation) variable(name string) *gqlVariableDefinition {
+	for i := range op.variables {
+		if op.variables[i].name == name {
+			return &op.variables[i]
+		}
+	}
+	return nil
+}
+
+// validateVariableDefinitions checks that the variables of the operation are defined once, of input
+// types and with defaults of their types
+func (e *gqlExecution) validateVariableDefinitions() error {
+	for i, v := range e.operation.variables {
+		if e.operation.variable(v.name) != &e.operation.variables[i] {
+			return &graphQLError{Message: "variable $" + v.name + " is defined twice"}
+		}
+		if !e.schema.isInputType(v.typ) {
+			return &graphQLError{Message: "variable $" + v.name + " is of type " + v.typ + " which is no input type"}
+		}
+		if v.hasDefault {
+			if _, err := e.schema.coerceLiteral(v.typ, v.defaultValue, nil); err != nil {
+				return &graphQLError{Message: "variable $" + v.name + ": default value: " + err.Error()}
+			}
+		}
+	}
+	return nil
+}
+
+func (e *gqlExecution) rootType() *gqlType {
+	switch e.operation.kind {
+	case "mutation":
+		return e.schema.types["Mutation"]
+	case "subscription":
+		return e.schema.types["Subscription"]
+	}
+	return e.schema.types["Query"]
+}
+
+// validate checks that the selections on t only select fields of t with known arguments, all
+// required arguments and selection sets exactly for fields of object types
+func (e *gqlExecution) validate(t *gqlType, selections []*gqlSelection, fragments map[string]bool, depth int) error {
+	if depth > gqlMaxDepth {
+		return selections[0].errorf("selections nested deeper than %d", gqlMaxDepth)
+	}
+	for _, sel := range selections {
+		if err := e.validateDirectives(sel); err != nil {
+			return err
+		}
+		switch {
+		case sel.fragment != "":
+			fragment := e.document.fragments[sel.fragment]
+			if fragment == nil {
+				return sel.errorf("no fragment %s", sel.fragment)
+			}
+			if fragments[sel.fragment] {
+				return sel.errorf("fragment %s spreads itself", sel.fragment)
+			}
+			if fragment.typeCondition != t.name {
+				return sel.errorf("fragment %s on %s can not be spread on %s", sel.fragment, fragment.typeCondition, t.name)
+			}
+			fragments[sel.fragment] = true
+			err := e.validate(t, fragment.selections, fragments, depth+1)
+			delete(fragments, sel.fragment)
+			if err != nil {
+				return err
+			}
+		case sel.name == "":
+			if sel.typeCondition != "" && sel.typeCondition != t.name {
+				return sel.errorf("fragment on %s can not be spread on %s", sel.typeCondition, t.name)
+			}
+			if err := e.validate(t, sel.selections, fragments, depth+1); err != nil {
+				return err
+			}
+		case sel.name == "__typename":
+			if sel.selections != nil {
+				return sel.errorf("field __typename has no fields")
+			}
+		default:
+			f := t.field(sel.name)
+			if f == nil {
+				return sel.errorf("no field %s on type %s", sel.name, t.name)
+			}
+			for name, literal := range sel.arguments {
+				a := f.arg(name)
+				if a == nil {
+					return sel.errorf("no argument %s on field %s.%s", name, t.name, sel.name)
+				}
+				if err := e.validateValue(a.typ, literal, a.defaultValue != nil); err != nil {
+					return sel.errorf("argument %s of field %s.%s: %v", name, t.name, sel.name, err)
+				}
+			}
+			for _, a := range f.args {
+				if _, ok := sel.arguments[a.name]; !ok && strings.HasSuffix(a.typ, "!") && a.defaultValue == nil {
+					return sel.errorf("field %s.%s needs the argument %s", t.name, sel.name, a.name)
+				}
+			}
+			fieldType := e.schema.types[namedType(f.typ)]
+			if fieldType.kind == "OBJECT" {
+				if sel.selections == nil {
+					return sel.errorf("field %s.%s of type %s needs a selection of its fields", t.name, sel.name, f.typ)
+				}
+				if err := e.validate(fieldType, sel.selections, fragments, depth+1); err != nil {
+					return err
+				}
+			} else if sel.selections != nil {
+				return sel.errorf("field %s.%s of type %s has no fields", t.name, sel.name, f.typ)
+			}
+		}
+	}
+	return nil
+}
+
+// validateDirectives checks that sel has only the directives @skip and @include, each with a
+// Boolean! argument if
+func (e *gqlExecution) validateDirectives(sel *gqlSelection) error {
+	names := make([]string, 0, len(sel.directives))
+	for name := range sel.directives {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if name != "skip" && name != "include" {
+			return sel.errorf("no directive @%s", name)
+		}
+		args := sel.directives[name]
+		for arg := range args {
+			if arg != "if" {
+				return sel.errorf("no argument %s on directive @%s", arg, name)
+			}
+		}
+		literal, ok := args["if"]
+		if !ok {
+			return sel.errorf("directive @%s needs the argument if", name)
+		}
+		if err := e.validateValue("Boolean!", literal, false); err != nil {
+			return sel.errorf("argument if of directive @%s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// validateValue checks that the argument value literal can be coerced to the input type typ and
+// marks the variables it uses, which have to be defined with a type allowed for typ; hasDefault
+// tells whether the argument or input field has a default
+func (e *gqlExecution) validateValue(typ string, literal interface{}, hasDefault bool) error {
+	switch value := literal.(type) {
+	case gqlVariable:
+		v := e.operation.variable(string(value))
+		if v == nil {
+			return fmt.Errorf("variable $%s is not defined", value)
+		}
+		e.usedVariables[v.name] = true
+		if !variableAllowed(v.typ, typ, hasDefault || (v.hasDefault && v.defaultValue != nil)) {
+			return fmt.Errorf("variable $%s of type %s can not be used as %s", value, v.typ, typ)
+		}
+		return nil
+	case []interface{}:
+		if inner := strings.TrimSuffix(typ, "!"); strings.HasPrefix(inner, "[") {
+			for _, item := range value {
+				if err := e.validateValue(inner[1:len(inner)-1], item, false); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	case map[string]interface{}:
+		if t := e.schema.types[strings.TrimSuffix(typ, "!")]; t != nil && t.kind == "INPUT_OBJECT" {
+			for name, v := range value {
+				f := t.field(name)
+				if f == nil {
+					return fmt.Errorf("no field %s on %s", name, t.name)
+				}
+				if err := e.validateValue(f.typ, v, f.defaultValue != nil); err != nil {
+					return fmt.Errorf("field %s: %v", name, err)
+				}
+			}
+			for _, f := range t.fields {
+				if _, ok := value[f.name]; !ok && strings.HasSuffix(f.typ, "!") && f.defaultValue == nil {
+					return fmt.Errorf("%s needs the field %s", t.name, f.name)
+				}
+			}
+			return nil
+		}
+	}
+	_, err := e.schema.coerceLiteral(typ, literal, nil)
+	return err
+}
+
+// variableAllowed reports whether a variable of type varType can be used for a value of type typ, a
+// nullable variable for a non-null type only when a default replaces a missing value
+func variableAllowed(varType, typ string, hasDefault bool) bool {
+	if strings.HasSuffix(typ, "!") && !strings.HasSuffix(varType, "!") {
+		if !hasDefault {
+			return false
+		}
+		typ = strings.TrimSuffix(typ, "!")
+	}
+	return typeCompatible(varType, typ)
+}
+
+// typeCompatible reports whether a value of type sub is always one of type typ, e.g. Int! of Int
+func typeCompatible(sub, typ string) bool {
+	if inner := strings.TrimSuffix(typ, "!"); inner != typ {
+		return strings.HasSuffix(sub, "!") && typeCompatible(strings.TrimSuffix(sub, "!"), inner)
+	}
+	sub = strings.TrimSuffix(sub, "!")
+	if strings.HasPrefix(typ, "[") {
+		return strings.HasPrefix(sub, "[") && typeCompatible(sub[1:len(sub)-1], typ[1:len(typ)-1])
+	}
+	return sub == typ
+}
+
+// validateMerge checks that the fields selected on t under the same response key select the same
+// field with the same arguments, so that they can be merged, and that their selections can be
+// merged in turn
+func (e *gqlExecution) validateMerge(t *gqlType, selections []*gqlSelection, depth int) error {
+	if depth > gqlMaxDepth {
+		return selections[0].errorf("selections nested deeper than %d", gqlMaxDepth)
+	}
+	var keys []string
+	fields := map[string][]*gqlSelection{}
+	var collect func(selections []*gqlSelection)
+	collect = func(selections []*gqlSelection) {
+		for _, sel := range selections {
+			switch {
+			case sel.fragment != "":
+				collect(e.document.fragments[sel.fragment].selections)
+			case sel.name == "":
+				collect(sel.selections)
+			default:
+				key := sel.alias
+				if key == "" {
+					key = sel.name
+				}
+				if fields[key] == nil {
+					keys = append(keys, key)
+				}
+				fields[key] = append(fields[key], sel)
+			}
+		}
+	}
+	collect(selections)
+
+	for _, key := range keys {
+		first := fields[key][0]
+		var subselections []*gqlSelection
+		for _, sel := range fields[key] {
+			conflict := ""
+			switch {
+			case sel.name != first.name:
+				conflict = fmt.Sprintf("%s selects the fields %s and %s", key, first.name, sel.name)
+			case !sameArguments(sel.arguments, first.arguments):
+				conflict = fmt.Sprintf("%s selects the field %s with different arguments", key, sel.name)
+			}
+			if conflict != "" {
+				return &graphQLError{Message: conflict, Locations: []graphQLLocation{first.location, sel.location}}
+			}
+			subselections = append(subselections, sel.selections...)
+		}
+		if subselections != nil {
+			if err := e.validateMerge(e.schema.types[namedType(t.field(first.name).typ)], subselections, depth+1); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// sameArguments reports whether the argument literals a and b are the same, no arguments and empty
+// parentheses are
+func sameArguments(a, b map[string]interface{}) bool {
+	return (len(a) == 0 && len(b) == 0) || reflect.DeepEqual(a, b)
+}
+
+// gqlCollectedField is a response key with the field selections that are merged into it
+type gqlCollectedField struct {
+	key        string
+	selections []*gqlSelection
+}
+
+// collectFields returns the fields selected on t in order, skipping those excluded by @skip or
+// @include and expanding fragments
+func (e *gqlExecution) collectFields(t *gqlType, selections []*gqlSelection) ([]*gqlCollectedField, error) {
+	var fields []*gqlCollectedField
+	index := map[string]*gqlCollectedField{}
+	var collect func(selections []*gqlSelection) error
+	collect = func(selections []*gqlSelection) error {
+		for _, sel := range selections {
+			included, err := e.included(sel)
+			if err != nil {
+				return err
+			}
+			if !included {
+				continue
+			}
+			switch {
+			case sel.fragment != "":
+				err = collect(e.document.fragments[sel.fragment].selections)
+			case sel.name == "":
+				err = collect(sel.selections)
+			default:
+				key := sel.alias
+				if key == "" {
+					key = sel.name
+				}
+				if index[key] == nil {
+					index[key] = &gqlCollectedField{key: key}
+					fields = append(fields, index[key])
+				}
+				index[key].selections = append(index[key].selections, sel)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	err := collect(selections)
+	return fields, err
+}
+
+// included reports whether sel is selected according to its @skip and @include directives
+func (e *gqlExecution) included(sel *gqlSelection) (bool, error) {
+	for _, name := range []string{"skip", "include"} {
+		args, ok := sel.directives[name]
+		if !ok {
+			continue
+		}
+		value, err := e.schema.coerceLiteral("Boolean!", args["if"], e.variables)
+		if err != nil {
+			return false, sel.errorf("argument if of directive @%s: %v", name, err)
+		}
+		if value == (name == "skip") {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// execute runs the query or mutation, mutation fields one after another
+func (e *gqlExecution) execute() graphQLResponse {
+	return e.executeRoot(nil)
+}
+
+// executeRoot runs the selection set of the operation on source
+func (e *gqlExecution) executeRoot(source interface{}) graphQLResponse {
+	e.errors = nil
+	data, ok := e.executeSelections(e.rootType(), source, e.operation.selections, nil)
+	response := graphQLResponse{Data: data, Errors: e.errors}
+	if !ok {
+		response.Data = json.RawMessage("null")
+	}
+	return response
+}
+
+// subscribe starts the subscription of the operation, its events are run through executeRoot
+func (e *gqlExecution) subscribe() (<-chan interface{}, func(), error) {
+	root := e.rootType()
+	fields, err := e.collectFields(root, e.operation.selections)
+	if err != nil {
+		return nil, nil, err
+	}
+	field := fields[0]
+	f := root.field(field.selections[0].name)
+	if f.subscribe == nil {
+		return nil, nil, &graphQLError{Message: "field " + f.name + " can not be subscribed to"}
+	}
+	args, err := e.arguments(f, field.selections[0])
+	if err != nil {
+		return nil, nil, &graphQLError{Message: err.Error(), Path: []interface{}{field.key}}
+	}
+	return f.subscribe(e.request, args)
+}
+
+// executeSelections returns the fields selected on source of type t, ok is false when a non-null
+// field is null and source itself becomes null
+func (e *gqlExecution) executeSelections(t *gqlType, source interface{}, selections []*gqlSelection, path []interface{}) (*gqlObject, bool) {
+	object := &gqlObject{values: map[string]interface{}{}}
+	fields, err := e.collectFields(t, selections)
+	if err != nil {
+		e.errors = append(e.errors, &graphQLError{Message: err.(*graphQLError).Message, Path: path})
+		return nil, false
+	}
+	for _, field := range fields {
+		sel := field.selections[0]
+		fieldPath := append(append([]interface{}{}, path...), field.key)
+		if sel.name == "__typename" {
+			object.set(field.key, t.name)
+			continue
+		}
+		f := t.field(sel.name)
+		value, err := e.resolve(f, source, sel)
+		if err != nil {
+			e.errors = append(e.errors, &graphQLError{Message: err.Error(), Path: fieldPath})
+			if strings.HasSuffix(f.typ, "!") {
+				return nil, false
+			}
+			object.set(field.key, nil)
+			continue
+		}
+		var subselections []*gqlSelection
+		for _, sel := range field.selections {
+			subselections = append(subselections, sel.selections...)
+		}
+		completed, ok := e.complete(f.typ, subselections, value, fieldPath)
+		if !ok {
+			return nil, false
+		}
+		object.set(field.key, completed)
+	}
+	return object, true
+}
+
+func (e *gqlExecution) resolve(f *gqlField, source interface{}, sel *gqlSelection) (interface{}, error) {
+	args, err := e.arguments(f, sel)
+	if err != nil {
+		return nil, err
+	}
+	if f.resolve != nil {
+		return f.resolve(e.request, source, args)
+	}
+	return structField(source, f.name), nil
+}
+
+// arguments returns the coerced arguments of the field selection sel
+func (e *gqlExecution) arguments(f *gqlField, sel *gqlSelection) (map[string]interface{}, error) {
+	args := map[string]interface{}{}
+	for _, a := range f.args {
+		literal, ok := sel.arguments[a.name]
+		if variable, isVariable := literal.(gqlVariable); isVariable {
+			_, ok = e.variables[string(variable)]
+		}
+		var err error
+		switch {
+		case ok:
+			args[a.name], err = e.schema.coerceLiteral(a.typ, literal, e.variables)
+		case a.defaultValue != nil:
+			args[a.name] = a.defaultValue
+		case strings.HasSuffix(a.typ, "!"):
+			err = fmt.Errorf("needs a value of type %s", a.typ)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("argument %s: %v", a.name, err)
+		}
+	}
+	return args, nil
+}
+
+// structField returns the field of the struct source matching name case-insensitively
+func structField(source interface{}, name string) interface{} {
+	v := reflect.ValueOf(source)
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return nil
+		}
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return nil
+	}
+	f := v.FieldByNameFunc(func(field string) bool { return strings.EqualFold(field, name) })
+	if !f.IsValid() {
+		return nil
+	}
+	return f.Interface()
+}
+
+// complete returns value as the type typ for the response, ok is false when a non-null value is
+// null and the error has to propagate to the enclosing field
+func (e *gqlExecution) complete(typ string, selections []*gqlSelection, value interface{}, path []interface{}) (interface{}, bool) {
+	if inner := strings.TrimSuffix(typ, "!"); inner != typ {
+		completed, ok := e.completeNullable(inner, selections, value, path)
+		if ok && completed == nil {
+			e.errors = append(e.errors, &graphQLError{Message: "non-null field of type " + typ + " is null", Path: path})
+			return nil, false
+		}
+		return completed, ok
+	}
+	completed, _ := e.completeNullable(typ, selections, value, path)
+	return completed, true
+}
+
+func (e *gqlExecution) completeNullable(typ string, selections []*gqlSelection, value interface{}, path []interface{}) (interface{}, bool) {
+	v := reflect.ValueOf(value)
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return nil, true
+		}
+		v = v.Elem()
+	}
+	if !v.IsValid() {
+		return nil, true
+	}
+
+	if strings.HasPrefix(typ, "[") {
+		if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+			e.errors = append(e.errors, &graphQLError{Message: "expected a list for " + typ, Path: path})
+			return nil, true
+		}
+		items := make([]interface{}, v.Len())
+		for i := range items {
+			item, ok := e.complete(typ[1:len(typ)-1], selections, v.Index(i).Interface(), append(append([]interface{}{}, path...), i))
+			if !ok {
+				return nil, false
+			}
+			items[i] = item
+		}
+		return items, true
+	}
+
+	t := e.schema.types[typ]
+	if t.kind == "OBJECT" {
+		object, ok := e.executeSelections(t, value, selections, path)
+		if !ok {
+			return nil, false
+		}
+		return object, true
+	}
+	completed, err := serializeScalar(t, v.Interface())
+	if err != nil {
+		e.errors = append(e.errors, &graphQLError{Message: err.Error(), Path: path})
+		return nil, true
+	}
+	return completed, true
+}
+
+// serializeScalar returns value as the scalar or enum t, a zero time is null
+func serializeScalar(t *gqlType, value interface{}) (interface{}, error) {
+	if at, ok := value.(time.Time); ok {
+		if t.name != "Time" {
+			return nil, fmt.Errorf("can not serialize a time as %s", t.name)
+		}
+		if at.IsZero() {
+			return nil, nil
+		}
+		return at.UTC().Format(time.RFC3339Nano), nil
+	}
+	v := reflect.ValueOf(value)
+	switch t.name {
+	case "Int":
+		switch v.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			return v.Int(), nil
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			return v.Uint(), nil
+		}
+	case "Float":
+		switch v.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			return float64(v.Int()), nil
+		case reflect.Float32, reflect.Float64:
+			return v.Float(), nil
+		}
+	case "Boolean":
+		if v.Kind() == reflect.Bool {
+			return v.Bool(), nil
+		}
+	case "ID", "String":
+		if v.Kind() == reflect.String {
+			return v.String(), nil
+		}
+	default:
+		if t.kind == "ENUM" && v.Kind() == reflect.String {
+			return v.String(), nil
+		}
+	}
+	return nil, fmt.Errorf("can not serialize %v as %s", value, t.name)
+}
+
+func (s *gqlSchema) isInputType(typ string) bool {
+	t := s.types[namedType(typ)]
+	return t != nil && t.kind != "OBJECT"
+}
+
+// coerceLiteral returns the argument value literal as the input type typ, variables are replaced
+// by their values
+func (s *gqlSchema) coerceLiteral(typ string, literal interface{}, variables map[string]interface{}) (interface{}, error) {
+	if variable, ok := literal.(gqlVariable); ok {
+		value := variables[string(variable)]
+		if value == nil && strings.HasSuffix(typ, "!") {
+			return nil, fmt.Errorf("variable $%s is null", variable)
+		}
+		return value, nil
+	}
+	if inner := strings.TrimSuffix(typ, "!"); inner != typ {
+		if literal == nil {
+			return nil, fmt.Errorf("null for %s", typ)
+		}
+		return s.coerceLiteral(inner, literal, variables)
+	}
+	if literal == nil {
+		return nil, nil
+	}
+	if strings.HasPrefix(typ, "[") {
+		items, ok := literal.([]interface{})
+		if !ok {
+			items = []interface{}{literal}
+		}
+		coerced := make([]interface{}, len(items))
+		for i, item := range items {
+			var err error
+			coerced[i], err = s.coerceLiteral(typ[1:len(typ)-1], item, variables)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return coerced, nil
+	}
+	t := s.types[typ]
+	switch value := literal.(type) {
+	case map[string]interface{}:
+		if t.kind != "INPUT_OBJECT" {
+			break
+		}
+		return s.coerceObject(t, value, func(typ string, v interface{}) (interface{}, error) {
+			return s.coerceLiteral(typ, v, variables)
+		})
+	case gqlEnum:
+		if t.kind == "ENUM" && contains(t.values, string(value)) {
+			return string(value), nil
+		}
+		return nil, fmt.Errorf("%s is no value of %s", quoteLiteral(string(value)), typ)
+	case int64:
+		switch typ {
+		case "Int":
+			if value < math.MinInt32 || value > math.MaxInt32 {
+				return nil, fmt.Errorf("%d is out of range for Int", value)
+			}
+			return int(value), nil
+		case "Float":
+			return float64(value), nil
+		case "ID":
+			return strconv.FormatInt(value, 10), nil
+		}
+	default:
+		return s.coerceValue(typ, value)
+	}
+	return nil, fmt.Errorf("%s is no %s", quoteLiteral(literal), typ)
+}
+
+// nestedDeeper reports whether the lists and objects of the JSON value v are nested deeper than max,
+// coercion of variables follows the nesting of their values
+func nestedDeeper(v interface{}, max int) bool {
+	if max < 0 {
+		return true
+	}
+	switch v := v.(type) {
+	case []interface{}:
+		for _, item := range v {
+			if nestedDeeper(item, max-1) {
+				return true
+			}
+		}
+	case map[string]interface{}:
+		for _, item := range v {
+			if nestedDeeper(item, max-1) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// quoteLiteral returns v as quoted in an error, cut short when it is long
+func quoteLiteral(v interface{}) string {
+	const max = 40
+	quoted := fmt.Sprint(v)
+	if len(quoted) > max {
+		cut := max
+		for cut > 0 && !utf8.RuneStart(quoted[cut]) {
+			cut--
+		}
+		quoted = quoted[:cut] + "…"
+	}
+	return quoted
+}
+
+// coerceValue returns the JSON value of a variable as the input type typ
+func (s *gqlSchema) coerceValue(typ string, value interface{}) (interface{}, error) {
+	if inner := strings.TrimSuffix(typ, "!"); inner != typ {
+		if value == nil {
+			return nil, fmt.Errorf("null for %s", typ)
+		}
+		return s.coerceValue(inner, value)
+	}
+	if value == nil {
+		return nil, nil
+	}
+	if strings.HasPrefix(typ, "[") {
+		items, ok := value.([]interface{})
+		if !ok {
+			items = []interface{}{value}
+		}
+		coerced := make([]interface{}, len(items))
+		for i, item := range items {
+			var err error
+			coerced[i], err = s.coerceValue(typ[1:len(typ)-1], item)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return coerced, nil
+	}
+	t := s.types[typ]
+	switch v := value.(type) {
+	case bool:
+		if typ == "Boolean" {
+			return v, nil
+		}
+	case float64:
+		switch typ {
+		case "Int":
+			if v != math.Trunc(v) || v < math.MinInt32 || v > math.MaxInt32 {
+				return nil, fmt.Errorf("%v is no Int", v)
+			}
+			return int(v), nil
+		case "Float":
+			return v, nil
+		case "ID":
+			if v == math.Trunc(v) {
+				return strconv.FormatInt(int64(v), 10), nil
+			}
+		}
+	case string:
+		switch {
+		case typ == "String" || typ == "ID":
+			return v, nil
+		case typ == "Time":
+			at, err := time.Parse(time.RFC3339Nano, v)
+			if err != nil {
+				return nil, fmt.Errorf("%s is no RFC 3339 time", quoteLiteral(strconv.Quote(v)))
+			}
+			return at, nil
+		case t.kind == "ENUM" && contains(t.values, v):
+			return v, nil
+		}
+	case map[string]interface{}:
+		if t.kind == "INPUT_OBJECT" {
+			return s.coerceObject(t, v, s.coerceValue)
+		}
+	}
+	return nil, fmt.Errorf("%s is no %s", quoteLiteral(value), typ)
+}
+
+// coerceObject returns the fields of the input object t in value coerced by coerce, with defaults
+func (s *gqlSchema) coerceObject(t *gqlType, value map[string]interface{}, coerce func(typ string, v interface{}) (interface{}, error)) (interface{}, error) {
+	for name := range value {
+		if t.field(name) == nil {
+			return nil, fmt.Errorf("no field %s in %s", name, t.name)
+		}
+	}
+	object := map[string]interface{}{}
+	for _, f := range t.fields {
+		v, ok := value[f.name]
+		switch {
+		case ok:
+			coerced, err := coerce(f.typ, v)
+			if err != nil {
+				return nil, fmt.Errorf("%s.%s: %v", t.name, f.name, err)
+			}
+			object[f.name] = coerced
+		case f.defaultValue != nil:
+			object[f.name] = f.defaultValue
+		case strings.HasSuffix(f.typ, "!"):
+			return nil, fmt.Errorf("%s.%s is required", t.name, f.name)
+		}
+	}
+	return object, nil
+}
+
+// gqlDocument is a parsed GraphQL document
+type gqlDocument struct {
+	operations []*gqlOperation
+	fragments  map[string]*gqlFragment
+}
+
+// gqlOperation is a query, mutation or subscription of a document
+type gqlOperation struct {
+	kind       string
+	name       string
+	variables  []gqlVariableDefinition
+	selections []*gqlSelection
+}
+
+type gqlVariableDefinition struct {
+	name         string
+	typ          string
+	defaultValue interface{}
+	hasDefault   bool
+}
+
+type gqlFragment struct {
+	typeCondition string
+	selections    []*gqlSelection
+	location      graphQLLocation
+}
+
+// gqlSelection is a field, a fragment spread naming a fragment or an inline fragment, which has
+// neither a name nor a fragment
+type gqlSelection struct {
+	alias         string
+	name          string
+	arguments     map[string]interface{}
+	directives    map[string]map[string]interface{}
+	fragment      string
+	typeCondition string
+	selections    []*gqlSelection
+	location      graphQLLocation
+}
+
+func (sel *gqlSelection) errorf(format string, args ...interface{}) error {
+	return &graphQLError{Message: fmt.Sprintf(format, args...), Locations: []graphQLLocation{sel.location}}
+}
+
+// gqlVariable and gqlEnum are the values of variables and enums in a document, the other values are
+// nil, bool, int64, float64, string, []interface{} and map[string]interface{}
+type (
+	gqlVariable string
+	gqlEnum     string
+)
+
+const (
+	gqlEOF = iota
+	gqlPunctuator
+	gqlName
+	gqlInt
+	gqlFloat
+	gqlString
+)
+
+type gqlToken struct {
+	kind  int
+	value string
+	start int
+}
+
+// gqlParser parses a GraphQL document in a single pass, token is the token at pos
+type gqlParser struct {
+	source string
+	pos    int
+	token  gqlToken
+	// depth is the number of lists, objects, selection sets and types the parser is in
+	depth int
+}
+
+var gqlNumber = regexp.MustCompile(`^-?(0|[1-9][0-9]*)(\.[0-9]+)?([eE][+-]?[0-9]+)?`)
+
+// parseGraphQL parses the executable definitions of a GraphQL document
+func parseGraphQL(source string) (*gqlDocument, error) {
+	p := &gqlParser{source: source}
+	document := &gqlDocument{fragments: map[string]*gqlFragment{}}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	for p.token.kind != gqlEOF {
+		switch {
+		case p.token.kind == gqlName && p.token.value == "fragment":
+			name, fragment, err := p.fragment()
+			if err != nil {
+				return nil, err
+			}
+			if document.fragments[name] != nil {
+				return nil, p.errorf(p.token.start, "fragment %s is defined twice", name)
+			}
+			document.fragments[name] = fragment
+		case p.is(gqlPunctuator, "{") || p.token.kind == gqlName:
+			op, err := p.operation()
+			if err != nil {
+				return nil, err
+			}
+			document.operations = append(document.operations, op)
+		default:
+			return nil, p.unexpected()
+		}
+	}
+	if len(document.operations) == 0 {
+		return nil, &graphQLError{Message: "the document has no operation"}
+	}
+	return document, nil
+}
+
+func (p *gqlParser) errorf(pos int, format string, args ...interface{}) error {
+	location := graphQLLocation{1, 1}
+	for _, c := range p.source[:pos] {
+		if c == '\n' {
+			location.Line++
+			location.Column = 1
+		} else {
+			location.Column++
+		}
+	}
+	return &graphQLError{Message: "syntax error: " + fmt.Sprintf(format, args...), Locations: []graphQLLocation{location}}
+}
+
+func (p *gqlParser) unexpected() error {
+	if p.token.kind == gqlEOF {
+		return p.errorf(p.token.start, "unexpected end of document")
+	}
+	return p.errorf(p.token.start, "unexpected %s", quoteLiteral(p.source[p.token.start:p.pos]))
+}
+
+func (p *gqlParser) location() graphQLLocation {
+	err := p.errorf(p.token.start, "").(*graphQLError)
+	return err.Locations[0]
+}
+
+// enter counts the nesting of a list, object, selection set or type starting at the current token,
+// the parser has to leave it when done
+func (p *gqlParser) enter() error {
+	p.depth++
+	if p.depth > gqlMaxDepth {
+		return p.errorf(p.token.start, "nested deeper than %d", gqlMaxDepth)
+	}
+	return nil
+}
+
+func (p *gqlParser) leave() {
+	p.depth--
+}
+
+func (p *gqlParser) is(kind int, value string) bool {
+	return p.token.kind == kind && p.token.value == value
+}
+
+// skip reads past the punctuator value and reports whether it was there
+func (p *gqlParser) skip(value string) (bool, error) {
+	if !p.is(gqlPunctuator, value) {
+		return false, nil
+	}
+	return true, p.next()
+}
+
+func (p *gqlParser) expect(value string) error {
+	if p.token.kind == gqlEOF {
+		return p.unexpected()
+	}
+	if !p.is(gqlPunctuator, value) {
+		return p.errorf(p.token.start, "expected %s", value)
+	}
+	return p.next()
+}
+
+func (p *gqlParser) name() (string, error) {
+	if p.token.kind == gqlEOF {
+		return "", p.unexpected()
+	}
+	if p.token.kind != gqlName {
+		return "", p.errorf(p.token.start, "expected a name")
+	}
+	name := p.token.value
+	return name, p.next()
+}
+
+// next reads the token following the current one
+func (p *gqlParser) next() error {
+	for p.pos < len(p.source) {
+		c := p.source[p.pos]
+		if c == '#' {
+			for p.pos < len(p.source) && p.source[p.pos] != '\n' && p.source[p.pos] != '\r' {
+				p.pos++
+			}
+		} else if c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',' {
+			p.pos++
+		} else if strings.HasPrefix(p.source[p.pos:], "\ufeff") {
+			p.pos += len("\ufeff")
+		} else {
+			break
+		}
+	}
+	start := p.pos
+	if p.pos >= len(p.source) {
+		p.token = gqlToken{gqlEOF, "", start}
+		return nil
+	}
+	c := p.source[p.pos]
+	switch {
+	case strings.HasPrefix(p.source[p.pos:], "..."):
+		p.pos += 3
+		p.token = gqlToken{gqlPunctuator, "...", start}
+	case strings.IndexByte("!$&():=@[]{}|", c) >= 0:
+		p.pos++
+		p.token = gqlToken{gqlPunctuator, string(c), start}
+	case c == '_' || (c|0x20 >= 'a' && c|0x20 <= 'z'):
+		for p.pos < len(p.source) && isNameByte(p.source[p.pos]) {
+			p.pos++
+		}
+		p.token = gqlToken{gqlName, p.source[start:p.pos], start}
+	case c == '-' || (c >= '0' && c <= '9'):
+		match := gqlNumber.FindStringSubmatch(p.source[p.pos:])
+		if match == nil {
+			return p.errorf(start, "invalid number")
+		}
+		p.pos += len(match[0])
+		if p.pos < len(p.source) && (isNameByte(p.source[p.pos]) || p.source[p.pos] == '.') {
+			return p.errorf(start, "invalid number")
+		}
+		kind := gqlInt
+		if match[2] != "" || match[3] != "" {
+			kind = gqlFloat
+		}
+		p.token = gqlToken{kind, match[0], start}
+	case strings.HasPrefix(p.source[p.pos:], `"""`):
+		end := strings.Index(strings.Replace(p.source[p.pos+3:], `\"""`, "    ", -1), `"""`)
+		if end < 0 {
+			return p.errorf(start, "unterminated string")
+		}
+		raw := strings.Replace(p.source[p.pos+3:p.pos+3+end], `\"""`, `"""`, -1)
+		p.pos += end + 6
+		p.token = gqlToken{gqlString, blockString(raw), start}
+	case c == '"':
+		value, err := p.string()
+		if err != nil {
+			return err
+		}
+		p.token = gqlToken{gqlString, value, start}
+	default:
+		return p.errorf(start, "unexpected character %q", c)
+	}
+	return nil
+}
+
+func isNameByte(c byte) bool {
+	return c == '_' || (c >= '0' && c <= '9') || (c|0x20 >= 'a' && c|0x20 <= 'z')
+}
+
+// string reads a quoted string with escape sequences
+func (p *gqlParser) string() (string, error) {
+	start := p.pos
+	var b strings.Builder
+	p.pos++
+	for {
+		if p.pos >= len(p.source) || p.source[p.pos] == '\n' || p.source[p.pos] == '\r' {
+			return "", p.errorf(start, "unterminated string")
+		}
+		c := p.source[p.pos]
+		switch {
+		case c == '"':
+			p.pos++
+			return b.String(), nil
+		case c != '\\':
+			r, size := utf8.DecodeRuneInString(p.source[p.pos:])
+			b.WriteRune(r)
+			p.pos += size
+		case p.pos+1 < len(p.source) && strings.IndexByte(`"\/bfnrt`, p.source[p.pos+1]) >= 0:
+			b.WriteString(map[byte]string{'"': `"`, '\\': `\`, '/': "/", 'b': "\b", 'f': "\f", 'n': "\n", 'r': "\r", 't': "\t"}[p.source[p.pos+1]])
+			p.pos += 2
+		case strings.HasPrefix(p.source[p.pos:], `\u`) && p.pos+6 <= len(p.source):
+			code, err := strconv.ParseUint(p.source[p.pos+2:p.pos+6], 16, 16)
+			if err != nil {
+				return "", p.errorf(p.pos, "invalid escape sequence")
+			}
+			b.WriteRune(rune(code))
+			p.pos += 6
+		default:
+			return "", p.errorf(p.pos, "invalid escape sequence")
+		}
+	}
+}
+
+// blockString removes the common indentation and the leading and trailing blank lines of a block
+// string
+func blockString(raw string) string {
+	lines := strings.Split(strings.Replace(strings.Replace(raw, "\r\n", "\n", -1), "\r", "\n", -1), "\n")
+	indent := -1
+	for _, line := range lines[1:] {
+		trimmed := strings.TrimLeft(line, " \t")
+		if trimmed != "" && (indent < 0 || len(line)-len(trimmed) < indent) {
+			indent = len(line) - len(trimmed)
+		}
+	}
+	for i := 1; i < len(lines) && indent > 0; i++ {
+		if len(lines[i]) >= indent {
+			lines[i] = lines[i][indent:]
+		} else {
+			lines[i] = ""
+		}
+	}
+	for len(lines) > 0 && strings.TrimSpace(lines[0]) == "" {
+		lines = lines[1:]
+	}
+	for len(lines) > 0 && strings.TrimSpace(lines[len(lines)-1]) == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (p *gqlParser) operation() (*gqlOperation, error) {
+	op := &gqlOperation{kind: "query"}
+	if p.token.kind == gqlName {
+		if p.token.value != "query" && p.token.value != "mutation" && p.token.value != "subscription" {
+			return nil, p.unexpected()
+		}
+		op.kind = p.token.value
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		if p.token.kind == gqlName {
+			op.name = p.token.value
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+		}
+		if ok, err := p.skip("("); err != nil {
+			return nil, err
+		} else if ok {
+			for !p.is(gqlPunctuator, ")") {
+				v, err := p.variableDefinition()
+				if err != nil {
+					return nil, err
+				}
+				op.variables = append(op.variables, v)
+			}
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+		}
+		if _, err := p.directives(); err != nil {
+			return nil, err
+		}
+	}
+	var err error
+	op.selections, err = p.selectionSet()
+	return op, err
+}
+
+func (p *gqlParser) variableDefinition() (gqlVariableDefinition, error) {
+	var v gqlVariableDefinition
+	err := p.expect("$")
+	if err == nil {
+		v.name, err = p.name()
+	}
+	if err == nil {
+		err = p.expect(":")
+	}
+	if err == nil {
+		v.typ, err = p.typeReference()
+	}
+	if err != nil {
+		return v, err
+	}
+	if v.hasDefault, err = p.skip("="); err == nil && v.hasDefault {
+		v.defaultValue, err = p.value(true)
+	}
+	if err == nil {
+		_, err = p.directives()
+	}
+	return v, err
+}
+
+// typeReference reads a type like [Sensor!]! as it is written
+func (p *gqlParser) typeReference() (string, error) {
+	if err := p.enter(); err != nil {
+		return "", err
+	}
+	defer p.leave()
+	var typ string
+	if ok, err := p.skip("["); err != nil {
+		return "", err
+	} else if ok {
+		inner, err := p.typeReference()
+		if err == nil {
+			err = p.expect("]")
+		}
+		if err != nil {
+			return "", err
+		}
+		typ = "[" + inner + "]"
+	} else {
+		name, err := p.name()
+		if err != nil {
+			return "", err
+		}
+		typ = name
+	}
+	if ok, err := p.skip("!"); err != nil {
+		return "", err
+	} else if ok {
+		typ += "!"
+	}
+	return typ, nil
+}
+
+func (p *gqlParser) fragment() (string, *gqlFragment, error) {
+	fragment := &gqlFragment{location: p.location()}
+	if err := p.next(); err != nil {
+		return "", nil, err
+	}
+	name, err := p.name()
+	if err != nil {
+		return "", nil, err
+	}
+	if name == "on" || !p.is(gqlName, "on") {
+		return "", nil, p.errorf(p.token.start, "expected a fragment name and on")
+	}
+	if err := p.next(); err != nil {
+		return "", nil, err
+	}
+	fragment.typeCondition, err = p.name()
+	if err == nil {
+		_, err = p.directives()
+	}
+	if err == nil {
+		fragment.selections, err = p.selectionSet()
+	}
+	return name, fragment, err
+}
+
+func (p *gqlParser) selectionSet() ([]*gqlSelection, error) {
+	if err := p.enter(); err != nil {
+		return nil, err
+	}
+	defer p.leave()
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	var selections []*gqlSelection
+	for {
+		if ok, err := p.skip("}"); err != nil {
+			return nil, err
+		} else if ok {
+			break
+		}
+		sel, err := p.selection()
+		if err != nil {
+			return nil, err
+		}
+		selections = append(selections, sel)
+	}
+	if len(selections) == 0 {
+		return nil, p.errorf(p.token.start, "empty selection set")
+	}
+	return selections, nil
+}
+
+func (p *gqlParser) selection() (*gqlSelection, error) {
+	sel := &gqlSelection{location: p.location()}
+	var err error
+	if ok, err := p.skip("..."); err != nil {
+		return nil, err
+	} else if ok {
+		switch {
+		case p.is(gqlName, "on"):
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+			if sel.typeCondition, err = p.name(); err != nil {
+				return nil, err
+			}
+		case p.token.kind == gqlName:
+			sel.fragment, _ = p.name()
+			sel.directives, err = p.directives()
+			return sel, err
+		}
+		if sel.directives, err = p.directives(); err == nil {
+			sel.selections, err = p.selectionSet()
+		}
+		return sel, err
+	}
+
+	if sel.name, err = p.name(); err != nil {
+		return nil, err
+	}
+	if ok, err := p.skip(":"); err != nil {
+		return nil, err
+	} else if ok {
+		sel.alias = sel.name
+		if sel.name, err = p.name(); err != nil {
+			return nil, err
+		}
+	}
+	if sel.arguments, err = p.arguments(false); err != nil {
+		return nil, err
+	}
+	if sel.directives, err = p.directives(); err != nil {
+		return nil, err
+	}
+	if p.is(gqlPunctuator, "{") {
+		sel.selections, err = p.selectionSet()
+	}
+	return sel, err
+}
+
+// arguments reads the arguments in parentheses, nil when there are none
+func (p *gqlParser) arguments(constant bool) (map[string]interface{}, error) {
+	if ok, err := p.skip("("); err != nil || !ok {
+		return nil, err
+	}
+	args := map[string]interface{}{}
+	for {
+		if ok, err := p.skip(")"); err != nil {
+			return nil, err
+		} else if ok {
+			return args, nil
+		}
+		start := p.token.start
+		name, err := p.name()
+		if err == nil {
+			err = p.expect(":")
+		}
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := args[name]; ok {
+			return nil, p.errorf(start, "argument %s is given twice", name)
+		}
+		if args[name], err = p.value(constant); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// directives reads the directives of a definition or selection by name
+func (p *gqlParser) directives() (map[string]map[string]interface{}, error) {
+	var directives map[string]map[string]interface{}
+	for p.is(gqlPunctuator, "@") {
+		start := p.token.start
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		args, err := p.arguments(false)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := directives[name]; ok {
+			return nil, p.errorf(start, "directive @%s is given twice", name)
+		}
+		if directives == nil {
+			directives = map[string]map[string]interface{}{}
+		}
+		directives[name] = args
+	}
+	return directives, nil
+}
+
+// value reads a value, variables are not allowed in constant values
+func (p *gqlParser) value(constant bool) (interface{}, error) {
+	token := p.token
+	if p.is(gqlPunctuator, "[") || p.is(gqlPunctuator, "{") {
+		if err := p.enter(); err != nil {
+			return nil, err
+		}
+		defer p.leave()
+	}
+	switch token.kind {
+	case gqlPunctuator:
+		switch token.value {
+		case "$":
+			if constant {
+				return nil, p.errorf(token.start, "variables are not allowed here")
+			}
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+			name, err := p.name()
+			return gqlVariable(name), err
+		case "[":
+			list := []interface{}{}
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+			for !p.is(gqlPunctuator, "]") {
+				item, err := p.value(constant)
+				if err != nil {
+					return nil, err
+				}
+				list = append(list, item)
+			}
+			return list, p.next()
+		case "{":
+			object := map[string]interface{}{}
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+			for !p.is(gqlPunctuator, "}") {
+				name, err := p.name()
+				if err == nil {
+					err = p.expect(":")
+				}
+				if err != nil {
+					return nil, err
+				}
+				if object[name], err = p.value(constant); err != nil {
+					return nil, err
+				}
+			}
+			return object, p.next()
+		}
+	case gqlInt:
+		i, err := strconv.ParseInt(token.value, 10, 64)
+		if err != nil {
+			return nil, p.errorf(token.start, "integer out of range")
+		}
+		return i, p.next()
+	case gqlFloat:
+		f, _ := strconv.ParseFloat(token.value, 64)
+		return f, p.next()
+	case gqlString:
+		return token.value, p.next()
+	case gqlName:
+		values := map[string]interface{}{"true": true, "false": false, "null": nil}
+		value, ok := values[token.value]
+		if !ok {
+			value = gqlEnum(token.value)
+		}
+		return value, p.next()
+	}
+	return nil, p.unexpected()
+}
+
+// introspectionTypes returns the types of the __schema and __type fields, which describe s
+func (s *gqlSchema) introspectionTypes() []*gqlType {
+	resolve := func(fn func(source interface{}, args map[string]interface{}) interface{}) gqlResolver {
+		return func(r *http.Request, source interface{}, args map[string]interface{}) (interface{}, error) {
+			return fn(source, args), nil
+		}
+	}
+	// a __Type is a type reference, the wrapping types are those ending in ! and starting with [
+	typeKind := func(typ string) string {
+		switch {
+		case strings.HasSuffix(typ, "!"):
+			return "NON_NULL"
+		case strings.HasPrefix(typ, "["):
+			return "LIST"
+		}
+		return s.types[typ].kind
+	}
+	named := func(typ string) *gqlType {
+		if typeKind(typ) == "NON_NULL" || typeKind(typ) == "LIST" {
+			return nil
+		}
+		return s.types[typ]
+	}
+	field := func(name, typ string, fn func(source interface{}, args map[string]interface{}) interface{}, args ...*gqlField) *gqlField {
+		return &gqlField{name: name, typ: typ, args: args, resolve: resolve(fn)}
+	}
+	none := func(source interface{}, args map[string]interface{}) interface{} { return nil }
+	deprecated := func(source interface{}, args map[string]interface{}) interface{} { return false }
+	includeDeprecated := gqlArg("includeDeprecated", "Boolean", false, "")
+
+	return []*gqlType{
+		gqlObjectType("__Schema", "",
+			field("description", "String", none),
+			field("types", "[__Type!]!", func(source interface{}, args map[string]interface{}) interface{} {
+				var names []string
+				for name := range s.types {
+					names = append(names, name)
+				}
+				sort.Strings(names)
+				return names
+			}),
+			field("queryType", "__Type!", func(source interface{}, args map[string]interface{}) interface{} { return "Query" }),
+			field("mutationType", "__Type", func(source interface{}, args map[string]interface{}) interface{} {
+				if s.types["Mutation"] == nil {
+					return nil
+				}
+				return "Mutation"
+			}),
+			field("subscriptionType", "__Type", func(source interface{}, args map[string]interface{}) interface{} {
+				if s.types["Subscription"] == nil {
+					return nil
+				}
+				return "Subscription"
+			}),
+			field("directives", "[__Directive!]!", func(source interface{}, args map[string]interface{}) interface{} {
+				condition := []*gqlField{gqlArg("if", "Boolean!", nil, "")}
+				return []*gqlField{
+					{name: "skip", description: "Skip the field or fragment when if is true", args: condition},
+					{name: "include", description: "Only include the field or fragment when if is true", args: condition},
+				}
+			}),
+		),
+		gqlObjectType("__Type", "",
+			field("kind", "__TypeKind!", func(source interface{}, args map[string]interface{}) interface{} { return typeKind(source.(string)) }),
+			field("name", "String", func(source interface{}, args map[string]interface{}) interface{} {
+				if t := named(source.(string)); t != nil {
+					return t.name
+				}
+				return nil
+			}),
+			field("description", "String", func(source interface{}, args map[string]interface{}) interface{} {
+				if t := named(source.(string)); t != nil && t.description != "" {
+					return t.description
+				}
+				return nil
+			}),
+			field("specifiedByURL", "String", none),
+			field("fields", "[__Field!]", func(source interface{}, args map[string]interface{}) interface{} {
+				if t := named(source.(string)); t != nil && t.kind == "OBJECT" {
+					var fields []*gqlField
+					for _, f := range t.fields {
+						if !strings.HasPrefix(f.name, "__") {
+							fields = append(fields, f)
+						}
+					}
+					return fields
+				}
+				return nil
+			}, includeDeprecated),
+			field("interfaces", "[__Type!]", func(source interface{}, args map[string]interface{}) interface{} {
+				if t := named(source.(string)); t != nil && t.kind == "OBJECT" {
+					return []string{}
+				}
+				return nil
+			}),
+			field("possibleTypes", "[__Type!]", none),
+			field("enumValues", "[__EnumValue!]", func(source interface{}, args map[string]interface{}) interface{} {
+				if t := named(source.(string)); t != nil && t.kind == "ENUM" {
+					return t.values
+				}
+				return nil
+			}, includeDeprecated),
+			field("inputFields", "[__InputValue!]", func(source interface{}, args map[string]interface{}) interface{} {
+				if t := named(source.(string)); t != nil && t.kind == "INPUT_OBJECT" {
+					return t.fields
+				}
+				return nil
+			}, includeDeprecated),
+			field("ofType", "__Type", func(source interface{}, args map[string]interface{}) interface{} {
+				typ := source.(string)
+				switch typeKind(typ) {
+				case "NON_NULL":
+					return strings.TrimSuffix(typ, "!")
+				case "LIST":
+					return typ[1 : len(typ)-1]
+				}
+				return nil
+			}),
+			field("isOneOf", "Boolean", none),
+		),
+		gqlObjectType("__Field", "",
+			field("name", "String!", func(source interface{}, args map[string]interface{}) interface{} { return source.(*gqlField).name }),
+			field("description", "String", func(source interface{}, args map[string]interface{}) interface{} {
+				return optional(source.(*gqlField).description)
+			}),
+			field("args", "[__InputValue!]!", func(source interface{}, args map[string]interface{}) interface{} { return source.(*gqlField).args }, includeDeprecated),
+			field("type", "__Type!", func(source interface{}, args map[string]interface{}) interface{} { return source.(*gqlField).typ }),
+			field("isDeprecated", "Boolean!", deprecated),
+			field("deprecationReason", "String", none),
+		),
+		gqlObjectType("__InputValue", "",
+			field("name", "String!", func(source interface{}, args map[string]interface{}) interface{} { return source.(*gqlField).name }),
+			field("description", "String", func(source interface{}, args map[string]interface{}) interface{} {
+				return optional(source.(*gqlField).description)
+			}),
+			field("type", "__Type!", func(source interface{}, args map[string]interface{}) interface{} { return source.(*gqlField).typ }),
+			field("defaultValue", "String", func(source interface{}, args map[string]interface{}) interface{} {
+				f := source.(*gqlField)
+				if f.defaultValue == nil {
+					return nil
+				}
+				return printGQLValue(s.types[namedType(f.typ)], f.defaultValue)
+			}),
+			field("isDeprecated", "Boolean!", deprecated),
+			field("deprecationReason", "String", none),
+		),
+		gqlObjectType("__EnumValue", "",
+			field("name", "String!", func(source interface{}, args map[string]interface{}) interface{} { return source }),
+			field("description", "String", none),
+			field("isDeprecated", "Boolean!", deprecated),
+			field("deprecationReason", "String", none),
+		),
+		gqlObjectType("__Directive", "",
+			field("name", "String!", func(source interface{}, args map[string]interface{}) interface{} { return source.(*gqlField).name }),
+			field("description", "String", func(source interface{}, args map[string]interface{}) interface{} {
+				return source.(*gqlField).description
+			}),
+			field("isRepeatable", "Boolean!", deprecated),
+			field("locations", "[__DirectiveLocation!]!", func(source interface{}, args map[string]interface{}) interface{} {
+				return []string{"FIELD", "FRAGMENT_SPREAD", "INLINE_FRAGMENT"}
+			}),
+			field("args", "[__InputValue!]!", func(source interface{}, args map[string]interface{}) interface{} { return source.(*gqlField).args }, includeDeprecated),
+		),
+		gqlEnumType("__TypeKind", "", "SCALAR", "OBJECT", "INTERFACE", "UNION", "ENUM", "INPUT_OBJECT", "LIST", "NON_NULL"),
+		gqlEnumType("__DirectiveLocation", "", "QUERY", "MUTATION", "SUBSCRIPTION", "FIELD", "FRAGMENT_DEFINITION", "FRAGMENT_SPREAD", "INLINE_FRAGMENT", "VARIABLE_DEFINITION"),
+	}
+}
+
+// optional returns s, nil when it is empty
+func optional(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// printGQLValue returns the coerced input value v of type t as written in GraphQL
+func printGQLValue(t *gqlType, v interface{}) string {
+	switch value := v.(type) {
+	case nil:
+		return "null"
+	case string:
+		if t.kind == "ENUM" {
+			return value
+		}
+	case []interface{}:
+		var items []string
+		for _, item := range value {
+			items = append(items, printGQLValue(t, item))
+		}
+		return "[" + strings.Join(items, ", ") + "]"
+	}
+	encoded, _ := json.Marshal(v)
+	return string(encoded)
+}
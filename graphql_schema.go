@@ -0,0 +1,595 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// graphQLMaxBody is the size limit of the body of a GraphQL request
+const graphQLMaxBody = 1 << 20
+
+// changeFeedBuffer is the number of changes a subscriber may fall behind before it is dropped
+const changeFeedBuffer = 64
+
+// changeFeed is a ChangeListener passing changed sensors and switches on to the subscriptions of the
+// GraphQL API
+type changeFeed struct {
+	mutex       sync.Mutex
+	subscribers map[*changeSubscriber]bool
+	closed      bool
+}
+
+type changeSubscriber struct {
+	accept  func(change interface{}) bool
+	changes chan interface{}
+}
+
+func newChangeFeed() *changeFeed {
+	return &changeFeed{subscribers: map[*changeSubscriber]bool{}}
+}
+
+// subscribe returns the changes accepted by accept, a Sensor or a Switch each, and a function to end
+// the subscription; the channel is closed when the subscriber falls behind or the feed is closed
+func (f *changeFeed) subscribe(accept func(change interface{}) bool) (<-chan interface{}, func()) {
+	s := &changeSubscriber{accept: accept, changes: make(chan interface{}, changeFeedBuffer)}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.closed {
+		close(s.changes)
+	} else {
+		f.subscribers[s] = true
+	}
+	return s.changes, func() { f.unsubscribe(s) }
+}
+
+func (f *changeFeed) unsubscribe(s *changeSubscriber) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.subscribers[s] {
+		delete(f.subscribers, s)
+		close(s.changes)
+	}
+}
+
+// publish passes change on to the subscribers accepting it, which are asked outside the lock as
+// publish runs on the write path of the store
+func (f *changeFeed) publish(change interface{}) {
+	f.mutex.Lock()
+	subscribers := make([]*changeSubscriber, 0, len(f.subscribers))
+	for s := range f.subscribers {
+		subscribers = append(subscribers, s)
+	}
+	f.mutex.Unlock()
+
+	var accepted []*changeSubscriber
+	for _, s := range subscribers {
+		if s.accept(change) {
+			accepted = append(accepted, s)
+		}
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for _, s := range accepted {
+		if !f.subscribers[s] {
+			continue
+		}
+		select {
+		case s.changes <- change:
+		default:
+			delete(f.subscribers, s)
+			close(s.changes)
+		}
+	}
+}
+
+// close ends all subscriptions, for the server to shut down
+func (f *changeFeed) close() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.closed = true
+	for s := range f.subscribers {
+		delete(f.subscribers, s)
+		close(s.changes)
+	}
+}
+
+func (f *changeFeed) sensorChanged(s Sensor, l *slog.Logger) {
+	f.publish(s)
+}
+
+func (f *changeFeed) switchChanged(s Switch, l *slog.Logger) {
+	f.publish(s)
+}
+
+// graphQLSchema returns the schema of /api/graphql, its resolvers apply the same authorization as the
+// REST API
+func (h *HivemindServer) graphQLSchema() *gqlSchema {
+	field := func(name, typ, description string, fn gqlResolver, args ...*gqlField) *gqlField {
+		return &gqlField{name: name, typ: typ, description: description, resolve: fn, args: args}
+	}
+	plain := func(name, typ string) *gqlField {
+		return &gqlField{name: name, typ: typ}
+	}
+	order := []*gqlField{
+		gqlArg("orderBy", "RecordOrder", "ID", "Field to sort by"),
+		gqlArg("descending", "Boolean", false, "Reverse the order"),
+		gqlArg("first", "Int", nil, "Return at most this many, all when missing"),
+	}
+
+	return newGQLSchema(
+		gqlObjectType("Query", "",
+			field("sensors", "[Sensor!]!", "Sensors matching filter", h.resolveSensors,
+				append([]*gqlField{gqlArg("filter", "SensorFilter", nil, "")}, order...)...),
+			field("sensor", "Sensor", "A sensor, null when it does not exist", h.resolveSensor,
+				gqlArg("id", "ID!", nil, "")),
+			field("switches", "[Switch!]!", "Switches matching filter", h.resolveSwitches,
+				append([]*gqlField{gqlArg("filter", "SwitchFilter", nil, "")}, order...)...),
+			field("switch", "Switch", "A switch, null when it does not exist", h.resolveSwitch,
+				gqlArg("id", "ID!", nil, "")),
+			field("devices", "[Device!]!", "Enrolled devices, for administrators", h.resolveDevices,
+				gqlArg("status", "DeviceStatus", nil, "Only devices with this status")),
+			field("device", "Device", "A device, null when it does not exist", h.resolveDevice,
+				gqlArg("id", "ID!", nil, "")),
+		),
+		gqlObjectType("Mutation", "",
+			field("setSwitch", "Switch!", "Turn a switch on or off", h.resolveSetSwitch,
+				gqlArg("id", "ID!", nil, ""), gqlArg("state", "Boolean!", nil, "")),
+			field("toggleSwitch", "Switch!", "Turn a switch on when it is off and off when it is on", h.resolveToggleSwitch,
+				gqlArg("id", "ID!", nil, "")),
+		),
+		gqlObjectType("Subscription", "",
+			&gqlField{name: "sensorChanged", typ: "Sensor!", description: "Sensors as they change",
+				args:      []*gqlField{gqlArg("ids", "[ID!]", nil, "Only these sensors, all when missing")},
+				subscribe: h.subscribeChanges("sensor"), resolve: resolveChange},
+			&gqlField{name: "switchChanged", typ: "Switch!", description: "Switches as they change",
+				args:      []*gqlField{gqlArg("ids", "[ID!]", nil, "Only these switches, all when missing")},
+				subscribe: h.subscribeChanges("switch"), resolve: resolveChange},
+		),
+		gqlObjectType("Sensor", "",
+			plain("id", "ID!"), plain("name", "String!"), plain("unit", "String!"), plain("type", "String!"),
+			plain("value", "Int!"), plain("revision", "Int!"), plain("updated", "Time"),
+			field("history", "[Reading!]!", "Readings of the sensor in time order, of the last day unless since is given, starting with the value the sensor had at since", h.resolveHistory,
+				gqlArg("since", "Time", nil, ""), gqlArg("until", "Time", nil, ""),
+				gqlArg("last", "Int", nil, "Return only the last readings")),
+		),
+		gqlObjectType("Reading", "A value a sensor had from time on", plain("time", "Time!"), plain("value", "Int!")),
+		gqlObjectType("Switch", "",
+			plain("id", "ID!"), plain("name", "String!"), plain("type", "String!"), plain("state", "Boolean!"),
+			plain("revision", "Int!"), plain("updated", "Time"),
+		),
+		gqlObjectType("Device", "",
+			plain("id", "ID!"), plain("name", "String!"),
+			field("status", "DeviceStatus!", "", func(r *http.Request, source interface{}, args map[string]interface{}) (interface{}, error) {
+				return strings.ToUpper(source.(Device).Status), nil
+			}),
+			plain("serial", "String"), plain("requested", "Time"), plain("approved", "Time"), plain("revoked", "Time"),
+			field("sensors", "[Sensor!]!", "The sensors the device may write", h.resolveDeviceSensors),
+		),
+		gqlInputType("SensorFilter", "Sensors matching all given fields",
+			gqlArg("ids", "[ID!]", nil, ""), gqlArg("type", "String", nil, ""), gqlArg("unit", "String", nil, ""),
+			gqlArg("nameContains", "String", nil, "Case-insensitive part of the name"),
+			gqlArg("minValue", "Int", nil, ""), gqlArg("maxValue", "Int", nil, ""),
+			gqlArg("updatedSince", "Time", nil, ""),
+		),
+		gqlInputType("SwitchFilter", "Switches matching all given fields",
+			gqlArg("ids", "[ID!]", nil, ""), gqlArg("type", "String", nil, ""),
+			gqlArg("nameContains", "String", nil, "Case-insensitive part of the name"),
+			gqlArg("state", "Boolean", nil, ""), gqlArg("updatedSince", "Time", nil, ""),
+		),
+		gqlEnumType("RecordOrder", "", "ID", "NAME", "VALUE", "UPDATED"),
+		gqlEnumType("DeviceStatus", "", "PENDING", "APPROVED", "REVOKED"),
+	)
+}
+
+// recordQuery returns the query of the sensors or switches of kind listed by a field with args
+func (h *HivemindServer) recordQuery(r *http.Request, kind string, args map[string]interface{}) (pageQuery, int, error) {
+	orderBy, ok := args["orderBy"].(string)
+	if !ok {
+		orderBy = "ID"
+	}
+	q := pageQuery{Sort: strings.ToLower(orderBy), Descending: args["descending"] == true}
+	ids := idList(filterArg(args, "ids"))
+	q.Include = func(id string) bool {
+		return (ids == nil || contains(ids, id)) && h.authorized(r, kind, id, readAccess)
+	}
+	first, ok := args["first"].(int)
+	if !ok {
+		first = -1
+	} else if first < 0 {
+		return q, 0, errors.New("first must not be negative")
+	}
+	return q, first, nil
+}
+
+// filterArg returns the field name of the filter argument, nil when it is not given
+func filterArg(args map[string]interface{}, name string) interface{} {
+	filter, _ := args["filter"].(map[string]interface{})
+	return filter[name]
+}
+
+// idList returns the IDs of a [ID!] argument, nil when it is not given
+func idList(v interface{}) []string {
+	items, ok := v.([]interface{})
+	if !ok {
+		return nil
+	}
+	list := []string{}
+	for _, item := range items {
+		list = append(list, item.(string))
+	}
+	return list
+}
+
+// matchesFilter reports whether the name and updated time of a record match the filter in args
+func matchesFilter(args map[string]interface{}, recordType, name string, updated time.Time) bool {
+	if t, ok := filterArg(args, "type").(string); ok && t != recordType {
+		return false
+	}
+	if part, ok := filterArg(args, "nameContains").(string); ok && !strings.Contains(strings.ToLower(name), strings.ToLower(part)) {
+		return false
+	}
+	if since, ok := filterArg(args, "updatedSince").(time.Time); ok && updated.Before(since) {
+		return false
+	}
+	return true
+}
+
+func (h *HivemindServer) resolveSensors(r *http.Request, source interface{}, args map[string]interface{}) (interface{}, error) {
+	q, first, err := h.recordQuery(r, "sensor", args)
+	if err != nil {
+		return nil, err
+	}
+	sensors, _, err := h.store.listSensors(q)
+	if err != nil {
+		return nil, err
+	}
+	matching := []Sensor{}
+	for _, s := range sensors {
+		if unit, ok := filterArg(args, "unit").(string); ok && unit != s.Unit {
+			continue
+		}
+		if min, ok := filterArg(args, "minValue").(int); ok && s.Value < min {
+			continue
+		}
+		if max, ok := filterArg(args, "maxValue").(int); ok && s.Value > max {
+			continue
+		}
+		if matchesFilter(args, s.Type, s.Name, s.Updated) && len(matching) != first {
+			matching = append(matching, s)
+		}
+	}
+	return matching, nil
+}
+
+func (h *HivemindServer) resolveSensor(r *http.Request, source interface{}, args map[string]interface{}) (interface{}, error) {
+	id := args["id"].(string)
+	if !h.authorized(r, "sensor", id, readAccess) {
+		return nil, fmt.Errorf("sensor %s: %s", id, strings.ToLower(http.StatusText(http.StatusForbidden)))
+	}
+	s, err := h.store.getSensor(id)
+	if errors.Is(err, ErrNotFound) {
+		return nil, nil
+	}
+	return s, err
+}
+
+func (h *HivemindServer) resolveSwitches(r *http.Request, source interface{}, args map[string]interface{}) (interface{}, error) {
+	q, first, err := h.recordQuery(r, "switch", args)
+	if err != nil {
+		return nil, err
+	}
+	switches, _, err := h.store.listSwitches(q)
+	if err != nil {
+		return nil, err
+	}
+	matching := []Switch{}
+	for _, s := range switches {
+		if state, ok := filterArg(args, "state").(bool); ok && state != s.State {
+			continue
+		}
+		if matchesFilter(args, s.Type, s.Name, s.Updated) && len(matching) != first {
+			matching = append(matching, s)
+		}
+	}
+	return matching, nil
+}
+
+func (h *HivemindServer) resolveSwitch(r *http.Request, source interface{}, args map[string]interface{}) (interface{}, error) {
+	id := args["id"].(string)
+	if !h.authorized(r, "switch", id, readAccess) {
+		return nil, fmt.Errorf("switch %s: %s", id, strings.ToLower(http.StatusText(http.StatusForbidden)))
+	}
+	s, err := h.store.getSwitch(id)
+	if errors.Is(err, ErrNotFound) {
+		return nil, nil
+	}
+	return s, err
+}
+
+// checkDevices fails unless devices are managed and the caller of r is an administrator
+func (h *HivemindServer) checkDevices(r *http.Request) error {
+	if h.devices == nil {
+		return errors.New("devices are not managed by this server")
+	}
+	if i, ok := identityFromRequest(r); ok && !i.hasScope(scopeAdmin) {
+		return errors.New("devices need the scope " + scopeAdmin)
+	}
+	return nil
+}
+
+func (h *HivemindServer) resolveDevices(r *http.Request, source interface{}, args map[string]interface{}) (interface{}, error) {
+	if err := h.checkDevices(r); err != nil {
+		return nil, err
+	}
+	status, filtered := args["status"].(string)
+	devices := []Device{}
+	for _, d := range h.devices.getAllDevices() {
+		if !filtered || d.Status == strings.ToLower(status) {
+			devices = append(devices, d)
+		}
+	}
+	return devices, nil
+}
+
+func (h *HivemindServer) resolveDevice(r *http.Request, source interface{}, args map[string]interface{}) (interface{}, error) {
+	if err := h.checkDevices(r); err != nil {
+		return nil, err
+	}
+	d, err := h.devices.getDevice(args["id"].(string))
+	if errors.Is(err, ErrNotFound) {
+		return nil, nil
+	}
+	return d, err
+}
+
+// resolveDeviceSensors returns the existing sensors of a device the caller of r may read
+func (h *HivemindServer) resolveDeviceSensors(r *http.Request, source interface{}, args map[string]interface{}) (interface{}, error) {
+	sensors := []Sensor{}
+	for _, id := range source.(Device).Sensors {
+		if !h.authorized(r, "sensor", id, readAccess) {
+			continue
+		}
+		s, err := h.store.getSensor(id)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		sensors = append(sensors, s)
+	}
+	return sensors, nil
+}
+
+func (h *HivemindServer) resolveHistory(r *http.Request, source interface{}, args map[string]interface{}) (interface{}, error) {
+	if h.history == nil {
+		return nil, errors.New("no reading history is kept")
+	}
+	until, ok := args["until"].(time.Time)
+	if !ok {
+		until = time.Now().UTC()
+	}
+	since, ok := args["since"].(time.Time)
+	if !ok {
+		since = until.Add(-24 * time.Hour)
+	}
+	readings, err := h.history.getReadings(source.(Sensor).ID, since, until)
+	if err != nil {
+		return nil, err
+	}
+	if last, ok := args["last"].(int); ok && last >= 0 && last < len(readings) {
+		readings = readings[len(readings)-last:]
+	}
+	return readings, nil
+}
+
+// updateSwitchState changes the state of the existing switch id to the result of state
+func (h *HivemindServer) updateSwitchState(r *http.Request, id string, state func(current bool) bool) (interface{}, error) {
+	if !h.authorized(r, "switch", id, writeAccess) {
+		return nil, fmt.Errorf("switch %s: %s", id, strings.ToLower(http.StatusText(http.StatusForbidden)))
+	}
+	return h.storeFor(r).updateSwitch(id, func(s *Switch) error {
+		s.State = state(s.State)
+		return nil
+	})
+}
+
+func (h *HivemindServer) resolveSetSwitch(r *http.Request, source interface{}, args map[string]interface{}) (interface{}, error) {
+	return h.updateSwitchState(r, args["id"].(string), func(bool) bool { return args["state"].(bool) })
+}
+
+func (h *HivemindServer) resolveToggleSwitch(r *http.Request, source interface{}, args map[string]interface{}) (interface{}, error) {
+	return h.updateSwitchState(r, args["id"].(string), func(current bool) bool { return !current })
+}
+
+// subscribeChanges returns the subscription to the changed sensors or switches of kind the caller may
+// read
+func (h *HivemindServer) subscribeChanges(kind string) func(r *http.Request, args map[string]interface{}) (<-chan interface{}, func(), error) {
+	return func(r *http.Request, args map[string]interface{}) (<-chan interface{}, func(), error) {
+		if h.changes == nil {
+			return nil, nil, errors.New("subscriptions are not supported by this server")
+		}
+		ids := idList(args["ids"])
+		changes, cancel := h.changes.subscribe(func(change interface{}) bool {
+			var id string
+			switch c := change.(type) {
+			case Sensor:
+				if kind != "sensor" {
+					return false
+				}
+				id = c.ID
+			case Switch:
+				if kind != "switch" {
+					return false
+				}
+				id = c.ID
+			}
+			return ids == nil || contains(ids, id)
+		})
+		return h.authorizeChanges(r, kind, changes, cancel)
+	}
+}
+
+// subscriptionRecheck is how often the credentials of an idle subscription are checked again
+var subscriptionRecheck = time.Minute
+
+// authorizeChanges passes on the changes of kind the caller of r may read, off the write path of the
+// store; the identity of r is resolved again for every change and every subscriptionRecheck, the
+// subscription ends once its credentials are revoked
+func (h *HivemindServer) authorizeChanges(r *http.Request, kind string, changes <-chan interface{}, cancel func()) (<-chan interface{}, func(), error) {
+	authorized := make(chan interface{})
+	done := make(chan struct{})
+	recheck := time.NewTicker(subscriptionRecheck)
+	go func() {
+		defer close(authorized)
+		defer recheck.Stop()
+		for {
+			var change interface{}
+			select {
+			case c, ok := <-changes:
+				if !ok {
+					return
+				}
+				change = c
+			case <-recheck.C:
+			case <-done:
+				return
+			}
+			current, err := h.reidentify(r)
+			if err != nil {
+				requestLogger(r).Info("subscription ended", "error", err)
+				cancel()
+				return
+			}
+			if change == nil || !h.authorized(current, kind, recordID(change), readAccess) {
+				continue
+			}
+			select {
+			case authorized <- change:
+			case <-done:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return authorized, func() {
+		once.Do(func() {
+			close(done)
+			cancel()
+		})
+	}, nil
+}
+
+// recordID returns the ID of the changed Sensor or Switch
+func recordID(change interface{}) string {
+	switch c := change.(type) {
+	case Sensor:
+		return c.ID
+	case Switch:
+		return c.ID
+	}
+	return ""
+}
+
+// resolveChange resolves a subscription field to the change it is executed for
+func resolveChange(r *http.Request, source interface{}, args map[string]interface{}) (interface{}, error) {
+	return source, nil
+}
+
+// apiGraphQLHandler runs GraphQL requests, queries by GET or POST and mutations by POST; subscriptions
+// are streamed as server-sent events to requests accepting text/event-stream
+func (h *HivemindServer) apiGraphQLHandler(w http.ResponseWriter, r *http.Request) {
+	var req graphQLRequest
+	switch r.Method {
+	case http.MethodGet:
+		query := r.URL.Query()
+		req.Query, req.OperationName = query.Get("query"), query.Get("operationName")
+		if variables := query.Get("variables"); variables != "" {
+			if err := json.Unmarshal([]byte(variables), &req.Variables); err != nil {
+				writeProblem(w, r, http.StatusBadRequest, "variables: "+err.Error())
+				return
+			}
+		}
+	case http.MethodPost:
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, graphQLMaxBody))
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeProblem(w, r, http.StatusRequestEntityTooLarge, fmt.Sprintf("a GraphQL request has at most %d bytes", graphQLMaxBody))
+			return
+		}
+		if err := json.Unmarshal(body, &req); err != nil {
+			writeError(w, r, err)
+			return
+		}
+	default:
+		writeMethodNotAllowed(w, r, http.MethodGet, http.MethodPost)
+		return
+	}
+	if req.Query == "" {
+		writeProblem(w, r, http.StatusBadRequest, "query is missing")
+		return
+	}
+
+	execution, err := h.schema.prepare(r, req)
+	if err != nil {
+		writeGraphQL(w, graphQLResponse{Errors: []*graphQLError{err.(*graphQLError)}})
+		return
+	}
+	switch kind := execution.operation.kind; {
+	case kind == "mutation" && r.Method != http.MethodPost:
+		writeMethodNotAllowed(w, r, http.MethodPost)
+	case kind == "subscription" && !strings.Contains(r.Header.Get("Accept"), "text/event-stream"):
+		writeProblem(w, r, http.StatusNotAcceptable, "subscriptions are streamed as text/event-stream")
+	case kind == "subscription":
+		h.streamGraphQL(w, r, execution)
+	default:
+		writeGraphQL(w, execution.execute())
+	}
+}
+
+func writeGraphQL(w http.ResponseWriter, response graphQLResponse) {
+	w.Header().Set("content-type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// streamGraphQL sends the result for every event of the subscription as a next event until the client
+// goes away or the subscription ends, which is announced by a complete event
+func (h *HivemindServer) streamGraphQL(w http.ResponseWriter, r *http.Request, execution *gqlExecution) {
+	events, cancel, err := execution.subscribe()
+	if err != nil {
+		writeGraphQL(w, graphQLResponse{Errors: []*graphQLError{{Message: err.Error()}}})
+		return
+	}
+	defer cancel()
+
+	controller := http.NewResponseController(w)
+	w.Header().Set("content-type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	controller.Flush()
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				fmt.Fprint(w, "event: complete\ndata:\n\n")
+				controller.Flush()
+				return
+			}
+			data, _ := json.Marshal(execution.executeRoot(event))
+			fmt.Fprintf(w, "event: next\ndata: %s\n\n", data)
+			if controller.Flush() != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,460 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestGraphQL(t *testing.T) {
+	updated := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	stub := StubHivemindStore{
+		map[string]Sensor{
+			"kitchen": Sensor{ID: "kitchen", Name: "Kitchen", Unit: "C", Type: "temperature", Value: 21, Revision: 3, Updated: updated},
+			"cellar":  Sensor{ID: "cellar", Name: "Cellar", Unit: "C", Type: "temperature", Value: 12, Revision: 1, Updated: updated},
+			"window":  Sensor{ID: "window", Name: "Window", Type: "contact", Value: 1, Revision: 1},
+		},
+		map[string]Switch{
+			"lamp":   Switch{ID: "lamp", Name: "Lamp", Type: "light"},
+			"boiler": Switch{ID: "boiler", Name: "Boiler", Type: "generic", State: true},
+		},
+	}
+	store := NotifyingHivemindStore{HivemindStore: &stub}
+	changes := newChangeFeed()
+	store.addListener(changes)
+	history := &stubHistoryStore{readings: map[string][]Reading{"kitchen": {
+		{updated.Add(-2 * time.Hour), 19},
+		{updated.Add(-time.Hour), 20},
+		{updated, 21},
+	}}}
+	devices := newStubDeviceStore()
+	devices.storeDevice(Device{ID: "esp", Name: "ESP", Sensors: []string{"kitchen", "gone"}, Status: deviceApproved})
+	devices.storeDevice(Device{ID: "new", Name: "New", Status: devicePending})
+	server := NewHivemindServer(&store)
+	server.changes = changes
+	server.history = history
+	server.devices = devices
+
+	query := func(t *testing.T, query string, variables map[string]interface{}) string {
+		t.Helper()
+		body, _ := json.Marshal(graphQLRequest{Query: query, Variables: variables})
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, newPostRequest("api/graphql", strings.NewReader(string(body))))
+
+		assertResponseCode(t, response.Code, http.StatusOK)
+		assertContentType(t, response.Header().Get("content-type"), "application/json")
+		return strings.TrimSpace(response.Body.String())
+	}
+
+	t.Run("query several resources in one request", func(t *testing.T) {
+		got := query(t, `{
+			sensor(id: "kitchen") { id value updated }
+			switches(orderBy: NAME) { id state }
+		}`, nil)
+
+		assertBody(t, got, `{"data":{"sensor":{"id":"kitchen","value":21,"updated":"2026-10-18T12:00:00Z"},"switches":[{"id":"boiler","state":true},{"id":"lamp","state":false}]}}`)
+	})
+
+	t.Run("filter and order sensors with variables", func(t *testing.T) {
+		got := query(t, `query Warm($min: Int, $first: Int) {
+			sensors(filter: {type: "temperature", minValue: $min}, orderBy: VALUE, descending: true, first: $first) { id }
+		}`, map[string]interface{}{"min": 10, "first": 1})
+
+		assertBody(t, got, `{"data":{"sensors":[{"id":"kitchen"}]}}`)
+	})
+
+	t.Run("resolve aliases, fragments, directives and __typename", func(t *testing.T) {
+		got := query(t, `query ($brief: Boolean!) {
+			warm: sensor(id: "kitchen") { ...names }
+			cold: sensor(id: "cellar") { ...names unit @skip(if: $brief) }
+			missing: sensor(id: "attic") { id }
+		}
+		fragment names on Sensor { __typename ... on Sensor { name } }`, map[string]interface{}{"brief": true})
+
+		assertBody(t, got, `{"data":{"warm":{"__typename":"Sensor","name":"Kitchen"},"cold":{"__typename":"Sensor","name":"Cellar"},"missing":null}}`)
+	})
+
+	t.Run("return the history of a sensor", func(t *testing.T) {
+		got := query(t, `{ sensor(id: "kitchen") { history(since: "2026-10-18T10:30:00Z", until: "2026-10-18T12:00:00Z", last: 1) { time value } } }`, nil)
+
+		assertBody(t, got, `{"data":{"sensor":{"history":[{"time":"2026-10-18T12:00:00Z","value":21}]}}}`)
+	})
+
+	t.Run("return devices with their sensors by status", func(t *testing.T) {
+		got := query(t, `{ devices(status: APPROVED) { id status sensors { id } } }`, nil)
+
+		assertBody(t, got, `{"data":{"devices":[{"id":"esp","status":"APPROVED","sensors":[{"id":"kitchen"}]}]}}`)
+	})
+
+	t.Run("set and toggle switches", func(t *testing.T) {
+		got := query(t, `mutation { on: setSwitch(id: "lamp", state: true) { state } off: toggleSwitch(id: "boiler") { state } }`, nil)
+
+		assertBody(t, got, `{"data":{"on":{"state":true},"off":{"state":false}}}`)
+		assertSwitch(t, stub.switches["lamp"], Switch{ID: "lamp", Name: "Lamp", Type: "light", State: true})
+	})
+
+	t.Run("return the error of a field with its path and null its parent", func(t *testing.T) {
+		got := query(t, `mutation { setSwitch(id: "garage", state: true) { state } }`, nil)
+
+		assertBody(t, got, `{"data":null,"errors":[{"message":"switch garage: not found","path":["setSwitch"]}]}`)
+	})
+
+	t.Run("reject unknown fields before execution", func(t *testing.T) {
+		got := query(t, `{
+  sensor(id: "kitchen") { colour }
+}`, nil)
+
+		assertBody(t, got, `{"errors":[{"message":"no field colour on type Sensor","locations":[{"line":2,"column":27}]}]}`)
+	})
+
+	t.Run("reject documents breaking the validation rules before execution", func(t *testing.T) {
+		cases := []struct{ query, message string }{
+			{`{ a: sensors { id } a: switches { id } }`, "a selects the fields sensors and switches"},
+			{`{ s: sensor(id: "kitchen") { id } s: sensor(id: "cellar") { id } }`, "s selects the field sensor with different arguments"},
+			{`{ sensor(id: "kitchen") { v: value ...on Sensor { v: name } } }`, "v selects the fields value and name"},
+			{`{ sensors { id @include } }`, "directive @include needs the argument if"},
+			{`{ sensors { id @skip(if: "yes") } }`, "argument if of directive @skip: yes is no Boolean"},
+			{`{ sensors { id @include(if: true, unless: false) } }`, "no argument unless on directive @include"},
+			{`{ sensors { id @defer } }`, "no directive @defer"},
+			{`{ sensors { id @skip(if: true) @skip(if: false) } }`, "syntax error: directive @skip is given twice"},
+			{`query ($on: Boolean) { sensors { id @include(if: $on) } }`, "argument if of directive @include: variable $on of type Boolean can not be used as Boolean!"},
+			{`{ sensors { id @include(if: $on) } }`, "argument if of directive @include: variable $on is not defined"},
+			{`query ($id: ID!, $unit: String) { sensor(id: $id) { id } }`, "variable $unit is not used"},
+			{`query ($id: ID!, $id: ID!) { sensor(id: $id) { id } }`, "variable $id is defined twice"},
+			{`query ($first: Int = "ten") { sensors(first: $first) { id } }`, "variable $first: default value: ten is no Int"},
+			{`{ sensor(id: "kitchen") { id } } fragment names on Sensor { name }`, "fragment names is not used"},
+			{`{ sensor(id: "kitchen") { ...a } } fragment a on Sensor { ...b } fragment b on Sensor { ...a }`, "fragment a spreads itself"},
+			{`{ sensors(first: "ten") { id } }`, "argument first of field Query.sensors: ten is no Int"},
+			{`{ sensors(filter: {colour: "red"}) { id } }`, "argument filter of field Query.sensors: no field colour on SensorFilter"},
+			{`query A { sensors { id } } query A { switches { id } }`, "operation A is defined twice"},
+			{`{ sensors { id } } query B { switches { id } }`, "an anonymous operation has to be the only one of the document"},
+		}
+		for _, c := range cases {
+			var response graphQLResponse
+			json.Unmarshal([]byte(query(t, c.query, nil)), &response)
+			if response.Data != nil || len(response.Errors) != 1 || response.Errors[0].Message != c.message {
+				t.Errorf("got %v for %s, want the error %q", response.Errors, c.query, c.message)
+			}
+		}
+	})
+
+	t.Run("reject values, selections and types nested too deeply", func(t *testing.T) {
+		deep := strings.Repeat("[", 200000)
+		var nested interface{} = "kitchen"
+		for i := 0; i < 100; i++ {
+			nested = []interface{}{nested}
+		}
+		cases := []struct {
+			query     string
+			variables map[string]interface{}
+			message   string
+		}{
+			{`{ sensors(filter: {ids: ` + deep + `}) { id } }`, nil, "syntax error: nested deeper than 64"},
+			{strings.Repeat("{ sensors ", 100) + strings.Repeat("}", 100), nil, "syntax error: nested deeper than 64"},
+			{`query ($ids: ` + deep + `) { sensors { id } }`, nil, "syntax error: nested deeper than 64"},
+			{`query ($ids: [ID!]) { sensors(filter: {ids: $ids}) { id } }`, map[string]interface{}{"ids": nested}, "variable $ids: nested deeper than 64"},
+		}
+
+		for _, c := range cases {
+			var response graphQLResponse
+			json.Unmarshal([]byte(query(t, c.query, c.variables)), &response)
+			if len(response.Errors) != 1 || response.Errors[0].Message != c.message {
+				t.Errorf("got %v, want the error %q", response.Errors, c.message)
+			}
+		}
+	})
+
+	t.Run("quote long literals in errors cut short", func(t *testing.T) {
+		got := query(t, `{ sensors(first: "`+strings.Repeat("x", 1000)+`") { id } }`, nil)
+
+		assertBody(t, got, `{"errors":[{"message":"argument first of field Query.sensors: `+strings.Repeat("x", 40)+`… is no Int","locations":[{"line":1,"column":3}]}]}`)
+	})
+
+	t.Run("return status 413 on a request body above the limit", func(t *testing.T) {
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, newPostRequest("api/graphql", strings.NewReader(`{"query": "`+strings.Repeat("[", graphQLMaxBody)+`"}`)))
+
+		assertResponseCode(t, response.Code, http.StatusRequestEntityTooLarge)
+	})
+
+	t.Run("merge fields selected under the same response key", func(t *testing.T) {
+		got := query(t, `{ s: sensor(id: "kitchen") { id } s: sensor(id: "kitchen") { ...on Sensor { name } } }`, nil)
+
+		assertBody(t, got, `{"data":{"s":{"id":"kitchen","name":"Kitchen"}}}`)
+	})
+
+	t.Run("report syntax errors with their location", func(t *testing.T) {
+		got := query(t, `{ sensors { id }`, nil)
+
+		assertBody(t, got, `{"errors":[{"message":"syntax error: unexpected end of document","locations":[{"line":1,"column":17}]}]}`)
+	})
+
+	t.Run("describe the schema by introspection", func(t *testing.T) {
+		got := query(t, `{ __type(name: "SwitchFilter") { kind inputFields { name type { kind ofType { name } } } } }`, nil)
+
+		assertBody(t, got, `{"data":{"__type":{"kind":"INPUT_OBJECT","inputFields":[`+
+			`{"name":"ids","type":{"kind":"LIST","ofType":{"name":null}}},`+
+			`{"name":"type","type":{"kind":"SCALAR","ofType":null}},`+
+			`{"name":"nameContains","type":{"kind":"SCALAR","ofType":null}},`+
+			`{"name":"state","type":{"kind":"SCALAR","ofType":null}},`+
+			`{"name":"updatedSince","type":{"kind":"SCALAR","ofType":null}}]}}}`)
+	})
+
+	t.Run("run queries by GET", func(t *testing.T) {
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, newGetRequest("api/graphql?query="+url.QueryEscape(`query ($id: ID!) { switch(id: $id) { name } }`)+"&variables="+url.QueryEscape(`{"id": "lamp"}`)))
+
+		assertResponseCode(t, response.Code, http.StatusOK)
+		assertBody(t, strings.TrimSpace(response.Body.String()), `{"data":{"switch":{"name":"Lamp"}}}`)
+	})
+
+	t.Run("return status 405 on mutations by GET", func(t *testing.T) {
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, newGetRequest("api/graphql?query="+url.QueryEscape(`mutation { toggleSwitch(id: "lamp") { state } }`)))
+
+		assertResponseCode(t, response.Code, http.StatusMethodNotAllowed)
+		assertSwitch(t, stub.switches["lamp"], Switch{ID: "lamp", Name: "Lamp", Type: "light", State: true})
+	})
+
+	t.Run("return status 400 on a body which is no GraphQL request", func(t *testing.T) {
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, newPostRequest("api/graphql", strings.NewReader(`{"query": 1}`)))
+
+		assertResponseCode(t, response.Code, http.StatusBadRequest)
+	})
+
+	t.Run("stream subscribed changes as server-sent events", func(t *testing.T) {
+		listener := httptest.NewServer(server)
+		defer listener.Close()
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		body, _ := json.Marshal(graphQLRequest{Query: `subscription { switchChanged(ids: ["lamp"]) { id state } }`})
+		request, _ := http.NewRequestWithContext(ctx, http.MethodPost, listener.URL+"/api/graphql", strings.NewReader(string(body)))
+		request.Header.Set("Accept", "text/event-stream")
+
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatalf("subscribing failed: %s", err)
+		}
+		defer response.Body.Close()
+		assertContentType(t, response.Header.Get("content-type"), "text/event-stream")
+
+		store.updateSwitch("boiler", func(s *Switch) error { s.State = true; return nil })
+		store.updateSwitch("lamp", func(s *Switch) error { s.State = false; return nil })
+
+		events := bufio.NewReader(response.Body)
+		var got []string
+		for len(got) < 2 {
+			line, err := events.ReadString('\n')
+			if err != nil {
+				t.Fatalf("reading events failed: %s", err)
+			}
+			if line = strings.TrimSpace(line); line != "" {
+				got = append(got, line)
+			}
+		}
+		assertBody(t, strings.Join(got, "\n"), "event: next\ndata: {\"data\":{\"switchChanged\":{\"id\":\"lamp\",\"state\":false}}}")
+	})
+
+	t.Run("end subscriptions when the feed is closed", func(t *testing.T) {
+		body, _ := json.Marshal(graphQLRequest{Query: `subscription { sensorChanged { id } }`})
+		request := newPostRequest("api/graphql", strings.NewReader(string(body)))
+		request.Header.Set("Accept", "text/event-stream")
+		response := httptest.NewRecorder()
+		changes.close()
+
+		server.ServeHTTP(response, request)
+
+		assertBody(t, response.Body.String(), "event: complete\ndata:\n\n")
+	})
+}
+
+func TestGraphQLAuthorization(t *testing.T) {
+	stub := StubHivemindStore{
+		map[string]Sensor{"kitchen": Sensor{ID: "kitchen", Name: "Kitchen", Unit: "C", Type: "temperature", Value: 21}},
+		map[string]Switch{
+			"lamp":   Switch{ID: "lamp", Name: "Lamp", Type: "light"},
+			"boiler": Switch{ID: "boiler", Name: "Boiler", Type: "generic", State: true},
+		},
+	}
+	store := NotifyingHivemindStore{HivemindStore: &stub}
+	changes := newChangeFeed()
+	store.addListener(changes)
+	tokens := newStubTokenStore()
+	users := newStubUserStore()
+	hash, _ := bcrypt.GenerateFromPassword([]byte("correct horse"), bcrypt.MinCost)
+	users.storeUser(User{Username: "guest", PasswordHash: string(hash), Roles: []RoleGrant{{Role: roleViewer, Switch: "boiler"}}})
+	devices := newStubDeviceStore()
+	devices.storeDevice(Device{ID: "esp", Name: "ESP", Sensors: []string{"kitchen"}, Status: deviceApproved})
+	server := NewHivemindServer(&store)
+	server.changes = changes
+	server.tokens = tokens
+	server.users = users
+	server.locations = newStubLocationStore()
+	server.devices = devices
+
+	_, switchReader, _ := mintToken(tokens, "switches", []string{scopeSwitchRead}, nil)
+	_, device, _ := mintDeviceToken(tokens, "esp", []string{"kitchen"})
+	bearer := func(secret string) func(*http.Request) *http.Request {
+		return func(request *http.Request) *http.Request {
+			request.Header.Set("Authorization", "Bearer "+secret)
+			return request
+		}
+	}
+	response := httptest.NewRecorder()
+	server.ServeHTTP(response, newPostRequest("api/auth/login", strings.NewReader(`{"Username": "guest", "Password": "correct horse"}`)))
+	var session sessionInfo
+	json.NewDecoder(response.Body).Decode(&session)
+	cookie := response.Result().Cookies()[0]
+	guest := func(request *http.Request) *http.Request {
+		request.AddCookie(cookie)
+		request.Header.Set(csrfHeader, session.CSRFToken)
+		return request
+	}
+
+	query := func(t *testing.T, as func(*http.Request) *http.Request, query string) string {
+		t.Helper()
+		body, _ := json.Marshal(graphQLRequest{Query: query})
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, as(newPostRequest("api/graphql", strings.NewReader(string(body)))))
+
+		assertResponseCode(t, response.Code, http.StatusOK)
+		return strings.TrimSpace(response.Body.String())
+	}
+
+	t.Run("leave out the sensors of a caller with the scope switch:read", func(t *testing.T) {
+		got := query(t, bearer(switchReader), `{ sensors { id } switches(orderBy: NAME) { id } }`)
+
+		assertBody(t, got, `{"data":{"sensors":[],"switches":[{"id":"boiler"},{"id":"lamp"}]}}`)
+
+		got = query(t, bearer(switchReader), `{ sensor(id: "kitchen") { id } }`)
+
+		assertBody(t, got, `{"data":{"sensor":null},"errors":[{"message":"sensor kitchen: forbidden","path":["sensor"]}]}`)
+	})
+
+	t.Run("refuse setSwitch to a viewer of the switch", func(t *testing.T) {
+		got := query(t, guest, `mutation { setSwitch(id: "boiler", state: false) { state } }`)
+
+		assertBody(t, got, `{"data":null,"errors":[{"message":"switch boiler: forbidden","path":["setSwitch"]}]}`)
+		assertSwitch(t, stub.switches["boiler"], Switch{ID: "boiler", Name: "Boiler", Type: "generic", State: true})
+	})
+
+	t.Run("refuse devices to a device", func(t *testing.T) {
+		got := query(t, bearer(device), `{ devices { id } }`)
+
+		assertBody(t, got, `{"data":null,"errors":[{"message":"devices need the scope admin","path":["devices"]}]}`)
+	})
+
+	listener := httptest.NewServer(server)
+	defer listener.Close()
+	subscribe := func(t *testing.T, as func(*http.Request) *http.Request, query string) (events func() string, cancel func()) {
+		t.Helper()
+		ctx, stop := context.WithCancel(context.Background())
+		body, _ := json.Marshal(graphQLRequest{Query: query})
+		request, _ := http.NewRequestWithContext(ctx, http.MethodPost, listener.URL+"/api/graphql", strings.NewReader(string(body)))
+		request.Header.Set("Accept", "text/event-stream")
+
+		response, err := http.DefaultClient.Do(as(request))
+		if err != nil {
+			t.Fatalf("subscribing failed: %s", err)
+		}
+		assertResponseCode(t, response.StatusCode, http.StatusOK)
+		reader := bufio.NewReader(response.Body)
+		return func() string {
+				var got []string
+				for len(got) < 2 {
+					line, err := reader.ReadString('\n')
+					if err != nil {
+						t.Fatalf("reading events failed: %s", err)
+					}
+					if line = strings.TrimSpace(line); line != "" {
+						got = append(got, line)
+					}
+				}
+				return strings.Join(got, "\n")
+			}, func() {
+				stop()
+				response.Body.Close()
+			}
+	}
+
+	t.Run("stream only the changes of switches granted to the subscriber", func(t *testing.T) {
+		events, cancel := subscribe(t, guest, `subscription { switchChanged { id state } }`)
+		defer cancel()
+
+		store.updateSwitch("lamp", func(s *Switch) error { s.State = true; return nil })
+		store.updateSwitch("boiler", func(s *Switch) error { s.State = false; return nil })
+
+		assertBody(t, events(), "event: next\ndata: {\"data\":{\"switchChanged\":{\"id\":\"boiler\",\"state\":false}}}")
+	})
+
+	t.Run("end the subscription of a revoked token", func(t *testing.T) {
+		events, cancel := subscribe(t, bearer(switchReader), `subscription { switchChanged { id state } }`)
+		defer cancel()
+
+		store.updateSwitch("lamp", func(s *Switch) error { s.State = false; return nil })
+		assertBody(t, events(), "event: next\ndata: {\"data\":{\"switchChanged\":{\"id\":\"lamp\",\"state\":false}}}")
+
+		for _, token := range tokens.getAllTokens() {
+			if token.Name == "switches" {
+				tokens.deleteToken(token.ID)
+			}
+		}
+		store.updateSwitch("lamp", func(s *Switch) error { s.State = true; return nil })
+
+		assertBody(t, events(), "event: complete\ndata:")
+	})
+}
+
+func TestChangeFeed(t *testing.T) {
+	t.Run("ask subscribers whether they accept a change outside the lock of the feed", func(t *testing.T) {
+		feed := newChangeFeed()
+		changes, cancel := feed.subscribe(func(change interface{}) bool {
+			_, other := feed.subscribe(func(change interface{}) bool { return false })
+			other()
+			return true
+		})
+		defer cancel()
+
+		feed.switchChanged(Switch{ID: "lamp"}, slog.Default())
+
+		if change := <-changes; change.(Switch).ID != "lamp" {
+			t.Errorf("got change %v, want lamp", change)
+		}
+	})
+
+	t.Run("drop subscribers which fall behind", func(t *testing.T) {
+		feed := newChangeFeed()
+		slow, cancel := feed.subscribe(func(change interface{}) bool { return true })
+		defer cancel()
+
+		for i := 0; i <= changeFeedBuffer; i++ {
+			feed.sensorChanged(Sensor{ID: "s", Value: i}, slog.Default())
+		}
+
+		received := 0
+		for range slow {
+			received++
+		}
+		if received != changeFeedBuffer {
+			t.Errorf("got %d changes before the subscription ended, want %d", received, changeFeedBuffer)
+		}
+	})
+}
+
+// stubs
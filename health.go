@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+)
+
+// healthCheck is a dependency that has to work for Hivemind to be ready
+type healthCheck struct {
+	name  string
+	check func() error
+}
+
+// checkResult is the outcome of a healthCheck in the /readyz response
+type checkResult struct {
+	Status string
+	Error  string `json:",omitempty"`
+}
+
+// readiness is the /readyz response, Checks maps the names of the checks to their outcome
+type readiness struct {
+	Status string
+	Checks map[string]checkResult
+}
+
+// addCheck adds a dependency check to the /readyz endpoint
+func (h *HivemindServer) addCheck(name string, check func() error) {
+	h.checks = append(h.checks, healthCheck{name, check})
+}
+
+// healthzHandler reports that the process is alive and serving
+func (h *HivemindServer) healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"Status": "ok"})
+}
+
+// readyzHandler runs all checks, answering 503 with the failing ones when any of them fails
+func (h *HivemindServer) readyzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	response := readiness{"ok", make(map[string]checkResult)}
+	var failing []string
+	for _, c := range h.checks {
+		if err := c.check(); err != nil {
+			response.Checks[c.name] = checkResult{"failing", err.Error()}
+			failing = append(failing, c.name)
+			continue
+		}
+		response.Checks[c.name] = checkResult{Status: "ok"}
+	}
+	if len(failing) > 0 {
+		sort.Strings(failing)
+		response.Status = "unavailable"
+		requestLogger(r).Warn("not ready", "failing", failing)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestHealth(t *testing.T) {
+	server := NewHivemindServer(&StubHivemindStore{})
+	server.tokens = newStubTokenStore()
+	var mqttErr error
+	server.addCheck("store", func() error { return nil })
+	server.addCheck("mqtt", func() error { return mqttErr })
+
+	t.Run("return status 200 on GET /healthz without token", func(t *testing.T) {
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, newGetRequest("healthz"))
+
+		assertResponseCode(t, response.Code, http.StatusOK)
+		assertBody(t, response.Body.String(), `{"Status":"ok"}`+"\n")
+	})
+
+	t.Run("return status 200 on GET /readyz with all checks passing", func(t *testing.T) {
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, newGetRequest("readyz"))
+
+		assertResponseCode(t, response.Code, http.StatusOK)
+		assertBody(t, response.Body.String(), `{"Status":"ok","Checks":{"mqtt":{"Status":"ok"},"store":{"Status":"ok"}}}`+"\n")
+	})
+
+	t.Run("return status 503 on GET /readyz with the failing check", func(t *testing.T) {
+		mqttErr = errors.New("not connected to the MQTT broker")
+		defer func() { mqttErr = nil }()
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, newGetRequest("readyz"))
+
+		var got readiness
+		json.NewDecoder(response.Body).Decode(&got)
+
+		assertResponseCode(t, response.Code, http.StatusServiceUnavailable)
+		if got.Status != "unavailable" || got.Checks["mqtt"].Error != mqttErr.Error() || got.Checks["store"].Status != "ok" {
+			t.Errorf("unexpected readiness %v", got)
+		}
+	})
+
+	t.Run("fail the store check on unreadable records and once the database is closed", func(t *testing.T) {
+		database, err := bolt.Open("health.db", 0600, &bolt.Options{Timeout: 1 * time.Second})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer deleteDatabase(t, "health.db")
+		store := BoltHivemindStore{database}
+
+		if err := store.ping(); err != nil {
+			t.Errorf("ping of an open database failed: %s", err)
+		}
+		store.storeSensor(Sensor{ID: "test", Name: "Test"})
+		if err := store.ping(); err != nil {
+			t.Errorf("ping of a database with a sensor failed: %s", err)
+		}
+		database.Update(func(tx *bolt.Tx) error {
+			return tx.Bucket([]byte("sensor")).Put([]byte("test"), []byte("garbage"))
+		})
+		if err := store.ping(); err == nil {
+			t.Errorf("ping of an unreadable sensor succeeded")
+		}
+		database.Close()
+		if err := store.ping(); err == nil {
+			t.Errorf("ping of a closed database succeeded")
+		}
+	})
+
+	t.Run("report background workers only while they run", func(t *testing.T) {
+		webhooks := NewWebhookDispatcher(newStubWebhookStore())
+		alerts := NewAlertManager(newStubAlertStore())
+		if webhooks.running() == nil || alerts.running() == nil {
+			t.Errorf("workers reported running before start")
+		}
+
+		webhooks.start(1)
+		alerts.start(time.Hour)
+		for i := 0; i < 100 && (webhooks.running() != nil || alerts.running() != nil); i++ {
+			time.Sleep(time.Millisecond)
+		}
+		if err := webhooks.running(); err != nil {
+			t.Errorf("webhooks not running: %s", err)
+		}
+		if err := alerts.running(); err != nil {
+			t.Errorf("alerts not running: %s", err)
+		}
+
+		webhooks.shutdown()
+		alerts.shutdown()
+		if webhooks.running() == nil || alerts.running() == nil {
+			t.Errorf("workers reported running after shutdown")
+		}
+	})
+}
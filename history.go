@@ -0,0 +1,153 @@
+package main
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Reading is a value a sensor had from Time on
+type Reading struct {
+	Time  time.Time
+	Value int
+}
+
+// sensorReading is a Reading of sensor ID
+type sensorReading struct {
+	ID string
+	Reading
+}
+
+// HistoryStore is an interface for the storage of the readings of sensors
+type HistoryStore interface {
+	// getReadings returns the readings of sensor id from from to to in time order, starting with the
+	// last one before from, which is the value the sensor had at from
+	getReadings(id string, from, to time.Time) ([]Reading, error)
+	// storeReadings appends the readings to those of their sensors and drops the readings of these
+	// sensors before keepSince
+	storeReadings(readings []sensorReading, keepSince time.Time) error
+	deleteReadings(id string) error
+}
+
+// historyOp is a reading to store or, with remove, the readings of a sensor to delete
+type historyOp struct {
+	reading sensorReading
+	remove  bool
+}
+
+// SensorHistory is a ChangeListener recording every changed sensor value as a reading, readings
+// older than retention are dropped. The readings are queued and stored by a worker, which writes all
+// readings queued meanwhile in one transaction
+type SensorHistory struct {
+	store     HistoryStore
+	retention time.Duration
+	queue     chan historyOp
+	stop      chan struct{}
+	wg        sync.WaitGroup
+}
+
+// NewSensorHistory creates a SensorHistory keeping the readings of retention in s, register it as
+// ChangeListener and start it to store readings
+func NewSensorHistory(s HistoryStore, retention time.Duration) *SensorHistory {
+	return &SensorHistory{
+		store:     s,
+		retention: retention,
+		queue:     make(chan historyOp, 1000),
+		stop:      make(chan struct{}),
+	}
+}
+
+func (h *SensorHistory) start() {
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+		for {
+			select {
+			case op := <-h.queue:
+				h.write(h.drain([]historyOp{op}))
+			case <-h.stop:
+				h.write(h.drain(nil))
+				return
+			}
+		}
+	}()
+}
+
+// shutdown stops the worker after it stored the readings still queued
+func (h *SensorHistory) shutdown() {
+	close(h.stop)
+	h.wg.Wait()
+}
+
+// drain appends the ops queued to ops without waiting for more
+func (h *SensorHistory) drain(ops []historyOp) []historyOp {
+	for {
+		select {
+		case op := <-h.queue:
+			ops = append(ops, op)
+		default:
+			return ops
+		}
+	}
+}
+
+// write stores the readings of ops in one transaction, up to each removal, which is done in order
+func (h *SensorHistory) write(ops []historyOp) {
+	var readings []sensorReading
+	for _, op := range ops {
+		if !op.remove {
+			readings = append(readings, op.reading)
+			continue
+		}
+		h.storeReadings(readings)
+		readings = nil
+		err := h.store.deleteReadings(op.reading.ID)
+		if err != nil {
+			slog.Error("deleting readings failed", "id", op.reading.ID, "error", err)
+		}
+	}
+	h.storeReadings(readings)
+}
+
+// storeReadings stores readings, dropping those older than the retention before the newest of them
+func (h *SensorHistory) storeReadings(readings []sensorReading) {
+	if len(readings) == 0 {
+		return
+	}
+	newest := readings[0].Time
+	for _, r := range readings[1:] {
+		if r.Time.After(newest) {
+			newest = r.Time
+		}
+	}
+	err := h.store.storeReadings(readings, newest.Add(-h.retention))
+	if err != nil {
+		slog.Error("storing readings failed", "readings", len(readings), "error", err)
+	}
+}
+
+func (h *SensorHistory) sensorChanged(s Sensor, l *slog.Logger) {
+	updated := s.Updated
+	if updated.IsZero() {
+		updated = time.Now().UTC()
+	}
+	select {
+	case h.queue <- historyOp{reading: sensorReading{s.ID, Reading{updated, s.Value}}}:
+	default:
+		l.Error("dropping reading, history queue full", "id", s.ID)
+	}
+}
+
+func (h *SensorHistory) switchChanged(s Switch, l *slog.Logger) {}
+
+// sensorRemoved queues the deletion of the readings of sensor id behind its queued readings, unlike a
+// reading it is not dropped when the queue is full
+func (h *SensorHistory) sensorRemoved(id string) {
+	select {
+	case h.queue <- historyOp{reading: sensorReading{ID: id}, remove: true}:
+	case <-h.stop:
+		slog.Error("deleting readings failed", "id", id, "error", "history shut down")
+	}
+}
+
+func (h *SensorHistory) switchRemoved(id string) {}
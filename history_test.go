@@ -0,0 +1,103 @@
+package main
+
+import (
+	"log/slog"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestSensorHistory(t *testing.T) {
+	at := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+
+	t.Run("store the readings queued meanwhile in one write", func(t *testing.T) {
+		store := &stubHistoryStore{readings: map[string][]Reading{}}
+		history := NewSensorHistory(store, time.Hour)
+
+		history.sensorChanged(Sensor{ID: "kitchen", Value: 20, Updated: at}, slog.Default())
+		history.sensorChanged(Sensor{ID: "cellar", Value: 12, Updated: at}, slog.Default())
+		history.sensorChanged(Sensor{ID: "kitchen", Value: 21, Updated: at.Add(time.Minute)}, slog.Default())
+		history.start()
+		history.shutdown()
+
+		if store.writes != 1 {
+			t.Errorf("got %d writes, want 1", store.writes)
+		}
+		want := []Reading{{at, 20}, {at.Add(time.Minute), 21}}
+		if got := store.readings["kitchen"]; !reflect.DeepEqual(got, want) {
+			t.Errorf("got readings %v, want %v", got, want)
+		}
+		if got := store.keepSince; !got.Equal(at.Add(time.Minute - time.Hour)) {
+			t.Errorf("got readings kept since %v, want the retention before the newest reading", got)
+		}
+	})
+
+	t.Run("delete the readings of a removed sensor after those queued before", func(t *testing.T) {
+		store := &stubHistoryStore{readings: map[string][]Reading{}}
+		history := NewSensorHistory(store, time.Hour)
+
+		history.sensorChanged(Sensor{ID: "kitchen", Value: 20, Updated: at}, slog.Default())
+		history.sensorRemoved("kitchen")
+		history.sensorChanged(Sensor{ID: "kitchen", Value: 5, Updated: at.Add(time.Minute)}, slog.Default())
+		history.start()
+		history.shutdown()
+
+		want := []Reading{{at.Add(time.Minute), 5}}
+		if got := store.readings["kitchen"]; !reflect.DeepEqual(got, want) {
+			t.Errorf("got readings %v, want %v", got, want)
+		}
+	})
+
+	t.Run("drop readings when the queue is full", func(t *testing.T) {
+		store := &stubHistoryStore{readings: map[string][]Reading{}}
+		history := NewSensorHistory(store, time.Hour)
+		history.queue = make(chan historyOp, 1)
+
+		history.sensorChanged(Sensor{ID: "kitchen", Value: 20, Updated: at}, slog.Default())
+		history.sensorChanged(Sensor{ID: "kitchen", Value: 21, Updated: at.Add(time.Minute)}, slog.Default())
+		history.start()
+		history.shutdown()
+
+		want := []Reading{{at, 20}}
+		if got := store.readings["kitchen"]; !reflect.DeepEqual(got, want) {
+			t.Errorf("got readings %v, want %v", got, want)
+		}
+	})
+}
+
+// stubs
+type stubHistoryStore struct {
+	readings  map[string][]Reading
+	writes    int
+	keepSince time.Time
+}
+
+func (s *stubHistoryStore) getReadings(id string, from, to time.Time) ([]Reading, error) {
+	var readings []Reading
+	for _, r := range s.readings[id] {
+		switch {
+		case r.Time.After(to):
+		case r.Time.Before(from) && len(readings) > 0 && readings[0].Time.Before(from):
+			readings[0] = r
+		default:
+			readings = append(readings, r)
+		}
+	}
+	return readings, nil
+}
+
+func (s *stubHistoryStore) storeReadings(readings []sensorReading, keepSince time.Time) error {
+	s.writes++
+	s.keepSince = keepSince
+	for _, r := range readings {
+		s.readings[r.ID] = append(s.readings[r.ID], r.Reading)
+		sort.Slice(s.readings[r.ID], func(i, j int) bool { return s.readings[r.ID][i].Time.Before(s.readings[r.ID][j].Time) })
+	}
+	return nil
+}
+
+func (s *stubHistoryStore) deleteReadings(id string) error {
+	delete(s.readings, id)
+	return nil
+}
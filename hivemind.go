@@ -1,28 +1,48 @@
 package main
 
-// Sensor represents a sensor with an ID and current value
+import "time"
+
+// Sensor represents a sensor with an ID and current value, Revision is counted up and Updated set
+// by the store on every write
 type Sensor struct {
-	ID    string
-	Name  string
-	Unit  string
-	Type  string
-	Value int
+	ID       string
+	Name     string
+	Unit     string
+	Type     string
+	Value    int
+	Revision uint64
+	Updated  time.Time
 }
 
-// Switch represents a switch with an ID and current boolean state
+// Switch represents a switch with an ID and current boolean state, Revision and Updated are
+// maintained by the store like those of a Sensor
 type Switch struct {
-	ID    string
-	Name  string
-	Type  string
-	State bool
+	ID       string
+	Name     string
+	Type     string
+	State    bool
+	Revision uint64
+	Updated  time.Time
 }
 
 // HivemindStore is an interface for datastorage
 type HivemindStore interface {
 	getSensor(id string) (Sensor, error)
 	getAllSensors() []Sensor
+	// listSensors returns the page of sensors selected by q and whether more follow it
+	listSensors(q pageQuery) ([]Sensor, bool, error)
 	storeSensor(s Sensor) error
+	// storeSensors stores all sensors, calling fn when not nil in the same transaction with the previous,
+	// zero when new, and the stored version of each
+	storeSensors(s []Sensor, fn func(previous, s Sensor)) ([]error, error)
+	// updateSensor reads, changes with fn and stores the sensor id in a single transaction
+	updateSensor(id string, fn func(s *Sensor) error) (Sensor, error)
+	// deleteSensor deletes the sensor id unless fn, called with it in the same transaction, fails
+	deleteSensor(id string, fn func(s Sensor) error) error
 	getSwitch(id string) (Switch, error)
 	getAllSwitches() []Switch
+	listSwitches(q pageQuery) ([]Switch, bool, error)
 	storeSwitch(s Switch) error
+	updateSwitch(id string, fn func(s *Switch) error) (Switch, error)
+	deleteSwitch(id string, fn func(s Switch) error) error
 }
@@ -0,0 +1,457 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	haDiscoveryPrefix = "homeassistant"
+	haNodeID          = "hivemind"
+	haStatusTopic     = "hivemind/status"
+	haImportPrefix    = "ha_"
+)
+
+// haAbbreviations maps the abbreviated discovery keys Home Assistant accepts to their full name
+var haAbbreviations = map[string]string{
+	"avty_t":       "availability_topic",
+	"cmd_t":        "command_topic",
+	"dev":          "device",
+	"dev_cla":      "device_class",
+	"obj_id":       "object_id",
+	"pl_off":       "payload_off",
+	"pl_on":        "payload_on",
+	"stat_off":     "state_off",
+	"stat_on":      "state_on",
+	"stat_t":       "state_topic",
+	"uniq_id":      "unique_id",
+	"unit_of_meas": "unit_of_measurement",
+	"val_tpl":      "value_template",
+}
+
+// haUnits maps Hivemind units to their Home Assistant notation
+var haUnits = map[string]string{
+	"C": "°C",
+	"F": "°F",
+}
+
+var haObjectID = regexp.MustCompile("[^a-zA-Z0-9_-]+")
+var haValueTemplate = regexp.MustCompile(`^{{\s*value(_json((\.[a-zA-Z0-9_]+)+))?\s*}}$`)
+
+// haDevice groups entities in Home Assistant
+type haDevice struct {
+	Identifiers []string `json:"identifiers"`
+	Name        string   `json:"name"`
+}
+
+// haDiscoveryConfig is a Home Assistant MQTT discovery payload for sensors and switches
+type haDiscoveryConfig struct {
+	Name              string    `json:"name"`
+	UniqueID          string    `json:"unique_id"`
+	ObjectID          string    `json:"object_id,omitempty"`
+	StateTopic        string    `json:"state_topic"`
+	CommandTopic      string    `json:"command_topic,omitempty"`
+	AvailabilityTopic string    `json:"availability_topic,omitempty"`
+	UnitOfMeasurement string    `json:"unit_of_measurement,omitempty"`
+	DeviceClass       string    `json:"device_class,omitempty"`
+	ValueTemplate     string    `json:"value_template,omitempty"`
+	PayloadOn         string    `json:"payload_on,omitempty"`
+	PayloadOff        string    `json:"payload_off,omitempty"`
+	StateOn           string    `json:"state_on,omitempty"`
+	StateOff          string    `json:"state_off,omitempty"`
+	Device            *haDevice `json:"device,omitempty"`
+}
+
+// haImport is an entity discovered through Home Assistant and mirrored into the store
+type haImport struct {
+	component string
+	config    haDiscoveryConfig
+	reported  bool
+}
+
+// HomeAssistantBridge publishes Home Assistant MQTT discovery for every sensor and switch
+// in the store, handles Home Assistant commands and imports devices discovered by Home Assistant
+type HomeAssistantBridge struct {
+	store    HivemindStore
+	client   mqttClient
+	mutex    sync.Mutex
+	imported map[string]*haImport
+}
+
+// NewHomeAssistantBridge creates a HomeAssistantBridge, register it as ChangeListener on s to keep Home Assistant up to date
+func NewHomeAssistantBridge(s HivemindStore, c mqttClient) *HomeAssistantBridge {
+	return &HomeAssistantBridge{
+		store:    s,
+		client:   c,
+		imported: make(map[string]*haImport),
+	}
+}
+
+// start subscribes to commands and discovery and announces everything currently in the store
+func (b *HomeAssistantBridge) start() error {
+	err := b.client.subscribe(haNodeID+"/switch/+/set", b.onSwitchCommand)
+	if err != nil {
+		return err
+	}
+	for _, topic := range []string{haDiscoveryPrefix + "/+/+/config", haDiscoveryPrefix + "/+/+/+/config"} {
+		err = b.client.subscribe(topic, b.onDiscovery)
+		if err != nil {
+			return err
+		}
+	}
+	for _, s := range b.store.getAllSensors() {
+		b.sensorChanged(s, slog.Default())
+	}
+	for _, s := range b.store.getAllSwitches() {
+		b.switchChanged(s, slog.Default())
+	}
+	return nil
+}
+
+func (b *HomeAssistantBridge) sensorChanged(s Sensor, l *slog.Logger) {
+	if b.isImported(s.ID) {
+		return
+	}
+	config := b.baseConfig("sensor", s.ID, s.Name)
+	config.UnitOfMeasurement = haUnit(s.Unit)
+	if s.Type != "generic" {
+		config.DeviceClass = s.Type
+	}
+	b.publishConfig("sensor", s.ID, config)
+	b.client.publish(config.StateTopic, true, []byte(strconv.Itoa(s.Value)))
+}
+
+func (b *HomeAssistantBridge) switchChanged(s Switch, l *slog.Logger) {
+	b.mutex.Lock()
+	i, ok := b.imported[s.ID]
+	if ok {
+		// only forward changes that did not originate from the device itself
+		send := i.config.CommandTopic != "" && i.reported != s.State
+		i.reported = s.State
+		b.mutex.Unlock()
+		if send {
+			payload := i.config.PayloadOff
+			if s.State {
+				payload = i.config.PayloadOn
+			}
+			b.client.publish(i.config.CommandTopic, false, []byte(payload))
+		}
+		return
+	}
+	b.mutex.Unlock()
+
+	config := b.baseConfig("switch", s.ID, s.Name)
+	config.CommandTopic = haNodeID + "/switch/" + haObjectID.ReplaceAllString(s.ID, "_") + "/set"
+	config.PayloadOn = "ON"
+	config.PayloadOff = "OFF"
+	b.publishConfig("switch", s.ID, config)
+	b.client.publish(config.StateTopic, true, []byte(haSwitchPayload(s.State)))
+}
+
+func (b *HomeAssistantBridge) baseConfig(component, id, name string) haDiscoveryConfig {
+	objectID := haObjectID.ReplaceAllString(id, "_")
+	if name == "" {
+		name = id
+	}
+	return haDiscoveryConfig{
+		Name:              name,
+		UniqueID:          haNodeID + "_" + component + "_" + objectID,
+		StateTopic:        haNodeID + "/" + component + "/" + objectID + "/state",
+		AvailabilityTopic: haStatusTopic,
+		Device:            &haDevice{Identifiers: []string{haNodeID}, Name: "Hivemind"},
+	}
+}
+
+func (b *HomeAssistantBridge) publishConfig(component, id string, config haDiscoveryConfig) {
+	encoded, err := json.Marshal(config)
+	if err != nil {
+		return
+	}
+	b.client.publish(haConfigTopic(component, id), true, encoded)
+}
+
+func haConfigTopic(component, id string) string {
+	return haDiscoveryPrefix + "/" + component + "/" + haNodeID + "/" + haObjectID.ReplaceAllString(id, "_") + "/config"
+}
+
+func (b *HomeAssistantBridge) sensorRemoved(id string) {
+	b.removeEntity("sensor", id)
+}
+
+func (b *HomeAssistantBridge) switchRemoved(id string) {
+	b.removeEntity("switch", id)
+}
+
+// removeEntity clears the retained config and state of an exported entity, which makes Home
+// Assistant remove it
+func (b *HomeAssistantBridge) removeEntity(component, id string) {
+	if b.isImported(id) {
+		return
+	}
+	b.client.publish(haConfigTopic(component, id), true, nil)
+	b.client.publish(b.baseConfig(component, id, "").StateTopic, true, nil)
+}
+
+func (b *HomeAssistantBridge) isImported(id string) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	_, ok := b.imported[id]
+	return ok
+}
+
+func (b *HomeAssistantBridge) onSwitchCommand(topic string, payload []byte) {
+	parts := strings.Split(topic, "/")
+	if len(parts) != 4 {
+		return
+	}
+	for _, sw := range b.store.getAllSwitches() {
+		if haObjectID.ReplaceAllString(sw.ID, "_") != parts[2] {
+			continue
+		}
+		l := slog.Default().With("source", "mqtt", "correlation_id", newID()[:16], "topic", topic)
+		switch strings.ToUpper(strings.TrimSpace(string(payload))) {
+		case "ON":
+			sw.State = true
+		case "OFF":
+			sw.State = false
+		default:
+			l.Warn("unknown switch command", "payload", string(payload))
+			return
+		}
+		l.Info("switch command", "id", sw.ID, "state", sw.State)
+		storeWithLogger(b.store, l).storeSwitch(sw)
+		return
+	}
+}
+
+func (b *HomeAssistantBridge) onDiscovery(topic string, payload []byte) {
+	// <prefix>/<component>/[<node_id>/]<object_id>/config
+	parts := strings.Split(topic, "/")
+	component := parts[1]
+	if len(parts) == 5 && parts[2] == haNodeID {
+		return
+	}
+	if component != "sensor" && component != "switch" {
+		return
+	}
+	id := sanitizeID(haImportPrefix + parts[len(parts)-2])
+
+	if len(payload) == 0 {
+		// an empty config removes the entity from Home Assistant, stop following it
+		b.mutex.Lock()
+		delete(b.imported, id)
+		b.mutex.Unlock()
+		return
+	}
+	config, err := parseHADiscoveryConfig(payload)
+	if err != nil || config.StateTopic == "" {
+		return
+	}
+	if config.Name == "" {
+		config.Name = parts[len(parts)-2]
+	}
+	if config.PayloadOn == "" {
+		config.PayloadOn = "ON"
+	}
+	if config.PayloadOff == "" {
+		config.PayloadOff = "OFF"
+	}
+	if config.StateOn == "" {
+		config.StateOn = config.PayloadOn
+	}
+	if config.StateOff == "" {
+		config.StateOff = config.PayloadOff
+	}
+
+	sensor, _ := b.store.getSensor(id)
+	sw, _ := b.store.getSwitch(id)
+
+	b.mutex.Lock()
+	_, known := b.imported[id]
+	b.imported[id] = &haImport{component: component, config: config, reported: sw.State}
+	b.mutex.Unlock()
+
+	if component == "sensor" {
+		sensor.ID = id
+		sensor.Name = config.Name
+		sensor.Unit = hivemindUnit(config.UnitOfMeasurement)
+		sensor.Type = config.DeviceClass
+		if sensor.Type == "" {
+			sensor.Type = "generic"
+		}
+		b.store.storeSensor(sanitizeSensor(sensor))
+	} else {
+		sw.ID = id
+		sw.Name = sanitizeName(config.Name)
+		sw.Type = "generic"
+		b.store.storeSwitch(sw)
+	}
+	if !known {
+		b.client.subscribe(config.StateTopic, b.importedStateHandler(id))
+	}
+}
+
+func (b *HomeAssistantBridge) importedStateHandler(id string) func(string, []byte) {
+	return func(topic string, payload []byte) {
+		b.mutex.Lock()
+		i, ok := b.imported[id]
+		if !ok {
+			b.mutex.Unlock()
+			return
+		}
+		config := i.config
+		b.mutex.Unlock()
+
+		l := slog.Default().With("source", "homeassistant", "correlation_id", newID()[:16], "topic", topic)
+		value, ok := renderHAValue(config.ValueTemplate, payload)
+		if !ok {
+			l.Debug("state does not match the value template", "payload", string(payload))
+			return
+		}
+		if i.component == "sensor" {
+			f, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return
+			}
+			sensor, err := b.store.getSensor(id)
+			if err != nil || sensor.ID == "" {
+				return
+			}
+			sensor.Value = int(math.Round(f))
+			if invalid := validateSensor(sensor); len(invalid) > 0 {
+				l.Warn("ignoring invalid state", "id", id, "payload", string(payload), "error", invalid)
+				return
+			}
+			storeWithLogger(b.store, l).storeSensor(sensor)
+			return
+		}
+
+		var state bool
+		switch value {
+		case config.StateOn:
+			state = true
+		case config.StateOff:
+			state = false
+		default:
+			return
+		}
+		sw, err := b.store.getSwitch(id)
+		if err != nil || sw.ID == "" {
+			return
+		}
+		b.mutex.Lock()
+		i.reported = state
+		b.mutex.Unlock()
+		sw.State = state
+		storeWithLogger(b.store, l).storeSwitch(sw)
+	}
+}
+
+// parseHADiscoveryConfig decodes a discovery payload, expanding abbreviated keys and the ~ base topic
+func parseHADiscoveryConfig(payload []byte) (haDiscoveryConfig, error) {
+	var config haDiscoveryConfig
+	var raw map[string]interface{}
+	err := json.Unmarshal(payload, &raw)
+	if err != nil {
+		return config, err
+	}
+
+	base, _ := raw["~"].(string)
+	expanded := make(map[string]interface{})
+	for k, v := range raw {
+		if full, ok := haAbbreviations[k]; ok {
+			k = full
+		}
+		if topic, ok := v.(string); ok && base != "" && strings.HasSuffix(k, "_topic") {
+			if strings.HasPrefix(topic, "~") {
+				topic = base + topic[1:]
+			} else if strings.HasSuffix(topic, "~") {
+				topic = topic[:len(topic)-1] + base
+			}
+			v = topic
+		}
+		expanded[k] = v
+	}
+	// payloads can be numbers or booleans as well, store them as strings
+	for _, k := range []string{"payload_on", "payload_off", "state_on", "state_off"} {
+		if v, ok := expanded[k]; ok {
+			if _, ok := v.(string); !ok {
+				encoded, _ := json.Marshal(v)
+				expanded[k] = string(encoded)
+			}
+		}
+	}
+	// the device block of imported entities is not used
+	delete(expanded, "device")
+
+	encoded, err := json.Marshal(expanded)
+	if err != nil {
+		return config, err
+	}
+	err = json.Unmarshal(encoded, &config)
+	return config, err
+}
+
+// renderHAValue applies the simple value templates ({{ value }} and {{ value_json.a.b }}) to a state payload
+func renderHAValue(template string, payload []byte) (string, bool) {
+	value := strings.TrimSpace(string(payload))
+	if template == "" {
+		return value, true
+	}
+	match := haValueTemplate.FindStringSubmatch(strings.TrimSpace(template))
+	if match == nil {
+		return "", false
+	}
+	if match[1] == "" {
+		return value, true
+	}
+
+	var current interface{}
+	if err := json.Unmarshal(payload, &current); err != nil {
+		return "", false
+	}
+	for _, key := range strings.Split(match[2][1:], ".") {
+		object, ok := current.(map[string]interface{})
+		if !ok {
+			return "", false
+		}
+		current = object[key]
+	}
+	switch v := current.(type) {
+	case string:
+		return v, true
+	case nil:
+		return "", false
+	default:
+		encoded, _ := json.Marshal(v)
+		return string(encoded), true
+	}
+}
+
+func haSwitchPayload(state bool) string {
+	if state {
+		return "ON"
+	}
+	return "OFF"
+}
+
+func haUnit(unit string) string {
+	if u, ok := haUnits[unit]; ok {
+		return u
+	}
+	return unit
+}
+
+func hivemindUnit(unit string) string {
+	for k, v := range haUnits {
+		if v == unit {
+			return k
+		}
+	}
+	return unit
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestHomeAssistantBridge(t *testing.T) {
+	store := StubHivemindStore{
+		map[string]Sensor{
+			"test": Sensor{ID: "test", Name: "Test", Unit: "C", Type: "temperature", Value: 21},
+		},
+		map[string]Switch{
+			"lamp": Switch{ID: "lamp", Name: "Lamp", Type: "generic"},
+		},
+	}
+	notifying := NotifyingHivemindStore{HivemindStore: &store}
+	client := newStubMQTTClient()
+	bridge := NewHomeAssistantBridge(&notifying, client)
+	notifying.addListener(bridge)
+
+	err := bridge.start()
+	if err != nil {
+		t.Fatalf("failure within start(): %s", err)
+	}
+
+	t.Run("publish discovery config and state for a sensor", func(t *testing.T) {
+		var config haDiscoveryConfig
+		err := json.Unmarshal(client.published["homeassistant/sensor/hivemind/test/config"], &config)
+		if err != nil {
+			t.Fatalf("unable to parse discovery config: %s", err)
+		}
+		if config.StateTopic != "hivemind/sensor/test/state" || config.UnitOfMeasurement != "°C" || config.DeviceClass != "temperature" {
+			t.Errorf("unexpected discovery config %v", config)
+		}
+		assertBody(t, string(client.published["hivemind/sensor/test/state"]), "21")
+	})
+
+	t.Run("publish discovery config and state for a switch", func(t *testing.T) {
+		var config haDiscoveryConfig
+		err := json.Unmarshal(client.published["homeassistant/switch/hivemind/lamp/config"], &config)
+		if err != nil {
+			t.Fatalf("unable to parse discovery config: %s", err)
+		}
+		if config.CommandTopic != "hivemind/switch/lamp/set" {
+			t.Errorf("unexpected command topic %s", config.CommandTopic)
+		}
+		assertBody(t, string(client.published["hivemind/switch/lamp/state"]), "OFF")
+	})
+
+	t.Run("switch command from Home Assistant is stored and echoed", func(t *testing.T) {
+		client.deliver("hivemind/switch/lamp/set", []byte("ON"))
+
+		assertSwitch(t, store.switches["lamp"], Switch{ID: "lamp", Name: "Lamp", Type: "generic", State: true})
+		assertBody(t, string(client.published["hivemind/switch/lamp/state"]), "ON")
+	})
+
+	t.Run("import sensor discovered by Home Assistant", func(t *testing.T) {
+		client.deliver("homeassistant/sensor/tasmota/kitchen/config", []byte(`{"~": "tele/kitchen", "name": "Kitchen", "stat_t": "~/SENSOR", "unit_of_meas": "°C", "dev_cla": "temperature", "val_tpl": "{{ value_json.AM2301.Temperature }}"}`))
+		client.deliver("tele/kitchen/SENSOR", []byte(`{"AM2301": {"Temperature": 19.6}}`))
+
+		assertSensor(t, store.sensors["ha_kitchen"], Sensor{ID: "ha_kitchen", Name: "Kitchen", Unit: "C", Type: "temperature", Value: 20})
+		if _, ok := client.published["homeassistant/sensor/hivemind/ha_kitchen/config"]; ok {
+			t.Errorf("imported sensor announced back to Home Assistant")
+		}
+	})
+
+	t.Run("import sensors of unknown device classes as generic sensors with valid IDs", func(t *testing.T) {
+		client.deliver("homeassistant/sensor/air.quality/config", []byte(`{"name": "Air", "stat_t": "air/pm25", "unit_of_meas": "µg/m³", "dev_cla": "pm25"}`))
+		client.deliver("air/pm25", []byte("12"))
+
+		assertSensor(t, store.sensors["ha_air_quality"], Sensor{ID: "ha_air_quality", Name: "Air", Unit: "µg/m³", Type: "generic", Value: 12})
+	})
+
+	t.Run("ignore imported states outside the range of the sensor", func(t *testing.T) {
+		client.deliver("tele/kitchen/SENSOR", []byte(`{"AM2301": {"Temperature": 900}}`))
+
+		assertSensor(t, store.sensors["ha_kitchen"], Sensor{ID: "ha_kitchen", Name: "Kitchen", Unit: "C", Type: "temperature", Value: 20})
+	})
+
+	t.Run("imported switch forwards changes to its command topic", func(t *testing.T) {
+		client.deliver("homeassistant/switch/plug/config", []byte(`{"name": "Plug", "state_topic": "plug/state", "command_topic": "plug/set"}`))
+		client.deliver("plug/state", []byte("ON"))
+
+		assertSwitch(t, store.switches["ha_plug"], Switch{ID: "ha_plug", Name: "Plug", Type: "generic", State: true})
+		if _, ok := client.published["plug/set"]; ok {
+			t.Errorf("state reported by the device was sent back as command")
+		}
+
+		notifying.storeSwitch(Switch{ID: "ha_plug", Name: "Plug", Type: "generic"})
+
+		assertBody(t, string(client.published["plug/set"]), "OFF")
+	})
+
+	t.Run("clear the retained config of a deleted sensor", func(t *testing.T) {
+		notifying.deleteSensor("test", func(s Sensor) error { return nil })
+
+		if payload, ok := client.published["homeassistant/sensor/hivemind/test/config"]; !ok || len(payload) != 0 {
+			t.Errorf("got config %q, want an empty retained message", payload)
+		}
+	})
+}
+
+func TestRenderHAValue(t *testing.T) {
+	cases := []struct {
+		template string
+		payload  string
+		want     string
+		ok       bool
+	}{
+		{"", " 12 ", "12", true},
+		{"{{ value }}", "12", "12", true},
+		{"{{value_json.temp}}", `{"temp": 12.5}`, "12.5", true},
+		{"{{ value_json.a.state }}", `{"a": {"state": "ON"}}`, "ON", true},
+		{"{{ value_json.missing }}", `{"temp": 12.5}`, "", false},
+		{"{{ value | float }}", "12", "", false},
+	}
+	for _, c := range cases {
+		got, ok := renderHAValue(c.template, []byte(c.payload))
+		if got != c.want || ok != c.ok {
+			t.Errorf("renderHAValue(%q, %q) = %q, %v; want %q, %v", c.template, c.payload, got, ok, c.want, c.ok)
+		}
+	}
+}
+
+// stubs
+type stubMQTTClient struct {
+	published     map[string][]byte
+	subscriptions map[string]func(string, []byte)
+}
+
+func newStubMQTTClient() *stubMQTTClient {
+	return &stubMQTTClient{
+		published:     make(map[string][]byte),
+		subscriptions: make(map[string]func(string, []byte)),
+	}
+}
+
+func (s *stubMQTTClient) publish(topic string, retained bool, payload []byte) error {
+	s.published[topic] = payload
+	return nil
+}
+
+func (s *stubMQTTClient) subscribe(topic string, handler func(topic string, payload []byte)) error {
+	s.subscriptions[topic] = handler
+	return nil
+}
+
+// deliver hands a message to the handler of every subscription matching topic
+func (s *stubMQTTClient) deliver(topic string, payload []byte) {
+	for filter, handler := range s.subscriptions {
+		if mqttTopicMatches(filter, topic) {
+			handler(topic, payload)
+		}
+	}
+}
+
+func mqttTopicMatches(filter, topic string) bool {
+	f := strings.Split(filter, "/")
+	p := strings.Split(topic, "/")
+	if len(f) != len(p) {
+		return false
+	}
+	for i := range f {
+		if f[i] != "+" && f[i] != p[i] {
+			return false
+		}
+	}
+	return true
+}
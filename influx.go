@@ -0,0 +1,303 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// influxPoint is a single line of InfluxDB line protocol
+type influxPoint struct {
+	measurement string
+	tags        map[string]string
+	fields      map[string]interface{}
+	timestamp   int64
+}
+
+// influxRule maps fields of line protocol points onto a sensor, ID, Name, Unit and Type can
+// reference {measurement}, {field} and any tag like {host}
+type influxRule struct {
+	Measurement string
+	Tags        map[string]string
+	Field       string
+	ID          string
+	Name        string
+	Unit        string
+	Type        string
+}
+
+// defaultInfluxRules are used when no rules are configured, every numeric field becomes a sensor
+var defaultInfluxRules = []influxRule{
+	{ID: "{measurement}_{field}"},
+}
+
+// loadInfluxRules reads a JSON array of influxRule from path
+func loadInfluxRules(path string) ([]influxRule, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var rules []influxRule
+	err = json.NewDecoder(f).Decode(&rules)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s failed: %s", path, err)
+	}
+	for i, rule := range rules {
+		if rule.ID == "" {
+			return nil, fmt.Errorf("rule %d in %s has no ID", i, path)
+		}
+	}
+	return rules, nil
+}
+
+func (r influxRule) matches(p influxPoint, field string) bool {
+	if r.Measurement != "" && r.Measurement != p.measurement {
+		return false
+	}
+	if r.Field != "" && r.Field != field {
+		return false
+	}
+	for k, v := range r.Tags {
+		if p.tags[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+func (r influxRule) expand(template string, p influxPoint, field string) string {
+	pairs := []string{"{measurement}", p.measurement, "{field}", field}
+	for k, v := range p.tags {
+		pairs = append(pairs, "{"+k+"}", v)
+	}
+	return strings.NewReplacer(pairs...).Replace(template)
+}
+
+// influxSensors maps points onto sensor readings using the first matching rule per field
+func influxSensors(store HivemindStore, rules []influxRule, points []influxPoint) []Sensor {
+	var sensors []Sensor
+	for _, p := range points {
+		for field, raw := range p.fields {
+			var value float64
+			switch v := raw.(type) {
+			case float64:
+				value = v
+			case int64:
+				value = float64(v)
+			case uint64:
+				value = float64(v)
+			case bool:
+				if v {
+					value = 1
+				}
+			default:
+				continue
+			}
+			for _, rule := range rules {
+				if !rule.matches(p, field) {
+					continue
+				}
+				id := sanitizeID(rule.expand(rule.ID, p, field))
+				sensor, err := store.getSensor(id)
+				if err != nil || sensor.ID == "" {
+					sensor = Sensor{ID: id, Name: id, Type: "generic"}
+				}
+				if rule.Name != "" {
+					sensor.Name = sanitizeName(rule.expand(rule.Name, p, field))
+				}
+				if rule.Unit != "" {
+					sensor.Unit = rule.expand(rule.Unit, p, field)
+				}
+				if rule.Type != "" {
+					sensor.Type = rule.expand(rule.Type, p, field)
+				}
+				sensor.Value = int(math.Round(value))
+				sensors = append(sensors, sensor)
+				break
+			}
+		}
+	}
+	return sensors
+}
+
+func (h *HivemindServer) apiInfluxWriteHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json")
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var body io.Reader = r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			writeInfluxError(w, http.StatusBadRequest, "invalid", err.Error())
+			return
+		}
+		defer gz.Close()
+		body = gz
+	}
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		writeInfluxError(w, http.StatusBadRequest, "invalid", err.Error())
+		return
+	}
+	points, err := parseLineProtocol(string(data))
+	if err != nil {
+		writeInfluxError(w, http.StatusBadRequest, "invalid", err.Error())
+		return
+	}
+
+	rules := h.influxRules
+	if len(rules) == 0 {
+		rules = defaultInfluxRules
+	}
+	sensors := influxSensors(h.store, rules, points)
+	for _, s := range sensors {
+		if invalid := validateSensor(s); len(invalid) > 0 {
+			writeInfluxError(w, http.StatusBadRequest, "invalid", "sensor "+s.ID+": "+invalid.Error())
+			return
+		}
+		if !h.authorized(r, "sensor", s.ID, reportAccess) {
+			writeInfluxError(w, http.StatusForbidden, "forbidden", "no write access to sensor "+s.ID)
+			return
+		}
+	}
+	if len(sensors) > 0 {
+		errs, err := h.storeFor(r).storeSensors(sensors, nil)
+		if err == nil {
+			for _, e := range errs {
+				if e != nil {
+					err = e
+					break
+				}
+			}
+		}
+		if err != nil {
+			writeInfluxError(w, http.StatusInternalServerError, "internal error", err.Error())
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeInfluxError answers with an error body the InfluxDB clients understand
+func writeInfluxError(w http.ResponseWriter, status int, code, message string) {
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"code": code, "message": message})
+}
+
+// parseLineProtocol parses InfluxDB line protocol, one point per line
+func parseLineProtocol(data string) ([]influxPoint, error) {
+	var points []influxPoint
+	for n, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		p, err := parseLineProtocolLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", n+1, err)
+		}
+		points = append(points, p)
+	}
+	return points, nil
+}
+
+func parseLineProtocolLine(line string) (influxPoint, error) {
+	p := influxPoint{tags: make(map[string]string), fields: make(map[string]interface{})}
+
+	sections := splitUnescaped(line, ' ', true)
+	if len(sections) < 2 || len(sections) > 3 {
+		return p, errors.New("expected measurement, fields and optional timestamp")
+	}
+
+	series := splitUnescaped(sections[0], ',', false)
+	p.measurement = unescapeLineProtocol(series[0])
+	if p.measurement == "" {
+		return p, errors.New("missing measurement")
+	}
+	for _, tag := range series[1:] {
+		kv := splitUnescaped(tag, '=', false)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return p, fmt.Errorf("invalid tag %q", tag)
+		}
+		p.tags[unescapeLineProtocol(kv[0])] = unescapeLineProtocol(kv[1])
+	}
+
+	for _, field := range splitUnescaped(sections[1], ',', true) {
+		kv := splitUnescaped(field, '=', true)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return p, fmt.Errorf("invalid field %q", field)
+		}
+		value, err := parseLineProtocolValue(kv[1])
+		if err != nil {
+			return p, fmt.Errorf("invalid field %q: %s", field, err)
+		}
+		p.fields[unescapeLineProtocol(kv[0])] = value
+	}
+
+	if len(sections) == 3 {
+		ts, err := strconv.ParseInt(sections[2], 10, 64)
+		if err != nil {
+			return p, fmt.Errorf("invalid timestamp %q", sections[2])
+		}
+		p.timestamp = ts
+	}
+	return p, nil
+}
+
+func parseLineProtocolValue(v string) (interface{}, error) {
+	switch {
+	case strings.HasPrefix(v, `"`):
+		if len(v) < 2 || !strings.HasSuffix(v, `"`) {
+			return nil, errors.New("unterminated string")
+		}
+		return strings.NewReplacer(`\"`, `"`, `\\`, `\`).Replace(v[1 : len(v)-1]), nil
+	case strings.HasSuffix(v, "i"):
+		return strconv.ParseInt(v[:len(v)-1], 10, 64)
+	case strings.HasSuffix(v, "u"):
+		return strconv.ParseUint(v[:len(v)-1], 10, 64)
+	}
+	switch v {
+	case "t", "T", "true", "True", "TRUE":
+		return true, nil
+	case "f", "F", "false", "False", "FALSE":
+		return false, nil
+	}
+	return strconv.ParseFloat(v, 64)
+}
+
+// splitUnescaped splits s on sep, skipping backslash escaped separators and,
+// if quotes is set, separators within double quoted strings
+func splitUnescaped(s string, sep byte, quotes bool) []string {
+	var parts []string
+	start := 0
+	quoted := false
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\':
+			i++
+		case s[i] == '"' && quotes:
+			quoted = !quoted
+		case s[i] == sep && !quoted:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+func unescapeLineProtocol(s string) string {
+	return strings.NewReplacer(`\,`, ",", `\=`, "=", `\ `, " ", `\\`, `\`).Replace(s)
+}
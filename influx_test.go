@@ -0,0 +1,124 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseLineProtocol(t *testing.T) {
+	t.Run("parse tags, field types and timestamp", func(t *testing.T) {
+		want := influxPoint{
+			measurement: "climate room",
+			tags:        map[string]string{"host": "esp,1", "room": "kitchen"},
+			fields: map[string]interface{}{
+				"temp":     21.5,
+				"count":    int64(3),
+				"uptime":   uint64(12),
+				"on":       true,
+				"firmware": "tasmota \"9\"",
+			},
+			timestamp: 1556813561098000000,
+		}
+
+		got, err := parseLineProtocol(`climate\ room,host=esp\,1,room=kitchen temp=21.5,count=3i,uptime=12u,on=t,firmware="tasmota \"9\"" 1556813561098000000`)
+		if err != nil {
+			t.Fatalf("failure within parseLineProtocol(): %s", err)
+		}
+		if len(got) != 1 || !reflect.DeepEqual(got[0], want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	})
+
+	t.Run("skip comments and empty lines", func(t *testing.T) {
+		got, err := parseLineProtocol("# comment\n\ncpu value=1\n")
+		if err != nil {
+			t.Fatalf("failure within parseLineProtocol(): %s", err)
+		}
+		if len(got) != 1 {
+			t.Errorf("got %d points, want 1", len(got))
+		}
+	})
+
+	t.Run("reject invalid lines", func(t *testing.T) {
+		for _, line := range []string{"cpu", "cpu value=", "cpu,host value=1", "cpu value=abc", "cpu value=1 now"} {
+			_, err := parseLineProtocol(line)
+			if err == nil {
+				t.Errorf("expected error for %q", line)
+			}
+		}
+	})
+}
+
+func TestInfluxWriteAPI(t *testing.T) {
+	store := StubHivemindStore{
+		map[string]Sensor{
+			"kitchen": Sensor{ID: "kitchen", Name: "Kitchen", Unit: "C", Type: "temperature", Value: 18},
+		},
+		nil,
+	}
+	server := NewHivemindServer(&store)
+	server.influxRules = []influxRule{
+		{Measurement: "climate", Tags: map[string]string{"room": "kitchen"}, Field: "temp", ID: "kitchen"},
+		{Measurement: "climate", Field: "humidity", ID: "{room}_humidity", Name: "Humidity {room}", Unit: "%", Type: "humidity"},
+	}
+
+	t.Run("return status 204 on POST /api/v2/write and store mapped sensors", func(t *testing.T) {
+		request := newPostRequest("api/v2/write?org=home&bucket=hivemind", strings.NewReader("climate,room=kitchen temp=21.4,humidity=55\nclimate,room=garage temp=9\n"))
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, request)
+
+		assertResponseCode(t, response.Code, http.StatusNoContent)
+		assertSensor(t, store.sensors["kitchen"], Sensor{ID: "kitchen", Name: "Kitchen", Unit: "C", Type: "temperature", Value: 21})
+		assertSensor(t, store.sensors["kitchen_humidity"], Sensor{ID: "kitchen_humidity", Name: "Humidity kitchen", Unit: "%", Type: "humidity", Value: 55})
+		if len(store.sensors) != 2 {
+			t.Errorf("unmatched points were stored: %v", store.sensors)
+		}
+	})
+
+	t.Run("store unmapped measurements under valid IDs", func(t *testing.T) {
+		rules := server.influxRules
+		defer func() { server.influxRules = rules }()
+		server.influxRules = nil
+		request := newPostRequest("api/v2/write", strings.NewReader("cpu.load,host=a value=1"))
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, request)
+
+		assertResponseCode(t, response.Code, http.StatusNoContent)
+		assertSensor(t, store.sensors["cpu_load_value"], Sensor{ID: "cpu_load_value", Name: "cpu_load_value", Type: "generic", Value: 1})
+		delete(store.sensors, "cpu_load_value")
+	})
+
+	t.Run("return status 400 on POST /api/v2/write with a value outside the range of the sensor", func(t *testing.T) {
+		request := newPostRequest("api/v2/write", strings.NewReader("climate,room=kitchen temp=500"))
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, request)
+
+		assertResponseCode(t, response.Code, http.StatusBadRequest)
+		assertSensor(t, store.sensors["kitchen"], Sensor{ID: "kitchen", Name: "Kitchen", Unit: "C", Type: "temperature", Value: 21})
+	})
+
+	t.Run("return status 400 on POST /api/v2/write with invalid line protocol", func(t *testing.T) {
+		request := newPostRequest("api/v2/write", strings.NewReader("climate temp=warm"))
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, request)
+
+		assertResponseCode(t, response.Code, http.StatusBadRequest)
+		assertContentType(t, response.Header().Get("content-type"), "application/json")
+	})
+
+	t.Run("return status 405 on GET /api/v2/write", func(t *testing.T) {
+		request := newGetRequest("api/v2/write")
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, request)
+
+		assertResponseCode(t, response.Code, http.StatusMethodNotAllowed)
+	})
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// requestIDHeader carries the correlation ID of a request, a usable ID sent by the client is kept
+const requestIDHeader = "X-Request-ID"
+
+// requestInfo is filled in while a request passes the middlewares and logged when it is done
+type requestInfo struct {
+	id     string
+	caller string
+}
+
+// newLogger creates a logger writing text (logfmt) or json records of at least level to w
+func newLogger(w io.Writer, format, level string) (*slog.Logger, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return nil, errors.New("unknown log level " + level)
+	}
+	options := &slog.HandlerOptions{Level: l}
+	switch format {
+	case "text":
+		return slog.New(slog.NewTextHandler(w, options)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, options)), nil
+	}
+	return nil, errors.New("unknown log format " + format)
+}
+
+// requestLogger returns a logger adding the correlation ID and caller of r to its records
+func requestLogger(r *http.Request) *slog.Logger {
+	info, ok := r.Context().Value(requestInfoContextKey).(*requestInfo)
+	if !ok {
+		return slog.Default()
+	}
+	l := slog.Default().With("request_id", info.id)
+	if info.caller != "" {
+		l = l.With("caller", info.caller)
+	}
+	return l
+}
+
+// setRequestCaller records the authenticated caller of r for the access log
+func setRequestCaller(r *http.Request, i identity) {
+	if info, ok := r.Context().Value(requestInfoContextKey).(*requestInfo); ok {
+		info.caller = i.Kind + ":" + i.Name
+	}
+}
+
+// loggingStore is implemented by stores that log their changes
+type loggingStore interface {
+	withLogger(l *slog.Logger) HivemindStore
+}
+
+// storeWithLogger returns s logging its changes to l, so they carry the attributes of l
+func storeWithLogger(s HivemindStore, l *slog.Logger) HivemindStore {
+	if ls, ok := s.(loggingStore); ok {
+		return ls.withLogger(l)
+	}
+	return s
+}
+
+// storeFor returns the store for changes made by r
+func (h *HivemindServer) storeFor(r *http.Request) HivemindStore {
+	return storeWithLogger(h.store, requestLogger(r))
+}
+
+// logRequests wraps next, assigning each request a correlation ID and logging it once it is done
+func (h *HivemindServer) logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = newID()[:16]
+		}
+		w.Header().Set(requestIDHeader, id)
+		info := &requestInfo{id: id}
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		next.ServeHTTP(recorder, r.WithContext(context.WithValue(r.Context(), requestInfoContextKey, info)))
+
+		level := slog.LevelInfo
+		if recorder.status >= 500 {
+			level = slog.LevelError
+		} else if r.URL.Path == "/healthz" || r.URL.Path == "/readyz" {
+			// probes of monitors would drown the other requests
+			level = slog.LevelDebug
+		}
+		slog.Default().LogAttrs(r.Context(), level, "request",
+			slog.String("request_id", info.id),
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", recorder.status),
+			slog.Duration("duration", time.Since(start)),
+			slog.String("remote", r.RemoteAddr),
+			slog.String("caller", info.caller),
+		)
+	})
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if c < '!' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
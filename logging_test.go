@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequestLogging(t *testing.T) {
+	var out bytes.Buffer
+	logger, _ := newLogger(&out, "json", "debug")
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(logger)
+
+	records := func() []map[string]interface{} {
+		var records []map[string]interface{}
+		for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+			var record map[string]interface{}
+			if json.Unmarshal([]byte(line), &record) == nil {
+				records = append(records, record)
+			}
+		}
+		out.Reset()
+		return records
+	}
+	find := func(records []map[string]interface{}, msg string) map[string]interface{} {
+		for _, r := range records {
+			if r["msg"] == msg {
+				return r
+			}
+		}
+		t.Fatalf("no %q record in %v", msg, records)
+		return nil
+	}
+
+	store := NotifyingHivemindStore{HivemindStore: &StubHivemindStore{
+		nil,
+		map[string]Switch{"boiler": Switch{ID: "boiler", Name: "Boiler", Type: "generic", State: true}},
+	}}
+	tokens := newStubTokenStore()
+	server := NewHivemindServer(&store)
+	server.tokens = tokens
+	_, secret, _ := mintToken(tokens, "dashboard", []string{scopeSwitchWrite}, nil)
+
+	t.Run("log the request and the switch change under one correlation ID", func(t *testing.T) {
+		request := newPutRequest("api/switch/boiler", strings.NewReader(`{"ID": "boiler", "Name": "Boiler", "Type": "generic", "State": false}`))
+		request.Header.Set("Authorization", "Bearer "+secret)
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, request)
+
+		id := response.Header().Get(requestIDHeader)
+		logged := records()
+		access := find(logged, "request")
+		change := find(logged, "switch changed")
+		if id == "" || access["request_id"] != id || change["request_id"] != id {
+			t.Errorf("correlation IDs differ, header %q, access log %v, change %v", id, access["request_id"], change["request_id"])
+		}
+		if access["method"] != http.MethodPut || access["path"] != "/api/switch/boiler" || access["status"] != float64(http.StatusAccepted) || access["caller"] != "token:dashboard" {
+			t.Errorf("unexpected access log %v", access)
+		}
+		if change["id"] != "boiler" || change["state"] != false || change["previous"] != true || change["caller"] != "token:dashboard" {
+			t.Errorf("unexpected change log %v", change)
+		}
+	})
+
+	t.Run("keep the request ID sent by the client", func(t *testing.T) {
+		request := newGetRequest("")
+		request.Header.Set(requestIDHeader, "ha-automation-42")
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, request)
+
+		assertHeader(t, response.Header(), requestIDHeader, "ha-automation-42")
+		if find(records(), "request")["request_id"] != "ha-automation-42" {
+			t.Errorf("request ID of the client not logged")
+		}
+	})
+
+	t.Run("replace unusable request IDs", func(t *testing.T) {
+		request := newGetRequest("")
+		request.Header.Set(requestIDHeader, "forged\nlog line")
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, request)
+
+		if id := response.Header().Get(requestIDHeader); id == "" || strings.Contains(id, "\n") {
+			t.Errorf("unusable request ID kept: %q", id)
+		}
+		records()
+	})
+
+	t.Run("log unauthenticated requests without a caller", func(t *testing.T) {
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, newGetRequest("api/switch/"))
+
+		access := find(records(), "request")
+		if access["status"] != float64(http.StatusUnauthorized) || access["caller"] != "" {
+			t.Errorf("unexpected access log %v", access)
+		}
+	})
+
+	t.Run("log webhook deliveries under the correlation ID of the change", func(t *testing.T) {
+		target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		defer target.Close()
+		webhooks := newStubWebhookStore()
+		webhooks.storeWebhook(Webhook{ID: "hook", URL: target.URL})
+		dispatcher := NewWebhookDispatcher(webhooks)
+		store.addListener(dispatcher)
+		request := newPutRequest("api/switch/boiler", strings.NewReader(`{"ID": "boiler", "Name": "Boiler", "Type": "generic", "State": true}`))
+		request.Header.Set("Authorization", "Bearer "+secret)
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, request)
+		records()
+		dispatcher.deliver(<-dispatcher.queue)
+
+		delivered := find(records(), "webhook delivered")
+		if id := response.Header().Get(requestIDHeader); delivered["request_id"] != id || delivered["webhook"] != "hook" {
+			t.Errorf("unexpected delivery log %v for request %q", delivered, id)
+		}
+	})
+}
+
+func TestNewLogger(t *testing.T) {
+	for _, c := range []struct{ format, level string }{{"xml", "info"}, {"json", "loud"}} {
+		if _, err := newLogger(&bytes.Buffer{}, c.format, c.level); err == nil {
+			t.Errorf("accepted format %s and level %s", c.format, c.level)
+		}
+	}
+}
@@ -1,24 +1,203 @@
 package main
 
 import (
+	"flag"
+	"fmt"
 	"log"
+	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/boltdb/bolt"
 )
 
 func main() {
-	database, err := bolt.Open("hivemind.db", 0600, &bolt.Options{Timeout: 1 * time.Second})
+	cfg, err := loadConfig(os.Args[1:], os.LookupEnv)
+	if err == flag.ErrHelp {
+		return
+	}
 	if err != nil {
-		log.Fatalf("setup of hivemind.db failed: %s", err)
+		log.Fatalf("invalid configuration: %s", err)
+	}
+	logger, _ := newLogger(os.Stderr, cfg.LogFormat, cfg.LogLevel)
+	slog.SetDefault(logger)
+
+	if cfg.PrintConfig {
+		out, err := cfg.yaml()
+		if err != nil {
+			fatal("printing configuration failed", "error", err)
+		}
+		os.Stdout.Write(out)
+		return
+	}
+
+	database, err := bolt.Open(cfg.Database, 0600, &bolt.Options{Timeout: cfg.DatabaseTimeout})
+	if err != nil {
+		fatal("opening database failed", "database", cfg.Database, "error", err)
+	}
+	closeDatabase := func() {
+		if err := database.Close(); err != nil {
+			slog.Error("closing database failed", "database", cfg.Database, "error", err)
+		}
+	}
+	started := time.Now()
+
+	boltStore := BoltHivemindStore{database}
+
+	if cfg.MintAdminToken != "" {
+		_, secret, err := mintToken(&boltStore, cfg.MintAdminToken, []string{scopeAdmin}, nil)
+		if err != nil {
+			fatal("minting admin token failed", "error", err)
+		}
+		fmt.Println(secret)
+		closeDatabase()
+		return
+	}
+
+	if cfg.MintDeviceToken != "" {
+		parts := strings.SplitN(cfg.MintDeviceToken, "=", 2)
+		if len(parts) != 2 {
+			fatal("-mint-device-token needs the form name=sensor,sensor")
+		}
+		_, secret, err := mintDeviceToken(&boltStore, parts[0], strings.Split(parts[1], ","))
+		if err != nil {
+			fatal("minting device token failed", "error", err)
+		}
+		fmt.Println(secret)
+		closeDatabase()
+		return
 	}
-	defer database.Close()
 
-	store := BoltHivemindStore{database}
+	store := NotifyingHivemindStore{HivemindStore: &boltStore}
+
+	var mqttClient *pahoMQTTClient
+	if cfg.MQTT != "" {
+		client, err := newPahoMQTTClient(cfg.MQTT, "hivemind", haStatusTopic)
+		if err != nil {
+			fatal("connecting to MQTT broker failed", "broker", cfg.MQTT, "error", err)
+		}
+		mqttClient = client
+
+		bridge := NewHomeAssistantBridge(&store, client)
+		store.addListener(bridge)
+		err = bridge.start()
+		if err != nil {
+			fatal("starting Home Assistant bridge failed", "error", err)
+		}
+	}
+
+	webhooks := NewWebhookDispatcher(&boltStore)
+	store.addListener(webhooks)
+	webhooks.start(4)
+
+	alerts := NewAlertManager(&boltStore)
+	alerts.smtpRelay = cfg.SMTP.Relay
+	alerts.smtpFrom = cfg.SMTP.From
+	store.addListener(alerts)
+	alerts.start(10 * time.Second)
+
+	changes := newChangeFeed()
+	store.addListener(changes)
+
+	history := NewSensorHistory(&boltStore, cfg.HistoryRetention)
+	if cfg.HistoryRetention > 0 {
+		store.addListener(history)
+	}
+	history.start()
+
 	server := NewHivemindServer(&store)
+	server.changes = changes
+	if cfg.HistoryRetention > 0 {
+		server.history = &boltStore
+	}
+	server.webhooks = webhooks
+	server.alerts = alerts
+	server.locations = &boltStore
+	if cfg.Auth {
+		server.tokens = &boltStore
+		server.users = &boltStore
+	}
+	server.cors = cfg.corsPolicy()
+	server.legacySunset, _ = cfg.legacySunset()
+	server.addCollector(&boltStore)
+	server.addCheck("store", boltStore.ping)
+	server.addCheck("webhooks", webhooks.running)
+	server.addCheck("alerts", alerts.running)
+	if mqttClient != nil {
+		server.addCheck("mqtt", mqttClient.connected)
+	}
+	if cfg.InfluxRules != "" {
+		server.influxRules, err = loadInfluxRules(cfg.InfluxRules)
+		if err != nil {
+			fatal("loading InfluxDB rules failed", "file", cfg.InfluxRules, "error", err)
+		}
+	}
 
-	if err := http.ListenAndServe(":5000", server); err != nil {
-		log.Fatalf("could not listen on port 5000 %v", err)
+	var certs *certManager
+	dataDir := filepath.Dir(database.Path())
+	if cfg.TLS.Cert != "" || cfg.TLS.Auto {
+		server.ca, err = loadOrCreateCA(dataDir, time.Now())
+		if err != nil {
+			fatal("setup of local CA failed", "error", err)
+		}
+		if cfg.Auth {
+			server.devices = &boltStore
+		}
 	}
+	switch {
+	case cfg.TLS.Cert != "":
+		certs, err = newFileCertManager(cfg.TLS.Cert, cfg.TLS.Key)
+		if err != nil {
+			fatal("loading TLS certificate failed", "file", cfg.TLS.Cert, "error", err)
+		}
+	case cfg.TLS.Auto:
+		hosts := localHosts()
+		if len(cfg.TLS.Hosts) > 0 {
+			hosts = cfg.TLS.Hosts
+		}
+		certs, err = newAutoCertManager(server.ca, dataDir, hosts)
+		if err != nil {
+			fatal("setup of server certificate failed", "error", err)
+		}
+	}
+
+	slog.Info("serving", "addr", cfg.Listen, "tls", certs != nil, "auth", cfg.Auth)
+	servers := []*http.Server{{Addr: cfg.Listen, Handler: server}}
+	if certs != nil {
+		servers[0].TLSConfig = server.clientAuthConfig(certs.tlsConfig())
+		if cfg.TLS.RedirectHTTP != "" {
+			servers = append(servers, &http.Server{Addr: cfg.TLS.RedirectHTTP, Handler: httpsRedirect(cfg.Listen)})
+		}
+	}
+
+	// end GraphQL subscriptions, which would keep their requests in flight until the shutdown timeout
+	servers[0].RegisterOnShutdown(changes.close)
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	serveErr := serveUntilStopped(servers, stop, cfg.ShutdownTimeout)
+
+	// stop the sources of store writes before the subsystems they notify, and the store last
+	if mqttClient != nil {
+		mqttClient.disconnect()
+	}
+	alerts.shutdown()
+	webhooks.shutdown()
+	history.shutdown()
+	closeDatabase()
+	slog.Info("shut down", "uptime", time.Since(started).Round(time.Second), "requests", server.metrics.total())
+	if serveErr != nil {
+		os.Exit(1)
+	}
+}
+
+// fatal logs msg with the key value pairs of args and exits
+func fatal(msg string, args ...interface{}) {
+	slog.Error(msg, args...)
+	os.Exit(1)
 }
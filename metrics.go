@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// latencyBuckets are the upper bounds in seconds of the request duration histogram
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// metricsCollector writes its metrics in the Prometheus text exposition format
+type metricsCollector interface {
+	collectMetrics(w io.Writer)
+}
+
+type httpRequestKey struct {
+	handler string
+	method  string
+	code    int
+}
+
+type latencyHistogram struct {
+	buckets []uint64
+	sum     float64
+	count   uint64
+}
+
+// httpMetrics keeps request counts and latencies per registered handler
+type httpMetrics struct {
+	mutex     sync.Mutex
+	requests  map[httpRequestKey]uint64
+	latencies map[string]*latencyHistogram
+}
+
+func newHTTPMetrics() *httpMetrics {
+	return &httpMetrics{
+		requests:  make(map[httpRequestKey]uint64),
+		latencies: make(map[string]*latencyHistogram),
+	}
+}
+
+// instrument wraps next, recording its requests under the handler label
+func (m *httpMetrics) instrument(handler string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+		m.observe(httpRequestKey{handler, r.Method, recorder.status}, time.Since(start))
+	})
+}
+
+func (m *httpMetrics) observe(key httpRequestKey, duration time.Duration) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.requests[key]++
+	h, ok := m.latencies[key.handler]
+	if !ok {
+		h = &latencyHistogram{buckets: make([]uint64, len(latencyBuckets))}
+		m.latencies[key.handler] = h
+	}
+	seconds := duration.Seconds()
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			h.buckets[i]++
+		}
+	}
+	h.sum += seconds
+	h.count++
+}
+
+// total returns the number of requests served
+func (m *httpMetrics) total() uint64 {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var total uint64
+	for _, n := range m.requests {
+		total += n
+	}
+	return total
+}
+
+func (m *httpMetrics) collectMetrics(w io.Writer) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	keys := make([]httpRequestKey, 0, len(m.requests))
+	for k := range m.requests {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].handler != keys[j].handler {
+			return keys[i].handler < keys[j].handler
+		}
+		if keys[i].method != keys[j].method {
+			return keys[i].method < keys[j].method
+		}
+		return keys[i].code < keys[j].code
+	})
+	writeMetricHeader(w, "hivemind_http_requests_total", "counter", "Total number of HTTP requests by handler, method and status code.")
+	for _, k := range keys {
+		writeMetric(w, "hivemind_http_requests_total", []string{"handler", k.handler, "method", k.method, "code", strconv.Itoa(k.code)}, float64(m.requests[k]))
+	}
+
+	handlers := make([]string, 0, len(m.latencies))
+	for handler := range m.latencies {
+		handlers = append(handlers, handler)
+	}
+	sort.Strings(handlers)
+	writeMetricHeader(w, "hivemind_http_request_duration_seconds", "histogram", "Latency of HTTP requests by handler.")
+	for _, handler := range handlers {
+		h := m.latencies[handler]
+		for i, bound := range latencyBuckets {
+			writeMetric(w, "hivemind_http_request_duration_seconds_bucket", []string{"handler", handler, "le", strconv.FormatFloat(bound, 'g', -1, 64)}, float64(h.buckets[i]))
+		}
+		writeMetric(w, "hivemind_http_request_duration_seconds_bucket", []string{"handler", handler, "le", "+Inf"}, float64(h.count))
+		writeMetric(w, "hivemind_http_request_duration_seconds_sum", []string{"handler", handler}, h.sum)
+		writeMetric(w, "hivemind_http_request_duration_seconds_count", []string{"handler", handler}, float64(h.count))
+	}
+}
+
+// statusRecorder remembers the status code written to a http.ResponseWriter
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if !s.wroteHeader {
+		s.status = code
+		s.wroteHeader = true
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	s.wroteHeader = true
+	return s.ResponseWriter.Write(b)
+}
+
+// Unwrap returns the wrapped ResponseWriter, so http.ResponseController can flush streamed responses
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+func writeMetricHeader(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// writeMetric writes a single sample, labels are given as name, value pairs
+func writeMetric(w io.Writer, name string, labels []string, value float64) {
+	var pairs []string
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", labels[i], escapeLabelValue(labels[i+1])))
+	}
+	if len(pairs) > 0 {
+		name += "{" + strings.Join(pairs, ",") + "}"
+	}
+	fmt.Fprintf(w, "%s %s\n", name, strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+func escapeLabelValue(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	store := StubHivemindStore{
+		map[string]Sensor{
+			"test": Sensor{ID: "test", Name: "Test \"quoted\"", Unit: "C", Type: "generic", Value: 64},
+		},
+		map[string]Switch{
+			"lamp": Switch{ID: "lamp", Name: "Lamp", Type: "generic", State: true},
+		},
+	}
+	server := NewHivemindServer(&store)
+
+	t.Run("return sensor and switch gauges, status 200 on GET /metrics", func(t *testing.T) {
+		request := newGetRequest("metrics")
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, request)
+
+		assertResponseCode(t, response.Code, http.StatusOK)
+		assertContentType(t, response.Header().Get("content-type"), "text/plain; version=0.0.4; charset=utf-8")
+		assertContainsLine(t, response.Body.String(), `hivemind_sensor_value{id="test",name="Test \"quoted\"",unit="C",type="generic"} 64`)
+		assertContainsLine(t, response.Body.String(), `hivemind_switch_state{id="lamp",name="Lamp",type="generic"} 1`)
+	})
+
+	t.Run("count requests by handler, method and code", func(t *testing.T) {
+		server.ServeHTTP(httptest.NewRecorder(), newGetRequest("api/sensor/test"))
+		server.ServeHTTP(httptest.NewRecorder(), newGetRequest("api/sensor/unknown"))
+
+		request := newGetRequest("metrics")
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, request)
+
+		assertContainsLine(t, response.Body.String(), `hivemind_http_requests_total{handler="/api/sensor/",method="GET",code="200"} 1`)
+		assertContainsLine(t, response.Body.String(), `hivemind_http_requests_total{handler="/api/sensor/",method="GET",code="404"} 1`)
+		assertContainsLine(t, response.Body.String(), `hivemind_http_request_duration_seconds_count{handler="/api/sensor/"} 2`)
+	})
+}
+
+func assertContainsLine(t *testing.T, body, line string) {
+	t.Helper()
+	for _, l := range strings.Split(body, "\n") {
+		if l == line {
+			return
+		}
+	}
+	t.Errorf("line %s not found in %s", line, body)
+}
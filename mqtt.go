@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// mqttClient is the minimal MQTT functionality Hivemind depends on
+type mqttClient interface {
+	publish(topic string, retained bool, payload []byte) error
+	subscribe(topic string, handler func(topic string, payload []byte)) error
+}
+
+// mqttMessage is a message waiting in the outbox of a pahoMQTTClient
+type mqttMessage struct {
+	topic    string
+	retained bool
+	payload  []byte
+}
+
+// pahoMQTTClient is a mqttClient based on the Eclipse Paho library. Messages are published by a
+// worker from an outbox, as change listeners publish on the write path of the store and paho holds
+// back the completion of a publish while it reconnects
+type pahoMQTTClient struct {
+	client         mqtt.Client
+	mutex          sync.Mutex
+	subscriptions  map[string]mqtt.MessageHandler
+	outbox         chan mqttMessage
+	stop           chan struct{}
+	wg             sync.WaitGroup
+	publishTimeout time.Duration
+}
+
+// newPahoMQTTClient connects to broker, announcing availability on statusTopic
+func newPahoMQTTClient(broker, clientID, statusTopic string) (*pahoMQTTClient, error) {
+	p := &pahoMQTTClient{
+		subscriptions:  make(map[string]mqtt.MessageHandler),
+		outbox:         make(chan mqttMessage, 1000),
+		stop:           make(chan struct{}),
+		publishTimeout: 10 * time.Second,
+	}
+
+	opts := mqtt.NewClientOptions()
+	opts.AddBroker(broker)
+	opts.SetClientID(clientID)
+	opts.SetAutoReconnect(true)
+	opts.SetConnectTimeout(5 * time.Second)
+	// handlers publish themselves, which blocks when messages are routed in order
+	opts.SetOrderMatters(false)
+	opts.SetWill(statusTopic, "offline", 1, true)
+	opts.SetConnectionLostHandler(func(c mqtt.Client, err error) {
+		slog.Warn("MQTT connection lost", "broker", broker, "error", err)
+	})
+	opts.SetOnConnectHandler(func(c mqtt.Client) {
+		slog.Info("MQTT connected", "broker", broker)
+		c.Publish(statusTopic, 1, true, "online")
+		// subscriptions do not survive a reconnect with a clean session
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+		for topic, handler := range p.subscriptions {
+			c.Subscribe(topic, 1, handler)
+		}
+	})
+
+	p.client = mqtt.NewClient(opts)
+	token := p.client.Connect()
+	token.Wait()
+	if err := token.Error(); err != nil {
+		return nil, err
+	}
+	p.start()
+	return p, nil
+}
+
+// start runs the worker publishing the messages of the outbox in order
+func (p *pahoMQTTClient) start() {
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		for {
+			select {
+			case m := <-p.outbox:
+				p.send(m, p.publishTimeout)
+			case <-p.stop:
+				for {
+					select {
+					case m := <-p.outbox:
+						p.send(m, 0)
+					default:
+						return
+					}
+				}
+			}
+		}
+	}()
+}
+
+// send publishes m, waiting up to timeout for the broker to acknowledge it
+func (p *pahoMQTTClient) send(m mqttMessage, timeout time.Duration) {
+	token := p.client.Publish(m.topic, 1, m.retained, m.payload)
+	if timeout == 0 {
+		return
+	}
+	if !token.WaitTimeout(timeout) {
+		slog.Warn("MQTT publish not acknowledged", "topic", m.topic, "timeout", timeout)
+		return
+	}
+	if err := token.Error(); err != nil {
+		slog.Warn("MQTT publish failed", "topic", m.topic, "error", err)
+	}
+}
+
+// publish queues the message for the worker, it fails when the outbox is full
+func (p *pahoMQTTClient) publish(topic string, retained bool, payload []byte) error {
+	select {
+	case p.outbox <- mqttMessage{topic, retained, payload}:
+		return nil
+	default:
+		slog.Warn("MQTT message dropped, outbox full", "topic", topic)
+		return errors.New("MQTT outbox full")
+	}
+}
+
+func (p *pahoMQTTClient) subscribe(topic string, handler func(topic string, payload []byte)) error {
+	h := func(c mqtt.Client, m mqtt.Message) {
+		handler(m.Topic(), m.Payload())
+	}
+	p.mutex.Lock()
+	p.subscriptions[topic] = h
+	p.mutex.Unlock()
+
+	token := p.client.Subscribe(topic, 1, h)
+	token.Wait()
+	return token.Error()
+}
+
+// connected reports whether the connection to the broker is up, for the readiness check
+func (p *pahoMQTTClient) connected() error {
+	if !p.client.IsConnectionOpen() {
+		return errors.New("not connected to the MQTT broker")
+	}
+	return nil
+}
+
+// disconnect hands the messages left in the outbox to paho without waiting for them and disconnects
+func (p *pahoMQTTClient) disconnect() {
+	close(p.stop)
+	p.wg.Wait()
+	p.client.Disconnect(250)
+}
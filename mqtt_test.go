@@ -0,0 +1,78 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+func TestPahoMQTTClient(t *testing.T) {
+	t.Run("keep sensor writes going while the broker does not acknowledge publishes", func(t *testing.T) {
+		broker := &reconnectingPahoClient{published: make(chan string, 10)}
+		client := &pahoMQTTClient{
+			client:         broker,
+			outbox:         make(chan mqttMessage, 2),
+			stop:           make(chan struct{}),
+			publishTimeout: time.Minute,
+		}
+		client.start()
+		store := NotifyingHivemindStore{HivemindStore: &StubHivemindStore{map[string]Sensor{}, map[string]Switch{}}}
+		store.addListener(NewHomeAssistantBridge(&store, client))
+
+		stored := make(chan error)
+		go func() {
+			for i := 0; i < 10; i++ {
+				if err := store.storeSensor(Sensor{ID: "kitchen", Name: "Kitchen", Unit: "C", Type: "temperature", Value: i}); err != nil {
+					stored <- err
+					return
+				}
+			}
+			stored <- nil
+		}()
+
+		select {
+		case err := <-stored:
+			if err != nil {
+				t.Fatalf("failure within storeSensor(): %s", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("storeSensor() blocked on a pending publish")
+		}
+		if topic := <-broker.published; topic != "homeassistant/sensor/hivemind/kitchen/config" {
+			t.Errorf("got first publish to %s, want the discovery config", topic)
+		}
+	})
+}
+
+// stubs
+
+// reconnectingPahoClient is a paho client during a broker outage, its publishes never complete
+type reconnectingPahoClient struct {
+	mqtt.Client
+	published chan string
+}
+
+func (c *reconnectingPahoClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	c.published <- topic
+	return pendingToken{}
+}
+
+type pendingToken struct{}
+
+func (pendingToken) Wait() bool {
+	select {}
+}
+
+func (pendingToken) WaitTimeout(d time.Duration) bool {
+	time.Sleep(d)
+	return false
+}
+
+func (pendingToken) Done() <-chan struct{} {
+	return nil
+}
+
+func (pendingToken) Error() error {
+	return nil
+}
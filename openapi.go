@@ -0,0 +1,355 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// apiRoute is a pattern of the router with its handler, Operations describe it in the OpenAPI
+// document
+type apiRoute struct {
+	Pattern    string
+	Handler    http.HandlerFunc
+	Operations []apiOperation
+}
+
+// apiOperation is a method on a path of a route; Request and Response are values of the types of
+// the bodies, which are JSON unless RequestTypes or ResponseType say otherwise
+type apiOperation struct {
+	Method  string
+	Path    string
+	Summary string
+	// Parameters name entries of apiParameters, path parameters are taken from Path
+	Parameters   []string
+	Request      interface{}
+	RequestTypes []string
+	Response     interface{}
+	ResponseType string
+	// Status is the status of a success, 200 when it is 0
+	Status     int
+	Deprecated bool
+}
+
+// apiParameters are the query and header parameters operations refer to by name
+var apiParameters = map[string]interface{}{
+	"limit": map[string]interface{}{
+		"name": "limit", "in": "query", "description": "Number of items per page, " + strconv.Itoa(defaultPageLimit) + " below /api/v1/ when missing while the legacy paths list all items",
+		"schema": map[string]interface{}{"type": "integer", "minimum": 1, "maximum": maxPageLimit},
+	},
+	"cursor": map[string]interface{}{
+		"name": "cursor", "in": "query", "description": "Position after the previous page, taken from the next link in its Link header",
+		"schema": map[string]interface{}{"type": "string"},
+	},
+	"sort": map[string]interface{}{
+		"name": "sort", "in": "query", "description": "Field to sort by, a leading - sorts descending",
+		"schema": map[string]interface{}{"type": "string", "enum": sortOrders(), "default": "id"},
+	},
+	"fields": map[string]interface{}{
+		"name": "fields", "in": "query", "description": "Comma separated fields to return, all when missing",
+		"schema": map[string]interface{}{"type": "string"},
+	},
+	"query": map[string]interface{}{
+		"name": "query", "in": "query", "required": true, "description": "GraphQL document",
+		"schema": map[string]interface{}{"type": "string"},
+	},
+	"variables": map[string]interface{}{
+		"name": "variables", "in": "query", "description": "JSON object of the variables of the operation",
+		"schema": map[string]interface{}{"type": "string"},
+	},
+	"operationName": map[string]interface{}{
+		"name": "operationName", "in": "query", "description": "Operation of the document to run, needed when it has several",
+		"schema": map[string]interface{}{"type": "string"},
+	},
+	"If-Match": map[string]interface{}{
+		"name": "If-Match", "in": "header", "description": "Only change the record while its ETag matches",
+		"schema": map[string]interface{}{"type": "string"},
+	},
+	"If-None-Match": map[string]interface{}{
+		"name": "If-None-Match", "in": "header", "description": "Answer 304 while the ETag of the response matches",
+		"schema": map[string]interface{}{"type": "string"},
+	},
+}
+
+func sortOrders() []string {
+	var orders []string
+	for _, field := range sortFields {
+		orders = append(orders, field, "-"+field)
+	}
+	return orders
+}
+
+// pathParameter matches the parameters in the path of an operation
+var pathParameter = regexp.MustCompile(`\{(\w+)\}`)
+
+// openAPIDocument describes the routes of h as an OpenAPI 3 document
+func (h *HivemindServer) openAPIDocument() map[string]interface{} {
+	schemas := openAPISchemas{}
+	paths := map[string]map[string]interface{}{}
+	for _, route := range h.routes() {
+		for _, op := range route.Operations {
+			if paths[op.Path] == nil {
+				paths[op.Path] = map[string]interface{}{}
+			}
+			paths[op.Path][strings.ToLower(op.Method)] = schemas.operation(op)
+		}
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":       "Hivemind",
+			"description": "Sensors and switches of a smart home. Errors are RFC 7807 problem details.",
+			"version":     "1",
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas":    schemas,
+			"parameters": apiParameters,
+			"securitySchemes": map[string]interface{}{
+				"token":   map[string]interface{}{"type": "http", "scheme": "bearer"},
+				"session": map[string]interface{}{"type": "apiKey", "in": "cookie", "name": sessionCookie},
+			},
+		},
+		"security": []interface{}{
+			map[string]interface{}{"token": []string{}},
+			map[string]interface{}{"session": []string{}},
+		},
+	}
+}
+
+// openAPISchemas collects the schemas of the named types of the bodies by their names
+type openAPISchemas map[string]interface{}
+
+func (s openAPISchemas) operation(op apiOperation) map[string]interface{} {
+	o := map[string]interface{}{
+		"summary":     op.Summary,
+		"operationId": operationID(op),
+		"tags":        []string{operationTag(op.Path)},
+	}
+	if op.Deprecated {
+		o["deprecated"] = true
+	}
+
+	var parameters []interface{}
+	for _, match := range pathParameter.FindAllStringSubmatch(op.Path, -1) {
+		parameters = append(parameters, map[string]interface{}{
+			"name": match[1], "in": "path", "required": true,
+			"schema": map[string]interface{}{"type": "string"},
+		})
+	}
+	for _, name := range op.Parameters {
+		parameters = append(parameters, map[string]interface{}{"$ref": "#/components/parameters/" + name})
+	}
+	if parameters != nil {
+		o["parameters"] = parameters
+	}
+
+	if op.Request != nil {
+		types := op.RequestTypes
+		if types == nil {
+			types = []string{"application/json"}
+		}
+		content := map[string]interface{}{}
+		for _, t := range types {
+			content[t] = map[string]interface{}{"schema": s.schema(reflect.TypeOf(op.Request))}
+		}
+		o["requestBody"] = map[string]interface{}{"required": true, "content": content}
+	}
+
+	status := op.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	success := map[string]interface{}{"description": http.StatusText(status)}
+	if op.Response != nil && status != http.StatusNoContent {
+		responseType := op.ResponseType
+		if responseType == "" {
+			responseType = "application/json"
+		}
+		success["content"] = map[string]interface{}{
+			responseType: map[string]interface{}{"schema": s.schema(reflect.TypeOf(op.Response))},
+		}
+	}
+	problemResponse := map[string]interface{}{
+		"description": "Problem details",
+		"content": map[string]interface{}{
+			problemContentType: map[string]interface{}{"schema": s.schema(reflect.TypeOf(problem{}))},
+		},
+	}
+	responses := map[string]interface{}{strconv.Itoa(status): success, "default": problemResponse}
+	if contains(op.Parameters, "If-None-Match") {
+		responses["304"] = map[string]interface{}{"description": http.StatusText(http.StatusNotModified)}
+	}
+	if contains(op.Parameters, "If-Match") {
+		responses["412"] = problemResponse
+	}
+	o["responses"] = responses
+
+	// the scopes come from the authentication itself so they can not differ from it
+	r, _ := http.NewRequest(op.Method, pathParameter.ReplaceAllString(op.Path, "x"), nil)
+	if scope := requiredScope(r); scope == "" {
+		o["security"] = []interface{}{}
+	} else {
+		o["description"] = "Requires the " + scope + " scope."
+	}
+	return o
+}
+
+// operationID names op after its method and path without version, listing a collection is list
+// instead of get and deprecated operations are legacy ones
+func operationID(op apiOperation) string {
+	method := strings.ToLower(op.Method)
+	if op.Method == http.MethodGet && strings.HasSuffix(op.Path, "/") {
+		method = "list"
+	}
+	id := method
+	if op.Deprecated {
+		id = "legacy" + strings.ToUpper(id[:1]) + id[1:]
+	}
+	for _, segment := range strings.Split(strings.TrimPrefix(unversionedPath(op.Path), "/api/"), "/") {
+		if match := pathParameter.FindStringSubmatch(segment); match != nil {
+			segment = "by_" + match[1]
+		}
+		for _, word := range strings.FieldsFunc(segment, func(r rune) bool { return r == '_' || r == '.' || r == '-' }) {
+			id += strings.ToUpper(word[:1]) + word[1:]
+		}
+	}
+	return id
+}
+
+// operationTag groups operations by the first segment of their path below /api/ and its version
+func operationTag(path string) string {
+	return strings.Split(strings.TrimPrefix(unversionedPath(path), "/api/"), "/")[0]
+}
+
+// schema returns the JSON schema of values of t encoded by encoding/json, named structs are
+// referenced from the components
+func (s openAPISchemas) schema(t reflect.Type) map[string]interface{} {
+	switch t {
+	case reflect.TypeOf(time.Time{}):
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case reflect.TypeOf(json.RawMessage{}):
+		return map[string]interface{}{}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return s.schema(t.Elem())
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "minimum": 0}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "format": "binary"}
+		}
+		return map[string]interface{}{"type": "array", "items": s.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": s.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return s.object(t)
+		}
+		name := schemaName(t)
+		if _, ok := s[name]; !ok {
+			s[name] = map[string]interface{}{}
+			s[name] = constrainSchema(name, s.object(t))
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+	}
+	return map[string]interface{}{}
+}
+
+// object returns the schema of the struct t with the fields encoding/json encodes
+func (s openAPISchemas) object(t reflect.Type) map[string]interface{} {
+	properties := map[string]interface{}{}
+	s.addFields(properties, t)
+	return map[string]interface{}{"type": "object", "properties": properties}
+}
+
+func (s openAPISchemas) addFields(properties map[string]interface{}, t reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := strings.Split(f.Tag.Get("json"), ",")[0]
+		if tag == "-" {
+			continue
+		}
+		if f.Anonymous && tag == "" && f.Type.Kind() == reflect.Struct {
+			s.addFields(properties, f.Type)
+			continue
+		}
+		if f.PkgPath != "" {
+			continue
+		}
+		name := f.Name
+		if tag != "" {
+			name = tag
+		}
+		properties[name] = s.schema(f.Type)
+	}
+}
+
+// schemaName returns the name of the component of the named type t, exported like in generated clients
+func schemaName(t reflect.Type) string {
+	name := []rune(t.Name())
+	name[0] = unicode.ToUpper(name[0])
+	return string(name)
+}
+
+// constrainSchema adds the rules of validateSensor and validateSwitch to the schemas of sensors and
+// switches
+func constrainSchema(name string, schema map[string]interface{}) map[string]interface{} {
+	var types []string
+	switch name {
+	case "Sensor":
+		types = sensorTypeNames()
+	case "Switch":
+		types = switchTypes
+	default:
+		return schema
+	}
+	properties := schema["properties"].(map[string]interface{})
+	properties["ID"] = map[string]interface{}{"type": "string", "pattern": validID.String()}
+	properties["Name"] = map[string]interface{}{"type": "string", "maxLength": maxNameLength}
+	properties["Type"] = map[string]interface{}{"type": "string", "enum": types, "default": "generic"}
+	properties["Revision"] = map[string]interface{}{"type": "integer", "minimum": 0, "readOnly": true}
+	properties["Updated"] = map[string]interface{}{"type": "string", "format": "date-time", "readOnly": true}
+	schema["required"] = []string{"Name"}
+	return schema
+}
+
+func (h *HivemindServer) apiOpenAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json")
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeMethodNotAllowed(w, r, http.MethodGet, http.MethodHead)
+		return
+	}
+	writeJSONList(w, r, h.openAPIDocument())
+}
+
+// apiDocs is a page rendering the OpenAPI document, it needs no files or scripts from elsewhere
+//
+//go:embed apidocs.html
+var apiDocs []byte
+
+func (h *HivemindServer) apiDocsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeMethodNotAllowed(w, r, http.MethodGet, http.MethodHead)
+		return
+	}
+	w.Header().Set("content-type", "text/html; charset=utf-8")
+	w.Write(apiDocs)
+}
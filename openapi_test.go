@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOpenAPI(t *testing.T) {
+	server := NewHivemindServer(&StubHivemindStore{})
+	server.tokens = newStubTokenStore()
+
+	t.Run("return the document on GET /api/openapi.json without token", func(t *testing.T) {
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, newGetRequest("api/openapi.json"))
+
+		assertResponseCode(t, response.Code, http.StatusOK)
+		assertContentType(t, response.Header().Get("content-type"), "application/json")
+		var got struct {
+			OpenAPI string `json:"openapi"`
+			Paths   map[string]map[string]json.RawMessage
+		}
+		if err := json.NewDecoder(response.Body).Decode(&got); err != nil {
+			t.Fatalf("unable to parse the document, %v", err)
+		}
+		if got.OpenAPI != "3.0.3" || got.Paths["/api/sensor/{id}"]["patch"] == nil {
+			t.Errorf("unexpected document %v", got)
+		}
+	})
+
+	t.Run("document the methods the handlers answer", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "hivemind-openapi")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		full := NewHivemindServer(&StubHivemindStore{map[string]Sensor{}, map[string]Switch{}})
+		full.tokens = newStubTokenStore()
+		full.users = newStubUserStore()
+		full.locations = newStubLocationStore()
+		full.devices = newStubDeviceStore()
+		full.ca, _ = loadOrCreateCA(dir, time.Now())
+		full.webhooks = NewWebhookDispatcher(newStubWebhookStore())
+		full.alerts = NewAlertManager(newStubAlertStore())
+		full.history = &stubHistoryStore{readings: map[string][]Reading{}}
+		full.changes = newChangeFeed()
+		full.changes.close()
+		_, admin, _ := mintToken(full.tokens, "admin", []string{scopeAdmin}, nil)
+
+		documented := map[string]map[string]bool{}
+		for _, route := range full.routes() {
+			for _, op := range route.Operations {
+				if documented[op.Path] == nil {
+					documented[op.Path] = map[string]bool{}
+				}
+				documented[op.Path][op.Method] = true
+			}
+		}
+		parameter := regexp.MustCompile(`{[a-z]+}`)
+		for path, methods := range documented {
+			for _, method := range []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete} {
+				request, _ := http.NewRequest(method, parameter.ReplaceAllString(path, "x"), strings.NewReader("{}"))
+				request.Header.Set("Authorization", "Bearer "+admin)
+				response := httptest.NewRecorder()
+
+				full.ServeHTTP(response, request)
+
+				if answered := response.Code != http.StatusMethodNotAllowed; answered != methods[method] {
+					t.Errorf("%s %s answered %d, documented %v", method, path, response.Code, methods[method])
+				}
+			}
+		}
+	})
+
+	t.Run("give every operation a unique ID", func(t *testing.T) {
+		ids := map[string]bool{}
+		for path, operations := range server.openAPIDocument()["paths"].(map[string]map[string]interface{}) {
+			for method, o := range operations {
+				id := o.(map[string]interface{})["operationId"].(string)
+				if ids[id] {
+					t.Errorf("operation ID %s of %s %s is not unique", id, method, path)
+				}
+				ids[id] = true
+			}
+		}
+	})
+
+	t.Run("generate the schemas of the bodies from their types", func(t *testing.T) {
+		schemas := server.openAPIDocument()["components"].(map[string]interface{})["schemas"].(openAPISchemas)
+
+		sensor := schemas["Sensor"].(map[string]interface{})["properties"].(map[string]interface{})
+		for _, field := range []string{"ID", "Name", "Unit", "Type", "Value", "Revision", "Updated"} {
+			if sensor[field] == nil {
+				t.Errorf("Sensor has no property %s", field)
+			}
+		}
+		problem := schemas["Problem"].(map[string]interface{})["properties"].(map[string]interface{})
+		if problem["type"] == nil || problem["Type"] != nil {
+			t.Errorf("Problem does not use its JSON names, %v", problem)
+		}
+	})
+
+	t.Run("require the scope of the operation", func(t *testing.T) {
+		paths := server.openAPIDocument()["paths"].(map[string]map[string]interface{})
+
+		put := paths["/api/sensor/{id}"]["put"].(map[string]interface{})
+		login := paths["/api/auth/login"]["post"].(map[string]interface{})
+
+		if put["description"] != "Requires the sensor:write scope." || put["security"] != nil {
+			t.Errorf("unexpected security of PUT /api/sensor/{id}, %v", put)
+		}
+		if security, ok := login["security"].([]interface{}); !ok || len(security) != 0 {
+			t.Errorf("POST /api/auth/login should need no authentication, %v", login["security"])
+		}
+	})
+
+	t.Run("return the docs page on GET /api/docs", func(t *testing.T) {
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, newGetRequest("api/docs"))
+
+		assertResponseCode(t, response.Code, http.StatusOK)
+		assertContentType(t, response.Header().Get("content-type"), "text/html; charset=utf-8")
+		if !strings.Contains(response.Body.String(), `fetch("openapi.json"`) {
+			t.Errorf("the page does not load the document")
+		}
+	})
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultPageLimit = 100
+	maxPageLimit     = 1000
+)
+
+// sortFields are the fields lists of sensors and switches can be sorted by, value is the state of
+// a switch
+var sortFields = []string{"id", "name", "value", "updated"}
+
+// pageQuery selects a page of a list of sensors or switches
+type pageQuery struct {
+	// Sort is one of sortFields, Descending reverses the order
+	Sort       string
+	Descending bool
+	// After is the position of the last item of the previous page, nil for the first page
+	After *pageCursor
+	// Limit is the number of items of a page, 0 for all
+	Limit int
+	// Include filters the items by ID, nil includes all
+	Include func(id string) bool
+	// Fields are the JSON fields of the items to return, nil for all
+	Fields []string
+}
+
+// pageCursor is the position of an item in a list, its sort key and ID; Sort is the order of the
+// list as in the sort parameter
+type pageCursor struct {
+	Sort string
+	Key  string
+	ID   string
+}
+
+// before reports whether a comes before b in the order of q, items with the same sort key are
+// ordered by ID
+func (q pageQuery) before(a, b pageCursor) bool {
+	if a.Key != b.Key {
+		return (a.Key < b.Key) != q.Descending
+	}
+	return a.ID != b.ID && (a.ID < b.ID) != q.Descending
+}
+
+// order returns the order of q as in the sort parameter
+func (q pageQuery) order() string {
+	if q.Descending {
+		return "-" + q.Sort
+	}
+	return q.Sort
+}
+
+// limit returns the number of items of a page
+func (q pageQuery) limit() int {
+	if q.Limit == 0 {
+		return math.MaxInt32
+	}
+	return q.Limit
+}
+
+// position returns the cursor pointing at the item with key and id
+func (q pageQuery) position(key, id string) pageCursor {
+	return pageCursor{q.order(), key, id}
+}
+
+// sensorSortKey returns the key of s for sorting by field, keys compare like the field values
+func sensorSortKey(s Sensor, field string) string {
+	switch field {
+	case "name":
+		return strings.ToLower(s.Name)
+	case "value":
+		return sortableInt(int64(s.Value))
+	case "updated":
+		return sortableTime(s.Updated)
+	}
+	return ""
+}
+
+// switchSortKey returns the key of sw for sorting by field like sensorSortKey
+func switchSortKey(sw Switch, field string) string {
+	switch field {
+	case "name":
+		return strings.ToLower(sw.Name)
+	case "value":
+		if sw.State {
+			return "1"
+		}
+		return "0"
+	case "updated":
+		return sortableTime(sw.Updated)
+	}
+	return ""
+}
+
+// sortableInt encodes i so that the encodings compare like the numbers
+func sortableInt(i int64) string {
+	return fmt.Sprintf("%016x", uint64(i)^1<<63)
+}
+
+// sortableTime encodes t so that the encodings compare like the times
+func sortableTime(t time.Time) string {
+	return t.UTC().Format("20060102150405.000000000")
+}
+
+// pageCollector keeps the first items after the cursor of a query in order, they may be offered in
+// any order; it holds no more than a page and one item to tell whether more follow. Without a limit
+// the items are appended and sorted once when the page is taken
+type pageCollector struct {
+	query     pageQuery
+	positions []pageCursor
+	items     []interface{}
+	unsorted  bool
+}
+
+func (p *pageCollector) offer(position pageCursor, item interface{}) {
+	q := p.query
+	if q.Include != nil && !q.Include(position.ID) {
+		return
+	}
+	if q.After != nil && !q.before(*q.After, position) {
+		return
+	}
+	if q.Limit == 0 {
+		p.positions = append(p.positions, position)
+		p.items = append(p.items, item)
+		p.unsorted = true
+		return
+	}
+	i := sort.Search(len(p.positions), func(i int) bool {
+		return q.before(position, p.positions[i])
+	})
+	limit := q.limit()
+	if i > limit {
+		return
+	}
+	if len(p.items) <= limit {
+		p.positions = append(p.positions, pageCursor{})
+		p.items = append(p.items, nil)
+	}
+	copy(p.positions[i+1:], p.positions[i:])
+	copy(p.items[i+1:], p.items[i:])
+	p.positions[i] = position
+	p.items[i] = item
+}
+
+// Len, Less and Swap sort the items by their positions
+func (p *pageCollector) Len() int           { return len(p.items) }
+func (p *pageCollector) Less(i, j int) bool { return p.query.before(p.positions[i], p.positions[j]) }
+func (p *pageCollector) Swap(i, j int) {
+	p.positions[i], p.positions[j] = p.positions[j], p.positions[i]
+	p.items[i], p.items[j] = p.items[j], p.items[i]
+}
+
+// complete reports whether items offered in ascending ID order can no longer change the page
+func (p *pageCollector) complete() bool {
+	return p.query.Sort == "id" && !p.query.Descending && len(p.items) > p.query.limit()
+}
+
+// page returns the collected items and whether more follow them
+func (p *pageCollector) page() ([]interface{}, bool) {
+	if p.unsorted {
+		sort.Sort(p)
+		p.unsorted = false
+	}
+	if limit := p.query.limit(); len(p.items) > limit {
+		return p.items[:limit], true
+	}
+	return p.items, false
+}
+
+// parsePageQuery reads the limit, cursor, sort and fields parameters of a request for a list of
+// records of type t; lists of the legacy API are complete without a limit as they were before paging
+func parsePageQuery(r *http.Request, t reflect.Type) (pageQuery, error) {
+	query := r.URL.Query()
+	q := pageQuery{Sort: "id", Limit: defaultPageLimit}
+	if isLegacyAPI(r) {
+		q.Limit = 0
+	}
+	fields, err := parseFields(r, t)
+	invalid, _ := err.(validationErrors)
+	q.Fields = fields
+
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > maxPageLimit {
+			invalid.add("limit", "must be a number from 1 to "+strconv.Itoa(maxPageLimit))
+		}
+		q.Limit = n
+	}
+	if s := strings.ToLower(query.Get("sort")); s != "" {
+		q.Descending = strings.HasPrefix(s, "-")
+		q.Sort = strings.TrimPrefix(s, "-")
+		if !contains(sortFields, q.Sort) {
+			invalid.add("sort", "must be one of "+strings.Join(sortFields, ", ")+", with a leading - to sort descending")
+		}
+	}
+	if cursor := query.Get("cursor"); cursor != "" {
+		var after pageCursor
+		decoded, err := base64.RawURLEncoding.DecodeString(cursor)
+		if err == nil {
+			err = json.Unmarshal(decoded, &after)
+		}
+		if err != nil || after.Sort != q.order() {
+			invalid.add("cursor", "is not a cursor of this list, take it from the Link header of the previous page")
+		}
+		q.After = &after
+	}
+	return q, invalid.err()
+}
+
+// encodeCursor returns position as value of the cursor parameter
+func encodeCursor(position pageCursor) string {
+	encoded, _ := json.Marshal(position)
+	return base64.RawURLEncoding.EncodeToString(encoded)
+}
+
+// setNextLink adds a Link header pointing at the page of r following the item at position
+func setNextLink(w http.ResponseWriter, r *http.Request, position pageCursor) {
+	query := r.URL.Query()
+	query.Set("cursor", encodeCursor(position))
+	w.Header().Add("Link", "<"+r.URL.Path+"?"+query.Encode()+`>; rel="next"`)
+}
+
+// parseFields reads the fields parameter of r, the JSON fields of records of type t to return; nil
+// when all are requested
+func parseFields(r *http.Request, t reflect.Type) ([]string, error) {
+	list := r.URL.Query().Get("fields")
+	if list == "" {
+		return nil, nil
+	}
+	var fields []string
+	var invalid validationErrors
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if !hasJSONField(t, name) {
+			invalid.add("fields", name+" is not a field of "+t.Name())
+			continue
+		}
+		fields = append(fields, name)
+	}
+	return fields, invalid.err()
+}
+
+// selectFields returns v, a record or a slice of records, with only fields in the JSON encoding of
+// each record; v itself when fields is nil
+func selectFields(v interface{}, fields []string) interface{} {
+	if fields == nil {
+		return v
+	}
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		return v
+	}
+	var records []map[string]json.RawMessage
+	if json.Unmarshal(encoded, &records) == nil {
+		if records == nil {
+			return v
+		}
+		selected := make([]map[string]json.RawMessage, len(records))
+		for i, record := range records {
+			selected[i] = pickFields(record, fields)
+		}
+		return selected
+	}
+	var record map[string]json.RawMessage
+	json.Unmarshal(encoded, &record)
+	return pickFields(record, fields)
+}
+
+// pickFields returns the members of record named in fields, compared case-insensitive
+func pickFields(record map[string]json.RawMessage, fields []string) map[string]json.RawMessage {
+	picked := make(map[string]json.RawMessage, len(fields))
+	for name, value := range record {
+		for _, field := range fields {
+			if strings.EqualFold(name, field) {
+				picked[name] = value
+			}
+		}
+	}
+	return picked
+}
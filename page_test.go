@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPage(t *testing.T) {
+	t.Run("keep the first items after the cursor in order", func(t *testing.T) {
+		q := pageQuery{Sort: "value", Descending: true, Limit: 2}
+		q.After = &pageCursor{"-value", sortableInt(40), "d"}
+		p := &pageCollector{query: q}
+		for _, v := range []struct {
+			id    string
+			value int64
+		}{{"a", 10}, {"b", -5}, {"c", 30}, {"d", 40}, {"e", 50}, {"f", 30}} {
+			p.offer(q.position(sortableInt(v.value), v.id), v.id)
+		}
+
+		items, more := p.page()
+
+		if !reflect.DeepEqual(items, []interface{}{"f", "c"}) || !more {
+			t.Errorf("got %v, %v, want [f c], true", items, more)
+		}
+	})
+
+	t.Run("keep all items without a limit", func(t *testing.T) {
+		q := pageQuery{Sort: "id"}
+		p := &pageCollector{query: q}
+		for _, id := range []string{"c", "a", "b"} {
+			p.offer(q.position("", id), id)
+		}
+
+		items, more := p.page()
+
+		if !reflect.DeepEqual(items, []interface{}{"a", "b", "c"}) || more {
+			t.Errorf("got %v, %v, want [a b c], false", items, more)
+		}
+	})
+
+	t.Run("keep the same items with and without a limit for many items in any order", func(t *testing.T) {
+		unbounded := pageQuery{Sort: "value"}
+		bounded := pageQuery{Sort: "value", Limit: 50}
+		all, page := &pageCollector{query: unbounded}, &pageCollector{query: bounded}
+		for i, n := range rand.New(rand.NewSource(1)).Perm(20000) {
+			id := strconv.Itoa(i)
+			all.offer(unbounded.position(sortableInt(int64(n)), id), n)
+			page.offer(bounded.position(sortableInt(int64(n)), id), n)
+		}
+
+		items, more := all.page()
+		first, morePages := page.page()
+
+		sorted := sort.SliceIsSorted(items, func(i, j int) bool { return items[i].(int) < items[j].(int) })
+		if len(items) != 20000 || more || !sorted {
+			t.Fatalf("got %d items, sorted %v, more %v, want all 20000 sorted", len(items), sorted, more)
+		}
+		if !reflect.DeepEqual(first, items[:50]) || !morePages {
+			t.Errorf("got page %v, %v, want the first 50 items and more", first, morePages)
+		}
+	})
+
+	t.Run("encode numbers into keys of the same order", func(t *testing.T) {
+		numbers := []int64{-1 << 40, -2, -1, 0, 1, 255, 1 << 40}
+		for i := 1; i < len(numbers); i++ {
+			if sortableInt(numbers[i-1]) >= sortableInt(numbers[i]) {
+				t.Errorf("key of %d does not sort before key of %d", numbers[i-1], numbers[i])
+			}
+		}
+	})
+}
+
+func TestPageAPI(t *testing.T) {
+	now := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	store := StubHivemindStore{
+		map[string]Sensor{
+			"attic":   Sensor{ID: "attic", Name: "Attic", Unit: "C", Type: "temperature", Value: 30, Revision: 1, Updated: now.Add(3 * time.Minute)},
+			"cellar":  Sensor{ID: "cellar", Name: "Cellar", Unit: "C", Type: "temperature", Value: 12, Revision: 1, Updated: now.Add(1 * time.Minute)},
+			"kitchen": Sensor{ID: "kitchen", Name: "Kitchen", Unit: "C", Type: "temperature", Value: 21, Revision: 1, Updated: now.Add(2 * time.Minute)},
+		},
+		nil,
+	}
+	server := NewHivemindServer(&store)
+	get := func(url string) *httptest.ResponseRecorder {
+		request, _ := http.NewRequest(http.MethodGet, url, nil)
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, request)
+		return response
+	}
+	ids := func(response *httptest.ResponseRecorder) []string {
+		var ids []string
+		for _, s := range getSensorSliceFromResponse(t, response.Body) {
+			ids = append(ids, s.ID)
+		}
+		return ids
+	}
+	next := regexp.MustCompile(`^<(.+)>; rel="next"$`)
+
+	t.Run("follow the Link header through GET /api/v1/sensor/?limit=2&sort=-updated", func(t *testing.T) {
+		response := get("/api/v1/sensor/?limit=2&sort=-updated")
+
+		assertResponseCode(t, response.Code, http.StatusOK)
+		if got := ids(response); !reflect.DeepEqual(got, []string{"attic", "kitchen"}) {
+			t.Errorf("got first page %v", got)
+		}
+		link := next.FindStringSubmatch(response.Header().Get("Link"))
+		if link == nil {
+			t.Fatalf("no next link in %q", response.Header().Get("Link"))
+		}
+
+		response = get(link[1])
+
+		assertResponseCode(t, response.Code, http.StatusOK)
+		if got := ids(response); !reflect.DeepEqual(got, []string{"cellar"}) {
+			t.Errorf("got second page %v", got)
+		}
+		assertHeader(t, response.Header(), "Link", "")
+	})
+
+	t.Run("return all sensors without a next link on GET /api/sensor/", func(t *testing.T) {
+		response := get("/api/sensor/")
+
+		assertResponseCode(t, response.Code, http.StatusOK)
+		if got := ids(response); !reflect.DeepEqual(got, []string{"attic", "cellar", "kitchen"}) {
+			t.Errorf("got %v, want all sensors", got)
+		}
+		if link := response.Header().Get("Link"); strings.Contains(link, `rel="next"`) {
+			t.Errorf("got a next link in %q", link)
+		}
+	})
+
+	t.Run("return only the selected fields on GET /api/v1/sensor/?sort=value&fields=id,value", func(t *testing.T) {
+		response := get("/api/v1/sensor/?sort=value&fields=id,value")
+
+		var got []map[string]interface{}
+		json.NewDecoder(response.Body).Decode(&got)
+		want := []map[string]interface{}{{"ID": "cellar", "Value": 12.0}, {"ID": "kitchen", "Value": 21.0}, {"ID": "attic", "Value": 30.0}}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	})
+
+	t.Run("return status 422 on GET /api/v1/sensor/ with invalid parameters", func(t *testing.T) {
+		response := get("/api/v1/sensor/?limit=0&sort=color&cursor=x&fields=ID,Color")
+
+		assertResponseCode(t, response.Code, http.StatusUnprocessableEntity)
+		var got problem
+		json.NewDecoder(response.Body).Decode(&got)
+		if len(got.Errors) != 4 {
+			t.Errorf("unexpected errors %v", got.Errors)
+		}
+	})
+}
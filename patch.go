@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+const (
+	mergePatchContentType = "application/merge-patch+json"
+	jsonPatchContentType  = "application/json-patch+json"
+)
+
+// acceptPatch lists the patch formats for the Accept-Patch header
+var acceptPatch = mergePatchContentType + ", " + jsonPatchContentType
+
+// patchMediaType returns the patch format of the body of r, false when it is not supported
+func patchMediaType(r *http.Request) (string, bool) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return mediaType, mediaType == mergePatchContentType || mediaType == jsonPatchContentType
+}
+
+// writeUnsupportedPatch answers r with 415, naming the supported patch formats
+func writeUnsupportedPatch(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Accept-Patch", acceptPatch)
+	writeProblem(w, r, http.StatusUnsupportedMediaType, "PATCH needs a body of type "+acceptPatch)
+}
+
+// applyPatch applies the patch in body, a RFC 7396 merge patch or RFC 6902 JSON patch depending on
+// mediaType, to the JSON encoding of record and returns the patched document
+func applyPatch(mediaType string, body []byte, record interface{}) ([]byte, error) {
+	encoded, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	var doc interface{}
+	err = json.Unmarshal(encoded, &doc)
+	if err != nil {
+		return nil, err
+	}
+
+	if mediaType == mergePatchContentType {
+		var patch interface{}
+		err = json.Unmarshal(body, &patch)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := patch.(map[string]interface{}); !ok {
+			return nil, fmt.Errorf("a merge patch of a record needs to be a JSON object: %w", ErrValidation)
+		}
+		return json.Marshal(mergePatch(doc, patch))
+	}
+
+	var operations []patchOperation
+	err = json.Unmarshal(body, &operations)
+	if err != nil {
+		return nil, err
+	}
+	for i, op := range operations {
+		doc, err = op.apply(doc)
+		if err != nil {
+			return nil, fmt.Errorf("operation %d: %w", i, err)
+		}
+	}
+	return json.Marshal(doc)
+}
+
+// mergePatch merges patch into target as described in RFC 7396, object members match existing
+// ones case-insensitive like encoding/json does
+func mergePatch(target, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = map[string]interface{}{}
+	}
+	for key, value := range p {
+		key = memberName(t, key)
+		if value == nil {
+			delete(t, key)
+		} else {
+			t[key] = mergePatch(t[key], value)
+		}
+	}
+	return t
+}
+
+// memberName returns the member of object matching key case-insensitive, key when there is none
+func memberName(object map[string]interface{}, key string) string {
+	if _, ok := object[key]; ok {
+		return key
+	}
+	for name := range object {
+		if strings.EqualFold(name, key) {
+			return name
+		}
+	}
+	return key
+}
+
+// patchOperation is a single operation of a RFC 6902 JSON patch
+type patchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from"`
+	Value json.RawMessage `json:"value"`
+}
+
+func (op patchOperation) apply(doc interface{}) (interface{}, error) {
+	var value interface{}
+	if op.Op == "add" || op.Op == "replace" || op.Op == "test" {
+		if op.Value == nil {
+			return nil, fmt.Errorf("%s needs a value: %w", op.Op, ErrValidation)
+		}
+		json.Unmarshal(op.Value, &value)
+	}
+
+	switch op.Op {
+	case "add":
+		return setPointer(doc, op.Path, value, true)
+	case "remove":
+		doc, _, err := removePointer(doc, op.Path)
+		return doc, err
+	case "replace":
+		if _, err := getPointer(doc, op.Path); err != nil {
+			return nil, err
+		}
+		return setPointer(doc, op.Path, value, false)
+	case "move", "copy":
+		from, err := getPointer(doc, op.From)
+		if err != nil {
+			return nil, err
+		}
+		if op.Op == "copy" {
+			// the copy must not share maps or slices with its source
+			encoded, _ := json.Marshal(from)
+			json.Unmarshal(encoded, &from)
+		} else {
+			if strings.HasPrefix(op.Path, op.From+"/") {
+				return nil, fmt.Errorf("can not move %s into itself: %w", op.From, ErrValidation)
+			}
+			doc, _, err = removePointer(doc, op.From)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return setPointer(doc, op.Path, from, true)
+	case "test":
+		current, err := getPointer(doc, op.Path)
+		if err != nil {
+			return nil, err
+		}
+		if !reflect.DeepEqual(current, value) {
+			return nil, fmt.Errorf("test of %s failed: %w", op.Path, ErrConflict)
+		}
+		return doc, nil
+	}
+	return nil, fmt.Errorf("unknown op %q: %w", op.Op, ErrValidation)
+}
+
+// parsePointer splits a RFC 6901 JSON pointer into its unescaped reference tokens
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("path %q does not start with /: %w", pointer, ErrValidation)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, t := range tokens {
+		tokens[i] = strings.Replace(strings.Replace(t, "~1", "/", -1), "~0", "~", -1)
+	}
+	return tokens, nil
+}
+
+func getPointer(doc interface{}, pointer string) (interface{}, error) {
+	tokens, err := parsePointer(pointer)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range tokens {
+		switch node := doc.(type) {
+		case map[string]interface{}:
+			value, ok := node[memberName(node, t)]
+			if !ok {
+				return nil, fmt.Errorf("path %s: %w", pointer, ErrValidation)
+			}
+			doc = value
+		case []interface{}:
+			i, err := strconv.Atoi(t)
+			if err != nil || i < 0 || i >= len(node) {
+				return nil, fmt.Errorf("path %s: %w", pointer, ErrValidation)
+			}
+			doc = node[i]
+		default:
+			return nil, fmt.Errorf("path %s: %w", pointer, ErrValidation)
+		}
+	}
+	return doc, nil
+}
+
+// setPointer sets the value at pointer, inserting into arrays when insert is true
+func setPointer(doc interface{}, pointer string, value interface{}, insert bool) (interface{}, error) {
+	tokens, err := parsePointer(pointer)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return value, nil
+	}
+	parentPointer := pointer[:strings.LastIndex(pointer, "/")]
+	parent, err := getPointer(doc, parentPointer)
+	if err != nil {
+		return nil, err
+	}
+	last := tokens[len(tokens)-1]
+	switch node := parent.(type) {
+	case map[string]interface{}:
+		node[memberName(node, last)] = value
+		return doc, nil
+	case []interface{}:
+		i := len(node)
+		if last != "-" {
+			i, err = strconv.Atoi(last)
+			if err != nil || i < 0 || i > len(node) {
+				return nil, fmt.Errorf("path %s: %w", pointer, ErrValidation)
+			}
+		}
+		if !insert && i == len(node) {
+			return nil, fmt.Errorf("path %s: %w", pointer, ErrValidation)
+		}
+		if insert {
+			node = append(node[:i], append([]interface{}{value}, node[i:]...)...)
+		} else {
+			node[i] = value
+		}
+		return setPointer(doc, parentPointer, node, false)
+	}
+	return nil, fmt.Errorf("path %s: %w", pointer, ErrValidation)
+}
+
+// removePointer removes the value at pointer, returning the document and the removed value
+func removePointer(doc interface{}, pointer string) (interface{}, interface{}, error) {
+	value, err := getPointer(doc, pointer)
+	if err != nil {
+		return nil, nil, err
+	}
+	tokens, _ := parsePointer(pointer)
+	if len(tokens) == 0 {
+		return nil, value, nil
+	}
+	parentPointer := pointer[:strings.LastIndex(pointer, "/")]
+	parent, _ := getPointer(doc, parentPointer)
+	last := tokens[len(tokens)-1]
+	switch node := parent.(type) {
+	case map[string]interface{}:
+		delete(node, memberName(node, last))
+		return doc, value, nil
+	case []interface{}:
+		i, _ := strconv.Atoi(last)
+		node = append(node[:i:i], node[i+1:]...)
+		doc, err = setPointer(doc, parentPointer, node, false)
+		return doc, value, err
+	}
+	return nil, nil, fmt.Errorf("path %s: %w", pointer, ErrValidation)
+}
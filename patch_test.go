@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPatch(t *testing.T) {
+	t.Run("apply a merge patch", func(t *testing.T) {
+		got, err := applyPatch(mergePatchContentType, []byte(`{"value": 20, "Unit": null}`), Sensor{ID: "kitchen", Name: "Kitchen", Unit: "C", Type: "generic", Value: 18})
+
+		want := `{"ID":"kitchen","Name":"Kitchen","Revision":0,"Type":"generic","Updated":"0001-01-01T00:00:00Z","Value":20}`
+		if err != nil || string(got) != want {
+			t.Errorf("got %s, %v, want %s", got, err, want)
+		}
+	})
+
+	t.Run("apply a JSON patch", func(t *testing.T) {
+		patch := `[{"op": "test", "path": "/State", "value": false}, {"op": "replace", "path": "/State", "value": true}, {"op": "copy", "from": "/ID", "path": "/Name"}]`
+
+		got, err := applyPatch(jsonPatchContentType, []byte(patch), Switch{ID: "lamp", Name: "Lamp", Type: "generic"})
+
+		want := `{"ID":"lamp","Name":"lamp","Revision":0,"State":true,"Type":"generic","Updated":"0001-01-01T00:00:00Z"}`
+		if err != nil || string(got) != want {
+			t.Errorf("got %s, %v, want %s", got, err, want)
+		}
+	})
+
+	t.Run("fail JSON patches with a failing test or an unknown path", func(t *testing.T) {
+		sw := Switch{ID: "lamp", Name: "Lamp", Type: "generic"}
+
+		_, err := applyPatch(jsonPatchContentType, []byte(`[{"op": "test", "path": "/State", "value": true}]`), sw)
+		if !errors.Is(err, ErrConflict) {
+			t.Errorf("got %v, want ErrConflict", err)
+		}
+		_, err = applyPatch(jsonPatchContentType, []byte(`[{"op": "remove", "path": "/Color"}]`), sw)
+		if !errors.Is(err, ErrValidation) {
+			t.Errorf("got %v, want ErrValidation", err)
+		}
+	})
+
+	t.Run("edit arrays with JSON pointers", func(t *testing.T) {
+		doc := map[string]interface{}{"a": []interface{}{"x", "z"}, "b~/c": 1}
+		patch := `[{"op": "add", "path": "/a/1", "value": "y"}, {"op": "add", "path": "/a/-", "value": "end"}, {"op": "remove", "path": "/a/0"}, {"op": "move", "from": "/b~0~1c", "path": "/d"}]`
+
+		got, err := applyPatch(jsonPatchContentType, []byte(patch), doc)
+
+		want := `{"a":["y","z","end"],"d":1}`
+		if err != nil || string(got) != want {
+			t.Errorf("got %s, %v, want %s", got, err, want)
+		}
+	})
+}
+
+func TestPatchAPI(t *testing.T) {
+	store := StubHivemindStore{
+		map[string]Sensor{"kitchen": Sensor{ID: "kitchen", Name: "Kitchen", Unit: "C", Type: "temperature", Value: 18}},
+		map[string]Switch{"lamp": Switch{ID: "lamp", Name: "Lamp", Type: "generic"}},
+	}
+	server := NewHivemindServer(&store)
+	patch := func(url, contentType string, body io.Reader) *httptest.ResponseRecorder {
+		request, _ := http.NewRequest(http.MethodPatch, "/"+url, body)
+		request.Header.Set("Content-Type", contentType)
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, request)
+		return response
+	}
+
+	t.Run("keep the other fields on PATCH /api/sensor/kitchen with a reading", func(t *testing.T) {
+		response := patch("api/sensor/kitchen", mergePatchContentType, strings.NewReader(`{"Value": 20}`))
+
+		assertResponseCode(t, response.Code, http.StatusAccepted)
+		assertSensor(t, getSensorFromResponse(t, response.Body), Sensor{ID: "kitchen", Name: "Kitchen", Unit: "C", Type: "temperature", Value: 20})
+		assertSensor(t, store.sensors["kitchen"], Sensor{ID: "kitchen", Name: "Kitchen", Unit: "C", Type: "temperature", Value: 20})
+	})
+
+	t.Run("return status 422 on PATCH /api/sensor/kitchen with an invalid result", func(t *testing.T) {
+		response := patch("api/sensor/kitchen", mergePatchContentType, strings.NewReader(`{"Value": 900, "ID": "cellar"}`))
+
+		assertResponseCode(t, response.Code, http.StatusUnprocessableEntity)
+		var got problem
+		json.NewDecoder(response.Body).Decode(&got)
+		if len(got.Errors) != 2 {
+			t.Errorf("unexpected errors %v", got.Errors)
+		}
+		assertSensor(t, store.sensors["kitchen"], Sensor{ID: "kitchen", Name: "Kitchen", Unit: "C", Type: "temperature", Value: 20})
+	})
+
+	t.Run("return status 409 on PATCH /api/switch/lamp with a failing test", func(t *testing.T) {
+		response := patch("api/switch/lamp", jsonPatchContentType, strings.NewReader(`[{"op": "test", "path": "/State", "value": true}, {"op": "replace", "path": "/State", "value": false}]`))
+
+		assertResponseCode(t, response.Code, http.StatusConflict)
+	})
+
+	t.Run("return status 404 on PATCH /api/switch/{random}", func(t *testing.T) {
+		response := patch("api/switch/"+randomString(8), mergePatchContentType, strings.NewReader(`{"State": true}`))
+
+		assertResponseCode(t, response.Code, http.StatusNotFound)
+	})
+
+	t.Run("return status 415 on PATCH /api/switch/lamp with plain JSON", func(t *testing.T) {
+		response := patch("api/switch/lamp", "application/json", strings.NewReader(`{"State": true}`))
+
+		assertResponseCode(t, response.Code, http.StatusUnsupportedMediaType)
+		assertHeader(t, response.Header(), "Accept-Patch", acceptPatch)
+		assertSwitch(t, store.switches["lamp"], Switch{ID: "lamp", Name: "Lamp", Type: "generic"})
+	})
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+const (
+	roleViewer   = "viewer"
+	roleOperator = "operator"
+	roleAdmin    = "admin"
+)
+
+// RoleGrant gives a user a role on a Location, a single Sensor or Switch, or on everything when no
+// target is set; viewers can read, operators can also change state and admins, only granted globally,
+// have the admin scope
+type RoleGrant struct {
+	Role     string
+	Location string `json:",omitempty"`
+	Sensor   string `json:",omitempty"`
+	Switch   string `json:",omitempty"`
+}
+
+// Location groups sensors and switches, like a room
+type Location struct {
+	ID       string
+	Name     string
+	Sensors  []string
+	Switches []string
+}
+
+// LocationStore is an interface for location datastorage
+type LocationStore interface {
+	getLocation(id string) (Location, error)
+	getAllLocations() []Location
+	storeLocation(l Location) error
+	deleteLocation(id string) error
+}
+
+func (g RoleGrant) validate() error {
+	if g.Role != roleViewer && g.Role != roleOperator && g.Role != roleAdmin {
+		return errors.New("unknown role " + g.Role)
+	}
+	targets := 0
+	for _, t := range []string{g.Location, g.Sensor, g.Switch} {
+		if t != "" {
+			targets++
+		}
+	}
+	if targets > 1 {
+		return errors.New("a role grant targets either a Location, a Sensor or a Switch")
+	}
+	if g.Role == roleAdmin && targets > 0 {
+		return errors.New("the admin role can only be granted globally")
+	}
+	return nil
+}
+
+func (g RoleGrant) global() bool {
+	return g.Location == "" && g.Sensor == "" && g.Switch == ""
+}
+
+// covers reports whether the grant applies to the entity of kind sensor or switch with id
+func (g RoleGrant) covers(locations LocationStore, kind, id string) bool {
+	switch {
+	case g.global():
+		return true
+	case g.Sensor != "":
+		return kind == "sensor" && g.Sensor == id
+	case g.Switch != "":
+		return kind == "switch" && g.Switch == id
+	}
+	if locations == nil {
+		return false
+	}
+	l, err := locations.getLocation(g.Location)
+	if err != nil {
+		return false
+	}
+	if kind == "sensor" {
+		return contains(l.Sensors, id)
+	}
+	return contains(l.Switches, id)
+}
+
+// access is what a caller does to a sensor or switch
+type access int
+
+const (
+	readAccess access = iota
+	// reportAccess stores the current value of a sensor, by PUT or a batch or InfluxDB write
+	reportAccess
+	writeAccess
+)
+
+// authorized reports whether the caller of r may access the sensor or switch id as a; device tokens
+// and certificates may only report the values of their own sensors
+func (h *HivemindServer) authorized(r *http.Request, kind, id string, a access) bool {
+	i, ok := identityFromRequest(r)
+	if !ok {
+		return true
+	}
+	if i.sensors != nil {
+		return kind == "sensor" && a == reportAccess && contains(i.sensors, id)
+	}
+	write := a != readAccess
+	scope := kind + ":read"
+	if write {
+		scope = kind + ":write"
+	}
+	if i.hasScope(scope) {
+		return true
+	}
+	for _, g := range i.roles {
+		if write && g.Role == roleViewer {
+			continue
+		}
+		if g.covers(h.locations, kind, id) {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *HivemindServer) apiLocationHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.Split(r.URL.Path[len("/api/location/"):], "/")[0]
+	w.Header().Set("content-type", "application/json")
+	if h.locations == nil {
+		writeProblem(w, r, http.StatusNotImplemented, "")
+		return
+	}
+
+	switch {
+	case id == "" && r.Method == http.MethodGet:
+		json.NewEncoder(w).Encode(h.locations.getAllLocations())
+	case id == "":
+		writeProblem(w, r, http.StatusMethodNotAllowed, "")
+	case r.Method == http.MethodGet:
+		l, err := h.locations.getLocation(id)
+		if err != nil || l.ID == "" {
+			writeProblem(w, r, http.StatusNotFound, "")
+			return
+		}
+		json.NewEncoder(w).Encode(l)
+	case r.Method == http.MethodPut:
+		var l Location
+		err := json.NewDecoder(r.Body).Decode(&l)
+		if err != nil {
+			writeDecodeError(w, r, err)
+			return
+		}
+		l.ID = id
+		err = h.locations.storeLocation(l)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(l)
+	case r.Method == http.MethodDelete:
+		err := h.locations.deleteLocation(id)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeProblem(w, r, http.StatusMethodNotAllowed, "")
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestRoleBasedAccess(t *testing.T) {
+	store := StubHivemindStore{
+		map[string]Sensor{"kidsroom_temp": Sensor{ID: "kidsroom_temp", Name: "Kids Room", Unit: "C", Type: "generic", Value: 21}},
+		map[string]Switch{
+			"kidsroom_lamp": Switch{ID: "kidsroom_lamp", Name: "Lamp", Type: "generic"},
+			"boiler":        Switch{ID: "boiler", Name: "Boiler", Type: "generic", State: true},
+		},
+	}
+	users := newStubUserStore()
+	locations := newStubLocationStore()
+	locations.storeLocation(Location{"kidsroom", "Kids Room", []string{"kidsroom_temp"}, []string{"kidsroom_lamp"}})
+	hash, _ := bcrypt.GenerateFromPassword([]byte("correct horse"), bcrypt.MinCost)
+	users.storeUser(User{Username: "kid", PasswordHash: string(hash), Roles: []RoleGrant{{Role: roleOperator, Location: "kidsroom"}}})
+	users.storeUser(User{Username: "guest", PasswordHash: string(hash), Roles: []RoleGrant{{Role: roleViewer, Switch: "boiler"}}})
+	server := NewHivemindServer(&store)
+	server.users = users
+	server.locations = locations
+
+	login := func(username string) func(*http.Request) *http.Request {
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, newPostRequest("api/auth/login", strings.NewReader(`{"Username": "`+username+`", "Password": "correct horse"}`)))
+		var info sessionInfo
+		json.NewDecoder(response.Body).Decode(&info)
+		cookie := response.Result().Cookies()[0]
+		return func(request *http.Request) *http.Request {
+			request.AddCookie(cookie)
+			request.Header.Set(csrfHeader, info.CSRFToken)
+			return request
+		}
+	}
+	kid := login("kid")
+	guest := login("guest")
+
+	t.Run("return only the switches of the granted location on GET /api/switch/", func(t *testing.T) {
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, kid(newGetRequest("api/switch/")))
+
+		var got []Switch
+		json.NewDecoder(response.Body).Decode(&got)
+
+		assertResponseCode(t, response.Code, http.StatusOK)
+		assertSwitchSlice(t, got, []Switch{{ID: "kidsroom_lamp", Name: "Lamp", Type: "generic"}})
+	})
+
+	t.Run("return status 202 on PUT /api/switch/kidsroom_lamp as operator of the location", func(t *testing.T) {
+		request := newPutRequest("api/switch/kidsroom_lamp", strings.NewReader(`{"ID": "kidsroom_lamp", "Name": "Lamp", "Type": "generic", "State": true}`))
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, kid(request))
+
+		assertResponseCode(t, response.Code, http.StatusAccepted)
+		assertSwitch(t, store.switches["kidsroom_lamp"], Switch{ID: "kidsroom_lamp", Name: "Lamp", Type: "generic", State: true})
+	})
+
+	t.Run("return status 403 on PUT /api/switch/boiler outside the granted location", func(t *testing.T) {
+		request := newPutRequest("api/switch/boiler", strings.NewReader(`{"ID": "boiler", "Name": "Boiler", "Type": "generic", "State": false}`))
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, kid(request))
+
+		assertResponseCode(t, response.Code, http.StatusForbidden)
+		assertSwitch(t, store.switches["boiler"], Switch{ID: "boiler", Name: "Boiler", Type: "generic", State: true})
+	})
+
+	t.Run("return status 422 on PUT /api/switch/kidsroom_lamp with the id of another switch in the body", func(t *testing.T) {
+		request := newPutRequest("api/switch/kidsroom_lamp", strings.NewReader(`{"ID": "boiler", "Name": "Boiler", "Type": "generic", "State": false}`))
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, kid(request))
+
+		assertResponseCode(t, response.Code, http.StatusUnprocessableEntity)
+		assertSwitch(t, store.switches["boiler"], Switch{ID: "boiler", Name: "Boiler", Type: "generic", State: true})
+	})
+
+	t.Run("return status 403 on GET /api/switch/boiler outside the granted location", func(t *testing.T) {
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, kid(newGetRequest("api/switch/boiler")))
+
+		assertResponseCode(t, response.Code, http.StatusForbidden)
+	})
+
+	t.Run("let viewers read but not change", func(t *testing.T) {
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, guest(newGetRequest("api/switch/boiler")))
+
+		assertResponseCode(t, response.Code, http.StatusOK)
+
+		request := newPutRequest("api/switch/boiler", strings.NewReader(`{"ID": "boiler", "Name": "Boiler", "Type": "generic", "State": false}`))
+		response = httptest.NewRecorder()
+		server.ServeHTTP(response, guest(request))
+
+		assertResponseCode(t, response.Code, http.StatusForbidden)
+	})
+
+	t.Run("return status 403 on PUT /api/location/kidsroom without admin", func(t *testing.T) {
+		request := newPutRequest("api/location/kidsroom", strings.NewReader(`{"Name": "Kids Room", "Switches": ["kidsroom_lamp", "boiler"]}`))
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, kid(request))
+
+		assertResponseCode(t, response.Code, http.StatusForbidden)
+	})
+
+	t.Run("reject unknown roles on PUT /api/user/kid", func(t *testing.T) {
+		users.storeUser(User{Username: "root", PasswordHash: string(hash), Roles: []RoleGrant{{Role: roleAdmin}}})
+		root := login("root")
+		request := newPutRequest("api/user/kid", strings.NewReader(`{"Name": "Kid", "Roles": [{"Role": "owner", "Location": "kidsroom"}]}`))
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, root(request))
+
+		assertResponseCode(t, response.Code, http.StatusUnprocessableEntity)
+	})
+
+	t.Run("reject admin grants on a location on PUT /api/user/kid", func(t *testing.T) {
+		root := login("root")
+		request := newPutRequest("api/user/kid", strings.NewReader(`{"Name": "Kid", "Roles": [{"Role": "admin", "Location": "kidsroom"}]}`))
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, root(request))
+
+		assertResponseCode(t, response.Code, http.StatusUnprocessableEntity)
+	})
+}
+
+// stubs
+type stubLocationStore struct {
+	locations map[string]Location
+}
+
+func newStubLocationStore() *stubLocationStore {
+	return &stubLocationStore{make(map[string]Location)}
+}
+
+func (s *stubLocationStore) getLocation(id string) (Location, error) {
+	return s.locations[id], nil
+}
+
+func (s *stubLocationStore) getAllLocations() []Location {
+	var locations []Location
+	for _, l := range s.locations {
+		locations = append(locations, l)
+	}
+	return locations
+}
+
+func (s *stubLocationStore) storeLocation(l Location) error {
+	s.locations[l.ID] = l
+	return nil
+}
+
+func (s *stubLocationStore) deleteLocation(id string) error {
+	delete(s.locations, id)
+	return nil
+}
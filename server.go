@@ -1,35 +1,186 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/json"
 	"io/ioutil"
 	"net/http"
-	"strings"
+	"reflect"
+	"time"
 )
 
 // HivemindServer is a HTTP interface for Hivemind
 type HivemindServer struct {
-	store HivemindStore
+	store       HivemindStore
+	metrics     *httpMetrics
+	collectors  []metricsCollector
+	checks      []healthCheck
+	influxRules []influxRule
+	webhooks    *WebhookDispatcher
+	alerts      *AlertManager
+	tokens      TokenStore
+	users       UserStore
+	locations   LocationStore
+	devices     DeviceStore
+	ca          *localCA
+	cors        *corsPolicy
+	history     HistoryStore
+	changes     *changeFeed
+	schema      *gqlSchema
+	// legacySunset is announced as the end of the legacy API paths, none when zero
+	legacySunset time.Time
 	http.Handler
 }
 
 // NewHivemindServer creates a HivemindServer with routing configured
 func NewHivemindServer(s HivemindStore) *HivemindServer {
 	h := new(HivemindServer)
+	h.metrics = newHTTPMetrics()
 
 	router := http.NewServeMux()
-	router.Handle("/", http.HandlerFunc(h.rootHandler))
-	router.Handle("/api/", http.HandlerFunc(h.apiHandler))
-	router.Handle("/api/sensor/", http.HandlerFunc(h.apiSensorHandler))
-	router.Handle("/api/switch/", http.HandlerFunc(h.apiSwitchHandler))
+	handle := func(pattern string, handler http.HandlerFunc) {
+		router.Handle(pattern, h.metrics.instrument(pattern, handler))
+	}
+	for _, route := range h.routes() {
+		handle(route.Pattern, route.Handler)
+	}
 
-	h.Handler = router
+	h.Handler = h.logRequests(h.handleCORS(h.authenticate(router)))
 
 	h.store = s
+	h.schema = h.graphQLSchema()
 
 	return h
 }
 
+// routes returns the routes of the API, the OpenAPI document describes their operations; sensors and
+// switches are served below /api/v1/ and on their deprecated legacy paths
+func (h *HivemindServer) routes() []apiRoute {
+	batch := []string{"application/json", "application/x-ndjson"}
+	text := []string{"text/plain"}
+
+	return []apiRoute{
+		{"/", h.rootHandler, nil},
+		{"/api/", h.apiHandler, nil},
+		{apiV1Prefix + "/", h.apiHandler, nil},
+		{apiV1Prefix + "/sensor/", h.apiSensorHandler, recordOperations(apiV1Prefix+"/sensor/", "sensor", "sensors", Sensor{}, false)},
+		{apiV1Prefix + "/sensor/batch", h.apiSensorBatchHandler, []apiOperation{
+			{Method: http.MethodPost, Path: apiV1Prefix + "/sensor/batch", Summary: "Store a JSON array or NDJSON stream of sensors in one transaction", Request: []Sensor{}, RequestTypes: batch, Response: []batchResult{}},
+		}},
+		{apiV1Prefix + "/switch/", h.apiSwitchHandler, recordOperations(apiV1Prefix+"/switch/", "switch", "switches", Switch{}, false)},
+		{"/api/sensor/", h.deprecated(h.apiSensorHandler), recordOperations("/api/sensor/", "sensor", "sensors", Sensor{}, true)},
+		{"/api/sensor/batch", h.deprecated(h.apiSensorBatchHandler), []apiOperation{
+			{Method: http.MethodPost, Path: "/api/sensor/batch", Summary: "Store a JSON array or NDJSON stream of sensors in one transaction", Request: []Sensor{}, RequestTypes: batch, Response: []batchResult{}, Deprecated: true},
+		}},
+		{"/api/switch/", h.deprecated(h.apiSwitchHandler), recordOperations("/api/switch/", "switch", "switches", Switch{}, true)},
+		{"/api/v2/write", h.apiInfluxWriteHandler, []apiOperation{
+			{Method: http.MethodPost, Path: "/api/v2/write", Summary: "Store sensor readings in InfluxDB line protocol", Request: "", RequestTypes: text, Status: http.StatusNoContent},
+		}},
+		{"/api/webhook/", h.apiWebhookHandler, []apiOperation{
+			{Method: http.MethodGet, Path: "/api/webhook/", Summary: "List webhooks", Response: []Webhook{}},
+			{Method: http.MethodPost, Path: "/api/webhook/", Summary: "Create a webhook", Request: Webhook{}, Response: Webhook{}, Status: http.StatusAccepted},
+			{Method: http.MethodGet, Path: "/api/webhook/{id}", Summary: "Get a webhook", Response: Webhook{}},
+			{Method: http.MethodPut, Path: "/api/webhook/{id}", Summary: "Store a webhook", Request: Webhook{}, Response: Webhook{}, Status: http.StatusAccepted},
+			{Method: http.MethodDelete, Path: "/api/webhook/{id}", Summary: "Delete a webhook and its deliveries", Status: http.StatusNoContent},
+			{Method: http.MethodGet, Path: "/api/webhook/{id}/deliveries", Summary: "List the latest delivery attempts of a webhook", Response: []WebhookDelivery{}},
+		}},
+		{"/api/alert/", h.apiAlertHandler, []apiOperation{
+			{Method: http.MethodGet, Path: "/api/alert/", Summary: "List alerts", Response: []Alert{}},
+			{Method: http.MethodGet, Path: "/api/alert/{rule}", Summary: "Get the alert of a rule", Response: Alert{}},
+			{Method: http.MethodPost, Path: "/api/alert/{rule}/ack", Summary: "Acknowledge an alert", Response: Alert{}},
+			{Method: http.MethodGet, Path: "/api/alert/rule/", Summary: "List alert rules", Response: []AlertRule{}},
+			{Method: http.MethodPost, Path: "/api/alert/rule/", Summary: "Create an alert rule", Request: AlertRule{}, Response: AlertRule{}, Status: http.StatusAccepted},
+			{Method: http.MethodGet, Path: "/api/alert/rule/{id}", Summary: "Get an alert rule", Response: AlertRule{}},
+			{Method: http.MethodPut, Path: "/api/alert/rule/{id}", Summary: "Store an alert rule", Request: AlertRule{}, Response: AlertRule{}, Status: http.StatusAccepted},
+			{Method: http.MethodDelete, Path: "/api/alert/rule/{id}", Summary: "Delete an alert rule and its alert", Status: http.StatusNoContent},
+		}},
+		{"/api/token/", h.apiTokenHandler, []apiOperation{
+			{Method: http.MethodGet, Path: "/api/token/", Summary: "List API tokens", Response: []Token{}},
+			{Method: http.MethodPost, Path: "/api/token/", Summary: "Mint an API token with Scopes or a device token with Sensors", Request: Token{}, Response: mintedToken{}, Status: http.StatusAccepted},
+			{Method: http.MethodDelete, Path: "/api/token/{id}", Summary: "Revoke an API token", Status: http.StatusNoContent},
+		}},
+		{"/api/auth/", h.apiAuthHandler, []apiOperation{
+			{Method: http.MethodPost, Path: "/api/auth/login", Summary: "Start a session", Request: loginRequest{}, Response: sessionInfo{}},
+			{Method: http.MethodPost, Path: "/api/auth/logout", Summary: "End the session", Status: http.StatusNoContent},
+			{Method: http.MethodGet, Path: "/api/auth/session", Summary: "Get the current session", Response: sessionInfo{}},
+		}},
+		{"/api/user/", h.apiUserHandler, []apiOperation{
+			{Method: http.MethodGet, Path: "/api/user/", Summary: "List users", Response: []User{}},
+			{Method: http.MethodGet, Path: "/api/user/{username}", Summary: "Get a user", Response: User{}},
+			{Method: http.MethodPut, Path: "/api/user/{username}", Summary: "Create or change a user", Request: userRequest{}, Response: User{}, Status: http.StatusAccepted},
+			{Method: http.MethodDelete, Path: "/api/user/{username}", Summary: "Delete a user", Status: http.StatusNoContent},
+		}},
+		{"/api/location/", h.apiLocationHandler, []apiOperation{
+			{Method: http.MethodGet, Path: "/api/location/", Summary: "List locations", Response: []Location{}},
+			{Method: http.MethodGet, Path: "/api/location/{id}", Summary: "Get a location", Response: Location{}},
+			{Method: http.MethodPut, Path: "/api/location/{id}", Summary: "Store a location", Request: Location{}, Response: Location{}, Status: http.StatusAccepted},
+			{Method: http.MethodDelete, Path: "/api/location/{id}", Summary: "Delete a location", Status: http.StatusNoContent},
+		}},
+		{"/api/device/", h.apiDeviceHandler, []apiOperation{
+			{Method: http.MethodGet, Path: "/api/device/", Summary: "List devices", Response: []Device{}},
+			{Method: http.MethodGet, Path: "/api/device/{id}", Summary: "Get a device", Response: Device{}},
+			{Method: http.MethodDelete, Path: "/api/device/{id}", Summary: "Delete a device", Status: http.StatusNoContent},
+			{Method: http.MethodPost, Path: "/api/device/{id}/approve", Summary: "Approve a pending device and issue its certificate", Request: approveRequest{}, Response: Device{}, Status: http.StatusAccepted},
+			{Method: http.MethodPost, Path: "/api/device/{id}/revoke", Summary: "Revoke the certificate of a device", Response: Device{}, Status: http.StatusAccepted},
+			{Method: http.MethodPost, Path: "/api/device/enroll", Summary: "Request a certificate for a device", Request: enrollRequest{}, Response: map[string]string{}, Status: http.StatusAccepted},
+			{Method: http.MethodGet, Path: "/api/device/enroll/{id}", Summary: "Poll the status and certificate of an enrollment", Response: map[string]string{}},
+			{Method: http.MethodGet, Path: "/api/device/ca", Summary: "Get the certificate of the local CA", Response: "", ResponseType: "application/x-pem-file"},
+			{Method: http.MethodGet, Path: "/api/device/crl", Summary: "Get the list of revoked device certificates", Response: []byte{}, ResponseType: "application/pkix-crl"},
+		}},
+		{"/api/graphql", h.apiGraphQLHandler, []apiOperation{
+			{Method: http.MethodGet, Path: "/api/graphql", Summary: "Run a GraphQL query", Parameters: []string{"query", "variables", "operationName"}, Response: graphQLResponse{}},
+			{Method: http.MethodPost, Path: "/api/graphql", Summary: "Run a GraphQL query or mutation, or stream a subscription as server-sent events", Request: graphQLRequest{}, Response: graphQLResponse{}},
+		}},
+		{"/api/openapi.json", h.apiOpenAPIHandler, []apiOperation{
+			{Method: http.MethodGet, Path: "/api/openapi.json", Summary: "Get this OpenAPI document", Response: map[string]interface{}{}},
+		}},
+		{"/api/docs", h.apiDocsHandler, []apiOperation{
+			{Method: http.MethodGet, Path: "/api/docs", Summary: "Browse and try the API", Response: "", ResponseType: "text/html"},
+		}},
+		{"/metrics", h.metricsHandler, []apiOperation{
+			{Method: http.MethodGet, Path: "/metrics", Summary: "Get metrics in the Prometheus text format", Response: "", ResponseType: "text/plain"},
+		}},
+		{"/healthz", h.healthzHandler, []apiOperation{
+			{Method: http.MethodGet, Path: "/healthz", Summary: "Check that the server is alive", Response: map[string]string{}},
+		}},
+		{"/readyz", h.readyzHandler, []apiOperation{
+			{Method: http.MethodGet, Path: "/readyz", Summary: "Check that the dependencies of the server work", Response: readiness{}},
+		}},
+	}
+}
+
+// recordOperations returns the operations on the sensors or switches below collection; on the legacy
+// paths lists are complete unless a limit is given and writes are answered with 202 Accepted
+func recordOperations(collection, kind, plural string, record interface{}, legacy bool) []apiOperation {
+	list := []string{"limit", "cursor", "sort", "fields", "If-None-Match"}
+	read := []string{"fields", "If-None-Match"}
+	write := []string{"If-Match"}
+	patch := []string{mergePatchContentType, jsonPatchContentType}
+	records := reflect.MakeSlice(reflect.SliceOf(reflect.TypeOf(record)), 0, 0).Interface()
+	item := collection + "{id}"
+
+	created, stored, response := http.StatusCreated, http.StatusOK, record
+	if legacy {
+		created, stored, response = http.StatusAccepted, http.StatusAccepted, nil
+	}
+	operations := []apiOperation{
+		{Method: http.MethodGet, Path: collection, Summary: "List " + plural, Parameters: list, Response: records},
+		{Method: http.MethodPost, Path: collection, Summary: "Store a " + kind, Request: record, Response: response, Status: created},
+		{Method: http.MethodGet, Path: item, Summary: "Get a " + kind, Parameters: read, Response: record},
+		{Method: http.MethodPut, Path: item, Summary: "Store a " + kind, Parameters: write, Request: record, Response: response, Status: stored},
+		{Method: http.MethodPatch, Path: item, Summary: "Change fields of a " + kind, Parameters: write, Request: map[string]interface{}{}, RequestTypes: patch, Response: record, Status: stored},
+		{Method: http.MethodDelete, Path: item, Summary: "Delete a " + kind, Parameters: write, Status: http.StatusNoContent},
+	}
+	if legacy {
+		operations[0].Summary = "List all " + plural + " unless a limit is given"
+		for i := range operations {
+			operations[i].Deprecated = true
+		}
+	}
+	return operations
+}
+
 func (h *HivemindServer) rootHandler(w http.ResponseWriter, r *http.Request) {
 	url := r.URL.Path
 	if url == "/" {
@@ -39,169 +190,500 @@ func (h *HivemindServer) rootHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// addCollector adds metrics of c to the /metrics endpoint
+func (h *HivemindServer) addCollector(c metricsCollector) {
+	h.collectors = append(h.collectors, c)
+}
+
+func (h *HivemindServer) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("content-type", "text/plain; version=0.0.4; charset=utf-8")
+
+	writeMetricHeader(w, "hivemind_sensor_value", "gauge", "Current value of a sensor.")
+	for _, s := range h.store.getAllSensors() {
+		writeMetric(w, "hivemind_sensor_value", []string{"id", s.ID, "name", s.Name, "unit", s.Unit, "type", s.Type}, float64(s.Value))
+	}
+	writeMetricHeader(w, "hivemind_switch_state", "gauge", "Current state of a switch, 1 is on.")
+	for _, s := range h.store.getAllSwitches() {
+		state := 0.0
+		if s.State {
+			state = 1
+		}
+		writeMetric(w, "hivemind_switch_state", []string{"id", s.ID, "name", s.Name, "type", s.Type}, state)
+	}
+	h.metrics.collectMetrics(w)
+	for _, c := range h.collectors {
+		c.collectMetrics(w)
+	}
+}
+
 func (h *HivemindServer) apiHandler(w http.ResponseWriter, r *http.Request) {
-	endpoint := r.URL.Path[len("/api"):]
+	endpoint := unversionedPath(r.URL.Path)[len("/api"):]
 	w.Header().Set("content-type", "application/json")
 	if endpoint != "/" {
-		w.WriteHeader(http.StatusNotImplemented)
+		writeProblem(w, r, http.StatusNotFound, "no API endpoint "+r.URL.Path)
+	}
+}
+
+// itemMethods returns the methods supported on a collection or, with an id, on one of its items
+func itemMethods(id string) []string {
+	if id == "" {
+		return []string{http.MethodGet, http.MethodPost}
 	}
+	return []string{http.MethodGet, http.MethodPut, http.MethodPatch, http.MethodDelete}
 }
 
 func (h *HivemindServer) apiSensorHandler(w http.ResponseWriter, r *http.Request) {
-	trailing := r.URL.Path[len("/api/sensor"):]
-	id := strings.Split(trailing[1:], "/")[0]
+	id := itemID(r, "/api/sensor/")
 	w.Header().Set("content-type", "application/json")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
+	allowed := itemMethods(id)
+	if !contains(allowed, r.Method) {
+		writeMethodNotAllowed(w, r, allowed...)
+		return
+	}
 
 	switch r.Method {
 	case http.MethodGet:
-		h.apiSensorGet(w, trailing, id)
+		h.apiSensorGet(w, r, id)
 	case http.MethodPost:
-		var body []byte
-		if r.Body != nil {
-			body, _ = ioutil.ReadAll(r.Body)
-		}
-		h.apiSensorPost(w, trailing, body)
+		h.apiSensorPost(w, r, readBody(r))
 	case http.MethodPut:
-		var body []byte
-		if r.Body != nil {
-			body, _ = ioutil.ReadAll(r.Body)
-		}
-		h.apiSensorPut(w, trailing, id, body)
-	default:
-		w.WriteHeader(http.StatusNotImplemented)
+		h.apiSensorPut(w, r, id, readBody(r))
+	case http.MethodPatch:
+		h.apiSensorPatch(w, r, id, readBody(r))
+	case http.MethodDelete:
+		h.apiSensorDelete(w, r, id)
+	}
+}
+
+// readBody returns the body of r, nil when there is none
+func readBody(r *http.Request) []byte {
+	if r.Body == nil {
+		return nil
 	}
+	body, _ := ioutil.ReadAll(r.Body)
+	return body
 }
 
-func (h *HivemindServer) apiSensorGet(w http.ResponseWriter, trailing, id string) {
+func (h *HivemindServer) apiSensorGet(w http.ResponseWriter, r *http.Request, id string) {
 	if id == "" {
-		err := json.NewEncoder(w).Encode(h.store.getAllSensors())
+		q, err := parsePageQuery(r, reflect.TypeOf(Sensor{}))
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
+			writeError(w, r, err)
 			return
 		}
-	} else {
-		value, err := h.store.getSensor(id)
-		if err != nil {
-			w.WriteHeader(http.StatusNotFound)
+		q.Include = func(id string) bool {
+			return h.authorized(r, "sensor", id, readAccess)
 		}
-		err = json.NewEncoder(w).Encode(value)
+		sensors, more, err := h.store.listSensors(q)
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
+			writeError(w, r, err)
 			return
 		}
+		if more {
+			last := sensors[len(sensors)-1]
+			setNextLink(w, r, q.position(sensorSortKey(last, q.Sort), last.ID))
+		}
+		writeJSONList(w, r, selectFields(sensors, q.Fields))
+		return
+	}
+	if !h.authorized(r, "sensor", id, readAccess) {
+		writeProblem(w, r, http.StatusForbidden, "")
+		return
+	}
+	fields, err := parseFields(r, reflect.TypeOf(Sensor{}))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	value, err := h.store.getSensor(id)
+	if err != nil {
+		writeError(w, r, err)
+		return
 	}
+	writeJSONRevision(w, r, selectFields(value, fields), value.Revision, fields)
 }
 
-func (h *HivemindServer) apiSensorPost(w http.ResponseWriter, trailing string, body []byte) {
-	if trailing != "/" {
-		w.WriteHeader(http.StatusNotImplemented)
-	} else {
-		var s Sensor
-		err := json.Unmarshal(body, &s)
+func (h *HivemindServer) apiSensorPost(w http.ResponseWriter, r *http.Request, body []byte) {
+	s, err := decodeSensor(body, "")
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if !h.authorized(r, "sensor", s.ID, writeAccess) {
+		writeProblem(w, r, http.StatusForbidden, "")
+		return
+	}
+	err = h.storeFor(r).storeSensor(s)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if isLegacyAPI(r) {
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	w.Header().Set("Location", apiV1Prefix+"/sensor/"+s.ID)
+	h.writeStoredSensor(w, r, s.ID, http.StatusCreated)
+}
+
+func (h *HivemindServer) apiSensorPut(w http.ResponseWriter, r *http.Request, id string, body []byte) {
+	s, err := decodeSensor(body, id)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if !h.authorized(r, "sensor", id, reportAccess) {
+		writeProblem(w, r, http.StatusForbidden, "")
+		return
+	}
+	if !hasIfMatch(r) {
+		err = h.storeFor(r).storeSensor(s)
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
+			writeError(w, r, err)
 			return
 		}
-		err = h.store.storeSensor(s)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
+		if isLegacyAPI(r) {
+			w.WriteHeader(http.StatusAccepted)
 			return
 		}
+		h.writeStoredSensor(w, r, id, http.StatusOK)
+		return
+	}
+	// a conditional PUT only replaces the sensor at the revision the client has seen
+	stored, err := h.storeFor(r).updateSensor(id, func(current *Sensor) error {
+		err := checkIfMatch(r, "sensor", id, current.Revision)
+		if err == nil {
+			*current = s
+		}
+		return err
+	})
+	if err != nil {
+		writeError(w, r, conditionalError(r, err))
+		return
+	}
+	if isLegacyAPI(r) {
+		w.Header().Set("ETag", revisionETag(stored.Revision))
 		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	writeRecord(w, http.StatusOK, stored, stored.Revision)
+}
+
+// writeStoredSensor answers a write on /api/v1/ with status and the sensor as stored
+func (h *HivemindServer) writeStoredSensor(w http.ResponseWriter, r *http.Request, id string, status int) {
+	s, err := h.store.getSensor(id)
+	if err != nil {
+		writeError(w, r, err)
+		return
 	}
+	writeRecord(w, status, s, s.Revision)
 }
 
-func (h *HivemindServer) apiSensorPut(w http.ResponseWriter, trailing, id string, body []byte) {
-	var s Sensor
-	err := json.Unmarshal(body, &s)
+// apiSensorPatch applies a merge patch or JSON patch to the stored sensor
+func (h *HivemindServer) apiSensorPatch(w http.ResponseWriter, r *http.Request, id string, body []byte) {
+	mediaType, ok := patchMediaType(r)
+	if !ok {
+		writeUnsupportedPatch(w, r)
+		return
+	}
+	if !h.authorized(r, "sensor", id, writeAccess) {
+		writeProblem(w, r, http.StatusForbidden, "")
+		return
+	}
+	s, err := h.storeFor(r).updateSensor(id, func(s *Sensor) error {
+		err := checkIfMatch(r, "sensor", id, s.Revision)
+		if err != nil {
+			return err
+		}
+		patched, err := applyPatch(mediaType, body, s)
+		if err != nil {
+			return err
+		}
+		*s, err = decodeSensor(patched, id)
+		return err
+	})
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		writeError(w, r, conditionalError(r, err))
+		return
+	}
+	writeRecord(w, writeStatus(r, http.StatusOK), s, s.Revision)
+}
+
+// apiSensorDelete deletes the sensor, only at the revision in If-Match when the request has one
+func (h *HivemindServer) apiSensorDelete(w http.ResponseWriter, r *http.Request, id string) {
+	if !h.authorized(r, "sensor", id, writeAccess) {
+		writeProblem(w, r, http.StatusForbidden, "")
 		return
 	}
-	err = h.store.storeSensor(s)
+	err := h.storeFor(r).deleteSensor(id, func(s Sensor) error {
+		return checkIfMatch(r, "sensor", id, s.Revision)
+	})
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		writeError(w, r, conditionalError(r, err))
 		return
 	}
-	w.WriteHeader(http.StatusAccepted)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// batchResult is the outcome of storing a single item of a batch
+type batchResult struct {
+	ID     string
+	Status int
+	Error  string `json:",omitempty"`
+}
+
+// apiSensorBatchHandler stores a JSON array or NDJSON stream of sensors in a single transaction
+func (h *HivemindServer) apiSensorBatchHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json")
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w, r, http.MethodPost)
+		return
+	}
+	body := readBody(r)
+
+	var items []json.RawMessage
+	trimmed := bytes.TrimSpace(body)
+	if bytes.HasPrefix(trimmed, []byte("[")) {
+		err := json.Unmarshal(trimmed, &items)
+		if err != nil {
+			writeDecodeError(w, r, err)
+			return
+		}
+	} else {
+		scanner := bufio.NewScanner(bytes.NewReader(trimmed))
+		for scanner.Scan() {
+			line := bytes.TrimSpace(scanner.Bytes())
+			if len(line) > 0 {
+				items = append(items, json.RawMessage(append([]byte(nil), line...)))
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			writeDecodeError(w, r, err)
+			return
+		}
+	}
+
+	results := make([]batchResult, len(items))
+	var sensors []Sensor
+	var indexes []int
+	for i, item := range items {
+		s, err := decodeSensor(item, "")
+		results[i].ID = s.ID
+		if err != nil {
+			results[i].Status = errorStatus(err)
+			results[i].Error = err.Error()
+			continue
+		}
+		if !h.authorized(r, "sensor", s.ID, reportAccess) {
+			results[i].Status = http.StatusForbidden
+			continue
+		}
+		sensors = append(sensors, s)
+		indexes = append(indexes, i)
+	}
+
+	if len(sensors) > 0 {
+		errs, err := h.storeFor(r).storeSensors(sensors, nil)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		for j, i := range indexes {
+			results[i].Status = writeStatus(r, http.StatusOK)
+			if errs[j] != nil {
+				results[i].Status = errorStatus(errs[j])
+				results[i].Error = errs[j].Error()
+			}
+		}
+	}
+
+	json.NewEncoder(w).Encode(results)
 }
 
 func (h *HivemindServer) apiSwitchHandler(w http.ResponseWriter, r *http.Request) {
-	trailing := r.URL.Path[len("/api/switch"):]
-	id := strings.Split(trailing[1:], "/")[0]
+	id := itemID(r, "/api/switch/")
 	w.Header().Set("content-type", "application/json")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
+	allowed := itemMethods(id)
+	if !contains(allowed, r.Method) {
+		writeMethodNotAllowed(w, r, allowed...)
+		return
+	}
+
 	switch r.Method {
 	case http.MethodGet:
-		h.apiSwitchGet(w, trailing, id)
+		h.apiSwitchGet(w, r, id)
 	case http.MethodPost:
-		var body []byte
-		if r.Body != nil {
-			body, _ = ioutil.ReadAll(r.Body)
-		}
-		h.apiSwitchPost(w, trailing, body)
+		h.apiSwitchPost(w, r, readBody(r))
 	case http.MethodPut:
-		var body []byte
-		if r.Body != nil {
-			body, _ = ioutil.ReadAll(r.Body)
-		}
-		h.apiSwitchPut(w, trailing, id, body)
-	default:
-		w.WriteHeader(http.StatusNotImplemented)
+		h.apiSwitchPut(w, r, id, readBody(r))
+	case http.MethodPatch:
+		h.apiSwitchPatch(w, r, id, readBody(r))
+	case http.MethodDelete:
+		h.apiSwitchDelete(w, r, id)
 	}
 }
 
-func (h *HivemindServer) apiSwitchGet(w http.ResponseWriter, trailing, id string) {
+func (h *HivemindServer) apiSwitchGet(w http.ResponseWriter, r *http.Request, id string) {
 	if id == "" {
-		err := json.NewEncoder(w).Encode(h.store.getAllSwitches())
+		q, err := parsePageQuery(r, reflect.TypeOf(Switch{}))
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
+			writeError(w, r, err)
 			return
 		}
-	} else {
-		value, err := h.store.getSwitch(id)
-		if err != nil {
-			w.WriteHeader(http.StatusNotFound)
+		q.Include = func(id string) bool {
+			return h.authorized(r, "switch", id, readAccess)
 		}
-		err = json.NewEncoder(w).Encode(value)
+		switches, more, err := h.store.listSwitches(q)
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
+			writeError(w, r, err)
 			return
 		}
+		if more {
+			last := switches[len(switches)-1]
+			setNextLink(w, r, q.position(switchSortKey(last, q.Sort), last.ID))
+		}
+		writeJSONList(w, r, selectFields(switches, q.Fields))
+		return
+	}
+	if !h.authorized(r, "switch", id, readAccess) {
+		writeProblem(w, r, http.StatusForbidden, "")
+		return
+	}
+	fields, err := parseFields(r, reflect.TypeOf(Switch{}))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	value, err := h.store.getSwitch(id)
+	if err != nil {
+		writeError(w, r, err)
+		return
 	}
+	writeJSONRevision(w, r, selectFields(value, fields), value.Revision, fields)
 }
 
-func (h *HivemindServer) apiSwitchPost(w http.ResponseWriter, trailing string, body []byte) {
-	if trailing != "/" {
-		w.WriteHeader(http.StatusNotImplemented)
-	} else {
-		var s Switch
-		err := json.Unmarshal(body, &s)
+func (h *HivemindServer) apiSwitchPost(w http.ResponseWriter, r *http.Request, body []byte) {
+	s, err := decodeSwitch(body, "")
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if !h.authorized(r, "switch", s.ID, writeAccess) {
+		writeProblem(w, r, http.StatusForbidden, "")
+		return
+	}
+	err = h.storeFor(r).storeSwitch(s)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if isLegacyAPI(r) {
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	w.Header().Set("Location", apiV1Prefix+"/switch/"+s.ID)
+	h.writeStoredSwitch(w, r, s.ID, http.StatusCreated)
+}
+
+func (h *HivemindServer) apiSwitchPut(w http.ResponseWriter, r *http.Request, id string, body []byte) {
+	s, err := decodeSwitch(body, id)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if !h.authorized(r, "switch", id, writeAccess) {
+		writeProblem(w, r, http.StatusForbidden, "")
+		return
+	}
+	if !hasIfMatch(r) {
+		err = h.storeFor(r).storeSwitch(s)
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
+			writeError(w, r, err)
 			return
 		}
-		err = h.store.storeSwitch(s)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
+		if isLegacyAPI(r) {
+			w.WriteHeader(http.StatusAccepted)
 			return
 		}
+		h.writeStoredSwitch(w, r, id, http.StatusOK)
+		return
+	}
+	// a conditional PUT only replaces the switch at the revision the client has seen
+	stored, err := h.storeFor(r).updateSwitch(id, func(current *Switch) error {
+		err := checkIfMatch(r, "switch", id, current.Revision)
+		if err == nil {
+			*current = s
+		}
+		return err
+	})
+	if err != nil {
+		writeError(w, r, conditionalError(r, err))
+		return
+	}
+	if isLegacyAPI(r) {
+		w.Header().Set("ETag", revisionETag(stored.Revision))
 		w.WriteHeader(http.StatusAccepted)
+		return
 	}
+	writeRecord(w, http.StatusOK, stored, stored.Revision)
 }
 
-func (h *HivemindServer) apiSwitchPut(w http.ResponseWriter, trailing, id string, body []byte) {
-	var s Switch
-	err := json.Unmarshal(body, &s)
+// writeStoredSwitch answers a write on /api/v1/ with status and the switch as stored
+func (h *HivemindServer) writeStoredSwitch(w http.ResponseWriter, r *http.Request, id string, status int) {
+	s, err := h.store.getSwitch(id)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeRecord(w, status, s, s.Revision)
+}
+
+// apiSwitchPatch applies a merge patch or JSON patch to the stored switch
+func (h *HivemindServer) apiSwitchPatch(w http.ResponseWriter, r *http.Request, id string, body []byte) {
+	mediaType, ok := patchMediaType(r)
+	if !ok {
+		writeUnsupportedPatch(w, r)
+		return
+	}
+	if !h.authorized(r, "switch", id, writeAccess) {
+		writeProblem(w, r, http.StatusForbidden, "")
+		return
+	}
+	s, err := h.storeFor(r).updateSwitch(id, func(s *Switch) error {
+		err := checkIfMatch(r, "switch", id, s.Revision)
+		if err != nil {
+			return err
+		}
+		patched, err := applyPatch(mediaType, body, s)
+		if err != nil {
+			return err
+		}
+		*s, err = decodeSwitch(patched, id)
+		return err
+	})
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		writeError(w, r, conditionalError(r, err))
+		return
+	}
+	writeRecord(w, writeStatus(r, http.StatusOK), s, s.Revision)
+}
+
+// apiSwitchDelete deletes the switch, only at the revision in If-Match when the request has one
+func (h *HivemindServer) apiSwitchDelete(w http.ResponseWriter, r *http.Request, id string) {
+	if !h.authorized(r, "switch", id, writeAccess) {
+		writeProblem(w, r, http.StatusForbidden, "")
 		return
 	}
-	err = h.store.storeSwitch(s)
+	err := h.storeFor(r).deleteSwitch(id, func(s Switch) error {
+		return checkIfMatch(r, "switch", id, s.Revision)
+	})
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		writeError(w, r, conditionalError(r, err))
 		return
 	}
-	w.WriteHeader(http.StatusAccepted)
+	w.WriteHeader(http.StatusNoContent)
 }
@@ -20,7 +20,7 @@ func TestIntegrationSensorAPI(t *testing.T) {
 	defer deleteDatabase(t, "integration_test.db")
 
 	seed := []Sensor{
-		Sensor{"test", "Test", "C", "generic", 64},
+		Sensor{ID: "test", Name: "Test", Unit: "C", Type: "generic", Value: 64},
 	}
 
 	err = seedBoltDB(t, database, seed)
@@ -32,7 +32,7 @@ func TestIntegrationSensorAPI(t *testing.T) {
 	server := NewHivemindServer(&store)
 
 	t.Run("integration test: /api/sensor/test", func(t *testing.T) {
-		want := Sensor{"test", "Test", "C", "generic", 64}
+		want := Sensor{ID: "test", Name: "Test", Unit: "C", Type: "generic", Value: 64}
 		request := newGetRequest("api/sensor/test")
 		response := httptest.NewRecorder()
 
@@ -51,7 +51,7 @@ func TestIntegrationSensorAPI(t *testing.T) {
 
 		assertResponseCode(t, response.Code, http.StatusAccepted)
 
-		want = Sensor{"test", "Test", "C", "generic", 12}
+		want = Sensor{ID: "test", Name: "Test", Unit: "C", Type: "generic", Value: 12, Revision: 1}
 		request = newGetRequest("api/sensor/test")
 		response = httptest.NewRecorder()
 
@@ -61,13 +61,13 @@ func TestIntegrationSensorAPI(t *testing.T) {
 
 		assertResponseCode(t, response.Code, http.StatusOK)
 		assertContentType(t, response.Header().Get("content-type"), "application/json")
-		assertSensor(t, got, want)
+		assertStoredSensor(t, got, want)
 	})
 
 	t.Run("integration test: /api/sensor/", func(t *testing.T) {
 		want := []Sensor{
-			{"test", "Test", "C", "generic", 12},
-			{"third", "Third", "C", "generic", 3},
+			{ID: "test", Name: "Test", Unit: "C", Type: "generic", Value: 12, Revision: 1},
+			{ID: "third", Name: "Third", Unit: "C", Type: "generic", Value: 3, Revision: 1},
 		}
 
 		server.ServeHTTP(httptest.NewRecorder(), newPostRequest("api/sensor/", strings.NewReader("{\"ID\": \"third\", \"Name\": \"Third\", \"Unit\": \"C\", \"Type\": \"generic\", \"Value\": 3 }")))
@@ -81,6 +81,9 @@ func TestIntegrationSensorAPI(t *testing.T) {
 
 		assertResponseCode(t, response.Code, http.StatusOK)
 		assertContentType(t, response.Header().Get("content-type"), "application/json")
+		for i := range got {
+			got[i].Updated = time.Time{}
+		}
 		assertSensorSlice(t, got, want)
 	})
 }
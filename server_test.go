@@ -1,10 +1,11 @@
 package main
 
 import (
-	"errors"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
 	"strings"
 	"testing"
 )
@@ -43,28 +44,29 @@ func TestServer(t *testing.T) {
 		assertContentType(t, response.Header().Get("content-type"), "application/json")
 	})
 
-	t.Run("return status 501 on /api/{random}", func(t *testing.T) {
+	t.Run("return status 404 on /api/{random}", func(t *testing.T) {
 		request := newGetRequest(fmt.Sprintf("api/%s", randomString(8)))
 		response := httptest.NewRecorder()
 
 		server.ServeHTTP(response, request)
 
-		assertResponseCode(t, response.Code, http.StatusNotImplemented)
+		assertResponseCode(t, response.Code, http.StatusNotFound)
+		assertContentType(t, response.Header().Get("content-type"), problemContentType)
 	})
 }
 
 func TestSensorAPI(t *testing.T) {
 	store := StubHivemindStore{
 		map[string]Sensor{
-			"test":   Sensor{"test", "Test", "C", "generic", 64},
-			"second": Sensor{"second", "Second", "C", "generic", 2},
+			"test":   Sensor{ID: "test", Name: "Test", Unit: "C", Type: "generic", Value: 64},
+			"second": Sensor{ID: "second", Name: "Second", Unit: "C", Type: "generic", Value: 2},
 		},
 		nil,
 	}
 	server := NewHivemindServer(&store)
 
 	t.Run("return json value: 64, status 200 on GET /api/sensor/test", func(t *testing.T) {
-		want := Sensor{"test", "Test", "C", "generic", 64}
+		want := Sensor{ID: "test", Name: "Test", Unit: "C", Type: "generic", Value: 64}
 		request := newGetRequest("api/sensor/test")
 		response := httptest.NewRecorder()
 
@@ -78,18 +80,35 @@ func TestSensorAPI(t *testing.T) {
 	})
 
 	t.Run("return status 404 on GET /api/sensor/{random}", func(t *testing.T) {
-		request := newGetRequest(fmt.Sprintf("api/sensor/%s", randomString(8)))
+		id := randomString(8)
+		request := newGetRequest("api/sensor/" + id)
 		response := httptest.NewRecorder()
 
 		server.ServeHTTP(response, request)
 
 		assertResponseCode(t, response.Code, http.StatusNotFound)
+		assertContentType(t, response.Header().Get("content-type"), problemContentType)
+		var got map[string]interface{}
+		json.NewDecoder(response.Body).Decode(&got)
+		if got["status"] != float64(http.StatusNotFound) || got["instance"] != "/api/sensor/"+id || got["ID"] != nil {
+			t.Errorf("unexpected problem %v", got)
+		}
+	})
+
+	t.Run("return status 400 on POST /api/sensor/ with malformed JSON", func(t *testing.T) {
+		request := newPostRequest("api/sensor/", strings.NewReader(`{"ID": "broken"`))
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, request)
+
+		assertResponseCode(t, response.Code, http.StatusBadRequest)
+		assertContentType(t, response.Header().Get("content-type"), problemContentType)
 	})
 
 	t.Run("return api sensor table as json, status 200 on GET /api/sensor/", func(t *testing.T) {
 		want := []Sensor{
-			{"test", "Test", "C", "generic", 64},
-			{"second", "Second", "C", "generic", 2},
+			{ID: "test", Name: "Test", Unit: "C", Type: "generic", Value: 64},
+			{ID: "second", Name: "Second", Unit: "C", Type: "generic", Value: 2},
 		}
 
 		request := newGetRequest("api/sensor/")
@@ -113,13 +132,14 @@ func TestSensorAPI(t *testing.T) {
 		assertResponseCode(t, response.Code, http.StatusAccepted)
 	})
 
-	t.Run("return status 501 on POST /api/sensor/test", func(t *testing.T) {
+	t.Run("return status 405 on POST /api/sensor/test", func(t *testing.T) {
 		request := newPostRequest("api/sensor/test", nil)
 		response := httptest.NewRecorder()
 
 		server.ServeHTTP(response, request)
 
-		assertResponseCode(t, response.Code, http.StatusNotImplemented)
+		assertResponseCode(t, response.Code, http.StatusMethodNotAllowed)
+		assertHeader(t, response.Header(), "Allow", "GET, PUT, PATCH, DELETE")
 	})
 
 	t.Run("return status 202 on PUT /api/sensor/test", func(t *testing.T) {
@@ -132,18 +152,79 @@ func TestSensorAPI(t *testing.T) {
 	})
 }
 
+func TestSensorBatchAPI(t *testing.T) {
+	store := StubHivemindStore{map[string]Sensor{}, nil}
+	server := NewHivemindServer(&store)
+
+	t.Run("return per item results, status 200 on POST /api/sensor/batch with a JSON array", func(t *testing.T) {
+		want := []batchResult{
+			{"first", http.StatusAccepted, ""},
+			{"", http.StatusUnprocessableEntity, "ID is required"},
+			{"second", http.StatusAccepted, ""},
+		}
+		request := newPostRequest("api/sensor/batch", strings.NewReader(`[{"ID": "first", "Name": "First", "Value": 1}, {"Name": "Missing", "Value": 2}, {"ID": "second", "Name": "Second", "Value": 3}]`))
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, request)
+
+		var got []batchResult
+		err := json.NewDecoder(response.Body).Decode(&got)
+		if err != nil {
+			t.Fatalf("unable to parse response from server into []batchResult, '%v'", err)
+		}
+
+		assertResponseCode(t, response.Code, http.StatusOK)
+		assertContentType(t, response.Header().Get("content-type"), "application/json")
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		assertSensor(t, store.sensors["second"], Sensor{ID: "second", Name: "Second", Value: 3})
+	})
+
+	t.Run("return per item results, status 200 on POST /api/sensor/batch with NDJSON", func(t *testing.T) {
+		want := []batchResult{
+			{"third", http.StatusAccepted, ""},
+			{"", http.StatusBadRequest, "invalid character 'n' looking for beginning of object key string"},
+		}
+		request := newPostRequest("api/sensor/batch", strings.NewReader("{\"ID\": \"third\", \"Name\": \"Third\", \"Value\": 3}\n\n{not json}\n"))
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, request)
+
+		var got []batchResult
+		err := json.NewDecoder(response.Body).Decode(&got)
+		if err != nil {
+			t.Fatalf("unable to parse response from server into []batchResult, '%v'", err)
+		}
+
+		assertResponseCode(t, response.Code, http.StatusOK)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	})
+
+	t.Run("return status 400 on POST /api/sensor/batch with a malformed array", func(t *testing.T) {
+		request := newPostRequest("api/sensor/batch", strings.NewReader(`[{"ID": "first"`))
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, request)
+
+		assertResponseCode(t, response.Code, http.StatusBadRequest)
+	})
+}
+
 func TestSwitchAPI(t *testing.T) {
 	store := StubHivemindStore{
 		nil,
 		map[string]Switch{
-			"test":   Switch{"test", "test", "generic", true},
-			"second": Switch{"second", "second", "generic", false},
+			"test":   Switch{ID: "test", Name: "test", Type: "generic", State: true},
+			"second": Switch{ID: "second", Name: "second", Type: "generic"},
 		},
 	}
 	server := NewHivemindServer(&store)
 
 	t.Run("return json value: true, status 200 on GET /api/switch/test", func(t *testing.T) {
-		want := Switch{"test", "test", "generic", true}
+		want := Switch{ID: "test", Name: "test", Type: "generic", State: true}
 		request := newGetRequest("api/switch/test")
 		response := httptest.NewRecorder()
 
@@ -167,8 +248,8 @@ func TestSwitchAPI(t *testing.T) {
 
 	t.Run("return api switch table as json, status 200 on GET /api/sensor/", func(t *testing.T) {
 		want := []Switch{
-			{"test", "test", "generic", true},
-			{"second", "second", "generic", false},
+			{ID: "test", Name: "test", Type: "generic", State: true},
+			{ID: "second", Name: "second", Type: "generic"},
 		}
 
 		request := newGetRequest("api/switch/")
@@ -192,13 +273,14 @@ func TestSwitchAPI(t *testing.T) {
 		assertResponseCode(t, response.Code, http.StatusAccepted)
 	})
 
-	t.Run("return status 501 on POST /api/switch/test", func(t *testing.T) {
+	t.Run("return status 405 on POST /api/switch/test", func(t *testing.T) {
 		request := newPostRequest("api/switch/test", nil)
 		response := httptest.NewRecorder()
 
 		server.ServeHTTP(response, request)
 
-		assertResponseCode(t, response.Code, http.StatusNotImplemented)
+		assertResponseCode(t, response.Code, http.StatusMethodNotAllowed)
+		assertHeader(t, response.Header(), "Allow", "GET, PUT, PATCH, DELETE")
 	})
 
 	t.Run("return status 202 on PUT /api/switch/test", func(t *testing.T) {
@@ -221,7 +303,7 @@ func (s *StubHivemindStore) getSensor(id string) (Sensor, error) {
 	var err error
 	sensor, ok := s.sensors[id]
 	if !ok {
-		err = errors.New("Sensor not found in store")
+		err = notFound("sensor", id)
 	}
 	return sensor, err
 }
@@ -234,17 +316,72 @@ func (s *StubHivemindStore) getAllSensors() []Sensor {
 	return sensors
 }
 
+func (s *StubHivemindStore) listSensors(q pageQuery) ([]Sensor, bool, error) {
+	p := &pageCollector{query: q}
+	for _, sensor := range s.sensors {
+		p.offer(q.position(sensorSortKey(sensor, q.Sort), sensor.ID), sensor)
+	}
+	items, more := p.page()
+	var sensors []Sensor
+	for _, item := range items {
+		sensors = append(sensors, item.(Sensor))
+	}
+	return sensors, more, nil
+}
+
 func (s *StubHivemindStore) storeSensor(sensor Sensor) error {
 	var err error
 	s.sensors[sensor.ID] = sensor
 	return err
 }
 
+func (s *StubHivemindStore) storeSensors(sensors []Sensor, fn func(previous, s Sensor)) ([]error, error) {
+	errs := make([]error, len(sensors))
+	for i, sensor := range sensors {
+		if sensor.ID == "" {
+			errs[i] = errMissingID
+			continue
+		}
+		previous := s.sensors[sensor.ID]
+		s.sensors[sensor.ID] = sensor
+		if fn != nil {
+			fn(previous, sensor)
+		}
+	}
+	return errs, nil
+}
+
+func (s *StubHivemindStore) updateSensor(id string, fn func(s *Sensor) error) (Sensor, error) {
+	sensor, ok := s.sensors[id]
+	if !ok {
+		return sensor, notFound("sensor", id)
+	}
+	err := fn(&sensor)
+	if err != nil {
+		return sensor, err
+	}
+	s.sensors[id] = sensor
+	return sensor, nil
+}
+
+func (s *StubHivemindStore) deleteSensor(id string, fn func(s Sensor) error) error {
+	sensor, ok := s.sensors[id]
+	if !ok {
+		return notFound("sensor", id)
+	}
+	err := fn(sensor)
+	if err != nil {
+		return err
+	}
+	delete(s.sensors, id)
+	return nil
+}
+
 func (s *StubHivemindStore) getSwitch(id string) (Switch, error) {
 	var err error
 	sw, ok := s.switches[id]
 	if !ok {
-		err = errors.New("Switch not found in store")
+		err = notFound("switch", id)
 	}
 	return sw, err
 }
@@ -257,8 +394,47 @@ func (s *StubHivemindStore) getAllSwitches() []Switch {
 	return switches
 }
 
+func (s *StubHivemindStore) listSwitches(q pageQuery) ([]Switch, bool, error) {
+	p := &pageCollector{query: q}
+	for _, sw := range s.switches {
+		p.offer(q.position(switchSortKey(sw, q.Sort), sw.ID), sw)
+	}
+	items, more := p.page()
+	var switches []Switch
+	for _, item := range items {
+		switches = append(switches, item.(Switch))
+	}
+	return switches, more, nil
+}
+
 func (s *StubHivemindStore) storeSwitch(sw Switch) error {
 	var err error
 	s.switches[sw.ID] = sw
 	return err
 }
+
+func (s *StubHivemindStore) updateSwitch(id string, fn func(sw *Switch) error) (Switch, error) {
+	sw, ok := s.switches[id]
+	if !ok {
+		return sw, notFound("switch", id)
+	}
+	err := fn(&sw)
+	if err != nil {
+		return sw, err
+	}
+	s.switches[id] = sw
+	return sw, nil
+}
+
+func (s *StubHivemindStore) deleteSwitch(id string, fn func(sw Switch) error) error {
+	sw, ok := s.switches[id]
+	if !ok {
+		return notFound("switch", id)
+	}
+	err := fn(sw)
+	if err != nil {
+		return err
+	}
+	delete(s.switches, id)
+	return nil
+}
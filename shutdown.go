@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+)
+
+// serveUntilStopped runs servers, with TLS when they have a TLSConfig, until one of them fails or a
+// signal arrives on stop; then they stop accepting connections and in-flight requests get timeout to
+// finish before the remaining connections are closed
+func serveUntilStopped(servers []*http.Server, stop <-chan os.Signal, timeout time.Duration) error {
+	errs := make(chan error, len(servers))
+	for _, s := range servers {
+		go func(s *http.Server) {
+			var err error
+			if s.TLSConfig != nil {
+				err = s.ListenAndServeTLS("", "")
+			} else {
+				err = s.ListenAndServe()
+			}
+			if err != http.ErrServerClosed {
+				errs <- errors.New("serving " + s.Addr + " failed: " + err.Error())
+			}
+		}(s)
+	}
+
+	var err error
+	select {
+	case sig := <-stop:
+		slog.Info("shutting down", "signal", sig.String(), "drain_timeout", timeout)
+	case err = <-errs:
+		slog.Error("shutting down", "error", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	for _, s := range servers {
+		if shutdownErr := s.Shutdown(ctx); shutdownErr != nil {
+			slog.Warn("draining did not finish, closing remaining connections", "addr", s.Addr, "error", shutdownErr)
+			s.Close()
+		}
+	}
+	return err
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestServeUntilStopped(t *testing.T) {
+	freeAddr := func() string {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		return l.Addr().String()
+	}
+	waitListening := func(addr string) {
+		for i := 0; i < 100; i++ {
+			if c, err := net.Dial("tcp", addr); err == nil {
+				c.Close()
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("%s not listening", addr)
+	}
+
+	t.Run("drain in-flight requests on SIGTERM", func(t *testing.T) {
+		addr := freeAddr()
+		started := make(chan struct{})
+		release := make(chan struct{})
+		server := &http.Server{Addr: addr, Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			<-release
+			w.WriteHeader(http.StatusAccepted)
+		})}
+		stop := make(chan os.Signal, 1)
+		done := make(chan error)
+		go func() { done <- serveUntilStopped([]*http.Server{server}, stop, time.Second) }()
+		waitListening(addr)
+
+		responses := make(chan int)
+		go func() {
+			response, err := http.Get("http://" + addr + "/")
+			if err != nil {
+				responses <- 0
+				return
+			}
+			response.Body.Close()
+			responses <- response.StatusCode
+		}()
+		<-started
+		stop <- syscall.SIGTERM
+		time.Sleep(50 * time.Millisecond)
+		if _, err := net.Dial("tcp", addr); err == nil {
+			t.Errorf("new connections accepted while draining")
+		}
+		close(release)
+
+		assertResponseCode(t, <-responses, http.StatusAccepted)
+		if err := <-done; err != nil {
+			t.Errorf("unexpected error %s", err)
+		}
+	})
+
+	t.Run("close connections after the timeout", func(t *testing.T) {
+		addr := freeAddr()
+		started := make(chan struct{})
+		server := &http.Server{Addr: addr, Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			time.Sleep(5 * time.Second)
+		})}
+		stop := make(chan os.Signal, 1)
+		done := make(chan error)
+		go func() { done <- serveUntilStopped([]*http.Server{server}, stop, 50*time.Millisecond) }()
+		waitListening(addr)
+		go http.Get("http://" + addr + "/")
+		<-started
+
+		begin := time.Now()
+		stop <- syscall.SIGINT
+		<-done
+		if elapsed := time.Since(begin); elapsed > time.Second {
+			t.Errorf("waited %s for a request beyond the timeout", elapsed)
+		}
+	})
+
+	t.Run("return the error of a server that can not listen", func(t *testing.T) {
+		l, _ := net.Listen("tcp", "127.0.0.1:0")
+		defer l.Close()
+
+		err := serveUntilStopped([]*http.Server{{Addr: l.Addr().String()}}, make(chan os.Signal), time.Second)
+		if err == nil {
+			t.Errorf("no error for an address in use")
+		}
+	})
+}
@@ -10,6 +10,7 @@ import (
 	"reflect"
 	"sort"
 	"testing"
+	"time"
 
 	"github.com/boltdb/bolt"
 )
@@ -35,6 +36,13 @@ func assertContentType(t *testing.T, got, want string) {
 	}
 }
 
+func assertHeader(t *testing.T, header http.Header, name, want string) {
+	t.Helper()
+	if got := header.Get(name); got != want {
+		t.Errorf("wrong %s header; got %q, want %q", name, got, want)
+	}
+}
+
 func assertSensor(t *testing.T, got, want Sensor) {
 	t.Helper()
 	if !reflect.DeepEqual(got, want) {
@@ -42,6 +50,16 @@ func assertSensor(t *testing.T, got, want Sensor) {
 	}
 }
 
+// assertStoredSensor asserts that the store set the update time of got, which matches want otherwise
+func assertStoredSensor(t *testing.T, got, want Sensor) {
+	t.Helper()
+	if got.Updated.IsZero() {
+		t.Errorf("update time of %v not set", got)
+	}
+	got.Updated = time.Time{}
+	assertSensor(t, got, want)
+}
+
 func assertSensorSlice(t *testing.T, got, want []Sensor) {
 	t.Helper()
 	sort.Slice(got, func(i, j int) bool {
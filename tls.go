@@ -0,0 +1,317 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	caCertFile     = "hivemind-ca.pem"
+	caKeyFile      = "hivemind-ca-key.pem"
+	serverCertFile = "hivemind-cert.pem"
+	serverKeyFile  = "hivemind-key.pem"
+
+	caLifetime         = 10 * 365 * 24 * time.Hour
+	serverCertLifetime = 90 * 24 * time.Hour
+	serverCertRenewal  = 30 * 24 * time.Hour
+	certReloadInterval = time.Minute
+	certBackdate       = time.Minute
+)
+
+// localCA is the certificate authority Hivemind creates to sign its own certificates
+type localCA struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+}
+
+// loadOrCreateCA reads the CA from dir, creating and persisting a new one when there is none
+func loadOrCreateCA(dir string, now time.Time) (*localCA, error) {
+	certPath := filepath.Join(dir, caCertFile)
+	keyPath := filepath.Join(dir, caKeyFile)
+
+	certPEM, err := ioutil.ReadFile(certPath)
+	if err == nil {
+		keyPEM, err := ioutil.ReadFile(keyPath)
+		if err != nil {
+			return nil, err
+		}
+		pair, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			return nil, err
+		}
+		cert, err := x509.ParseCertificate(pair.Certificate[0])
+		if err != nil {
+			return nil, err
+		}
+		key, ok := pair.PrivateKey.(*ecdsa.PrivateKey)
+		if !ok {
+			return nil, errors.New("CA key is not an ECDSA key")
+		}
+		return &localCA{cert, key, certPEM}, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	hostname, _ := os.Hostname()
+	template := &x509.Certificate{
+		Subject:               pkix.Name{Organization: []string{"Hivemind"}, CommonName: "Hivemind CA " + hostname},
+		NotBefore:             now.Add(-certBackdate),
+		NotAfter:              now.Add(caLifetime),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	template.SerialNumber, err = randomSerial()
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	err = writePEM(keyPath, "EC PRIVATE KEY", keyDER, 0600)
+	if err != nil {
+		return nil, err
+	}
+	err = writePEM(certPath, "CERTIFICATE", der, 0644)
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("created local CA, add it to the trusted certificates of your clients", "file", certPath)
+	return &localCA{cert, key, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}, nil
+}
+
+// issue signs template for pub, filling in the serial number and issuer
+func (ca *localCA) issue(template *x509.Certificate, pub crypto.PublicKey) ([]byte, error) {
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+	template.SerialNumber = serial
+	return x509.CreateCertificate(rand.Reader, template, ca.cert, pub, ca.key)
+}
+
+// issueServerCert creates a key and server certificate for hosts, which are DNS names or IP addresses
+func (ca *localCA) issueServerCert(hosts []string, now time.Time) (certPEM, keyPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	template := &x509.Certificate{
+		Subject:     pkix.Name{Organization: []string{"Hivemind"}, CommonName: hosts[0]},
+		NotBefore:   now.Add(-certBackdate),
+		NotAfter:    now.Add(serverCertLifetime),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, h)
+		}
+	}
+	der, err := ca.issue(template, &key.PublicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	certPEM = append(certPEM, ca.certPEM...)
+	return certPEM, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), nil
+}
+
+func randomSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+func writePEM(path, blockType string, der []byte, mode os.FileMode) error {
+	return ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), mode)
+}
+
+// localHosts returns the hostname, localhost and the addresses of the network interfaces
+func localHosts() []string {
+	var hosts []string
+	if hostname, err := os.Hostname(); err == nil {
+		hosts = append(hosts, hostname)
+	}
+	hosts = append(hosts, "localhost")
+	addrs, _ := net.InterfaceAddrs()
+	for _, a := range addrs {
+		if ipnet, ok := a.(*net.IPNet); ok && !ipnet.IP.IsLinkLocalUnicast() {
+			hosts = append(hosts, ipnet.IP.String())
+		}
+	}
+	return hosts
+}
+
+// certManager serves the TLS certificate of the server; certificates signed by the local CA are
+// reissued before they expire, user provided ones are reloaded when their files change
+type certManager struct {
+	certFile string
+	keyFile  string
+	ca       *localCA
+	hosts    []string
+	now      func() time.Time
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+	checked time.Time
+}
+
+// newFileCertManager serves the certificate and key in certFile and keyFile
+func newFileCertManager(certFile, keyFile string) (*certManager, error) {
+	m := &certManager{certFile: certFile, keyFile: keyFile, now: time.Now}
+	return m, m.load()
+}
+
+// newAutoCertManager serves a certificate for hosts signed by ca, persisted in dir
+func newAutoCertManager(ca *localCA, dir string, hosts []string) (*certManager, error) {
+	if len(hosts) == 0 {
+		return nil, errors.New("no hosts for the server certificate")
+	}
+	m := &certManager{
+		certFile: filepath.Join(dir, serverCertFile),
+		keyFile:  filepath.Join(dir, serverKeyFile),
+		ca:       ca,
+		hosts:    hosts,
+		now:      time.Now,
+	}
+	err := m.load()
+	if err == nil && !m.expiring() && m.coversHosts() {
+		return m, nil
+	}
+	return m, m.renew()
+}
+
+func (m *certManager) load() error {
+	info, err := os.Stat(m.certFile)
+	if err != nil {
+		return err
+	}
+	pair, err := tls.LoadX509KeyPair(m.certFile, m.keyFile)
+	if err != nil {
+		return err
+	}
+	pair.Leaf, err = x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return err
+	}
+	m.cert = &pair
+	m.modTime = info.ModTime()
+	return nil
+}
+
+func (m *certManager) renew() error {
+	certPEM, keyPEM, err := m.ca.issueServerCert(m.hosts, m.now())
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(m.keyFile, keyPEM, 0600)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(m.certFile, certPEM, 0644)
+	if err != nil {
+		return err
+	}
+	slog.Info("issued server certificate", "file", m.certFile, "expires", m.now().Add(serverCertLifetime))
+	return m.load()
+}
+
+func (m *certManager) expiring() bool {
+	return m.now().Add(serverCertRenewal).After(m.cert.Leaf.NotAfter)
+}
+
+func (m *certManager) coversHosts() bool {
+	for _, h := range m.hosts {
+		if m.cert.Leaf.VerifyHostname(h) != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// getCertificate is the tls.Config callback, rotating the certificate when needed
+func (m *certManager) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	if now.Sub(m.checked) < certReloadInterval {
+		return m.cert, nil
+	}
+	m.checked = now
+	if m.ca != nil {
+		if m.expiring() {
+			if err := m.renew(); err != nil {
+				slog.Error("renewing server certificate failed", "error", err)
+			}
+		}
+		return m.cert, nil
+	}
+	if info, err := os.Stat(m.certFile); err == nil && !info.ModTime().Equal(m.modTime) {
+		if err := m.load(); err != nil {
+			slog.Error("reloading server certificate failed", "file", m.certFile, "error", err)
+		}
+	}
+	return m.cert, nil
+}
+
+func (m *certManager) tlsConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: m.getCertificate,
+	}
+}
+
+// httpsRedirect redirects all requests to the same host on httpsAddr
+func httpsRedirect(httpsAddr string) http.Handler {
+	_, port, _ := net.SplitHostPort(httpsAddr)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = h
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		target := "https://" + host + r.URL.RequestURI()
+		http.Redirect(w, r, target, http.StatusPermanentRedirect)
+	})
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLocalCA(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hivemind-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca, err := loadOrCreateCA(dir, time.Now())
+	if err != nil {
+		t.Fatalf("creating CA failed: %s", err)
+	}
+
+	t.Run("persist the CA next to the database", func(t *testing.T) {
+		info, err := os.Stat(filepath.Join(dir, caKeyFile))
+		if err != nil {
+			t.Fatalf("CA key not persisted: %s", err)
+		}
+		if info.Mode().Perm() != 0600 {
+			t.Errorf("CA key readable by others, mode %v", info.Mode().Perm())
+		}
+
+		loaded, err := loadOrCreateCA(dir, time.Now())
+		if err != nil {
+			t.Fatalf("loading CA failed: %s", err)
+		}
+		if !loaded.cert.Equal(ca.cert) {
+			t.Errorf("a new CA was created instead of loading the persisted one")
+		}
+	})
+
+	certs, err := newAutoCertManager(ca, dir, []string{"hivemind.local", "127.0.0.1"})
+	if err != nil {
+		t.Fatalf("issuing server certificate failed: %s", err)
+	}
+
+	t.Run("serve HTTPS with a certificate trusted through the CA", func(t *testing.T) {
+		server := httptest.NewUnstartedServer(NewHivemindServer(&StubHivemindStore{}))
+		server.TLS = certs.tlsConfig()
+		server.StartTLS()
+		defer server.Close()
+
+		roots := x509.NewCertPool()
+		roots.AddCert(ca.cert)
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, ServerName: "hivemind.local"}}}
+
+		response, err := client.Get(server.URL + "/")
+		if err != nil {
+			t.Fatalf("HTTPS request failed: %s", err)
+		}
+		response.Body.Close()
+
+		assertResponseCode(t, response.StatusCode, http.StatusOK)
+	})
+
+	t.Run("keep a valid certificate on restart", func(t *testing.T) {
+		restarted, err := newAutoCertManager(ca, dir, []string{"hivemind.local", "127.0.0.1"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !restarted.cert.Leaf.Equal(certs.cert.Leaf) {
+			t.Errorf("certificate reissued although it is still valid")
+		}
+	})
+
+	t.Run("reissue the certificate before it expires", func(t *testing.T) {
+		old := certs.cert.Leaf
+		certs.now = func() time.Time { return old.NotAfter.Add(-serverCertRenewal / 2) }
+
+		cert, err := certs.getCertificate(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !cert.Leaf.NotAfter.After(old.NotAfter) {
+			t.Errorf("certificate not renewed, expires %s", cert.Leaf.NotAfter)
+		}
+		if err := cert.Leaf.VerifyHostname("hivemind.local"); err != nil {
+			t.Errorf("renewed certificate lost its hosts: %s", err)
+		}
+	})
+}
+
+func TestHTTPSRedirect(t *testing.T) {
+	request, _ := http.NewRequest(http.MethodGet, "http://hivemind.local:5080/api/switch/?x=1", nil)
+	response := httptest.NewRecorder()
+
+	httpsRedirect(":5000").ServeHTTP(response, request)
+
+	assertResponseCode(t, response.Code, http.StatusPermanentRedirect)
+	if got := response.Header().Get("Location"); got != "https://hivemind.local:5000/api/switch/?x=1" {
+		t.Errorf("got redirect to %q", got)
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	sessionCookie   = "hivemind_session"
+	csrfHeader      = "X-CSRF-Token"
+	sessionLifetime = 7 * 24 * time.Hour
+)
+
+// User is an account for the dashboard, only the bcrypt hash of the password is stored
+type User struct {
+	Username     string
+	Name         string
+	PasswordHash string `json:",omitempty"`
+	Scopes       []string
+	Roles        []RoleGrant
+	Created      time.Time
+}
+
+// Session is a dashboard login of a User, only the SHA-256 hash of the cookie value is stored as ID
+type Session struct {
+	ID        string
+	Username  string
+	CSRFToken string
+	Expires   time.Time
+}
+
+// UserStore is an interface for user and session datastorage
+type UserStore interface {
+	getUser(username string) (User, error)
+	getAllUsers() []User
+	storeUser(u User) error
+	deleteUser(username string) error
+	getSession(id string) (Session, error)
+	storeSession(s Session) error
+	deleteSession(id string) error
+}
+
+var dummyPasswordHash struct {
+	once sync.Once
+	hash []byte
+}
+
+// checkPassword compares password with the hash of u, taking the same time for unknown users
+func checkPassword(u User, password string) bool {
+	if u.PasswordHash == "" {
+		dummyPasswordHash.once.Do(func() {
+			dummyPasswordHash.hash, _ = bcrypt.GenerateFromPassword([]byte("hivemind"), bcrypt.DefaultCost)
+		})
+		bcrypt.CompareHashAndPassword(dummyPasswordHash.hash, []byte(password))
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(password)) == nil
+}
+
+// startSession stores a new session for u, the returned secret is the cookie value
+func startSession(s UserStore, u User) (Session, string, error) {
+	secret := newID() + newID()
+	session := Session{
+		ID:        hashTokenSecret(secret),
+		Username:  u.Username,
+		CSRFToken: newID(),
+		Expires:   time.Now().UTC().Add(sessionLifetime),
+	}
+	return session, secret, s.storeSession(session)
+}
+
+// verifySession returns the session and user belonging to a cookie value
+func verifySession(s UserStore, secret string) (Session, User, error) {
+	invalid := errors.New("invalid session")
+	session, err := s.getSession(hashTokenSecret(secret))
+	if err != nil || session.ID == "" {
+		return Session{}, User{}, invalid
+	}
+	if time.Now().After(session.Expires) {
+		s.deleteSession(session.ID)
+		return Session{}, User{}, invalid
+	}
+	u, err := s.getUser(session.Username)
+	if err != nil || u.Username == "" {
+		return Session{}, User{}, invalid
+	}
+	return session, u, nil
+}
+
+// sessionInfo is returned on login and for the current session, the Vue app sends CSRFToken back in the X-CSRF-Token header
+type sessionInfo struct {
+	Username  string
+	Name      string
+	Scopes    []string
+	Roles     []RoleGrant
+	CSRFToken string
+	Expires   time.Time
+}
+
+func (h *HivemindServer) apiAuthHandler(w http.ResponseWriter, r *http.Request) {
+	endpoint := r.URL.Path[len("/api/auth"):]
+	w.Header().Set("content-type", "application/json")
+	if h.users == nil {
+		writeProblem(w, r, http.StatusNotImplemented, "")
+		return
+	}
+
+	switch {
+	case endpoint == "/login" && r.Method == http.MethodPost:
+		h.apiAuthLogin(w, r)
+	case endpoint == "/logout" && r.Method == http.MethodPost:
+		id, ok := identityFromRequest(r)
+		if ok && id.session != nil {
+			h.users.deleteSession(id.session.ID)
+		}
+		http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: "", Path: "/", MaxAge: -1, HttpOnly: true, Secure: r.TLS != nil, SameSite: http.SameSiteStrictMode})
+		w.WriteHeader(http.StatusNoContent)
+	case endpoint == "/session" && r.Method == http.MethodGet:
+		id, ok := identityFromRequest(r)
+		if !ok || id.session == nil {
+			writeProblem(w, r, http.StatusUnauthorized, "")
+			return
+		}
+		u, _ := h.users.getUser(id.session.Username)
+		json.NewEncoder(w).Encode(sessionInfo{u.Username, u.Name, u.Scopes, u.Roles, id.session.CSRFToken, id.session.Expires})
+	case endpoint == "/login" || endpoint == "/logout" || endpoint == "/session":
+		writeProblem(w, r, http.StatusMethodNotAllowed, "")
+	default:
+		writeProblem(w, r, http.StatusNotFound, "")
+	}
+}
+
+// loginRequest is the body of a login
+type loginRequest struct {
+	Username string
+	Password string
+}
+
+func (h *HivemindServer) apiAuthLogin(w http.ResponseWriter, r *http.Request) {
+	var credentials loginRequest
+	err := json.NewDecoder(r.Body).Decode(&credentials)
+	if err != nil {
+		writeDecodeError(w, r, err)
+		return
+	}
+	u, _ := h.users.getUser(credentials.Username)
+	if !checkPassword(u, credentials.Password) {
+		writeProblem(w, r, http.StatusUnauthorized, "")
+		return
+	}
+	session, secret, err := startSession(h.users, u)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    secret,
+		Path:     "/",
+		Expires:  session.Expires,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+	json.NewEncoder(w).Encode(sessionInfo{u.Username, u.Name, u.Scopes, u.Roles, session.CSRFToken, session.Expires})
+}
+
+func (h *HivemindServer) apiUserHandler(w http.ResponseWriter, r *http.Request) {
+	username := strings.Split(r.URL.Path[len("/api/user/"):], "/")[0]
+	w.Header().Set("content-type", "application/json")
+	if h.users == nil {
+		writeProblem(w, r, http.StatusNotImplemented, "")
+		return
+	}
+
+	switch {
+	case username == "" && r.Method == http.MethodGet:
+		users := h.users.getAllUsers()
+		for i := range users {
+			users[i].PasswordHash = ""
+		}
+		json.NewEncoder(w).Encode(users)
+	case username == "":
+		writeProblem(w, r, http.StatusMethodNotAllowed, "")
+	case r.Method == http.MethodGet:
+		u, err := h.users.getUser(username)
+		if err != nil || u.Username == "" {
+			writeProblem(w, r, http.StatusNotFound, "")
+			return
+		}
+		u.PasswordHash = ""
+		json.NewEncoder(w).Encode(u)
+	case r.Method == http.MethodPut:
+		h.apiUserPut(w, r, username)
+	case r.Method == http.MethodDelete:
+		err := h.users.deleteUser(username)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeProblem(w, r, http.StatusMethodNotAllowed, "")
+	}
+}
+
+// userRequest is the body of a PUT of a user, an empty Password keeps the current one
+type userRequest struct {
+	Name     string
+	Password string
+	Scopes   []string
+	Roles    []RoleGrant
+}
+
+// apiUserPut creates or updates a user
+func (h *HivemindServer) apiUserPut(w http.ResponseWriter, r *http.Request, username string) {
+	var request userRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		writeDecodeError(w, r, err)
+		return
+	}
+	for _, scope := range request.Scopes {
+		if !contains(knownScopes, scope) {
+			writeProblem(w, r, http.StatusUnprocessableEntity, "unknown scope "+scope)
+			return
+		}
+	}
+	for _, g := range request.Roles {
+		if err := g.validate(); err != nil {
+			writeProblem(w, r, http.StatusUnprocessableEntity, err.Error())
+			return
+		}
+	}
+
+	u, _ := h.users.getUser(username)
+	if u.Username == "" {
+		if len(request.Password) < 8 {
+			writeProblem(w, r, http.StatusUnprocessableEntity, "a new user needs a Password of at least 8 characters")
+			return
+		}
+		u = User{Username: username, Created: time.Now().UTC()}
+	}
+	u.Name = request.Name
+	u.Scopes = request.Scopes
+	u.Roles = request.Roles
+	if request.Password != "" {
+		if len(request.Password) < 8 {
+			writeProblem(w, r, http.StatusUnprocessableEntity, "Password needs at least 8 characters")
+			return
+		}
+		hash, err := bcrypt.GenerateFromPassword([]byte(request.Password), bcrypt.DefaultCost)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		u.PasswordHash = string(hash)
+	}
+
+	err = h.users.storeUser(u)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	u.PasswordHash = ""
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(u)
+}
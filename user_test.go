@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestSessionLogin(t *testing.T) {
+	store := StubHivemindStore{
+		nil,
+		map[string]Switch{"boiler": Switch{ID: "boiler", Name: "Boiler", Type: "generic", State: true}},
+	}
+	users := newStubUserStore()
+	hash, _ := bcrypt.GenerateFromPassword([]byte("correct horse"), bcrypt.MinCost)
+	users.storeUser(User{Username: "kid", PasswordHash: string(hash), Scopes: []string{scopeSwitchRead, scopeSwitchWrite}})
+	server := NewHivemindServer(&store)
+	server.users = users
+
+	login := func(password string) *httptest.ResponseRecorder {
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, newPostRequest("api/auth/login", strings.NewReader(`{"Username": "kid", "Password": "`+password+`"}`)))
+		return response
+	}
+
+	t.Run("return status 401 on POST /api/auth/login with a wrong password", func(t *testing.T) {
+		response := login("wrong")
+
+		assertResponseCode(t, response.Code, http.StatusUnauthorized)
+		if len(response.Result().Cookies()) != 0 {
+			t.Errorf("session cookie set for failed login")
+		}
+	})
+
+	response := login("correct horse")
+	var info sessionInfo
+	json.NewDecoder(response.Body).Decode(&info)
+	cookies := response.Result().Cookies()
+
+	t.Run("return an HTTP only session cookie and CSRF token on POST /api/auth/login", func(t *testing.T) {
+		assertResponseCode(t, response.Code, http.StatusOK)
+		if len(cookies) != 1 || cookies[0].Name != sessionCookie || !cookies[0].HttpOnly || cookies[0].SameSite != http.SameSiteStrictMode {
+			t.Fatalf("unexpected cookies %v", cookies)
+		}
+		if info.CSRFToken == "" || info.Username != "kid" {
+			t.Errorf("unexpected session info %v", info)
+		}
+		if _, ok := users.sessions[cookies[0].Value]; ok {
+			t.Errorf("session stored under the cookie value instead of its hash")
+		}
+	})
+
+	withSession := func(request *http.Request, csrf string) *http.Request {
+		request.AddCookie(cookies[0])
+		if csrf != "" {
+			request.Header.Set(csrfHeader, csrf)
+		}
+		return request
+	}
+
+	t.Run("return status 200 on GET /api/switch/ with a session", func(t *testing.T) {
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, withSession(newGetRequest("api/switch/"), ""))
+
+		assertResponseCode(t, response.Code, http.StatusOK)
+	})
+
+	t.Run("return status 403 on PUT /api/switch/boiler with a session but without CSRF token", func(t *testing.T) {
+		request := newPutRequest("api/switch/boiler", strings.NewReader(`{"ID": "boiler", "Name": "Boiler", "State": false}`))
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, withSession(request, ""))
+
+		assertResponseCode(t, response.Code, http.StatusForbidden)
+		assertSwitch(t, store.switches["boiler"], Switch{ID: "boiler", Name: "Boiler", Type: "generic", State: true})
+	})
+
+	t.Run("return status 202 on PUT /api/switch/boiler with a session and CSRF token", func(t *testing.T) {
+		request := newPutRequest("api/switch/boiler", strings.NewReader(`{"ID": "boiler", "Name": "Boiler", "State": false}`))
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, withSession(request, info.CSRFToken))
+
+		assertResponseCode(t, response.Code, http.StatusAccepted)
+	})
+
+	t.Run("return status 403 on GET /api/user/ without admin", func(t *testing.T) {
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, withSession(newGetRequest("api/user/"), ""))
+
+		assertResponseCode(t, response.Code, http.StatusForbidden)
+	})
+
+	t.Run("end the session on POST /api/auth/logout", func(t *testing.T) {
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, withSession(newPostRequest("api/auth/logout", nil), info.CSRFToken))
+
+		assertResponseCode(t, response.Code, http.StatusNoContent)
+		if len(users.sessions) != 0 {
+			t.Errorf("session not deleted on logout")
+		}
+
+		response = httptest.NewRecorder()
+		server.ServeHTTP(response, withSession(newGetRequest("api/switch/"), ""))
+
+		assertResponseCode(t, response.Code, http.StatusUnauthorized)
+	})
+
+	t.Run("reject expired sessions", func(t *testing.T) {
+		_, secret, _ := startSession(users, User{Username: "kid"})
+		for id, s := range users.sessions {
+			s.Expires = time.Now().Add(-time.Minute)
+			users.sessions[id] = s
+		}
+
+		_, _, err := verifySession(users, secret)
+		if err == nil {
+			t.Errorf("expired session accepted")
+		}
+	})
+}
+
+// stubs
+type stubUserStore struct {
+	users    map[string]User
+	sessions map[string]Session
+}
+
+func newStubUserStore() *stubUserStore {
+	return &stubUserStore{make(map[string]User), make(map[string]Session)}
+}
+
+func (s *stubUserStore) getUser(username string) (User, error) {
+	return s.users[username], nil
+}
+
+func (s *stubUserStore) getAllUsers() []User {
+	var users []User
+	for _, u := range s.users {
+		users = append(users, u)
+	}
+	return users
+}
+
+func (s *stubUserStore) storeUser(u User) error {
+	s.users[u.Username] = u
+	return nil
+}
+
+func (s *stubUserStore) deleteUser(username string) error {
+	delete(s.users, username)
+	return nil
+}
+
+func (s *stubUserStore) getSession(id string) (Session, error) {
+	return s.sessions[id], nil
+}
+
+func (s *stubUserStore) storeSession(session Session) error {
+	s.sessions[session.ID] = session
+	return nil
+}
+
+func (s *stubUserStore) deleteSession(id string) error {
+	delete(s.sessions, id)
+	return nil
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// validID matches the IDs of sensors and switches, they end up in URLs and MQTT topics
+var validID = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_-]{0,63}$`)
+
+// invalidIDChars matches the runs of characters sanitizeID replaces
+var invalidIDChars = regexp.MustCompile(`[^a-zA-Z0-9_-]+`)
+
+const (
+	maxIDLength   = 64
+	maxNameLength = 128
+)
+
+// valueRange is the plausible range of readings in a unit, bounds included
+type valueRange struct {
+	Min, Max int
+}
+
+// sensorTypes maps the known sensor types to their units and the range of readings in each unit;
+// generic sensors take any unit and value, an empty Type is generic
+var sensorTypes = map[string]map[string]valueRange{
+	"generic":        nil,
+	"temperature":    {"C": {-60, 150}, "F": {-76, 302}, "K": {213, 423}},
+	"humidity":       {"%": {0, 100}},
+	"moisture":       {"%": {0, 100}},
+	"battery":        {"%": {0, 100}},
+	"pressure":       {"hPa": {300, 1100}, "mbar": {300, 1100}, "kPa": {30, 110}},
+	"illuminance":    {"lx": {0, 200000}},
+	"carbon_dioxide": {"ppm": {0, 100000}},
+	"power":          {"W": {-100000, 100000}, "kW": {-100, 100}},
+	"energy":         {"Wh": {0, 2000000000}, "kWh": {0, 2000000000}},
+	"voltage":        {"V": {0, 1000}, "mV": {0, 1000000}},
+	"current":        {"A": {-1000, 1000}, "mA": {-1000000, 1000000}},
+}
+
+// switchTypes are the known switch types, an empty Type is generic
+var switchTypes = []string{"generic", "outlet", "switch"}
+
+// fieldError is a problem with a single field of a request body
+type fieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// validationErrors lists the invalid fields of a record, it matches ErrValidation with errors.Is
+type validationErrors []fieldError
+
+func (v validationErrors) Error() string {
+	messages := make([]string, len(v))
+	for i, e := range v {
+		messages[i] = e.Field + " " + e.Message
+	}
+	return strings.Join(messages, ", ")
+}
+
+func (v validationErrors) Is(target error) bool {
+	return target == ErrValidation
+}
+
+func (v *validationErrors) add(field, message string) {
+	*v = append(*v, fieldError{field, message})
+}
+
+// err returns v as error, nil when no field is invalid
+func (v validationErrors) err() error {
+	if len(v) == 0 {
+		return nil
+	}
+	return v
+}
+
+// decodeSensor unmarshals and validates a sensor from body; id is the ID in the URL of a PUT, which
+// fills in a missing ID in body and has to match a given one
+func decodeSensor(body []byte, id string) (Sensor, error) {
+	var s Sensor
+	err := json.Unmarshal(body, &s)
+	if err != nil {
+		return s, err
+	}
+	invalid := unknownFields(body, &s)
+	s.ID = checkURLID(&invalid, s.ID, id)
+	invalid = append(invalid, validateSensor(s)...)
+	return s, invalid.err()
+}
+
+// decodeSwitch unmarshals and validates a switch from body like decodeSensor
+func decodeSwitch(body []byte, id string) (Switch, error) {
+	var sw Switch
+	err := json.Unmarshal(body, &sw)
+	if err != nil {
+		return sw, err
+	}
+	invalid := unknownFields(body, &sw)
+	sw.ID = checkURLID(&invalid, sw.ID, id)
+	invalid = append(invalid, validateSwitch(sw)...)
+	return sw, invalid.err()
+}
+
+func validateSensor(s Sensor) validationErrors {
+	var invalid validationErrors
+	validateIDAndName(&invalid, s.ID, s.Name)
+	typ := s.Type
+	if typ == "" {
+		typ = "generic"
+	}
+	units, known := sensorTypes[typ]
+	if !known {
+		invalid.add("Type", "must be one of "+strings.Join(sensorTypeNames(), ", "))
+		return invalid
+	}
+	if units == nil {
+		return invalid
+	}
+	r, known := units[s.Unit]
+	if !known {
+		invalid.add("Unit", "must be one of "+strings.Join(unitNames(units), ", ")+" for "+typ+" sensors")
+		return invalid
+	}
+	if s.Value < r.Min || s.Value > r.Max {
+		invalid.add("Value", "must be between "+strconv.Itoa(r.Min)+" and "+strconv.Itoa(r.Max)+" "+s.Unit)
+	}
+	return invalid
+}
+
+func validateSwitch(sw Switch) validationErrors {
+	var invalid validationErrors
+	validateIDAndName(&invalid, sw.ID, sw.Name)
+	if sw.Type != "" && !contains(switchTypes, sw.Type) {
+		invalid.add("Type", "must be one of "+strings.Join(switchTypes, ", "))
+	}
+	return invalid
+}
+
+// sanitizeID turns a name of another system, like an InfluxDB measurement, into an ID by replacing
+// the characters validID does not allow with _ and cutting it to its maximum length
+func sanitizeID(id string) string {
+	id = strings.TrimLeft(invalidIDChars.ReplaceAllString(id, "_"), "_-")
+	if len(id) > maxIDLength {
+		id = id[:maxIDLength]
+	}
+	return id
+}
+
+// sanitizeName cuts name to its maximum length
+func sanitizeName(name string) string {
+	if len(name) > maxNameLength {
+		name = strings.ToValidUTF8(name[:maxNameLength], "")
+	}
+	return name
+}
+
+// sanitizeSensor makes a sensor described by another system valid apart from its value; a Type or
+// Unit unknown here turns it into a generic sensor keeping the unit
+func sanitizeSensor(s Sensor) Sensor {
+	s.ID, s.Name = sanitizeID(s.ID), sanitizeName(s.Name)
+	for _, e := range validateSensor(s) {
+		if e.Field == "Type" || e.Field == "Unit" {
+			s.Type = "generic"
+		}
+	}
+	return s
+}
+
+func validateIDAndName(invalid *validationErrors, id, name string) {
+	if id == "" {
+		invalid.add("ID", "is required")
+	} else if !validID.MatchString(id) {
+		invalid.add("ID", "must be 1 to 64 letters, digits, _ or -, starting with a letter or digit")
+	}
+	if strings.TrimSpace(name) == "" {
+		invalid.add("Name", "is required")
+	} else if len(name) > maxNameLength {
+		invalid.add("Name", "must not be longer than "+strconv.Itoa(maxNameLength)+" bytes")
+	}
+}
+
+// checkURLID returns the ID of a record, taken from the URL when the body has none
+func checkURLID(invalid *validationErrors, bodyID, urlID string) string {
+	if bodyID == "" {
+		return urlID
+	}
+	if urlID != "" && bodyID != urlID {
+		invalid.add("ID", "does not match "+urlID+" in the URL")
+	}
+	return bodyID
+}
+
+// unknownFields lists the keys of the JSON object in body that match no field of the struct v
+// points to, compared case-insensitive like encoding/json does
+func unknownFields(body []byte, v interface{}) validationErrors {
+	var object map[string]json.RawMessage
+	if json.Unmarshal(body, &object) != nil {
+		return nil
+	}
+	t := reflect.TypeOf(v).Elem()
+	var keys []string
+	for key := range object {
+		if !hasJSONField(t, key) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	var invalid validationErrors
+	for _, key := range keys {
+		invalid.add(key, "is not a field of "+t.Name())
+	}
+	return invalid
+}
+
+func hasJSONField(t reflect.Type, key string) bool {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := f.Name
+		if tag := strings.Split(f.Tag.Get("json"), ",")[0]; tag == "-" {
+			continue
+		} else if tag != "" {
+			name = tag
+		}
+		if strings.EqualFold(name, key) {
+			return true
+		}
+	}
+	return false
+}
+
+func sensorTypeNames() []string {
+	var names []string
+	for name := range sensorTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func unitNames(units map[string]valueRange) []string {
+	var names []string
+	for unit := range units {
+		names = append(names, unit)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestValidation(t *testing.T) {
+	t.Run("validate sensors field by field", func(t *testing.T) {
+		cases := []struct {
+			sensor Sensor
+			want   []string
+		}{
+			{Sensor{ID: "kitchen_temp", Name: "Kitchen", Unit: "C", Type: "temperature", Value: 21}, nil},
+			{Sensor{ID: "meter", Name: "Meter", Unit: "pulses", Value: 123456}, nil},
+			{Sensor{Type: "generic"}, []string{"ID", "Name"}},
+			{Sensor{ID: "kitchen/temp", Name: "Kitchen", Unit: "C", Type: "generic"}, []string{"ID"}},
+			{Sensor{ID: "kitchen", Name: "Kitchen", Unit: "C", Type: "thermometer"}, []string{"Type"}},
+			{Sensor{ID: "kitchen", Name: "Kitchen", Unit: "%", Type: "temperature", Value: 21}, []string{"Unit"}},
+			{Sensor{ID: "kitchen", Name: "Kitchen", Unit: "%", Type: "humidity", Value: 140}, []string{"Value"}},
+		}
+		for _, c := range cases {
+			var got []string
+			for _, e := range validateSensor(c.sensor) {
+				got = append(got, e.Field)
+			}
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("validateSensor(%v) rejected %v, want %v", c.sensor, got, c.want)
+			}
+		}
+	})
+
+	t.Run("sanitize IDs of other systems", func(t *testing.T) {
+		for id, want := range map[string]string{
+			"cpu.load_value":        "cpu_load_value",
+			"_living room/lamp":     "living_room_lamp",
+			strings.Repeat("a", 80): strings.Repeat("a", 64),
+		} {
+			if got := sanitizeID(id); got != want {
+				t.Errorf("sanitizeID(%q) = %q, want %q", id, got, want)
+			}
+		}
+	})
+
+	t.Run("reject unknown fields and IDs disagreeing with the URL", func(t *testing.T) {
+		_, err := decodeSwitch([]byte(`{"ID": "lamp", "name": "Lamp", "Sate": true}`), "boiler")
+
+		var invalid validationErrors
+		if !errors.As(err, &invalid) || !errors.Is(err, ErrValidation) {
+			t.Fatalf("got %v, want validation errors", err)
+		}
+		want := validationErrors{{"Sate", "is not a field of Switch"}, {"ID", "does not match boiler in the URL"}}
+		if !reflect.DeepEqual(invalid, want) {
+			t.Errorf("got %v, want %v", invalid, want)
+		}
+	})
+
+	t.Run("take a missing ID from the URL", func(t *testing.T) {
+		sw, err := decodeSwitch([]byte(`{"Name": "Lamp", "State": true}`), "lamp")
+
+		if err != nil || sw.ID != "lamp" {
+			t.Errorf("got %v, %v", sw, err)
+		}
+	})
+
+	t.Run("return status 422 and the invalid fields on POST /api/sensor/", func(t *testing.T) {
+		store := StubHivemindStore{map[string]Sensor{}, nil}
+		server := NewHivemindServer(&store)
+		request := newPostRequest("api/sensor/", strings.NewReader(`{"ID": "cellar", "Unit": "C", "Type": "temperature", "Value": 900}`))
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, request)
+
+		assertResponseCode(t, response.Code, http.StatusUnprocessableEntity)
+		assertContentType(t, response.Header().Get("content-type"), problemContentType)
+		var got problem
+		json.NewDecoder(response.Body).Decode(&got)
+		want := []fieldError{{"Name", "is required"}, {"Value", "must be between -60 and 150 C"}}
+		if !reflect.DeepEqual(got.Errors, want) {
+			t.Errorf("got %v, want %v", got.Errors, want)
+		}
+		if len(store.sensors) != 0 {
+			t.Errorf("invalid sensor stored")
+		}
+	})
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// apiV1Prefix is the path of version 1 of the API; the sensor and switch paths directly below /api/
+// are its legacy alias, kept for the devices flashed with them
+const apiV1Prefix = "/api/v1"
+
+// legacyAPIDeprecation is when the legacy paths were deprecated in favour of /api/v1/
+var legacyAPIDeprecation = time.Date(2026, time.October, 18, 0, 0, 0, 0, time.UTC)
+
+// unversionedPath returns path with the version removed, /api/v1/sensor/x becomes /api/sensor/x
+func unversionedPath(path string) string {
+	if strings.HasPrefix(path, apiV1Prefix+"/") {
+		return "/api" + path[len(apiV1Prefix):]
+	}
+	return path
+}
+
+// isLegacyAPI reports whether r was made to a legacy path instead of its successor below /api/v1/
+func isLegacyAPI(r *http.Request) bool {
+	return !strings.HasPrefix(r.URL.Path, apiV1Prefix+"/")
+}
+
+// itemID returns the ID of the item in the path of r below collection, e.g. /api/sensor/, in any
+// version of the API
+func itemID(r *http.Request, collection string) string {
+	return strings.Split(strings.TrimPrefix(unversionedPath(r.URL.Path), collection), "/")[0]
+}
+
+// writeStatus returns status for a successful write on /api/v1/, the legacy API answers all writes
+// with 202 Accepted
+func writeStatus(r *http.Request, status int) int {
+	if isLegacyAPI(r) {
+		return http.StatusAccepted
+	}
+	return status
+}
+
+// deprecated announces on every response of handler, served on a legacy path, that it is deprecated
+// and when it stops working, and links the same path below /api/v1/ as its successor
+func (h *HivemindServer) deprecated(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Deprecation", "@"+strconv.FormatInt(legacyAPIDeprecation.Unix(), 10))
+		if !h.legacySunset.IsZero() {
+			w.Header().Set("Sunset", h.legacySunset.UTC().Format(http.TimeFormat))
+		}
+		w.Header().Add("Link", "<"+apiV1Prefix+strings.TrimPrefix(r.URL.Path, "/api")+`>; rel="successor-version"`)
+		handler(w, r)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAPIVersions(t *testing.T) {
+	store := StubHivemindStore{map[string]Sensor{}, map[string]Switch{}}
+	for i := 0; i < defaultPageLimit+1; i++ {
+		id := "s" + randomString(8)
+		store.sensors[id] = Sensor{ID: id, Name: "Sensor", Unit: "C", Type: "temperature", Value: i}
+	}
+	server := NewHivemindServer(&store)
+	server.legacySunset = time.Date(2027, 12, 31, 0, 0, 0, 0, time.UTC)
+
+	t.Run("announce the successor and sunset on the legacy paths", func(t *testing.T) {
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, newGetRequest("api/switch/"))
+
+		assertResponseCode(t, response.Code, http.StatusOK)
+		assertHeader(t, response.Header(), "Deprecation", "@1792281600")
+		assertHeader(t, response.Header(), "Sunset", "Fri, 31 Dec 2027 00:00:00 GMT")
+		assertHeader(t, response.Header(), "Link", `</api/v1/switch/>; rel="successor-version"`)
+	})
+
+	t.Run("serve /api/v1/ without deprecation", func(t *testing.T) {
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, newGetRequest("api/v1/switch/"))
+
+		assertResponseCode(t, response.Code, http.StatusOK)
+		assertHeader(t, response.Header(), "Deprecation", "")
+		assertHeader(t, response.Header(), "Sunset", "")
+	})
+
+	t.Run("list all sensors on the legacy path and a page on /api/v1/", func(t *testing.T) {
+		legacy := httptest.NewRecorder()
+		v1 := httptest.NewRecorder()
+
+		server.ServeHTTP(legacy, newGetRequest("api/sensor/"))
+		server.ServeHTTP(v1, newGetRequest("api/v1/sensor/"))
+
+		if got := len(getSensorSliceFromResponse(t, legacy.Body)); got != defaultPageLimit+1 {
+			t.Errorf("got %d sensors on the legacy path, want all %d", got, defaultPageLimit+1)
+		}
+		if got := len(getSensorSliceFromResponse(t, v1.Body)); got != defaultPageLimit {
+			t.Errorf("got %d sensors on /api/v1/, want a page of %d", got, defaultPageLimit)
+		}
+	})
+
+	t.Run("return status 202 without body on POST /api/sensor/", func(t *testing.T) {
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, newPostRequest("api/sensor/", strings.NewReader(`{"ID": "kitchen", "Name": "Kitchen", "Value": 21}`)))
+
+		assertResponseCode(t, response.Code, http.StatusAccepted)
+		assertBody(t, response.Body.String(), "")
+	})
+
+	t.Run("return status 201 with the sensor on POST /api/v1/sensor/", func(t *testing.T) {
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, newPostRequest("api/v1/sensor/", strings.NewReader(`{"ID": "cellar", "Name": "Cellar", "Value": 12}`)))
+
+		assertResponseCode(t, response.Code, http.StatusCreated)
+		assertHeader(t, response.Header(), "Location", "/api/v1/sensor/cellar")
+		assertHeader(t, response.Header(), "ETag", `"0"`)
+		assertSensor(t, getSensorFromResponse(t, response.Body), Sensor{ID: "cellar", Name: "Cellar", Value: 12})
+	})
+
+	t.Run("return status 200 with the sensor on PUT /api/v1/sensor/cellar", func(t *testing.T) {
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, newPutRequest("api/v1/sensor/cellar", strings.NewReader(`{"Name": "Cellar", "Value": 13}`)))
+
+		assertResponseCode(t, response.Code, http.StatusOK)
+		assertSensor(t, getSensorFromResponse(t, response.Body), Sensor{ID: "cellar", Name: "Cellar", Value: 13})
+	})
+
+	t.Run("answer 200 for the items of POST /api/v1/sensor/batch", func(t *testing.T) {
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, newPostRequest("api/v1/sensor/batch", strings.NewReader(`[{"ID": "attic", "Name": "Attic"}]`)))
+
+		assertResponseCode(t, response.Code, http.StatusOK)
+		assertBody(t, response.Body.String(), `[{"ID":"attic","Status":200}]`+"\n")
+	})
+}
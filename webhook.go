@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	webhookSensorChanged = "sensor.changed"
+	webhookSwitchChanged = "switch.changed"
+)
+
+// Webhook is a subscription to changes of sensors and switches, an empty Events or IDs matches all
+type Webhook struct {
+	ID     string
+	URL    string
+	Events []string
+	IDs    []string
+	Secret string `json:",omitempty"`
+}
+
+// WebhookDelivery records a single attempt to deliver an event to a Webhook
+type WebhookDelivery struct {
+	ID      string
+	Webhook string
+	Event   string
+	Attempt int
+	Status  int
+	Error   string `json:",omitempty"`
+	Time    time.Time
+}
+
+// WebhookStore is an interface for webhook datastorage
+type WebhookStore interface {
+	getWebhook(id string) (Webhook, error)
+	getAllWebhooks() []Webhook
+	storeWebhook(w Webhook) error
+	deleteWebhook(id string) error
+	getWebhookDeliveries(id string) []WebhookDelivery
+	storeWebhookDelivery(d WebhookDelivery) error
+}
+
+// webhookEvent is the JSON payload posted to a Webhook
+type webhookEvent struct {
+	Event  string
+	Time   time.Time
+	Sensor *Sensor `json:",omitempty"`
+	Switch *Switch `json:",omitempty"`
+}
+
+type webhookJob struct {
+	logger   *slog.Logger
+	webhook  Webhook
+	delivery string
+	event    string
+	payload  []byte
+}
+
+// WebhookDispatcher delivers change events to the registered webhooks
+type WebhookDispatcher struct {
+	store       WebhookStore
+	client      *http.Client
+	queue       chan webhookJob
+	stop        chan struct{}
+	wg          sync.WaitGroup
+	workers     int32
+	maxAttempts int
+	backoff     time.Duration
+	// webhooks caches the webhooks of store, nil until loaded; it is dropped when they change
+	mutex    sync.Mutex
+	webhooks []Webhook
+}
+
+// NewWebhookDispatcher creates a WebhookDispatcher, register it as ChangeListener and start it to deliver events
+func NewWebhookDispatcher(s WebhookStore) *WebhookDispatcher {
+	return &WebhookDispatcher{
+		store:       s,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		queue:       make(chan webhookJob, 100),
+		stop:        make(chan struct{}),
+		maxAttempts: 5,
+		backoff:     time.Second,
+	}
+}
+
+// start launches workers delivering queued events
+func (d *WebhookDispatcher) start(workers int) {
+	for i := 0; i < workers; i++ {
+		d.wg.Add(1)
+		go func() {
+			defer d.wg.Done()
+			atomic.AddInt32(&d.workers, 1)
+			defer atomic.AddInt32(&d.workers, -1)
+			for {
+				select {
+				case job := <-d.queue:
+					d.deliver(job)
+				case <-d.stop:
+					return
+				}
+			}
+		}()
+	}
+}
+
+// shutdown stops the workers, pending retries are abandoned
+func (d *WebhookDispatcher) shutdown() {
+	close(d.stop)
+	d.wg.Wait()
+}
+
+// running reports whether workers are delivering events, for the readiness check
+func (d *WebhookDispatcher) running() error {
+	if atomic.LoadInt32(&d.workers) == 0 {
+		return errors.New("no delivery workers running")
+	}
+	if n := len(d.queue); n == cap(d.queue) {
+		return errors.New("delivery queue full")
+	}
+	return nil
+}
+
+// distinctChangesOnly makes d a DistinctChangeListener, a webhook is not called for a sensor or switch
+// stored unchanged
+func (d *WebhookDispatcher) distinctChangesOnly() {}
+
+func (d *WebhookDispatcher) sensorChanged(s Sensor, l *slog.Logger) {
+	d.dispatch(webhookEvent{Event: webhookSensorChanged, Time: time.Now().UTC(), Sensor: &s}, s.ID, l)
+}
+
+func (d *WebhookDispatcher) switchChanged(s Switch, l *slog.Logger) {
+	d.dispatch(webhookEvent{Event: webhookSwitchChanged, Time: time.Now().UTC(), Switch: &s}, s.ID, l)
+}
+
+// dispatch queues event for the matching webhooks, their deliveries are logged to l
+func (d *WebhookDispatcher) dispatch(event webhookEvent, id string, l *slog.Logger) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	for _, w := range d.allWebhooks() {
+		if !w.matches(event.Event, id) {
+			continue
+		}
+		job := webhookJob{logger: l, webhook: w, delivery: newID(), event: event.Event, payload: payload}
+		select {
+		case d.queue <- job:
+		default:
+			// dropped deliveries are not recorded, that would write to the store on the write path
+			// of the sensor or switch
+			l.Warn("webhook delivery dropped, delivery queue full", "webhook", w.ID, "delivery", job.delivery, "event", job.event)
+		}
+	}
+}
+
+// allWebhooks returns the webhooks of the store, read once until they change
+func (d *WebhookDispatcher) allWebhooks() []Webhook {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.webhooks == nil {
+		d.webhooks = append([]Webhook{}, d.store.getAllWebhooks()...)
+	}
+	return d.webhooks
+}
+
+// storeWebhook stores w and drops the cached webhooks
+func (d *WebhookDispatcher) storeWebhook(w Webhook) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.webhooks = nil
+	return d.store.storeWebhook(w)
+}
+
+// deleteWebhook deletes the webhook id and drops the cached webhooks
+func (d *WebhookDispatcher) deleteWebhook(id string) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.webhooks = nil
+	return d.store.deleteWebhook(id)
+}
+
+// deliver posts the job, retrying with exponential backoff on connection errors and server errors
+func (d *WebhookDispatcher) deliver(job webhookJob) {
+	backoff := d.backoff
+	for attempt := 1; attempt <= d.maxAttempts; attempt++ {
+		status, err := d.post(job)
+		d.record(job, attempt, status, err)
+		if err == nil || (status >= 400 && status < 500 && status != http.StatusTooManyRequests) {
+			return
+		}
+		if attempt == d.maxAttempts {
+			return
+		}
+		select {
+		case <-time.After(backoff):
+			backoff *= 2
+		case <-d.stop:
+			return
+		}
+	}
+}
+
+func (d *WebhookDispatcher) post(job webhookJob) (int, error) {
+	request, err := http.NewRequest(http.MethodPost, job.webhook.URL, bytes.NewReader(job.payload))
+	if err != nil {
+		return 0, err
+	}
+	request.Header.Set("content-type", "application/json")
+	request.Header.Set("X-Hivemind-Event", job.event)
+	request.Header.Set("X-Hivemind-Delivery", job.delivery)
+	if job.webhook.Secret != "" {
+		request.Header.Set("X-Hivemind-Signature", "sha256="+signWebhookPayload(job.webhook.Secret, job.payload))
+	}
+
+	response, err := d.client.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	ioutil.ReadAll(response.Body)
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return response.StatusCode, errors.New(response.Status)
+	}
+	return response.StatusCode, nil
+}
+
+func (d *WebhookDispatcher) record(job webhookJob, attempt, status int, err error) {
+	delivery := WebhookDelivery{
+		ID:      job.delivery,
+		Webhook: job.webhook.ID,
+		Event:   job.event,
+		Attempt: attempt,
+		Status:  status,
+		Time:    time.Now().UTC(),
+	}
+	l := job.logger.With("webhook", job.webhook.ID, "delivery", job.delivery, "event", job.event, "attempt", attempt, "status", status)
+	if err != nil {
+		delivery.Error = err.Error()
+		l.Warn("webhook delivery failed", "error", err)
+	} else {
+		l.Debug("webhook delivered")
+	}
+	d.store.storeWebhookDelivery(delivery)
+}
+
+func (w Webhook) matches(event, id string) bool {
+	return (len(w.Events) == 0 || contains(w.Events, event)) && (len(w.IDs) == 0 || contains(w.IDs, id))
+}
+
+func (w Webhook) validate() error {
+	u, err := url.Parse(w.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("URL must be an absolute http or https URL")
+	}
+	for _, e := range w.Events {
+		if e != webhookSensorChanged && e != webhookSwitchChanged {
+			return errors.New("unknown event " + e)
+		}
+	}
+	return nil
+}
+
+// signWebhookPayload returns the hex encoded HMAC-SHA256 of payload
+func signWebhookPayload(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (h *HivemindServer) apiWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	trailing := r.URL.Path[len("/api/webhook"):]
+	parts := strings.Split(trailing[1:], "/")
+	id := parts[0]
+	w.Header().Set("content-type", "application/json")
+	if h.webhooks == nil {
+		writeProblem(w, r, http.StatusNotImplemented, "")
+		return
+	}
+	store := h.webhooks.store
+
+	switch {
+	case id == "" && r.Method == http.MethodGet:
+		webhooks := store.getAllWebhooks()
+		for i := range webhooks {
+			webhooks[i].Secret = ""
+		}
+		json.NewEncoder(w).Encode(webhooks)
+	case id == "" && r.Method == http.MethodPost:
+		h.apiWebhookStore(w, r, newID())
+	case id == "":
+		writeProblem(w, r, http.StatusMethodNotAllowed, "")
+	case len(parts) == 2 && parts[1] == "deliveries" && r.Method == http.MethodGet:
+		json.NewEncoder(w).Encode(store.getWebhookDeliveries(id))
+	case len(parts) == 2 && parts[1] == "deliveries":
+		writeProblem(w, r, http.StatusMethodNotAllowed, "")
+	case len(parts) > 1:
+		writeProblem(w, r, http.StatusNotFound, "")
+	case r.Method == http.MethodGet:
+		webhook, err := store.getWebhook(id)
+		if err != nil || webhook.ID == "" {
+			writeProblem(w, r, http.StatusNotFound, "")
+			return
+		}
+		webhook.Secret = ""
+		json.NewEncoder(w).Encode(webhook)
+	case r.Method == http.MethodPut:
+		h.apiWebhookStore(w, r, id)
+	case r.Method == http.MethodDelete:
+		err := h.webhooks.deleteWebhook(id)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeProblem(w, r, http.StatusMethodNotAllowed, "")
+	}
+}
+
+func (h *HivemindServer) apiWebhookStore(w http.ResponseWriter, r *http.Request, id string) {
+	var webhook Webhook
+	err := json.NewDecoder(r.Body).Decode(&webhook)
+	if err != nil {
+		writeDecodeError(w, r, err)
+		return
+	}
+	webhook.ID = id
+	err = webhook.validate()
+	if err != nil {
+		writeProblem(w, r, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	err = h.webhooks.storeWebhook(webhook)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	webhook.Secret = ""
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(webhook)
+}
+
+// newID returns a random hex encoded identifier
+func newID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
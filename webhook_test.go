@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWebhookDispatcher(t *testing.T) {
+	var mutex sync.Mutex
+	var bodies [][]byte
+	var signatures []string
+	received := make(chan struct{}, 10)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mutex.Lock()
+		bodies = append(bodies, body)
+		signatures = append(signatures, r.Header.Get("X-Hivemind-Signature"))
+		attempt := len(bodies)
+		mutex.Unlock()
+		if attempt == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		received <- struct{}{}
+	}))
+	defer target.Close()
+
+	store := newStubWebhookStore()
+	store.storeWebhook(Webhook{ID: "hook", URL: target.URL, Events: []string{webhookSwitchChanged}, Secret: "s3cret"})
+	dispatcher := NewWebhookDispatcher(store)
+	dispatcher.backoff = time.Millisecond
+	dispatcher.start(1)
+
+	dispatcher.sensorChanged(Sensor{ID: "test", Name: "Test", Unit: "C", Type: "generic", Value: 1}, slog.Default())
+	dispatcher.switchChanged(Switch{ID: "lamp", Name: "Lamp", Type: "generic", State: true}, slog.Default())
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-received:
+		case <-time.After(time.Second):
+			t.Fatalf("webhook not delivered")
+		}
+	}
+	dispatcher.shutdown()
+
+	t.Run("retry failed delivery with a signed payload", func(t *testing.T) {
+		if len(bodies) != 2 {
+			t.Fatalf("got %d deliveries, want 2", len(bodies))
+		}
+		var event webhookEvent
+		err := json.Unmarshal(bodies[1], &event)
+		if err != nil {
+			t.Fatalf("unable to parse webhook payload: %s", err)
+		}
+		if event.Event != webhookSwitchChanged || event.Switch == nil || event.Switch.ID != "lamp" {
+			t.Errorf("unexpected payload %s", bodies[1])
+		}
+		if signatures[1] != "sha256="+signWebhookPayload("s3cret", bodies[1]) {
+			t.Errorf("wrong signature %s", signatures[1])
+		}
+	})
+
+	t.Run("record every delivery attempt", func(t *testing.T) {
+		deliveries := store.getWebhookDeliveries("hook")
+		if len(deliveries) != 2 {
+			t.Fatalf("got %d recorded deliveries, want 2", len(deliveries))
+		}
+		if deliveries[0].Attempt != 1 || deliveries[0].Status != http.StatusServiceUnavailable || deliveries[0].Error == "" {
+			t.Errorf("unexpected first attempt %v", deliveries[0])
+		}
+		if deliveries[1].Attempt != 2 || deliveries[1].Status != http.StatusOK || deliveries[1].Error != "" {
+			t.Errorf("unexpected second attempt %v", deliveries[1])
+		}
+	})
+}
+
+func TestWebhookDispatch(t *testing.T) {
+	t.Run("read the webhooks from the store once until they change", func(t *testing.T) {
+		store := newStubWebhookStore()
+		store.storeWebhook(Webhook{ID: "hook", URL: "http://localhost/hook"})
+		dispatcher := NewWebhookDispatcher(store)
+
+		dispatcher.switchChanged(Switch{ID: "lamp", Name: "Lamp", Type: "generic"}, slog.Default())
+		dispatcher.switchChanged(Switch{ID: "lamp", Name: "Lamp", Type: "generic", State: true}, slog.Default())
+		if store.reads != 1 || len(dispatcher.queue) != 2 {
+			t.Errorf("got %d reads and %d queued deliveries, want 1 and 2", store.reads, len(dispatcher.queue))
+		}
+
+		dispatcher.storeWebhook(Webhook{ID: "other", URL: "http://localhost/other"})
+		dispatcher.switchChanged(Switch{ID: "lamp", Name: "Lamp", Type: "generic"}, slog.Default())
+		if store.reads != 2 || len(dispatcher.queue) != 4 {
+			t.Errorf("got %d reads and %d queued deliveries, want 2 and 4", store.reads, len(dispatcher.queue))
+		}
+	})
+
+	t.Run("drop deliveries when the queue is full without writing to the store", func(t *testing.T) {
+		store := newStubWebhookStore()
+		store.storeWebhook(Webhook{ID: "hook", URL: "http://localhost/hook"})
+		dispatcher := NewWebhookDispatcher(store)
+		dispatcher.queue = make(chan webhookJob)
+
+		dispatcher.switchChanged(Switch{ID: "lamp", Name: "Lamp", Type: "generic"}, slog.Default())
+
+		if deliveries := store.getWebhookDeliveries("hook"); len(deliveries) != 0 {
+			t.Errorf("got recorded deliveries %v, want none", deliveries)
+		}
+	})
+}
+
+func TestWebhookAPI(t *testing.T) {
+	store := newStubWebhookStore()
+	server := NewHivemindServer(nil)
+	server.webhooks = NewWebhookDispatcher(store)
+
+	t.Run("return status 202 on POST /api/webhook/ and hide the secret", func(t *testing.T) {
+		request := newPostRequest("api/webhook/", strings.NewReader(`{"URL": "http://localhost:5678/hook", "Events": ["switch.changed"], "Secret": "s3cret"}`))
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, request)
+
+		var got Webhook
+		json.NewDecoder(response.Body).Decode(&got)
+
+		assertResponseCode(t, response.Code, http.StatusAccepted)
+		if got.ID == "" || got.Secret != "" {
+			t.Errorf("unexpected webhook in response %v", got)
+		}
+		stored, _ := store.getWebhook(got.ID)
+		assertBody(t, stored.Secret, "s3cret")
+	})
+
+	t.Run("return status 422 on POST /api/webhook/ with an invalid URL", func(t *testing.T) {
+		request := newPostRequest("api/webhook/", strings.NewReader(`{"URL": "ftp://localhost/hook"}`))
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, request)
+
+		assertResponseCode(t, response.Code, http.StatusUnprocessableEntity)
+	})
+
+	t.Run("return status 204 on DELETE /api/webhook/{id}", func(t *testing.T) {
+		store.storeWebhook(Webhook{ID: "delete", URL: "http://localhost/hook"})
+		request, _ := http.NewRequest(http.MethodDelete, "/api/webhook/delete", nil)
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, request)
+
+		assertResponseCode(t, response.Code, http.StatusNoContent)
+
+		response = httptest.NewRecorder()
+		server.ServeHTTP(response, newGetRequest("api/webhook/delete"))
+
+		assertResponseCode(t, response.Code, http.StatusNotFound)
+	})
+}
+
+// stubs
+type stubWebhookStore struct {
+	mutex      sync.Mutex
+	webhooks   map[string]Webhook
+	deliveries map[string][]WebhookDelivery
+	reads      int
+}
+
+func newStubWebhookStore() *stubWebhookStore {
+	return &stubWebhookStore{
+		webhooks:   make(map[string]Webhook),
+		deliveries: make(map[string][]WebhookDelivery),
+	}
+}
+
+func (s *stubWebhookStore) getWebhook(id string) (Webhook, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.webhooks[id], nil
+}
+
+func (s *stubWebhookStore) getAllWebhooks() []Webhook {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.reads++
+	var webhooks []Webhook
+	for _, w := range s.webhooks {
+		webhooks = append(webhooks, w)
+	}
+	return webhooks
+}
+
+func (s *stubWebhookStore) storeWebhook(w Webhook) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.webhooks[w.ID] = w
+	return nil
+}
+
+func (s *stubWebhookStore) deleteWebhook(id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.webhooks, id)
+	delete(s.deliveries, id)
+	return nil
+}
+
+func (s *stubWebhookStore) getWebhookDeliveries(id string) []WebhookDelivery {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.deliveries[id]
+}
+
+func (s *stubWebhookStore) storeWebhookDelivery(d WebhookDelivery) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.deliveries[d.Webhook] = append(s.deliveries[d.Webhook], d)
+	return nil
+}